@@ -0,0 +1,68 @@
+package balancer
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// AccessRule restricts paths under PathPrefix to the listed roles. The
+// prefix matches whole path segments: /admin covers /admin and /admin/users
+// but not /administrator.
+type AccessRule struct {
+	PathPrefix string
+	Roles      []string
+}
+
+// WithAccessRules configures which roles may access which paths. When
+// several rules match, the longest prefix wins. Paths without a matching
+// rule are open to every valid role.
+func WithAccessRules(rules ...AccessRule) Option {
+	return func(lb *LoadBalancer) {
+		lb.accessRules = rules
+	}
+}
+
+// isRoleAllowed reports whether the role may access the request's path.
+// The path is cleaned first, so dot segments and doubled slashes, e.g.
+// /public/../admin or //admin, can't slip past a rule.
+func (lb *LoadBalancer) isRoleAllowed(r *http.Request, role string) bool {
+	if len(lb.accessRules) == 0 {
+		return true
+	}
+	requestPath := cleanPath(r.URL.Path)
+	var match *AccessRule
+	matchLen := -1
+	for i, rule := range lb.accessRules {
+		prefix := cleanPath(rule.PathPrefix)
+		if !hasPathPrefix(requestPath, prefix) {
+			continue
+		}
+		if len(prefix) > matchLen {
+			match, matchLen = &lb.accessRules[i], len(prefix)
+		}
+	}
+	if match == nil {
+		return true
+	}
+	for _, allowed := range match.Roles {
+		if allowed == role {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanPath returns the rooted, cleaned form of a URL path without any
+// trailing slash
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// hasPathPrefix reports whether the cleaned path is prefix or lies below it
+func hasPathPrefix(p, prefix string) bool {
+	if prefix == "/" || p == prefix {
+		return true
+	}
+	return strings.HasPrefix(p, prefix+"/")
+}
@@ -0,0 +1,126 @@
+package balancer
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessLogFormat is the line format of the access log
+type AccessLogFormat string
+
+const (
+	// AccessLogCommon is the Apache Common Log Format:
+	// host ident user [time] "request" status bytes
+	AccessLogCommon AccessLogFormat = "common"
+	// AccessLogCombined adds the quoted Referer and User-Agent headers
+	AccessLogCombined AccessLogFormat = "combined"
+)
+
+// clfTimeFormat is the timestamp layout of the Common Log Format
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// accessLog writes one line per request, independently of the logger
+type accessLog struct {
+	mutex  sync.Mutex
+	out    io.Writer
+	format AccessLogFormat
+}
+
+// WithAccessLog writes an access log line for every request to out, in
+// addition to the balancer's own log. Requests rejected by the balancer are
+// logged too; metrics scrapes and probes are not. The byte count is the
+// response body as written to the client, so streamed responses are counted
+// in full once they finish.
+func WithAccessLog(out io.Writer, format AccessLogFormat) Option {
+	return func(lb *LoadBalancer) {
+		lb.accessLog = &accessLog{out: out, format: format}
+	}
+}
+
+// ParseAccessLogFormat checks an access log format name
+func ParseAccessLogFormat(name string) (AccessLogFormat, error) {
+	switch format := AccessLogFormat(strings.ToLower(name)); format {
+	case AccessLogCommon, AccessLogCombined:
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown access log format %q, want common or combined", name)
+}
+
+// write logs a finished request
+func (l *accessLog) write(r *http.Request, host, user string, received time.Time, status int, written int64) {
+	var line strings.Builder
+	line.WriteString(clfField(host))
+	line.WriteString(" - ")
+	line.WriteString(clfField(user))
+	line.WriteString(" [")
+	line.WriteString(received.Format(clfTimeFormat))
+	line.WriteString("] ")
+	line.WriteString(clfQuote(r.Method + " " + r.URL.RequestURI() + " " + r.Proto))
+	line.WriteByte(' ')
+	line.WriteString(strconv.Itoa(status))
+	line.WriteByte(' ')
+	if written > 0 {
+		line.WriteString(strconv.FormatInt(written, 10))
+	} else {
+		line.WriteByte('-')
+	}
+	if l.format == AccessLogCombined {
+		line.WriteByte(' ')
+		line.WriteString(clfQuote(headerOrDash(r.Referer())))
+		line.WriteByte(' ')
+		line.WriteString(clfQuote(headerOrDash(r.UserAgent())))
+	}
+	line.WriteByte('\n')
+
+	// One write per line keeps concurrent requests from interleaving
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	io.WriteString(l.out, line.String())
+}
+
+// clfField returns an unquoted field, or "-" when it is empty
+func clfField(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, value)
+}
+
+// headerOrDash returns "-" in place of a missing header
+func headerOrDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// clfQuote quotes a field, escaping quotes, backslashes and control
+// characters the way Apache does so a client can't forge log lines
+func clfQuote(value string) string {
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '"' || c == '\\':
+			quoted.WriteByte('\\')
+			quoted.WriteByte(c)
+		case c < ' ' || c == 0x7f:
+			fmt.Fprintf(&quoted, "\\x%02x", c)
+		default:
+			quoted.WriteByte(c)
+		}
+	}
+	quoted.WriteByte('"')
+	return quoted.String()
+}
@@ -0,0 +1,243 @@
+package balancer
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// ErrBackendBusy is returned by RemoveBackend when requests to the backend
+// are still in flight once the remove timeout has passed
+var ErrBackendBusy = errors.New("backend still has requests in flight")
+
+// findBackend looks a backend up by its ID or URL. URLs match after
+// normalization, see backendKey.
+func (lb *LoadBalancer) findBackend(ref string) (*Backend, error) {
+	id, idErr := strconv.Atoi(ref)
+	var key string
+	if parsedURL, err := parseBackendURL(ref); err == nil {
+		key = backendKey(parsedURL)
+	}
+	for _, backend := range lb.getBackends() {
+		if (idErr == nil && backend.ID == id) || (key != "" && backendKey(backend.URL) == key) {
+			return backend, nil
+		}
+	}
+	return nil, fmt.Errorf("backend %s not found", ref)
+}
+
+// DisableBackend takes a backend out of rotation until it is enabled again.
+// The backend is referenced by ID or URL.
+func (lb *LoadBalancer) DisableBackend(ref string) error {
+	return lb.setBackendDisabled(ref, true)
+}
+
+// EnableBackend puts a disabled backend back into rotation
+func (lb *LoadBalancer) EnableBackend(ref string) error {
+	return lb.setBackendDisabled(ref, false)
+}
+
+// setBackendDisabled flips the operator-controlled disabled flag
+func (lb *LoadBalancer) setBackendDisabled(ref string, disabled bool) error {
+	lb.adminMutex.Lock()
+	defer lb.adminMutex.Unlock()
+
+	backend, err := lb.findBackend(ref)
+	if err != nil {
+		return err
+	}
+	backend.mutex.Lock()
+	backend.disabled = disabled
+	backend.mutex.Unlock()
+
+	if disabled {
+		lb.logger.Log(LevelInfo, "Backend disabled", "backend", backend.ID)
+	} else {
+		lb.logger.Log(LevelInfo, "Backend enabled", "backend", backend.ID)
+	}
+	return nil
+}
+
+// SetBackendDraining stops sending new requests to a backend while letting
+// the ones in flight finish, e.g. ahead of a deploy. Unlike a failing
+// health check it does not count against the backend's health record. The
+// backend is referenced by ID or URL.
+func (lb *LoadBalancer) SetBackendDraining(ref string, draining bool) error {
+	lb.adminMutex.Lock()
+	defer lb.adminMutex.Unlock()
+
+	backend, err := lb.findBackend(ref)
+	if err != nil {
+		return err
+	}
+	backend.mutex.Lock()
+	backend.draining = draining
+	backend.mutex.Unlock()
+
+	if draining {
+		lb.logger.Log(LevelInfo, "Backend draining", "backend", backend.ID)
+	} else {
+		lb.logger.Log(LevelInfo, "Backend no longer draining", "backend", backend.ID)
+	}
+	return nil
+}
+
+// SetBackendWeight changes the weight of a backend for the weighted
+// strategies. The backend is referenced by ID or URL.
+func (lb *LoadBalancer) SetBackendWeight(ref string, weight int) error {
+	if weight < 0 {
+		return fmt.Errorf("weight must not be negative")
+	}
+	lb.adminMutex.Lock()
+	defer lb.adminMutex.Unlock()
+
+	backend, err := lb.findBackend(ref)
+	if err != nil {
+		return err
+	}
+	backend.mutex.Lock()
+	backend.Weight = weight
+	backend.mutex.Unlock()
+
+	lb.logger.Log(LevelInfo, "Backend weight changed", "backend", backend.ID, "weight", weight)
+	return nil
+}
+
+// ReloadResult lists the URLs of the backends a reload added, replaced
+// because their configuration changed, and removed
+type ReloadResult struct {
+	Added    []string
+	Replaced []string
+	Removed  []string
+}
+
+// String summarizes the result, e.g. "1 added, 0 replaced, 2 removed"
+func (r ReloadResult) String() string {
+	return fmt.Sprintf("%d added, %d replaced, %d removed", len(r.Added), len(r.Replaced), len(r.Removed))
+}
+
+// Reload brings the backend list in line with the given configuration:
+// backends that are new are added and those no longer listed are removed
+// the way RemoveBackend does, once their requests in flight have finished.
+// Those still busy after the remove timeout are left in the pool, draining,
+// and reported with ErrBackendBusy. Backends whose configuration changed
+// are replaced, see replaceBackend; the others keep their state.
+func (lb *LoadBalancer) Reload(configs []BackendConfig) (ReloadResult, error) {
+	var result ReloadResult
+	if err := ValidateBackendConfigs(configs); err != nil {
+		return result, err
+	}
+	lb.adminMutex.Lock()
+
+	wanted := make(map[string]bool, len(configs))
+	var errs []error
+	for _, cfg := range configs {
+		parsedURL, _ := parseBackendURL(cfg.URL)
+		wanted[backendKey(parsedURL)] = true
+		if existing, err := lb.findBackend(parsedURL.String()); err == nil {
+			if existing.config == cfg {
+				continue
+			}
+			if err := lb.replaceBackend(existing, cfg); err != nil {
+				errs = append(errs, err)
+			} else {
+				result.Replaced = append(result.Replaced, cfg.URL)
+			}
+			continue
+		}
+		if err := lb.addBackend(cfg); err != nil {
+			errs = append(errs, err)
+		} else {
+			result.Added = append(result.Added, cfg.URL)
+		}
+	}
+	var removed []*Backend
+	for _, backend := range lb.getBackends() {
+		if !wanted[backendKey(backend.URL)] {
+			backend.mutex.Lock()
+			backend.draining = true
+			backend.mutex.Unlock()
+			removed = append(removed, backend)
+		}
+	}
+	lb.adminMutex.Unlock()
+
+	// Wait for all of them at once, without blocking other admin calls
+	drained := make([]error, len(removed))
+	var wg sync.WaitGroup
+	for i, backend := range removed {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			drained[i] = lb.awaitRemoval(backend)
+		}()
+	}
+	wg.Wait()
+
+	lb.adminMutex.Lock()
+	defer lb.adminMutex.Unlock()
+	for i, backend := range removed {
+		if drained[i] != nil {
+			errs = append(errs, drained[i])
+			continue
+		}
+		if err := lb.removeBackend(backend.URL.String()); err != nil {
+			errs = append(errs, err)
+		} else {
+			result.Removed = append(result.Removed, backend.URL.String())
+		}
+	}
+
+	lb.logger.Log(LevelInfo, "Backend configuration reloaded", "backends", len(lb.getBackends()),
+		"added", len(result.Added), "replaced", len(result.Replaced), "removed", len(result.Removed))
+	return result, errors.Join(errs...)
+}
+
+// replaceBackend swaps a backend for one built from its changed
+// configuration; the caller holds adminMutex. The replacement keeps the ID
+// and position, so the pools, role routes and homes naming the backend
+// follow it, and takes over its health state and the operator's disabled
+// and draining flags. Its counters, circuit breaker and reported load start
+// afresh. Requests in flight finish on the old backend, whose idle
+// connections are closed once it is idle.
+func (lb *LoadBalancer) replaceBackend(old *Backend, cfg BackendConfig) error {
+	replacement, err := lb.newBackend(cfg, old.ID)
+	if err != nil {
+		return err
+	}
+	old.mutex.RLock()
+	replacement.IsAlive = old.IsAlive
+	replacement.rawAlive = old.rawAlive
+	replacement.rawChangedAt = old.rawChangedAt
+	replacement.recoveredAt = old.recoveredAt
+	replacement.disabled = old.disabled
+	replacement.draining = old.draining
+	old.mutex.RUnlock()
+
+	lb.mutex.Lock()
+	// Copy on write so readers holding the old slice are never affected
+	backends := make([]*Backend, len(lb.backends))
+	copy(backends, lb.backends)
+	for i, backend := range backends {
+		if backend == old {
+			backends[i] = replacement
+		}
+	}
+	lb.backends = backends
+	lb.rebuildRing()
+	lb.mutex.Unlock()
+
+	if replacement.URL.String() != old.URL.String() {
+		lb.metrics.forgetBackend(old)
+	}
+	lb.metrics.setBackendUp(replacement, replacement.IsAlive)
+	lb.logger.Log(LevelInfo, "Backend replaced with its changed configuration", "backend", replacement.ID, "url", replacement.URL.String())
+	lb.resolveBackends([]*Backend{replacement})
+
+	go func() {
+		old.waitIdle(0)
+		old.transport.CloseIdleConnections()
+	}()
+	return nil
+}
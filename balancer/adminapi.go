@@ -0,0 +1,198 @@
+package balancer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxAdminRequestBytes caps the JSON body of an admin API request
+const maxAdminRequestBytes = 64 << 10
+
+// WithAdminAPI serves the backend admin API under prefix, e.g. "/lb":
+//
+//	GET    <prefix>/backends              lists the backends and their state
+//	POST   <prefix>/backends              adds a backend from a BackendConfig
+//	DELETE <prefix>/backends?url=<url>    drains and removes a backend
+//	PATCH  <prefix>/backends?url=<url>    sets draining, disabled or weight
+//
+// Backends may also be referenced with ?id=<id>. Requests need a token with
+// the admin role, see WithAdminRole. An empty prefix disables the API.
+func WithAdminAPI(prefix string) Option {
+	return func(lb *LoadBalancer) {
+		lb.adminAPIPrefix = strings.TrimSuffix(prefix, "/")
+	}
+}
+
+// BackendPatch lists the backend settings a PATCH request changes. Settings
+// left out keep their value.
+type BackendPatch struct {
+	Draining *bool `json:"draining"`
+	Disabled *bool `json:"disabled"`
+	Weight   *int  `json:"weight"`
+}
+
+// isAdminAPIRequest reports whether the request is for the admin API
+func (lb *LoadBalancer) isAdminAPIRequest(r *http.Request) bool {
+	return lb.adminAPIPrefix != "" && (r.URL.Path == lb.adminAPIPrefix || strings.HasPrefix(r.URL.Path, lb.adminAPIPrefix+"/"))
+}
+
+// serveAdminAPI answers an authenticated admin API request
+func (lb *LoadBalancer) serveAdminAPI(w http.ResponseWriter, r *http.Request, role string) {
+	if role != lb.adminRole {
+		lb.logRequest(r, LevelWarn, "Admin API request without the admin role", "role", role, "method", r.Method, "path", r.URL.Path, "status", http.StatusForbidden)
+		writeAdminError(w, http.StatusForbidden, lb.adminRole+" role required")
+		return
+	}
+	if r.URL.Path != lb.adminAPIPrefix+"/backends" {
+		writeAdminError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	lb.logRequest(r, LevelInfo, "Admin API request", "method", r.Method, "path", r.URL.Path, "query", r.URL.RawQuery)
+
+	switch r.Method {
+	case http.MethodGet:
+		now := time.Now()
+		current := lb.getBackends()
+		backends := make([]map[string]interface{}, len(current))
+		for i, backend := range current {
+			backends[i] = lb.backendStats(backend, now)
+		}
+		writeAdminJSON(w, http.StatusOK, backends)
+	case http.MethodPost:
+		lb.adminAddBackend(w, r)
+	case http.MethodDelete:
+		backend, ok := lb.adminTarget(w, r)
+		if !ok {
+			return
+		}
+		if err := lb.RemoveBackend(backend.URL.String()); err != nil {
+			status := http.StatusNotFound
+			if errors.Is(err, ErrBackendBusy) {
+				status = http.StatusConflict
+			}
+			writeAdminError(w, status, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPatch:
+		lb.adminPatchBackend(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE, PATCH")
+		writeAdminError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// adminAddBackend adds the backend described by the request body
+func (lb *LoadBalancer) adminAddBackend(w http.ResponseWriter, r *http.Request) {
+	var cfg BackendConfig
+	if !decodeAdminBody(w, r, &cfg) {
+		return
+	}
+	if err := ValidateBackendConfigs([]BackendConfig{cfg}); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	lb.adminMutex.Lock()
+	parsedURL, _ := parseBackendURL(cfg.URL)
+	if _, err := lb.findBackend(parsedURL.String()); err == nil {
+		lb.adminMutex.Unlock()
+		writeAdminError(w, http.StatusConflict, fmt.Sprintf("backend %s already exists", parsedURL))
+		return
+	}
+	err := lb.addBackend(cfg)
+	lb.adminMutex.Unlock()
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	backend, err := lb.findBackend(parsedURL.String())
+	if err != nil {
+		// Removed again in the meantime
+		writeAdminError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeAdminJSON(w, http.StatusCreated, lb.backendStats(backend, time.Now()))
+}
+
+// adminPatchBackend applies the settings in the request body to a backend
+func (lb *LoadBalancer) adminPatchBackend(w http.ResponseWriter, r *http.Request) {
+	backend, ok := lb.adminTarget(w, r)
+	if !ok {
+		return
+	}
+	var patch BackendPatch
+	if !decodeAdminBody(w, r, &patch) {
+		return
+	}
+	if patch.Weight != nil && *patch.Weight < 0 {
+		writeAdminError(w, http.StatusBadRequest, "weight must not be negative")
+		return
+	}
+
+	ref := backend.URL.String()
+	var err error
+	if patch.Draining != nil {
+		err = lb.SetBackendDraining(ref, *patch.Draining)
+	}
+	if err == nil && patch.Disabled != nil {
+		err = lb.setBackendDisabled(ref, *patch.Disabled)
+	}
+	if err == nil && patch.Weight != nil {
+		err = lb.SetBackendWeight(ref, *patch.Weight)
+	}
+	if err != nil {
+		writeAdminError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, lb.backendStats(backend, time.Now()))
+}
+
+// adminTarget looks up the backend named by the url or id query parameter,
+// writing the error response itself when there is none
+func (lb *LoadBalancer) adminTarget(w http.ResponseWriter, r *http.Request) (*Backend, bool) {
+	ref := r.URL.Query().Get("url")
+	if ref == "" {
+		ref = r.URL.Query().Get("id")
+	}
+	if ref == "" {
+		writeAdminError(w, http.StatusBadRequest, "url or id query parameter required")
+		return nil, false
+	}
+	backend, err := lb.findBackend(ref)
+	if err != nil {
+		writeAdminError(w, http.StatusNotFound, err.Error())
+		return nil, false
+	}
+	return backend, true
+}
+
+// decodeAdminBody parses the JSON request body into v, writing the error
+// response itself when it can't
+func decodeAdminBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxAdminRequestBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return false
+	}
+	return true
+}
+
+// writeAdminJSON writes an admin API response
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeAdminError writes an admin API error as JSON
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	writeAdminJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,171 @@
+package balancer
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// AdminSocket serves a line-based admin protocol on a Unix domain socket.
+// Each line is a command; each reply is a single line starting with OK or
+// ERR. Supported commands:
+//
+//	stats               print the balancer statistics as JSON
+//	disable <backend>   take a backend (ID or URL) out of rotation
+//	enable <backend>    put a disabled backend back into rotation
+//	drain <backend>     let a backend finish its requests but send it no new ones
+//	undrain <backend>   end draining a backend
+//	debug on|off        toggle the X-Debug-* response headers
+//	split <group>=<n>   set traffic split group weights, e.g. split new=10 stable=90
+//	reload              re-read the backend configuration, reporting what changed
+//	quit                close the connection
+//
+// A command may be prefixed with key=<idempotency key>. Repeating a command
+// with the same key, e.g. when retrying after a lost reply, returns the
+// first result without applying it again; a different command with that
+// key is refused. Mutating commands from all
+// admin surfaces are applied one at a time.
+type AdminSocket struct {
+	lb       *LoadBalancer
+	listener net.Listener
+	reload   func() (ReloadResult, error)
+}
+
+// ServeAdminSocket starts the admin interface on the Unix socket at path.
+// The socket is only accessible to the current user. reload is invoked for
+// the reload command and may be nil if reloading is not supported.
+func (lb *LoadBalancer) ServeAdminSocket(path string, reload func() (ReloadResult, error)) (*AdminSocket, error) {
+	// Remove a stale socket left behind by a previous run
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale admin socket: %w", err)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on admin socket: %w", err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict admin socket permissions: %w", err)
+	}
+
+	socket := &AdminSocket{lb: lb, listener: listener, reload: reload}
+	go socket.serve()
+	lb.logger.Log(LevelInfo, "Admin socket listening", "path", path)
+	return socket, nil
+}
+
+// Close stops accepting admin connections and removes the socket
+func (s *AdminSocket) Close() error {
+	return s.listener.Close()
+}
+
+// serve accepts connections until the listener is closed
+func (s *AdminSocket) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle runs commands from a single connection
+func (s *AdminSocket) handle(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "quit" {
+			return
+		}
+		var key string
+		if k, ok := strings.CutPrefix(fields[0], "key="); ok {
+			key, fields = k, fields[1:]
+			if len(fields) == 0 {
+				fmt.Fprintf(conn, "ERR missing command\n")
+				continue
+			}
+		}
+		var reply string
+		var err error
+		if fields[0] == "stats" {
+			reply, err = s.execute(fields[0], fields[1:])
+		} else {
+			reply, err = s.lb.idempotent(key, strings.Join(fields, " "), func() (string, error) {
+				return s.execute(fields[0], fields[1:])
+			})
+		}
+		if err != nil {
+			fmt.Fprintf(conn, "ERR %v\n", err)
+			continue
+		}
+		fmt.Fprintf(conn, "OK %s\n", reply)
+	}
+}
+
+// execute runs a single admin command
+func (s *AdminSocket) execute(command string, args []string) (string, error) {
+	s.lb.logger.Log(LevelInfo, "Admin socket command", "command", command, "args", strings.Join(args, " "))
+
+	switch command {
+	case "stats":
+		data, err := json.Marshal(s.lb.GetStats())
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	case "disable", "enable":
+		if len(args) != 1 {
+			return "", fmt.Errorf("usage: %s <backend>", command)
+		}
+		if command == "disable" {
+			return "disabled", s.lb.DisableBackend(args[0])
+		}
+		return "enabled", s.lb.EnableBackend(args[0])
+	case "drain", "undrain":
+		if len(args) != 1 {
+			return "", fmt.Errorf("usage: %s <backend>", command)
+		}
+		if command == "drain" {
+			return "draining", s.lb.SetBackendDraining(args[0], true)
+		}
+		return "undrained", s.lb.SetBackendDraining(args[0], false)
+	case "debug":
+		if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+			return "", fmt.Errorf("usage: debug on|off")
+		}
+		s.lb.SetDebug(args[0] == "on")
+		return "debug " + args[0], nil
+	case "split":
+		if len(args) == 0 {
+			return "", fmt.Errorf("usage: split <group>=<weight> ...")
+		}
+		weights := make(map[string]int, len(args))
+		for _, arg := range args {
+			name, value, ok := strings.Cut(arg, "=")
+			weight, err := strconv.Atoi(value)
+			if !ok || err != nil {
+				return "", fmt.Errorf("usage: split <group>=<weight> ...")
+			}
+			weights[name] = weight
+		}
+		return "split updated", s.lb.SetSplitWeights(weights)
+	case "reload":
+		if s.reload == nil {
+			return "", fmt.Errorf("reload is not supported")
+		}
+		result, err := s.reload()
+		return "reloaded: " + result.String(), err
+	default:
+		return "", fmt.Errorf("unknown command %q", command)
+	}
+}
@@ -0,0 +1,87 @@
+package balancer
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// roleHome is a role's preferred backend and how often it was used. The
+// configured index is bound to the ID of the backend at that position once
+// the backends exist; an ID of zero means there was none.
+type roleHome struct {
+	index     int
+	backendID int
+	honored   uint64
+	fallbacks uint64
+}
+
+// WithRoleHomeBackends gives roles a home backend, by its index in the
+// initial backend list, that serves their requests whenever it is
+// available. Only when it is down, at capacity or outside the request's
+// pool is the backend picked as usual. A home stays bound to its backend
+// while others are added or removed; once it is removed itself, the role's
+// requests always fall back.
+func WithRoleHomeBackends(homes map[string]int) Option {
+	return func(lb *LoadBalancer) {
+		lb.roleHomes = make(map[string]*roleHome, len(homes))
+		for role, index := range homes {
+			lb.roleHomes[role] = &roleHome{index: index}
+		}
+	}
+}
+
+// bindRoleHomes binds each home's index to the ID of the backend at that
+// position
+func (lb *LoadBalancer) bindRoleHomes(backends []*Backend) {
+	for _, home := range lb.roleHomes {
+		if ids := backendIDs(backends, []int{home.index}); len(ids) > 0 {
+			home.backendID = ids[0]
+		}
+	}
+}
+
+// homeBackend returns the role's home backend when it can serve the
+// request, or nil when the role has none or it must fall back
+func (lb *LoadBalancer) homeBackend(r *http.Request, role string, pool []int) *Backend {
+	home, ok := lb.roleHomes[role]
+	if !ok {
+		return nil
+	}
+
+	if home.backendID == 0 {
+		atomic.AddUint64(&home.fallbacks, 1)
+		lb.logRequest(r, LevelWarn, "Home backend not configured, falling back", "role", role, "index", home.index)
+		return nil
+	}
+	found := backendsByID(lb.getBackends(), []int{home.backendID})
+	if len(found) == 0 {
+		atomic.AddUint64(&home.fallbacks, 1)
+		lb.logRequest(r, LevelInfo, "Home backend removed, falling back", "role", role, "backend", home.backendID)
+		return nil
+	}
+	backend := found[0]
+	if !backend.isAvailable() || !containsBackend(lb.eligibleBackends(role, pool), backend) {
+		atomic.AddUint64(&home.fallbacks, 1)
+		lb.logRequest(r, LevelInfo, "Home backend unavailable, falling back", "role", role, "backend", backend.ID)
+		return nil
+	}
+
+	atomic.AddUint64(&home.honored, 1)
+	lb.logRequest(r, LevelDebug, "Request routed to home backend", "role", role, "path", r.URL.Path, "backend", backend.ID)
+	return backend
+}
+
+// roleHomeStats reports each role's home backend, by ID, and how often it
+// was used
+func (lb *LoadBalancer) roleHomeStats() map[string]interface{} {
+	stats := make(map[string]interface{}, len(lb.roleHomes))
+	for role, home := range lb.roleHomes {
+		stats[role] = map[string]interface{}{
+			"backendIndex": home.index,
+			"backend":      home.backendID,
+			"honored":      atomic.LoadUint64(&home.honored),
+			"fallbacks":    atomic.LoadUint64(&home.fallbacks),
+		}
+	}
+	return stats
+}
@@ -0,0 +1,123 @@
+package balancer
+
+import (
+	"net/http"
+	"time"
+)
+
+// DefaultBreakerCooldown is how long an open circuit stays open when no
+// cooldown is configured
+const DefaultBreakerCooldown = 30 * time.Second
+
+// breakerState is the position of a backend's circuit breaker
+type breakerState int
+
+const (
+	// breakerClosed lets all requests through
+	breakerClosed breakerState = iota
+	// breakerOpen rejects requests until the cooldown elapses
+	breakerOpen
+	// breakerHalfOpen lets a single probe request through
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker takes a backend out of rotation after consecutive proxy
+// failures, well before the health checker would notice. Its fields are
+// guarded by the owning backend's mutex.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// WithCircuitBreaker opens a backend's circuit after threshold consecutive
+// failed requests. Once cooldown has passed a single probe request is let
+// through, and its outcome closes or reopens the circuit. A threshold of
+// zero disables the breaker.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(lb *LoadBalancer) {
+		if cooldown <= 0 {
+			cooldown = DefaultBreakerCooldown
+		}
+		lb.breakerThreshold = threshold
+		lb.breakerCooldown = cooldown
+	}
+}
+
+// allows reports whether a request may be sent through the breaker now
+func (cb *circuitBreaker) allows(now time.Time) bool {
+	switch cb.state {
+	case breakerOpen:
+		return now.Sub(cb.openedAt) >= cb.cooldown
+	case breakerHalfOpen:
+		return !cb.probing
+	default:
+		return true
+	}
+}
+
+// admitThroughBreaker claims passage through the backend's breaker for a
+// request about to be proxied. Past an open circuit's cooldown the request
+// becomes the half-open probe, and other requests are held back until it
+// completes.
+func (b *Backend) admitThroughBreaker() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !b.breaker.allows(time.Now()) {
+		return false
+	}
+	if b.breaker.state != breakerClosed {
+		b.breaker.state = breakerHalfOpen
+		b.breaker.probing = true
+	}
+	return true
+}
+
+// recordBreakerOutcome feeds the result of a proxied request to the
+// backend's breaker. Requests the client abandoned say nothing about the
+// backend and only release the probe slot.
+func (lb *LoadBalancer) recordBreakerOutcome(backend *Backend, state *attemptState) {
+	if lb.breakerThreshold <= 0 {
+		return
+	}
+
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	cb := &backend.breaker
+	cb.probing = false
+
+	if clientFault(state.err) {
+		return
+	}
+	if state.err == nil && state.status < http.StatusInternalServerError {
+		if cb.state != breakerClosed {
+			lb.logger.Log(LevelInfo, "Circuit closed", "backend", backend.ID)
+		}
+		cb.state = breakerClosed
+		cb.failures = 0
+		return
+	}
+
+	cb.failures++
+	if cb.state == breakerHalfOpen || (cb.state == breakerClosed && cb.failures >= cb.threshold) {
+		cb.state = breakerOpen
+		cb.openedAt = time.Now()
+		lb.logger.Log(LevelWarn, "Circuit opened", "backend", backend.ID, "failures", cb.failures)
+	}
+}
@@ -0,0 +1,145 @@
+package balancer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ParseCIDRs parses a list of CIDR blocks. Bare IP addresses are accepted
+// and treated as a single-host network.
+func ParseCIDRs(values []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", value)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", value, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// WithTrustedProxies sets the networks whose X-Forwarded-For header is
+// believed when determining the client IP
+func WithTrustedProxies(nets []*net.IPNet) Option {
+	return func(lb *LoadBalancer) {
+		lb.trustedProxies = nets
+	}
+}
+
+// WithIPAllowlist restricts access to clients in the given networks
+func WithIPAllowlist(nets []*net.IPNet) Option {
+	return func(lb *LoadBalancer) {
+		lb.ipAllowlist = nets
+	}
+}
+
+// WithIPDenylist rejects clients in the given networks
+func WithIPDenylist(nets []*net.IPNet) Option {
+	return func(lb *LoadBalancer) {
+		lb.ipDenylist = nets
+	}
+}
+
+// containsIP reports whether ip falls within any of the networks
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the IP of the directly connected peer
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// clientIP determines the originating client IP. X-Forwarded-For is only
+// consulted when the direct peer is a trusted proxy, and is walked from the
+// right so a client cannot spoof its address by prepending entries.
+func (lb *LoadBalancer) clientIP(r *http.Request) net.IP {
+	ip := remoteIP(r)
+	if ip == nil || !containsIP(lb.trustedProxies, ip) {
+		return ip
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !containsIP(lb.trustedProxies, hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// isIPAllowed applies the denylist and then the allowlist to the client IP.
+// An empty allowlist admits everyone not explicitly denied.
+func (lb *LoadBalancer) isIPAllowed(ip net.IP) bool {
+	if ip == nil {
+		return len(lb.ipAllowlist) == 0
+	}
+	if containsIP(lb.ipDenylist, ip) {
+		return false
+	}
+	if len(lb.ipAllowlist) > 0 && !containsIP(lb.ipAllowlist, ip) {
+		return false
+	}
+	return true
+}
+
+// setForwardedHeaders prepares the forwarding headers of an outgoing request.
+// Headers from a trusted proxy are kept so the reverse proxy appends the peer
+// to X-Forwarded-For; anything else sent by the client is discarded first.
+func (lb *LoadBalancer) setForwardedHeaders(req *http.Request) {
+	peer := remoteIP(req)
+	trusted := peer != nil && containsIP(lb.trustedProxies, peer)
+
+	if ip := lb.clientIP(req); ip != nil {
+		req.Header.Set("X-Real-IP", ip.String())
+	}
+
+	if !trusted {
+		req.Header.Del("X-Forwarded-For")
+		req.Header.Del("X-Forwarded-Proto")
+	}
+	if req.Header.Get("X-Forwarded-Proto") == "" {
+		proto := "http"
+		if req.TLS != nil {
+			proto = "https"
+		}
+		req.Header.Set("X-Forwarded-Proto", proto)
+	}
+}
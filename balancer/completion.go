@@ -0,0 +1,343 @@
+package balancer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Delivery settings for completion records
+const (
+	completionBatchSize  = 100
+	completionRetryMin   = 100 * time.Millisecond
+	completionRetryMax   = 30 * time.Second
+	completionFlushEvery = time.Second
+)
+
+// CompletionRecord describes a finished request, e.g. for usage-based
+// billing. One is emitted for every request except metrics scrapes,
+// including those rejected or failed by the balancer.
+type CompletionRecord struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Subject   string    `json:"subject,omitempty"`
+	Role      string    `json:"role,omitempty"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	BytesIn   int64     `json:"bytesIn"`
+	BytesOut  int64     `json:"bytesOut"`
+	Backend   string    `json:"backend,omitempty"`
+	Attempts  int       `json:"attempts,omitempty"`
+	// DurationMs is the time from receiving the request to finishing the
+	// response
+	DurationMs float64 `json:"durationMs"`
+}
+
+// CompletionSink delivers completion records. Emit must return an error
+// unless every record was stored; the batch is then retried, so sinks may
+// see a record more than once and should deduplicate by RequestID.
+type CompletionSink interface {
+	Emit(ctx context.Context, records []CompletionRecord) error
+}
+
+// JSONLinesSink writes completion records as JSON lines, syncing the writer
+// after each batch when it supports it (e.g. an *os.File)
+type JSONLinesSink struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+// NewJSONLinesSink creates a sink writing to w
+func NewJSONLinesSink(w io.Writer) *JSONLinesSink {
+	return &JSONLinesSink{w: w}
+}
+
+// Emit writes the records and syncs the writer
+func (s *JSONLinesSink) Emit(ctx context.Context, records []CompletionRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	encoder := json.NewEncoder(s.w)
+	for _, rec := range records {
+		if err := encoder.Encode(rec); err != nil {
+			return err
+		}
+	}
+	if syncer, ok := s.w.(interface{ Sync() error }); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+// CompletionEmitter queues completion records and hands them to a sink in
+// the background, so serving never waits on the sink. Records are retried
+// until the sink accepts them (at-least-once); the queue is held in memory
+// and is only lost if the process dies before Close flushes it.
+type CompletionEmitter struct {
+	sink   CompletionSink
+	logger Logger
+
+	mutex   sync.Mutex
+	pending []CompletionRecord
+	wake    chan struct{}
+	closing chan struct{}
+	stopped chan struct{}
+	start   sync.Once
+
+	emitted  uint64
+	failures uint64
+}
+
+// NewCompletionEmitter creates an emitter delivering to sink. It starts
+// once it is passed to a load balancer with WithCompletionRecords.
+func NewCompletionEmitter(sink CompletionSink) *CompletionEmitter {
+	return &CompletionEmitter{
+		sink:    sink,
+		wake:    make(chan struct{}, 1),
+		closing: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// WithCompletionRecords emits a CompletionRecord for every request
+func WithCompletionRecords(emitter *CompletionEmitter) Option {
+	return func(lb *LoadBalancer) {
+		lb.completions = emitter
+	}
+}
+
+// run starts delivering records, logging sink failures to logger
+func (e *CompletionEmitter) run(logger Logger) {
+	e.start.Do(func() {
+		e.logger = logger
+		go e.deliver()
+	})
+}
+
+// submit queues a record without blocking
+func (e *CompletionEmitter) submit(rec CompletionRecord) {
+	e.mutex.Lock()
+	e.pending = append(e.pending, rec)
+	full := len(e.pending) >= completionBatchSize
+	e.mutex.Unlock()
+
+	if full {
+		select {
+		case e.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// deliver sends queued records to the sink until the emitter is closed
+func (e *CompletionEmitter) deliver() {
+	defer close(e.stopped)
+
+	ticker := time.NewTicker(completionFlushEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.wake:
+		case <-ticker.C:
+		case <-e.closing:
+			return
+		}
+		e.flush(context.Background(), e.closing)
+	}
+}
+
+// flush delivers every queued record, backing off while the sink fails. It
+// gives up early, leaving the rest queued, once ctx is done or stop closes.
+func (e *CompletionEmitter) flush(ctx context.Context, stop <-chan struct{}) error {
+	backoff := completionRetryMin
+	for {
+		e.mutex.Lock()
+		n := len(e.pending)
+		if n > completionBatchSize {
+			n = completionBatchSize
+		}
+		batch := e.pending[:n:n]
+		e.mutex.Unlock()
+		if n == 0 {
+			return nil
+		}
+
+		err := e.sink.Emit(ctx, batch)
+		if err == nil {
+			e.mutex.Lock()
+			e.pending = e.pending[n:]
+			e.mutex.Unlock()
+			atomic.AddUint64(&e.emitted, uint64(n))
+			backoff = completionRetryMin
+			continue
+		}
+
+		atomic.AddUint64(&e.failures, 1)
+		if e.logger != nil {
+			e.logger.Log(LevelError, "Failed to emit completion records", "records", n, "retryIn", backoff.String(), "error", err)
+		}
+		select {
+		case <-time.After(backoff):
+		case <-stop:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+		if backoff > completionRetryMax {
+			backoff = completionRetryMax
+		}
+	}
+}
+
+// Close stops the background delivery and flushes the remaining records,
+// retrying until ctx is done. It reports how many records were left.
+func (e *CompletionEmitter) Close(ctx context.Context) error {
+	select {
+	case <-e.closing:
+	default:
+		close(e.closing)
+	}
+	e.start.Do(func() { close(e.stopped) })
+	<-e.stopped
+
+	if err := e.flush(ctx, nil); err != nil {
+		e.mutex.Lock()
+		left := len(e.pending)
+		e.mutex.Unlock()
+		return fmt.Errorf("%d completion records not delivered: %w", left, err)
+	}
+	return nil
+}
+
+// Stats reports delivery progress
+func (e *CompletionEmitter) Stats() map[string]interface{} {
+	e.mutex.Lock()
+	pending := len(e.pending)
+	e.mutex.Unlock()
+	return map[string]interface{}{
+		"pending":  pending,
+		"emitted":  atomic.LoadUint64(&e.emitted),
+		"failures": atomic.LoadUint64(&e.failures),
+	}
+}
+
+// completionState collects the parts of a completion record that are only
+// known deep inside request handling
+type completionState struct {
+	subject  string
+	role     string
+	backend  string
+	attempts int
+}
+
+type completionKey struct{}
+
+// completionFromContext returns the request's completion state, or nil when
+// completion records are disabled
+func completionFromContext(ctx context.Context) *completionState {
+	state, _ := ctx.Value(completionKey{}).(*completionState)
+	return state
+}
+
+// trackCompletion starts capturing the request's completion record and
+// access log line. The returned finish function emits them and must be
+// called once the response is done; it reads the request through the
+// pointer so later context values such as the tenant are included.
+func (lb *LoadBalancer) trackCompletion(w http.ResponseWriter, r **http.Request, received time.Time) (http.ResponseWriter, func()) {
+	if lb.completions == nil && lb.accessLog == nil {
+		return w, func() {}
+	}
+
+	state := &completionState{}
+	req := (*r).WithContext(context.WithValue((*r).Context(), completionKey{}, state))
+	body := &countingBody{ReadCloser: req.Body}
+	if req.Body != nil {
+		req.Body = body
+	}
+	*r = req
+	writer := &completionWriter{ResponseWriter: w}
+
+	return writer, func() {
+		req := *r
+		status := writer.status
+		if status == 0 {
+			// Nothing was written, net/http answers 200
+			status = http.StatusOK
+		}
+		if lb.accessLog != nil {
+			var host string
+			if ip := lb.clientIP(req); ip != nil {
+				host = ip.String()
+			}
+			lb.accessLog.write(req, host, state.subject, received, status, writer.written)
+		}
+		if lb.completions == nil {
+			return
+		}
+		lb.completions.submit(CompletionRecord{
+			Time:       received,
+			RequestID:  requestIDFromContext(req.Context()),
+			Tenant:     tenantFromContext(req.Context()),
+			Subject:    state.subject,
+			Role:       state.role,
+			Method:     req.Method,
+			Path:       req.URL.Path,
+			Status:     status,
+			BytesIn:    atomic.LoadInt64(&body.n),
+			BytesOut:   writer.written,
+			Backend:    state.backend,
+			Attempts:   state.attempts,
+			DurationMs: durationMillis(time.Since(received)),
+		})
+	}
+}
+
+// countingBody counts the request body bytes read
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.n, int64(n))
+	return n, err
+}
+
+// completionWriter captures the status and size of the response
+type completionWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *completionWriter) WriteHeader(status int) {
+	// Informational responses such as 103 Early Hints precede the real one
+	if w.status == 0 && status >= http.StatusOK {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *completionWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController so
+// flushing keeps working
+func (w *completionWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,115 @@
+package balancer
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// WithBackendGzip asks backends for gzip even when the client did not
+// accept it, saving bandwidth between balancer and backends; such responses
+// are decompressed for the client. Without it, Accept-Encoding is negotiated
+// end to end and compressed bodies pass through byte for byte.
+func WithBackendGzip(enabled bool) Option {
+	return func(lb *LoadBalancer) {
+		lb.transportConfig.RequestGzip = enabled
+	}
+}
+
+// WithDecodedSizeMetrics additionally decompresses gzip and deflate
+// responses on the side to record their decoded size. The client still
+// receives the original bytes.
+func WithDecodedSizeMetrics(enabled bool) Option {
+	return func(lb *LoadBalancer) {
+		lb.decodedSizeMetrics = enabled
+	}
+}
+
+// measureResponseBody wraps the response body to record how many bytes the
+// backend sent and, if enabled, how many they decode to
+func (lb *LoadBalancer) measureResponseBody(backend *Backend, resp *http.Response) {
+	body := &measuredBody{
+		ReadCloser: resp.Body,
+		record: func(wire, decoded int64) {
+			label := backend.URL.String()
+			lb.metrics.responseBytes.WithLabelValues(label).Add(float64(wire))
+			lb.metrics.responseDecodedBytes.WithLabelValues(label).Add(float64(decoded))
+		},
+	}
+
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if lb.decodedSizeMetrics && (encoding == "gzip" || encoding == "deflate") {
+		body.startDecoder(encoding)
+	}
+	resp.Body = body
+}
+
+// measuredBody counts the bytes read through it and optionally feeds a copy
+// to a decompressor counting the decoded size
+type measuredBody struct {
+	io.ReadCloser
+	record func(wire, decoded int64)
+
+	wire    int64
+	decoder *io.PipeWriter
+	decoded chan int64
+	once    sync.Once
+}
+
+// startDecoder decompresses a copy of the body in the background
+func (b *measuredBody) startDecoder(encoding string) {
+	reader, writer := io.Pipe()
+	b.decoder = writer
+	b.decoded = make(chan int64, 1)
+
+	go func() {
+		var n int64
+		var decompressor io.ReadCloser
+		var err error
+		if encoding == "gzip" {
+			decompressor, err = gzip.NewReader(reader)
+		} else {
+			decompressor, err = zlib.NewReader(reader)
+		}
+		if err == nil {
+			n, _ = io.Copy(io.Discard, decompressor)
+			decompressor.Close()
+		}
+		// Keep consuming so a malformed body never blocks the client
+		io.Copy(io.Discard, reader)
+		b.decoded <- n
+	}()
+}
+
+func (b *measuredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.wire += int64(n)
+	if n > 0 && b.decoder != nil {
+		b.decoder.Write(p[:n])
+	}
+	if err == io.EOF {
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *measuredBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.finish()
+	return err
+}
+
+// finish records the sizes once the body has been read or closed
+func (b *measuredBody) finish() {
+	b.once.Do(func() {
+		decoded := b.wire
+		if b.decoder != nil {
+			b.decoder.Close()
+			decoded = <-b.decoded
+		}
+		b.record(b.wire, decoded)
+	})
+}
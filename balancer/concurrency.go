@@ -0,0 +1,244 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// capacityRetryAfter is suggested to clients turned away because every
+// eligible backend is saturated
+const capacityRetryAfter = time.Second
+
+// WithMaxConnectionsPerBackend caps the number of requests proxied to a
+// single backend at once. Backends can override it with MaxConnections in
+// their config. Zero means unlimited.
+func WithMaxConnectionsPerBackend(max int) Option {
+	return func(lb *LoadBalancer) {
+		lb.maxConnections = int64(max)
+	}
+}
+
+// WithOverflowQueue lets up to depth requests wait for a free backend slot
+// for at most timeout when every backend is at capacity. Without it,
+// saturated requests are rejected immediately.
+func WithOverflowQueue(depth int, timeout time.Duration) Option {
+	return func(lb *LoadBalancer) {
+		lb.queueCapacity = int64(depth)
+		lb.queueTimeout = timeout
+	}
+}
+
+// hasCapacity reports whether the backend can accept another request
+func (b *Backend) hasCapacity() bool {
+	return b.maxConnections <= 0 || atomic.LoadInt64(&b.activeConnections) < b.maxConnections
+}
+
+// tryAcquire claims a connection slot on the backend if one is free
+func (b *Backend) tryAcquire() bool {
+	for {
+		active := atomic.LoadInt64(&b.activeConnections)
+		if b.maxConnections > 0 && active >= b.maxConnections {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.activeConnections, active, active+1) {
+			return true
+		}
+	}
+}
+
+// slotWaiter is a request in the overflow queue. It takes a slot on the
+// first backend it may use that frees up.
+type slotWaiter struct {
+	accepts func(*Backend) bool
+	handoff chan *Backend
+}
+
+// releaseBackend frees the backend's slot. When a queued request may use
+// the backend the slot is handed straight to the longest-waiting one, so
+// queued requests are served in order and ahead of new arrivals.
+func (lb *LoadBalancer) releaseBackend(backend *Backend) {
+	if backend.isRoutable() {
+		lb.waitMutex.Lock()
+		for i, waiter := range lb.waiters {
+			if waiter.accepts(backend) {
+				lb.waiters = append(lb.waiters[:i:i], lb.waiters[i+1:]...)
+				lb.waitMutex.Unlock()
+				waiter.handoff <- backend
+				return
+			}
+		}
+		lb.waitMutex.Unlock()
+	}
+	if atomic.AddInt64(&backend.activeConnections, -1) == 0 && backend.removing.Load() > 0 {
+		backend.notifyIdle()
+	}
+}
+
+// enqueue adds a request that may use any of its candidate backends to the
+// back of the overflow queue
+func (lb *LoadBalancer) enqueue(role string, pool []int, tried []*Backend) *slotWaiter {
+	waiter := &slotWaiter{
+		accepts: func(backend *Backend) bool {
+			return containsBackend(lb.candidateBackends(role, pool, tried), backend)
+		},
+		handoff: make(chan *Backend, 1),
+	}
+	lb.waitMutex.Lock()
+	lb.waiters = append(lb.waiters, waiter)
+	lb.waitMutex.Unlock()
+	return waiter
+}
+
+// dequeue takes a request out of the overflow queue. A slot it was handed
+// in the meantime is released again.
+func (lb *LoadBalancer) dequeue(waiter *slotWaiter) {
+	lb.waitMutex.Lock()
+	for i, w := range lb.waiters {
+		if w == waiter {
+			lb.waiters = append(lb.waiters[:i:i], lb.waiters[i+1:]...)
+			lb.waitMutex.Unlock()
+			return
+		}
+	}
+	lb.waitMutex.Unlock()
+	lb.releaseBackend(<-waiter.handoff)
+}
+
+// hasAliveBackend reports whether any candidate backend for the request is
+// up, regardless of how busy it is
+func (lb *LoadBalancer) hasAliveBackend(role string, pool []int, tried []*Backend) bool {
+	for _, backend := range lb.candidateBackends(role, pool, tried) {
+		if backend.isRoutable() {
+			return true
+		}
+	}
+	return false
+}
+
+// claimBackend selects a backend not yet tried for the request and claims
+// a slot on it. A backend that fills up between being selected and claimed
+// is passed over, so nil means every candidate is saturated or down.
+func (lb *LoadBalancer) claimBackend(r *http.Request, role string, pool []int, tried []*Backend) *Backend {
+	skip := tried
+	for {
+		if len(skip) > len(tried) && len(lb.candidateBackends(role, pool, skip)) == 0 {
+			return nil
+		}
+		backend := lb.getBackendForRequest(r, role, pool, skip)
+		if backend == nil || backend.tryAcquire() {
+			return backend
+		}
+		skip = append(skip[:len(skip):len(skip)], backend)
+	}
+}
+
+// acquireBackend selects a backend not yet tried for the request and claims
+// a slot on it.
+// When every eligible backend is saturated the request waits in the
+// overflow queue until one of them frees a slot or the queue timeout
+// elapses. Queued requests take whichever eligible backend frees up first,
+// in arrival order. On failure it writes the error response itself and
+// returns nil.
+func (lb *LoadBalancer) acquireBackend(w http.ResponseWriter, r *http.Request, role string, pool []int, tried []*Backend) *Backend {
+	var timeout <-chan time.Time
+	var waiter *slotWaiter
+	queued := false
+	defer func() {
+		if waiter != nil {
+			lb.dequeue(waiter)
+		}
+		if queued {
+			atomic.AddInt64(&lb.queueDepth, -1)
+		}
+	}()
+
+	first := len(tried) == 0
+	for {
+		// Prefer the role's home backend or the one the client is pinned to
+		// on the first attempt, otherwise pick one based on role and strategy
+		var backend *Backend
+		if first {
+			backend = lb.homeBackend(r, role, pool)
+			if backend == nil {
+				backend = lb.stickyBackend(r, role, pool)
+			}
+			if backend != nil && !backend.tryAcquire() {
+				backend = nil
+			}
+		}
+		pinned := backend != nil
+		if backend == nil {
+			backend = lb.claimBackend(r, role, pool, tried)
+		}
+
+		if backend != nil {
+			// Another request may have taken the half-open probe in the
+			// meantime; the backend is no longer routable, so pick again
+			if !backend.admitThroughBreaker() {
+				lb.releaseBackend(backend)
+				continue
+			}
+			if !pinned && lb.stickyCookieName != "" {
+				lb.setStickyCookie(w, backend)
+			}
+			return backend
+		}
+
+		if !lb.hasAliveBackend(role, pool, tried) {
+			lb.writeNoBackend(w, r, role)
+			return nil
+		}
+
+		// Every eligible backend is at capacity, wait for a slot
+		if !queued {
+			if atomic.AddInt64(&lb.queueDepth, 1) > lb.queueCapacity {
+				atomic.AddInt64(&lb.queueDepth, -1)
+				lb.logRequest(r, LevelWarn, "Request rejected - all backends at capacity", "role", role, "path", r.URL.Path, "status", http.StatusServiceUnavailable)
+				setRetryAfter(w, capacityRetryAfter)
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte("All backend servers are at capacity"))
+				return nil
+			}
+			queued = true
+			timer := time.NewTimer(lb.queueTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		if waiter == nil {
+			// Select once more after joining the queue so a slot released
+			// in between isn't missed
+			waiter = lb.enqueue(role, pool, tried)
+			first = false
+			continue
+		}
+
+		select {
+		case backend := <-waiter.handoff:
+			waiter = nil
+			if !backend.admitThroughBreaker() {
+				lb.releaseBackend(backend)
+				continue
+			}
+			if lb.stickyCookieName != "" {
+				lb.setStickyCookie(w, backend)
+			}
+			return backend
+		case <-timeout:
+			lb.logRequest(r, LevelWarn, "Request timed out in overflow queue", "role", role, "path", r.URL.Path, "status", http.StatusServiceUnavailable, "waitMs", durationMillis(lb.queueTimeout))
+			setRetryAfter(w, capacityRetryAfter)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("Timed out waiting for a free backend"))
+			return nil
+		case <-r.Context().Done():
+			if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+				lb.logRequest(r, LevelWarn, "Request deadline passed in overflow queue", "role", role, "path", r.URL.Path, "status", http.StatusGatewayTimeout)
+				w.WriteHeader(http.StatusGatewayTimeout)
+				w.Write([]byte("Timed out waiting for a free backend"))
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package balancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultHealthCheckPath is probed when a backend does not configure its own path
+const DefaultHealthCheckPath = "/health"
+
+// BackendConfig describes a single backend server
+type BackendConfig struct {
+	URL             string `json:"url" yaml:"url"`
+	Weight          int    `json:"weight" yaml:"weight"`
+	Admin           bool   `json:"admin" yaml:"admin"`
+	HealthCheckPath string `json:"healthCheckPath" yaml:"healthCheckPath"`
+
+	// MaxConnections caps concurrent requests to this backend, overriding
+	// the balancer-wide limit. Zero uses the balancer-wide limit.
+	MaxConnections int `json:"maxConnections" yaml:"maxConnections"`
+
+	// HealthCheckType is "http" (the default) or "tcp" for a plain connect check
+	HealthCheckType string `json:"healthCheckType" yaml:"healthCheckType"`
+	// HealthCheckTimeout overrides the timeout for the check type, e.g. "2s"
+	HealthCheckTimeout string `json:"healthCheckTimeout" yaml:"healthCheckTimeout"`
+	// HealthCheckInterval overrides how often this backend is checked, e.g. "30s"
+	HealthCheckInterval string `json:"healthCheckInterval" yaml:"healthCheckInterval"`
+	// HealthCheckBody, when set, must appear in the body of a 200 response to
+	// an HTTP check for the backend to count as healthy
+	HealthCheckBody string `json:"healthCheckBody" yaml:"healthCheckBody"`
+	// HealthCheckBodyPattern is a regular expression the body of a 200
+	// response to an HTTP check must match, e.g. `"status":\s*"ok"`
+	HealthCheckBodyPattern string `json:"healthCheckBodyPattern" yaml:"healthCheckBodyPattern"`
+
+	// Protocol is the HTTP version spoken to the backend: "http1", "http2"
+	// (HTTP/2 over TLS for https, h2c with prior knowledge for http) or
+	// empty to use HTTP/2 when an https backend offers it and HTTP/1.1
+	// otherwise
+	Protocol string `json:"protocol" yaml:"protocol"`
+
+	// StripPrefix is removed from the start of request paths and AddPrefix
+	// put in front before they are forwarded, e.g. with an AddPrefix of /v1
+	// GET /users reaches the backend as GET /v1/users. Paths that don't start
+	// with StripPrefix are forwarded with AddPrefix alone.
+	StripPrefix string `json:"stripPrefix" yaml:"stripPrefix"`
+	AddPrefix   string `json:"addPrefix" yaml:"addPrefix"`
+
+	// CAFile is a PEM bundle trusted for this https backend
+	CAFile string `json:"caFile" yaml:"caFile"`
+	// InsecureSkipVerify disables certificate verification. Only for development.
+	InsecureSkipVerify bool `json:"insecureSkipVerify" yaml:"insecureSkipVerify"`
+}
+
+// fileConfig is the on-disk layout of a configuration file
+type fileConfig struct {
+	Backends []BackendConfig `json:"backends" yaml:"backends"`
+}
+
+// LoadConfig reads the backend list from a JSON (.json) or YAML (.yaml,
+// .yml) file, chosen by file extension
+func LoadConfig(path string) ([]BackendConfig, error) {
+	var unmarshal func([]byte, interface{}) error
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		unmarshal = json.Unmarshal
+	case ".yaml", ".yml":
+		unmarshal = yaml.Unmarshal
+	default:
+		return nil, fmt.Errorf("unsupported config file extension %q, expected .json, .yaml or .yml", ext)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var cfg fileConfig
+	if err := unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	if err := ValidateBackendConfigs(cfg.Backends); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	return cfg.Backends, nil
+}
+
+// ValidateBackendConfigs checks that every backend has a usable URL, a
+// non-negative weight and that no URL is listed twice
+func ValidateBackendConfigs(configs []BackendConfig) error {
+	if len(configs) == 0 {
+		return fmt.Errorf("no backends configured")
+	}
+
+	seen := make(map[string]bool, len(configs))
+	for i, cfg := range configs {
+		parsedURL, err := parseBackendURL(cfg.URL)
+		if err != nil {
+			return fmt.Errorf("backend %d: %w", i+1, err)
+		}
+		if cfg.Weight < 0 {
+			return fmt.Errorf("backend %d: weight must not be negative", i+1)
+		}
+		if cfg.MaxConnections < 0 {
+			return fmt.Errorf("backend %d: maxConnections must not be negative", i+1)
+		}
+		if _, _, err := parseHealthCheck(cfg); err != nil {
+			return fmt.Errorf("backend %d: %w", i+1, err)
+		}
+		if _, err := parseHealthCheckInterval(cfg); err != nil {
+			return fmt.Errorf("backend %d: %w", i+1, err)
+		}
+		if _, err := parseHealthCheckBody(cfg); err != nil {
+			return fmt.Errorf("backend %d: %w", i+1, err)
+		}
+		if _, err := backendProtocols(cfg, parsedURL); err != nil {
+			return fmt.Errorf("backend %d: %w", i+1, err)
+		}
+		if _, _, err := parsePathPrefixes(cfg); err != nil {
+			return fmt.Errorf("backend %d: %w", i+1, err)
+		}
+		key := backendKey(parsedURL)
+		if seen[key] {
+			return fmt.Errorf("backend %d: duplicate URL %q", i+1, cfg.URL)
+		}
+		seen[key] = true
+	}
+
+	return nil
+}
+
+// parseBackendURL parses a backend URL and requires it to be absolute
+func parseBackendURL(rawURL string) (*url.URL, error) {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend URL %q: %w", rawURL, err)
+	}
+	if parsedURL.Scheme == "" || parsedURL.Host == "" {
+		return nil, fmt.Errorf("invalid backend URL %q: must include scheme and host", rawURL)
+	}
+	return parsedURL, nil
+}
+
+// backendKey normalizes a backend URL so that URLs reaching the same
+// backend compare equal: scheme and host are lowercased, default ports and
+// trailing slashes dropped
+func backendKey(u *url.URL) string {
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		port = ""
+	}
+	if port != "" {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	key := scheme + "://" + host + strings.TrimRight(u.EscapedPath(), "/")
+	if u.RawQuery != "" {
+		key += "?" + u.RawQuery
+	}
+	return key
+}
@@ -0,0 +1,89 @@
+package balancer
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// LimitConnectionsPerIP wraps the listener so that no client IP holds more
+// than max open connections. Excess connections are closed as soon as they
+// are accepted, before any TLS or HTTP processing. Trusted proxies are exempt
+// since they carry many clients' traffic; the client behind them is only
+// known per request.
+func (lb *LoadBalancer) LimitConnectionsPerIP(listener net.Listener, max int) net.Listener {
+	return &ipLimitListener{
+		Listener: listener,
+		lb:       lb,
+		max:      max,
+		open:     make(map[string]int),
+	}
+}
+
+// ipLimitListener counts open connections per remote IP
+type ipLimitListener struct {
+	net.Listener
+	lb  *LoadBalancer
+	max int
+
+	mutex sync.Mutex
+	open  map[string]int
+}
+
+// Accept returns the next connection whose IP is within its limit
+func (l *ipLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			return conn, nil
+		}
+		if ip := net.ParseIP(host); ip != nil && containsIP(l.lb.trustedProxies, ip) {
+			return conn, nil
+		}
+
+		if l.acquire(host) {
+			return &ipLimitConn{Conn: conn, release: func() { l.release(host) }}, nil
+		}
+		atomic.AddUint64(&l.lb.connectionsRefused, 1)
+		l.lb.logger.Log(LevelDebug, "Connection refused - too many connections from client", "clientIP", host, "limit", l.max)
+		conn.Close()
+	}
+}
+
+// acquire counts a new connection from host unless it is at the limit
+func (l *ipLimitListener) acquire(host string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.open[host] >= l.max {
+		return false
+	}
+	l.open[host]++
+	return true
+}
+
+// release forgets a closed connection from host
+func (l *ipLimitListener) release(host string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.open[host]--; l.open[host] <= 0 {
+		delete(l.open, host)
+	}
+}
+
+// ipLimitConn releases its slot once when closed
+type ipLimitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *ipLimitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
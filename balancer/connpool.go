@@ -0,0 +1,131 @@
+package balancer
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+)
+
+// connPool counts a backend transport's open and idle connections, which
+// http.Transport keeps to itself
+type connPool struct {
+	open int64
+	idle int64
+}
+
+// stats returns the open, idle and in-use connection counts
+func (p *connPool) stats() (open, idle, inUse int64) {
+	open = atomic.LoadInt64(&p.open)
+	idle = atomic.LoadInt64(&p.idle)
+	inUse = open - idle
+	if inUse < 0 {
+		// The two counters are read separately
+		inUse = 0
+	}
+	return open, idle, inUse
+}
+
+// dialer wraps the transport's dial function so every connection it opens
+// is counted until closed
+func (p *connPool) dialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		atomic.AddInt64(&p.open, 1)
+		return &pooledConn{Conn: conn, pool: p}, nil
+	}
+}
+
+// pooledConn is a backend connection counted by its connPool
+type pooledConn struct {
+	net.Conn
+	pool *connPool
+
+	mutex  sync.Mutex
+	idle   bool
+	closed bool
+}
+
+// setIdle records whether the connection sits in the transport's idle pool
+func (c *pooledConn) setIdle(idle bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed || c.idle == idle {
+		return
+	}
+	c.idle = idle
+	if idle {
+		atomic.AddInt64(&c.pool.idle, 1)
+	} else {
+		atomic.AddInt64(&c.pool.idle, -1)
+	}
+}
+
+func (c *pooledConn) Close() error {
+	c.mutex.Lock()
+	if !c.closed {
+		c.closed = true
+		atomic.AddInt64(&c.pool.open, -1)
+		if c.idle {
+			atomic.AddInt64(&c.pool.idle, -1)
+		}
+	}
+	c.mutex.Unlock()
+	return c.Conn.Close()
+}
+
+// pooledConnOf finds the pooledConn beneath a connection, e.g. a TLS one
+func pooledConnOf(conn net.Conn) *pooledConn {
+	for conn != nil {
+		switch c := conn.(type) {
+		case *pooledConn:
+			return c
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// pooledTransport sends a backend's requests, proxied and health checks
+// alike, noting when each connection leaves and returns to the idle pool.
+// HTTP/2 connections are shared by concurrent requests and never return to
+// the pool, so they always count as in use.
+type pooledTransport struct {
+	*http.Transport
+	pool *connPool
+}
+
+// newPooledTransport counts the connections of transport in pool
+func newPooledTransport(transport *http.Transport, pool *connPool) *pooledTransport {
+	transport.DialContext = pool.dialer(transport.DialContext)
+	return &pooledTransport{Transport: transport, pool: pool}
+}
+
+func (t *pooledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var conn atomic.Pointer[pooledConn]
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if c := pooledConnOf(info.Conn); c != nil {
+				c.setIdle(false)
+				conn.Store(c)
+			}
+		},
+		PutIdleConn: func(err error) {
+			if c := conn.Load(); c != nil && err == nil {
+				c.setIdle(true)
+			}
+		},
+	}
+	return t.Transport.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
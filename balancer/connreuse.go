@@ -0,0 +1,41 @@
+package balancer
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+)
+
+// connReuse counts how a backend's requests obtained their connection
+type connReuse struct {
+	dialed uint64
+	reused uint64
+}
+
+// ratio returns the share of requests served over a reused connection
+func (c *connReuse) ratio() float64 {
+	dialed := atomic.LoadUint64(&c.dialed)
+	reused := atomic.LoadUint64(&c.reused)
+	if dialed+reused == 0 {
+		return 0
+	}
+	return float64(reused) / float64(dialed+reused)
+}
+
+// traceConnections attaches an httptrace hook to the outgoing request that
+// records whether the transport reused an idle connection or dialed a new one
+func (lb *LoadBalancer) traceConnections(req *http.Request, backend *Backend) *http.Request {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			reused := "false"
+			if info.Reused {
+				reused = "true"
+				atomic.AddUint64(&backend.connections.reused, 1)
+			} else {
+				atomic.AddUint64(&backend.connections.dialed, 1)
+			}
+			lb.metrics.backendConnections.WithLabelValues(backend.URL.String(), reused).Inc()
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
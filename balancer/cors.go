@@ -0,0 +1,172 @@
+package balancer
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Methods and headers allowed by CORS when none are configured
+var (
+	DefaultCORSMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+	DefaultCORSHeaders = []string{"Authorization", "Content-Type"}
+)
+
+// CORSConfig controls which cross-origin browser requests are allowed
+type CORSConfig struct {
+	// AllowedOrigins lists the origins allowed to call the balancer, e.g.
+	// https://app.example.com. "*" allows any origin.
+	AllowedOrigins []string
+	// AllowedMethods defaults to DefaultCORSMethods
+	AllowedMethods []string
+	// AllowedHeaders lists the request headers a browser may send. Defaults
+	// to DefaultCORSHeaders.
+	AllowedHeaders []string
+	// ExposedHeaders lists the response headers scripts may read
+	ExposedHeaders []string
+	// AllowCredentials lets browsers send cookies and read the response
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache a preflight response
+	MaxAge time.Duration
+}
+
+// WithCORS answers CORS preflight requests at the balancer, without a JWT,
+// and sets the CORS headers on every other response in place of any the
+// backends send.
+func WithCORS(cfg CORSConfig) Option {
+	return func(lb *LoadBalancer) {
+		if len(cfg.AllowedMethods) == 0 {
+			cfg.AllowedMethods = DefaultCORSMethods
+		}
+		if len(cfg.AllowedHeaders) == 0 {
+			cfg.AllowedHeaders = DefaultCORSHeaders
+		}
+		lb.cors = &cfg
+	}
+}
+
+// isPreflight reports whether the request is a CORS preflight request
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// allowedOrigin returns the value of Access-Control-Allow-Origin for the
+// request's origin, or "" when the origin is not allowed
+func (cfg *CORSConfig) allowedOrigin(origin string) string {
+	if origin == "" {
+		return ""
+	}
+	for _, allowed := range cfg.AllowedOrigins {
+		if allowed == "*" {
+			// Credentials can't be combined with a wildcard, so echo the
+			// origin instead
+			if cfg.AllowCredentials {
+				return origin
+			}
+			return "*"
+		}
+		if strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// allowsMethod reports whether browsers may send requests with the method
+func (cfg *CORSConfig) allowsMethod(method string) bool {
+	for _, allowed := range cfg.AllowedMethods {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsHeaders reports whether browsers may send the comma separated
+// request headers
+func (cfg *CORSConfig) allowsHeaders(headers string) bool {
+	for _, header := range strings.Split(headers, ",") {
+		header = strings.TrimSpace(header)
+		if header == "" {
+			continue
+		}
+		allowed := false
+		for _, h := range cfg.AllowedHeaders {
+			if h == "*" || strings.EqualFold(h, header) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// servePreflight answers CORS preflight requests and reports whether the
+// request was one
+func (lb *LoadBalancer) servePreflight(w http.ResponseWriter, r *http.Request) bool {
+	if lb.cors == nil || !isPreflight(r) {
+		return false
+	}
+	header := w.Header()
+	header.Add("Vary", "Origin")
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+
+	origin := lb.cors.allowedOrigin(r.Header.Get("Origin"))
+	method := r.Header.Get("Access-Control-Request-Method")
+	headers := r.Header.Get("Access-Control-Request-Headers")
+	if origin == "" || !lb.cors.allowsMethod(method) || !lb.cors.allowsHeaders(headers) {
+		lb.logRequest(r, LevelWarn, "CORS preflight rejected", "origin", r.Header.Get("Origin"), "method", method, "headers", headers, "path", r.URL.Path, "status", http.StatusForbidden)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("CORS request not allowed"))
+		return true
+	}
+
+	header.Set("Access-Control-Allow-Origin", origin)
+	header.Set("Access-Control-Allow-Methods", strings.Join(lb.cors.AllowedMethods, ", "))
+	header.Set("Access-Control-Allow-Headers", strings.Join(lb.cors.AllowedHeaders, ", "))
+	if lb.cors.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if lb.cors.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(lb.cors.MaxAge.Seconds())))
+	}
+	lb.logRequest(r, LevelDebug, "CORS preflight answered", "origin", origin, "method", method, "path", r.URL.Path)
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// setCORSHeaders adds the CORS headers for the request's origin to a
+// response, including the errors written by the balancer itself
+func (lb *LoadBalancer) setCORSHeaders(w http.ResponseWriter, r *http.Request) {
+	if lb.cors == nil {
+		return
+	}
+	header := w.Header()
+	header.Add("Vary", "Origin")
+	origin := lb.cors.allowedOrigin(r.Header.Get("Origin"))
+	if origin == "" {
+		return
+	}
+	header.Set("Access-Control-Allow-Origin", origin)
+	if lb.cors.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(lb.cors.ExposedHeaders) > 0 {
+		header.Set("Access-Control-Expose-Headers", strings.Join(lb.cors.ExposedHeaders, ", "))
+	}
+}
+
+// stripCORSHeaders removes the CORS headers a backend sent so they don't
+// conflict with the balancer's
+func stripCORSHeaders(header http.Header) {
+	for name := range header {
+		if strings.HasPrefix(name, "Access-Control-") {
+			header.Del(name)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package balancer
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Debug response headers, only sent while debug mode is on
+const (
+	DebugBackendHeader  = "X-Debug-Backend"
+	DebugStrategyHeader = "X-Debug-Strategy"
+	DebugAttemptsHeader = "X-Debug-Attempts"
+)
+
+// SetDebug turns debug mode on or off. While on, responses carry headers
+// naming the backend, the selection strategy and the number of attempts.
+func (lb *LoadBalancer) SetDebug(enabled bool) {
+	lb.debug.Store(enabled)
+	lb.logger.Log(LevelInfo, "Debug mode changed", "enabled", enabled)
+}
+
+// Debug reports whether debug mode is on
+func (lb *LoadBalancer) Debug() bool {
+	return lb.debug.Load()
+}
+
+// strategyName describes how a backend is chosen for the role
+func (lb *LoadBalancer) strategyName(role string) string {
+	if lb.usesAdminPinning(role) {
+		return "admin-" + string(lb.adminBalancing)
+	}
+	if lb.selector != nil {
+		return "selector+" + string(lb.strategy)
+	}
+	return string(lb.strategy)
+}
+
+// setDebugHeaders adds the debug headers to a response when debug mode is
+// on. Otherwise it removes them, so a backend cannot emit them either.
+func (lb *LoadBalancer) setDebugHeaders(header http.Header, backend *Backend, state *attemptState) {
+	header.Del(DebugBackendHeader)
+	header.Del(DebugStrategyHeader)
+	header.Del(DebugAttemptsHeader)
+	if !lb.debug.Load() || state == nil {
+		return
+	}
+	header.Set(DebugBackendHeader, strconv.Itoa(backend.ID))
+	header.Set(DebugStrategyHeader, state.strategy)
+	header.Set(DebugAttemptsHeader, strconv.Itoa(state.attempt))
+}
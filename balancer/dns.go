@@ -0,0 +1,84 @@
+package balancer
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// dnsLookupTimeout bounds each resolution attempt of a backend host
+	dnsLookupTimeout = 2 * time.Second
+	// dnsRetryInitial and dnsRetryMax bound the backoff between attempts
+	dnsRetryInitial = time.Second
+	dnsRetryMax     = 30 * time.Second
+)
+
+// resolveBackends checks that each backend's host resolves. Backends whose
+// name does not resolve yet, e.g. because their DNS record is registered
+// after the balancer starts, are marked down and retried with backoff in
+// the background instead of failing their first requests.
+func (lb *LoadBalancer) resolveBackends(backends []*Backend) {
+	var wg sync.WaitGroup
+	for _, backend := range backends {
+		if net.ParseIP(backend.URL.Hostname()) != nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := lookupBackend(backend); err != nil {
+				lb.markUnresolved(backend, err)
+				go lb.awaitDNS(backend)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// lookupBackend resolves the backend's host name once
+func lookupBackend(backend *Backend) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	defer cancel()
+	_, err := net.DefaultResolver.LookupHost(ctx, backend.URL.Hostname())
+	return err
+}
+
+// markUnresolved takes a backend whose host does not resolve out of rotation
+func (lb *LoadBalancer) markUnresolved(backend *Backend, err error) {
+	backend.mutex.Lock()
+	wasAlive := backend.IsAlive
+	backend.unresolved = true
+	backend.IsAlive = false
+	backend.rawAlive = false
+	backend.rawChangedAt = time.Now()
+	backend.mutex.Unlock()
+
+	lb.metrics.setBackendUp(backend, false)
+	lb.logger.Log(LevelWarn, "Backend host does not resolve yet, marking down", "backend", backend.ID, "host", backend.URL.Hostname(), "error", err)
+	lb.notifyStateChange(backend, wasAlive, false)
+}
+
+// awaitDNS retries resolving the backend with exponential backoff. Once the
+// name resolves the backend is health checked right away rather than
+// waiting for its next scheduled check. It gives up if the backend is removed.
+func (lb *LoadBalancer) awaitDNS(backend *Backend) {
+	delay := dnsRetryInitial
+	for {
+		time.Sleep(delay)
+		if _, err := lb.findBackend(backend.URL.String()); err != nil {
+			return
+		}
+		if err := lookupBackend(backend); err == nil {
+			break
+		}
+		delay = min(2*delay, dnsRetryMax)
+	}
+
+	backend.mutex.Lock()
+	backend.unresolved = false
+	backend.mutex.Unlock()
+	lb.logger.Log(LevelInfo, "Backend host resolves now", "backend", backend.ID, "host", backend.URL.Hostname())
+	lb.checkBackend(backend)
+}
@@ -0,0 +1,114 @@
+package balancer
+
+import (
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// DefaultVirtualNodes is the number of ring positions per backend when none is configured
+const DefaultVirtualNodes = 100
+
+// hashRing maps keys to backends with consistent hashing, so adding or
+// removing a backend only moves about 1/N of the keys
+type hashRing struct {
+	hashes []uint32
+	owners map[uint32]*Backend
+}
+
+// WithConsistentHash tunes the consistent-hash strategy: the number of
+// virtual nodes per backend and the request header used as the hash key.
+// Without a header, or when the request lacks it, the client IP is used.
+func WithConsistentHash(virtualNodes int, keyHeader string) Option {
+	return func(lb *LoadBalancer) {
+		lb.virtualNodes = virtualNodes
+		lb.hashKeyHeader = keyHeader
+	}
+}
+
+// hashKey returns the 32-bit FNV-1a hash of the key, run through the
+// MurmurHash3 finalizer. FNV-1a alone maps keys differing only in their
+// last characters, like the virtual nodes of one backend, close together,
+// leaving some backends with most of the ring.
+func hashKey(key string) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	h := hash.Sum32()
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+// newHashRing places virtualNodes points on the ring for each backend.
+// Points are derived from the backend URL so they survive restarts.
+func newHashRing(backends []*Backend, virtualNodes int) *hashRing {
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+	ring := &hashRing{
+		hashes: make([]uint32, 0, len(backends)*virtualNodes),
+		owners: make(map[uint32]*Backend, len(backends)*virtualNodes),
+	}
+	for _, backend := range backends {
+		for i := 0; i < virtualNodes; i++ {
+			hash := hashKey(backend.URL.String() + "#" + strconv.Itoa(i))
+			if _, taken := ring.owners[hash]; taken {
+				continue
+			}
+			ring.owners[hash] = backend
+			ring.hashes = append(ring.hashes, hash)
+		}
+	}
+	sort.Slice(ring.hashes, func(i, j int) bool { return ring.hashes[i] < ring.hashes[j] })
+	return ring
+}
+
+// lookup walks the ring clockwise from the key's position and returns the
+// first backend accepted by usable
+func (ring *hashRing) lookup(key string, usable func(*Backend) bool) *Backend {
+	if len(ring.hashes) == 0 {
+		return nil
+	}
+	hash := hashKey(key)
+	start := sort.Search(len(ring.hashes), func(i int) bool { return ring.hashes[i] >= hash })
+
+	for i := 0; i < len(ring.hashes); i++ {
+		backend := ring.owners[ring.hashes[(start+i)%len(ring.hashes)]]
+		if usable(backend) {
+			return backend
+		}
+	}
+	return nil
+}
+
+// rebuildRing recomputes the hash ring. The caller must hold lb.mutex.
+func (lb *LoadBalancer) rebuildRing() {
+	lb.ring = newHashRing(lb.backends, lb.virtualNodes)
+}
+
+// consistentHash picks the candidate owning the request's key on the ring
+func (lb *LoadBalancer) consistentHash(r *http.Request, backends []*Backend) *Backend {
+	key := ""
+	if lb.hashKeyHeader != "" {
+		key = r.Header.Get(lb.hashKeyHeader)
+	}
+	if key == "" {
+		if ip := lb.clientIP(r); ip != nil {
+			key = ip.String()
+		} else {
+			key = r.RemoteAddr
+		}
+	}
+
+	lb.mutex.RLock()
+	ring := lb.ring
+	lb.mutex.RUnlock()
+
+	return ring.lookup(key, func(backend *Backend) bool {
+		return containsBackend(backends, backend) && backend.isAvailable()
+	})
+}
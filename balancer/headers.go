@@ -0,0 +1,67 @@
+package balancer
+
+import "net/http"
+
+// HeaderAction is what a header rule does to its header
+type HeaderAction string
+
+const (
+	// HeaderSet replaces any values of the header with the rule's value
+	HeaderSet HeaderAction = "set"
+	// HeaderAdd appends the rule's value to those already present
+	HeaderAdd HeaderAction = "add"
+	// HeaderRemove deletes the header
+	HeaderRemove HeaderAction = "remove"
+)
+
+// HeaderRule changes a single header. Header names are case-insensitive.
+type HeaderRule struct {
+	Action HeaderAction
+	Name   string
+	// Value is ignored by HeaderRemove
+	Value string
+}
+
+// HeaderRules lists the changes made to proxied requests and responses
+type HeaderRules struct {
+	// Request rules apply to requests on their way to a backend
+	Request []HeaderRule
+	// Response rules apply to backend responses on their way to the client
+	Response []HeaderRule
+}
+
+// WithHeaderRules rewrites the headers of proxied requests and responses.
+// Rules apply in the order listed, after the balancer's own headers are set,
+// so they can override those too. X-Forwarded-For is the exception, the
+// reverse proxy appends to it after the rules have run.
+func WithHeaderRules(rules HeaderRules) Option {
+	return func(lb *LoadBalancer) {
+		lb.requestHeaderRules = canonicalHeaderRules(rules.Request)
+		lb.responseHeaderRules = canonicalHeaderRules(rules.Response)
+	}
+}
+
+// canonicalHeaderRules copies the rules with their header names in
+// canonical form
+func canonicalHeaderRules(rules []HeaderRule) []HeaderRule {
+	canonical := make([]HeaderRule, len(rules))
+	for i, rule := range rules {
+		rule.Name = http.CanonicalHeaderKey(rule.Name)
+		canonical[i] = rule
+	}
+	return canonical
+}
+
+// applyHeaderRules changes the headers according to the rules, in order
+func applyHeaderRules(header http.Header, rules []HeaderRule) {
+	for _, rule := range rules {
+		switch rule.Action {
+		case HeaderSet:
+			header.Set(rule.Name, rule.Value)
+		case HeaderAdd:
+			header.Add(rule.Name, rule.Value)
+		case HeaderRemove:
+			header.Del(rule.Name)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package balancer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"regexp"
+	"sync/atomic"
+	"time"
+)
+
+// HealthCheckType selects how a backend is probed
+type HealthCheckType string
+
+const (
+	// HealthCheckHTTP expects 200 OK from the backend's health check path
+	HealthCheckHTTP HealthCheckType = "http"
+	// HealthCheckTCP only checks that a connection can be opened
+	HealthCheckTCP HealthCheckType = "tcp"
+)
+
+// DefaultHealthCheckTimeout applies to check types without a configured timeout
+const DefaultHealthCheckTimeout = 5 * time.Second
+
+// WithHealthCheckTimeout sets the probe timeout for one check type. Backends
+// can still override it in their own config.
+func WithHealthCheckTimeout(checkType HealthCheckType, timeout time.Duration) Option {
+	return func(lb *LoadBalancer) {
+		if lb.healthTimeouts == nil {
+			lb.healthTimeouts = make(map[HealthCheckType]time.Duration)
+		}
+		lb.healthTimeouts[checkType] = timeout
+	}
+}
+
+// parseHealthCheck validates a backend's check type and timeout override
+func parseHealthCheck(cfg BackendConfig) (HealthCheckType, time.Duration, error) {
+	checkType := HealthCheckType(cfg.HealthCheckType)
+	switch checkType {
+	case "":
+		checkType = HealthCheckHTTP
+	case HealthCheckHTTP, HealthCheckTCP:
+	default:
+		return "", 0, fmt.Errorf("unknown health check type %q", cfg.HealthCheckType)
+	}
+
+	if cfg.HealthCheckTimeout == "" {
+		return checkType, 0, nil
+	}
+	timeout, err := time.ParseDuration(cfg.HealthCheckTimeout)
+	if err != nil || timeout <= 0 {
+		return "", 0, fmt.Errorf("invalid health check timeout %q", cfg.HealthCheckTimeout)
+	}
+	return checkType, timeout, nil
+}
+
+// healthCheckTimeout returns the probe timeout for a backend: its own
+// override, else the one configured for its check type, else the default
+func (lb *LoadBalancer) healthCheckTimeout(backend *Backend) time.Duration {
+	if backend.healthTimeout > 0 {
+		return backend.healthTimeout
+	}
+	if timeout := lb.healthTimeouts[backend.healthCheck]; timeout > 0 {
+		return timeout
+	}
+	return DefaultHealthCheckTimeout
+}
+
+// WithHealthDebounce only acts on a health state change once the probe
+// result has been stable for at least the given window, which keeps a
+// flapping backend from thrashing traffic. Zero applies changes immediately.
+func WithHealthDebounce(window time.Duration) Option {
+	return func(lb *LoadBalancer) {
+		lb.healthDebounce = window
+	}
+}
+
+// WithBackendStateChange calls fn whenever a backend's effective health
+// state changes, e.g. to page someone when one goes down. It is only called
+// on transitions, after any debounce window, never on every check. fn runs
+// on the health checker without any balancer locks held, so it may call
+// back into the balancer, but it delays the backend's next check until it
+// returns; hand slow work such as sending notifications off to a goroutine.
+func WithBackendStateChange(fn func(backend *Backend, nowAlive bool)) Option {
+	return func(lb *LoadBalancer) {
+		lb.stateChange = fn
+	}
+}
+
+// notifyStateChange calls the state change hook if the backend's state
+// changed. The caller must not hold the backend's lock.
+func (lb *LoadBalancer) notifyStateChange(backend *Backend, wasAlive, alive bool) {
+	if lb.stateChange != nil && wasAlive != alive {
+		lb.stateChange(backend, alive)
+	}
+}
+
+// healthScheduleResolution bounds how long the health checker sleeps, so
+// backends added in the meantime are scheduled promptly
+const healthScheduleResolution = time.Second
+
+// WithHealthCheckJitter moves each health check forward by a random offset
+// of up to max, so backends sharing an interval are not all probed at the
+// same instant. Checks are never delayed, so each backend is still checked
+// at least once per its interval; the offset is capped at half of it.
+func WithHealthCheckJitter(max time.Duration) Option {
+	return func(lb *LoadBalancer) {
+		lb.healthJitter = max
+	}
+}
+
+// parseHealthCheckInterval validates a backend's check interval override
+func parseHealthCheckInterval(cfg BackendConfig) (time.Duration, error) {
+	if cfg.HealthCheckInterval == "" {
+		return 0, nil
+	}
+	interval, err := time.ParseDuration(cfg.HealthCheckInterval)
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("invalid health check interval %q", cfg.HealthCheckInterval)
+	}
+	return interval, nil
+}
+
+// healthBodyLimit caps how much of a health check response is read to match
+// the expected body
+const healthBodyLimit = 64 << 10
+
+// parseHealthCheckBody validates a backend's expected health check body and
+// compiles its pattern, if any
+func parseHealthCheckBody(cfg BackendConfig) (*regexp.Regexp, error) {
+	if cfg.HealthCheckBody == "" && cfg.HealthCheckBodyPattern == "" {
+		return nil, nil
+	}
+	if HealthCheckType(cfg.HealthCheckType) == HealthCheckTCP {
+		return nil, fmt.Errorf("health check body needs an http check")
+	}
+	if cfg.HealthCheckBodyPattern == "" {
+		return nil, nil
+	}
+	pattern, err := regexp.Compile(cfg.HealthCheckBodyPattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid health check body pattern %q: %w", cfg.HealthCheckBodyPattern, err)
+	}
+	return pattern, nil
+}
+
+// HealthCheck periodically checks if backends are alive, each on its own
+// schedule: every interval unless the backend overrides it, less any
+// jitter. Every check runs in its own goroutine so a slow backend never
+// holds up the others, but a backend's check is skipped while its previous
+// one is still running so health check goroutines can never pile up. It
+// returns once ctx is cancelled; checks already running finish on their own.
+func (lb *LoadBalancer) HealthCheck(ctx context.Context, interval time.Duration) {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	due := make(map[*Backend]time.Time)
+	for {
+		now := time.Now()
+		wake := now.Add(healthScheduleResolution)
+		backends := lb.getBackends()
+		scheduled := make(map[*Backend]time.Time, len(backends))
+		for _, backend := range backends {
+			at, known := due[backend]
+			if !known || !at.After(now) {
+				if known {
+					lb.startHealthCheck(backend)
+				}
+				at = now.Add(lb.nextHealthCheck(backend, interval))
+			}
+			scheduled[backend] = at
+			if at.Before(wake) {
+				wake = at
+			}
+		}
+		// Removed backends drop out of the schedule
+		due = scheduled
+
+		timer.Reset(time.Until(wake))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// nextHealthCheck returns how long until the backend's next check: its
+// interval less a random jitter offset
+func (lb *LoadBalancer) nextHealthCheck(backend *Backend, interval time.Duration) time.Duration {
+	if backend.healthInterval > 0 {
+		interval = backend.healthInterval
+	}
+	jitter := lb.healthJitter
+	if jitter > interval/2 {
+		jitter = interval / 2
+	}
+	if jitter <= 0 {
+		return interval
+	}
+	return interval - time.Duration(rand.Int63n(int64(jitter)+1))
+}
+
+// startHealthCheck checks the backend in the background unless its previous
+// check is still running
+func (lb *LoadBalancer) startHealthCheck(backend *Backend) {
+	if !backend.healthChecking.CompareAndSwap(false, true) {
+		atomic.AddUint64(&lb.healthChecksSkipped, 1)
+		lb.logger.Log(LevelWarn, "Skipping health check - previous check still running", "backend", backend.ID)
+		return
+	}
+	go func() {
+		defer backend.healthChecking.Store(false)
+		lb.checkBackend(backend)
+	}()
+}
+
+// checkBackend probes a single backend and updates its health state. The
+// probe result is recorded as the raw state; the effective IsAlive state
+// only follows it once it has been stable for the debounce window.
+func (lb *LoadBalancer) checkBackend(backend *Backend) {
+	healthy := lb.probe(backend)
+
+	backend.mutex.Lock()
+	wasAlive := backend.IsAlive
+	// A draining backend may be going down for a deploy; that is expected
+	// and not held against it
+	draining := backend.draining
+	if healthy {
+		backend.failCount = 0
+	} else if !draining {
+		backend.failCount++
+	}
+	if healthy != backend.rawAlive {
+		backend.rawAlive = healthy
+		backend.rawChangedAt = time.Now()
+	}
+	if backend.IsAlive != healthy && time.Since(backend.rawChangedAt) >= lb.healthDebounce {
+		backend.IsAlive = healthy
+		if healthy {
+			backend.recoveredAt = time.Now()
+		}
+	}
+	alive := backend.IsAlive
+	failCount := backend.failCount
+	backend.mutex.Unlock()
+
+	if !healthy && !draining {
+		lb.metrics.healthCheckFailures.WithLabelValues(backend.URL.String()).Inc()
+	}
+	lb.metrics.setBackendUp(backend, alive)
+	lb.logger.Log(LevelDebug, "Health check", "backend", backend.ID, "result", healthStatus(healthy), "effective", healthStatus(alive))
+	lb.reportHealth(backend, wasAlive, alive, healthy, failCount)
+	lb.notifyStateChange(backend, wasAlive, alive)
+}
+
+// probe runs the backend's health check and reports whether it passed
+func (lb *LoadBalancer) probe(backend *Backend) bool {
+	timeout := lb.healthCheckTimeout(backend)
+
+	if backend.healthCheck == HealthCheckTCP {
+		conn, err := net.DialTimeout("tcp", backendAddress(backend), timeout)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, backend.URL.String()+backend.healthCheckPath, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := backend.healthClient.Do(req)
+	if err != nil {
+		return false
+	}
+	// Always close the body so probes never leak connections
+	defer resp.Body.Close()
+	if backend.healthBody == "" && backend.healthBodyPattern == nil {
+		// Drain a little of the body so the connection can be reused
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		return resp.StatusCode == http.StatusOK
+	}
+
+	// Some backends answer 200 while degraded and only say so in the body
+	body, err := io.ReadAll(io.LimitReader(resp.Body, healthBodyLimit))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return false
+	}
+	if backend.healthBody != "" && !bytes.Contains(body, []byte(backend.healthBody)) {
+		lb.logger.Log(LevelDebug, "Health check body mismatch", "backend", backend.ID, "expected", backend.healthBody)
+		return false
+	}
+	if backend.healthBodyPattern != nil && !backend.healthBodyPattern.Match(body) {
+		lb.logger.Log(LevelDebug, "Health check body mismatch", "backend", backend.ID, "pattern", backend.healthBodyPattern.String())
+		return false
+	}
+	return true
+}
+
+// backendAddress returns the host:port a backend listens on, filling in the
+// scheme's default port
+func backendAddress(backend *Backend) string {
+	if backend.URL.Port() != "" {
+		return backend.URL.Host
+	}
+	port := "80"
+	if backend.URL.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(backend.URL.Hostname(), port)
+}
+
+// healthStatus renders a health state for logs
+func healthStatus(alive bool) string {
+	if alive {
+		return "up"
+	}
+	return "down"
+}
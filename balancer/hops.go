@@ -0,0 +1,42 @@
+package balancer
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// HopHeader counts how many times a request has passed through a load balancer
+const HopHeader = "X-LB-Hops"
+
+// WithMaxHops rejects requests with 508 Loop Detected once they have passed
+// through the balancer max times, which breaks redirect and routing loops.
+// Zero disables hop counting.
+func WithMaxHops(max int) Option {
+	return func(lb *LoadBalancer) {
+		lb.maxHops = max
+	}
+}
+
+// checkHops increments the request's hop count and reports whether it is
+// still under the limit. Otherwise it writes a 508 response.
+func (lb *LoadBalancer) checkHops(w http.ResponseWriter, r *http.Request) bool {
+	if lb.maxHops <= 0 {
+		return true
+	}
+
+	// A missing or garbled header counts as the first hop
+	hops, err := strconv.Atoi(strings.TrimSpace(r.Header.Get(HopHeader)))
+	if err != nil || hops < 0 {
+		hops = 0
+	}
+	if hops >= lb.maxHops {
+		lb.logRequest(r, LevelWarn, "Loop detected", "method", r.Method, "path", r.URL.Path, "hops", hops, "status", http.StatusLoopDetected)
+		w.WriteHeader(http.StatusLoopDetected)
+		w.Write([]byte("Request loop detected"))
+		return false
+	}
+
+	r.Header.Set(HopHeader, strconv.Itoa(hops+1))
+	return true
+}
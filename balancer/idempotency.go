@@ -0,0 +1,77 @@
+package balancer
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrIdempotencyKeyReused is returned when a key is sent again with a
+// command other than the one it was first used for
+var ErrIdempotencyKeyReused = errors.New("idempotency key already used for another command")
+
+// idempotencyTTL is how long the result of a keyed admin command is kept
+// to answer retries of the same command
+const idempotencyTTL = 10 * time.Minute
+
+// idempotentResult is the outcome of a keyed admin command. done is closed
+// once reply and err are set.
+type idempotentResult struct {
+	request string
+	done    chan struct{}
+	reply   string
+	err     error
+	at      time.Time
+}
+
+// idempotencyCache remembers recent keyed admin commands
+type idempotencyCache struct {
+	mutex   sync.Mutex
+	results map[string]*idempotentResult
+}
+
+// idempotent runs command once per key. A retry or concurrent duplicate
+// with the same key and request, the command with its arguments, waits for
+// and returns the first run's result instead of applying the command again.
+// The same key with another request is refused with ErrIdempotencyKeyReused
+// rather than answered with the result of a command that wasn't asked for.
+// An empty key always runs the command.
+func (lb *LoadBalancer) idempotent(key, request string, command func() (string, error)) (string, error) {
+	if key == "" {
+		return command()
+	}
+
+	cache := &lb.idempotency
+	now := time.Now()
+	cache.mutex.Lock()
+	if cache.results == nil {
+		cache.results = make(map[string]*idempotentResult)
+	}
+	for k, result := range cache.results {
+		if !result.at.IsZero() && now.Sub(result.at) > idempotencyTTL {
+			delete(cache.results, k)
+		}
+	}
+	if result, ok := cache.results[key]; ok {
+		cache.mutex.Unlock()
+		if result.request != request {
+			lb.logger.Log(LevelWarn, "Admin command key reused", "key", key, "command", request, "firstCommand", result.request)
+			return "", fmt.Errorf("%w: %q", ErrIdempotencyKeyReused, key)
+		}
+		<-result.done
+		lb.logger.Log(LevelInfo, "Admin command already applied", "key", key)
+		return result.reply, result.err
+	}
+	result := &idempotentResult{request: request, done: make(chan struct{})}
+	cache.results[key] = result
+	cache.mutex.Unlock()
+
+	reply, err := command()
+
+	cache.mutex.Lock()
+	result.reply, result.err, result.at = reply, err, time.Now()
+	cache.mutex.Unlock()
+	close(result.done)
+	return reply, err
+}
@@ -0,0 +1,171 @@
+package balancer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Defaults for JWKS caching
+const (
+	DefaultJWKSTTL = time.Hour
+	// DefaultJWKSMinRefresh limits how often an unknown key ID may trigger
+	// a fetch, so forged kids cannot hammer the provider
+	DefaultJWKSMinRefresh = 10 * time.Second
+)
+
+// JWKS fetches and caches the signing keys published at a JSON Web Key Set
+// URL. Keys are looked up by the token's kid header. The set is refetched
+// once TTL has passed or when a token names an unknown kid.
+type JWKS struct {
+	URL string
+	// TTL is how long a fetched key set is used before it is refreshed
+	TTL time.Duration
+	// MinRefresh is the minimum time between fetches for unknown kids
+	MinRefresh time.Duration
+
+	client    *http.Client
+	mutex     sync.Mutex
+	keys      map[string]interface{}
+	fetchedAt time.Time
+}
+
+// NewJWKS creates a key set cache for url. A ttl of zero or less uses
+// DefaultJWKSTTL.
+func NewJWKS(url string, ttl time.Duration) *JWKS {
+	if ttl <= 0 {
+		ttl = DefaultJWKSTTL
+	}
+	return &JWKS{
+		URL:        url,
+		TTL:        ttl,
+		MinRefresh: DefaultJWKSMinRefresh,
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// key returns the verification key with the given ID. It fails closed: if
+// the key set cannot be fetched when it is needed, the token is rejected.
+func (j *JWKS) key(kid string) (interface{}, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	now := time.Now()
+	expired := now.Sub(j.fetchedAt) >= j.TTL
+	key, known := j.keys[kid]
+	if known && !expired {
+		return key, nil
+	}
+	if expired || now.Sub(j.fetchedAt) >= j.MinRefresh {
+		keys, err := j.fetch()
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+		}
+		j.keys = keys
+		j.fetchedAt = now
+	}
+	if key, ok := j.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key ID %q", kid)
+}
+
+// jsonWebKey holds the fields of a JWK used for RSA and EC public keys
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetch downloads and parses the key set. Keys that are not for signing or
+// of an unsupported type are skipped.
+func (j *JWKS) fetch() (map[string]interface{}, error) {
+	resp, err := j.client.Get(j.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("invalid key set: %w", err)
+	}
+
+	keys := make(map[string]interface{})
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+// publicKey decodes the JWK into an RSA or ECDSA public key
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeJWKInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJWKInt(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeJWKInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJWKInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// decodeJWKInt decodes a base64url encoded big-endian integer
+func decodeJWKInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(data) == 0 {
+		return nil, fmt.Errorf("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
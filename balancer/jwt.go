@@ -1,7 +1,11 @@
 package balancer
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"os"
 	"strings"
 	"time"
 
@@ -12,59 +16,323 @@ const (
 	// For this example, we'll use a simple symmetric key
 	// In production, you would use proper key management
 	jwtSecretKey = "your-secret-key-replace-in-production"
+
+	// DefaultRoleClaim is the claim the role is read from by default
+	DefaultRoleClaim = "role"
+)
+
+// Errors returned by token validation. Use errors.Is to test for them.
+var (
+	// ErrNoToken is returned when the request carries no token
+	ErrNoToken = errors.New("no token provided")
+	// ErrTokenExpired is returned for an otherwise valid token past its
+	// expiry. Clients should refresh the token rather than log in again.
+	ErrTokenExpired = errors.New("token expired")
+	// ErrInvalidToken is returned for a malformed token or one with a bad
+	// signature, algorithm or claims
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrForbiddenRole is returned for an authentic token whose role is not
+	// allowed. Callers should answer 403 rather than 401 for it.
+	ErrForbiddenRole = errors.New("role not allowed")
 )
 
 // Claims represents the JWT claims
 type Claims struct {
 	Role string `json:"role"`
+	// Tenant identifies the customer the request is made for, if any
+	Tenant string `json:"tenant,omitempty"`
 	jwt.RegisteredClaims
 }
 
-// ValidateJWT validates the JWT token and returns the role
+// JWTValidator validates tokens signed with one of an allowlist of algorithms
+type JWTValidator struct {
+	// Algorithms lists the accepted "alg" header values, e.g. HS256 or RS256.
+	// Tokens using any other algorithm, including "none", are rejected.
+	Algorithms []string
+	// Secret is the shared key for HMAC algorithms
+	Secret []byte
+	// PublicKey verifies RSA and ECDSA signatures
+	PublicKey interface{}
+	// JWKS, when set, supplies RSA and ECDSA keys by the token's kid header
+	// and takes precedence over PublicKey
+	JWKS *JWKS
+	// Roles lists the accepted values of the role claim
+	Roles []string
+	// DefaultRole, when set, is assigned to authentic tokens whose role claim
+	// is missing or not in Roles instead of rejecting them. It must be one of
+	// Roles, and the load balancer refuses the admin role.
+	DefaultRole string
+	// RoleClaim names the claim holding the role, e.g. "roles" or a
+	// namespaced "https://example.com/role", DefaultRoleClaim when empty.
+	// The claim is a string or an array of roles.
+	RoleClaim string
+	// RolePriority ranks roles, highest privilege first. A token carrying
+	// several accepted roles is routed with the one ranked highest; roles
+	// not listed rank below those that are, in the token's order.
+	RolePriority []string
+	// Leeway allows for clock skew between the issuer and the balancer when
+	// checking the exp, nbf and iat claims. Zero checks them strictly.
+	Leeway time.Duration
+}
+
+// DefaultRolePriority ranks the default roles
+var DefaultRolePriority = []string{"Admin", "Client", "User"}
+
+// tokenClaims decodes a token's claims, taking the roles from the
+// configured claim
+type tokenClaims struct {
+	Claims
+	roleClaim string
+	roles     []string
+	leeway    time.Duration
+}
+
+// Valid checks the time based claims like RegisteredClaims.Valid, allowing
+// for the leeway in each direction. The jwt v4 parser has no leeway option.
+func (c *tokenClaims) Valid() error {
+	vErr := &jwt.ValidationError{}
+	now := jwt.TimeFunc()
+	if !c.VerifyExpiresAt(now.Add(-c.leeway), false) {
+		vErr.Inner = fmt.Errorf("%w by %s", jwt.ErrTokenExpired, now.Sub(c.ExpiresAt.Time))
+		vErr.Errors |= jwt.ValidationErrorExpired
+	}
+	if !c.VerifyIssuedAt(now.Add(c.leeway), false) {
+		vErr.Inner = jwt.ErrTokenUsedBeforeIssued
+		vErr.Errors |= jwt.ValidationErrorIssuedAt
+	}
+	if !c.VerifyNotBefore(now.Add(c.leeway), false) {
+		vErr.Inner = jwt.ErrTokenNotValidYet
+		vErr.Errors |= jwt.ValidationErrorNotValidYet
+	}
+	if vErr.Errors != 0 {
+		return vErr
+	}
+	return nil
+}
+
+func (c *tokenClaims) UnmarshalJSON(data []byte) error {
+	// The role field is shadowed so a "role" claim that isn't a string
+	// doesn't fail decoding
+	if err := json.Unmarshal(data, &struct {
+		*Claims
+		Role json.RawMessage `json:"role"`
+	}{Claims: &c.Claims}); err != nil {
+		return err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	c.roles = rolesFromClaim(raw[c.roleClaim])
+	return nil
+}
+
+// rolesFromClaim returns the role held by a string claim or the string
+// elements of an array claim
+func rolesFromClaim(raw json.RawMessage) []string {
+	var role string
+	if json.Unmarshal(raw, &role) == nil {
+		return []string{role}
+	}
+	var elements []json.RawMessage
+	if json.Unmarshal(raw, &elements) != nil {
+		return nil
+	}
+	roles := make([]string, 0, len(elements))
+	for _, element := range elements {
+		if json.Unmarshal(element, &role) == nil {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// DefaultRoles are accepted when no role routing is configured
+var DefaultRoles = []string{"User", "Client", "Admin"}
+
+// DefaultJWTValidator accepts only HS256 tokens signed with the built-in secret
+func DefaultJWTValidator() *JWTValidator {
+	return &JWTValidator{
+		Algorithms:   []string{jwt.SigningMethodHS256.Alg()},
+		Secret:       []byte(jwtSecretKey),
+		Roles:        DefaultRoles,
+		RolePriority: DefaultRolePriority,
+	}
+}
+
+// WithJWTValidator replaces the default token validator
+func WithJWTValidator(validator *JWTValidator) Option {
+	return func(lb *LoadBalancer) {
+		lb.validator = validator
+	}
+}
+
+// WithTokenSources also reads the token from the named cookie, then the
+// named query parameter, when the request has no Authorization header, for
+// clients such as EventSource that can't set headers. Empty names skip the
+// source. A token taken from the query is removed from the URL before the
+// request is proxied, so it doesn't end up in backend logs.
+func WithTokenSources(cookie, queryParam string) Option {
+	return func(lb *LoadBalancer) {
+		lb.tokenCookie = cookie
+		lb.tokenQueryParam = queryParam
+	}
+}
+
+// requestToken returns the raw token of the request from the first source
+// that has one: the Authorization header, the token cookie or the token
+// query parameter
+func (lb *LoadBalancer) requestToken(r *http.Request) string {
+	if token := r.Header.Get("Authorization"); token != "" {
+		return token
+	}
+	if lb.tokenCookie != "" {
+		if cookie, err := r.Cookie(lb.tokenCookie); err == nil && cookie.Value != "" {
+			return cookie.Value
+		}
+	}
+	if lb.tokenQueryParam != "" {
+		query := r.URL.Query()
+		if token := query.Get(lb.tokenQueryParam); token != "" {
+			query.Del(lb.tokenQueryParam)
+			r.URL.RawQuery = query.Encode()
+			return token
+		}
+	}
+	return ""
+}
+
+// LoadPublicKey reads a PEM encoded RSA or ECDSA public key for verifying tokens
+func LoadPublicKey(path string) (interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key: %w", err)
+	}
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+		return key, nil
+	}
+	if key, err := jwt.ParseECPublicKeyFromPEM(data); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s does not contain an RSA or ECDSA public key", path)
+}
+
+// ValidateJWT validates the JWT token with the default validator and returns the role
 func ValidateJWT(tokenString string) (string, error) {
+	return DefaultJWTValidator().Validate(tokenString)
+}
+
+// Validate validates the JWT token and returns the role
+func (v *JWTValidator) Validate(tokenString string) (string, error) {
+	claims, err := v.ValidateClaims(tokenString)
+	if err != nil {
+		return "", err
+	}
+	return claims.Role, nil
+}
+
+// ValidateClaims validates the JWT token and returns its claims. The Role
+// is the one requests should be routed with, i.e. DefaultRole when the
+// token's own role is not accepted.
+func (v *JWTValidator) ValidateClaims(tokenString string) (*Claims, error) {
 	if tokenString == "" {
-		return "", fmt.Errorf("no token provided")
+		return nil, ErrNoToken
 	}
-	
+
 	// Remove 'Bearer ' prefix if present
-	if strings.HasPrefix(tokenString, "Bearer ") {
-		tokenString = strings.TrimPrefix(tokenString, "Bearer ")
-	}
-	
-	// Parse and validate the token
-	claims := &Claims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		// Make sure token uses the correct signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(jwtSecretKey), nil
-	})
-	
+	tokenString = strings.TrimPrefix(tokenString, "Bearer ")
+
+	// Parse and validate the token, rejecting any algorithm not in the allowlist
+	parser := jwt.NewParser(jwt.WithValidMethods(v.Algorithms))
+	roleClaim := v.RoleClaim
+	if roleClaim == "" {
+		roleClaim = DefaultRoleClaim
+	}
+	parsed := &tokenClaims{roleClaim: roleClaim, leeway: v.Leeway}
+	token, err := parser.ParseWithClaims(tokenString, parsed, v.keyFunc)
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		return nil, fmt.Errorf("%w: %v", ErrTokenExpired, err)
+	}
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
 	}
-	
+
 	if !token.Valid {
-		return "", fmt.Errorf("invalid token")
+		return nil, ErrInvalidToken
+	}
+	claims := &parsed.Claims
+
+	// Validate the role claim - at least one role should be one of the
+	// configured roles
+	role, ok := v.effectiveRole(parsed.roles)
+	if !ok {
+		if v.DefaultRole == "" {
+			return nil, fmt.Errorf("%w: invalid role claim: %s", ErrForbiddenRole, strings.Join(parsed.roles, ","))
+		}
+		role = v.DefaultRole
 	}
-	
-	// Validate the role claim - it should be one of "User", "Client", or "Admin"
-	role := claims.Role
-	if role != "User" && role != "Client" && role != "Admin" {
-		return "", fmt.Errorf("invalid role claim: %s", role)
+	claims.Role = role
+
+	return claims, nil
+}
+
+// effectiveRole picks the accepted role ranked highest by RolePriority from
+// the token's roles, reporting false when none is accepted
+func (v *JWTValidator) effectiveRole(roles []string) (string, bool) {
+	for _, ranked := range v.RolePriority {
+		for _, role := range roles {
+			if role == ranked && v.isKnownRole(role) {
+				return role, true
+			}
+		}
+	}
+	for _, role := range roles {
+		if v.isKnownRole(role) {
+			return role, true
+		}
+	}
+	return "", false
+}
+
+// isKnownRole reports whether the role is one the validator accepts
+func (v *JWTValidator) isKnownRole(role string) bool {
+	for _, known := range v.Roles {
+		if role == known {
+			return true
+		}
+	}
+	return false
+}
+
+// keyFunc returns the verification key matching the token's signing method
+func (v *JWTValidator) keyFunc(token *jwt.Token) (interface{}, error) {
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		if len(v.Secret) == 0 {
+			return nil, fmt.Errorf("no HMAC secret configured")
+		}
+		return v.Secret, nil
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodECDSA:
+		if v.JWKS != nil {
+			kid, _ := token.Header["kid"].(string)
+			return v.JWKS.key(kid)
+		}
+		if v.PublicKey == nil {
+			return nil, fmt.Errorf("no public key configured")
+		}
+		return v.PublicKey, nil
+	default:
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 	}
-	
-	return role, nil
 }
 
 // GenerateJWT creates a JWT token with the specified role claim
 // This is helpful for testing purposes
 func GenerateJWT(role string) (string, error) {
-	if role != "User" && role != "Client" && role != "Admin" {
+	if role == "" {
 		return "", fmt.Errorf("invalid role: %s", role)
 	}
-	
+
 	claims := Claims{
 		Role: role,
 		RegisteredClaims: jwt.RegisteredClaims{
@@ -72,13 +340,31 @@ func GenerateJWT(role string) (string, error) {
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
-	
+
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	tokenString, err := token.SignedString([]byte(jwtSecretKey))
 	if err != nil {
 		return "", err
 	}
-	
+
 	return tokenString, nil
 }
 
+// writeUnauthorized answers a request whose token failed validation with
+// 401 and a WWW-Authenticate challenge telling the client what went wrong
+func writeUnauthorized(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrTokenExpired):
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token", error_description="expired"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("JWT token expired"))
+	case errors.Is(err, ErrNoToken):
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Invalid or missing JWT token"))
+	default:
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Invalid or missing JWT token"))
+	}
+}
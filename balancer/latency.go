@@ -0,0 +1,69 @@
+package balancer
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// latencyEWMAAlpha is the weight given to each new sample in the moving average
+	latencyEWMAAlpha = 0.1
+	// latencyReservoirSize is the number of recent samples kept for percentiles
+	latencyReservoirSize = 128
+)
+
+// latencyTracker keeps an exponentially weighted moving average and a ring
+// of the most recent samples for a backend
+type latencyTracker struct {
+	mutex   sync.Mutex
+	ewma    float64
+	samples []time.Duration
+	next    int
+}
+
+// observe records a single request duration
+func (t *latencyTracker) observe(d time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(t.samples) == 0 {
+		t.ewma = float64(d)
+	} else {
+		t.ewma = latencyEWMAAlpha*float64(d) + (1-latencyEWMAAlpha)*t.ewma
+	}
+
+	if len(t.samples) < latencyReservoirSize {
+		t.samples = append(t.samples, d)
+		return
+	}
+	t.samples[t.next] = d
+	t.next = (t.next + 1) % latencyReservoirSize
+}
+
+// average returns the moving average latency
+func (t *latencyTracker) average() time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return time.Duration(t.ewma)
+}
+
+// percentile returns the p-th percentile (0-100) of the recent samples
+func (t *latencyTracker) percentile(p float64) time.Duration {
+	t.mutex.Lock()
+	sorted := make([]time.Duration, len(t.samples))
+	copy(sorted, t.samples)
+	t.mutex.Unlock()
+
+	if len(sorted) == 0 {
+		return 0
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	idx := int(float64(len(sorted)-1) * p / 100)
+	return sorted[idx]
+}
+
+// durationMillis converts a duration to fractional milliseconds for stats
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
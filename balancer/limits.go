@@ -0,0 +1,100 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// errResponseTooLarge fails a response whose body exceeds the configured cap
+var errResponseTooLarge = errors.New("response body too large")
+
+// WithMaxRequestBodyBytes caps the size of request bodies. Larger requests
+// are answered with 413 Request Entity Too Large. Zero means no limit.
+func WithMaxRequestBodyBytes(max int64) Option {
+	return func(lb *LoadBalancer) {
+		lb.maxRequestBody = max
+	}
+}
+
+// WithMaxResponseBodyBytes caps the size of backend response bodies. A
+// response declaring a larger Content-Length is answered with 502 Bad
+// Gateway; a streamed one is cut off once it passes the cap. Zero means no
+// limit.
+func WithMaxResponseBodyBytes(max int64) Option {
+	return func(lb *LoadBalancer) {
+		lb.maxResponseBody = max
+	}
+}
+
+// limitRequestBody enforces the request body cap. A body declared too large
+// is rejected right away, otherwise reading past the cap fails the request
+// once it is proxied. It reports whether the request may go on.
+func (lb *LoadBalancer) limitRequestBody(w http.ResponseWriter, r *http.Request) bool {
+	if lb.maxRequestBody <= 0 || r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+	if r.ContentLength > lb.maxRequestBody {
+		lb.logRequest(r, LevelWarn, "Request body too large", "path", r.URL.Path, "contentLength", r.ContentLength, "status", http.StatusRequestEntityTooLarge)
+		writeRequestTooLarge(w)
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, lb.maxRequestBody)
+	return true
+}
+
+// writeRequestTooLarge answers a request whose body exceeds the cap
+func writeRequestTooLarge(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	w.Write([]byte("Request body too large"))
+}
+
+// isRequestTooLarge reports whether the error comes from reading a request
+// body past the cap
+func isRequestTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// clientFault reports whether a failed attempt was caused by the client, so
+// it says nothing about the backend's health
+func clientFault(err error) bool {
+	return errors.Is(err, context.Canceled) || isRequestTooLarge(err)
+}
+
+// limitResponseBody enforces the response body cap
+func (lb *LoadBalancer) limitResponseBody(resp *http.Response) error {
+	if lb.maxResponseBody <= 0 {
+		return nil
+	}
+	if resp.ContentLength > lb.maxResponseBody {
+		resp.Body.Close()
+		return errResponseTooLarge
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: lb.maxResponseBody}
+	return nil
+}
+
+// limitedBody fails reads once more than the allowed bytes were read
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errResponseTooLarge
+	}
+	// Read one byte past the cap to tell a body of exactly the cap from a
+	// larger one
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n + int(b.remaining), errResponseTooLarge
+	}
+	return n, err
+}
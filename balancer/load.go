@@ -0,0 +1,112 @@
+package balancer
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultLoadHeader is the response header backends report their load in
+	DefaultLoadHeader = "X-Backend-Load"
+	// DefaultLoadHalfLife is how quickly a reported load fades without updates
+	DefaultLoadHalfLife = 10 * time.Second
+)
+
+// reportedLoad is the latest load a backend advertised, between 0 (idle)
+// and 1 (saturated). It is guarded by the backend's mutex.
+type reportedLoad struct {
+	value float64
+	at    time.Time
+}
+
+// WithBackendLoadReporting reads the load backends report in the given
+// response header and lets it scale down their weight in the weighted
+// strategy. A report loses half its influence every halfLife, so a backend
+// that stops reporting drifts back to its configured weight.
+func WithBackendLoadReporting(header string, halfLife time.Duration) Option {
+	return func(lb *LoadBalancer) {
+		if halfLife <= 0 {
+			halfLife = DefaultLoadHalfLife
+		}
+		lb.loadHeader = http.CanonicalHeaderKey(header)
+		lb.loadHalfLife = halfLife
+	}
+}
+
+// recordReportedLoad stores the load advertised in a backend response and
+// strips the header so it does not leak to clients
+func (lb *LoadBalancer) recordReportedLoad(backend *Backend, resp *http.Response) {
+	value := resp.Header.Get(lb.loadHeader)
+	if value == "" {
+		return
+	}
+	resp.Header.Del(lb.loadHeader)
+
+	load, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(load) {
+		lb.logger.Log(LevelWarn, "Backend reported invalid load", "backend", backend.ID, "load", value)
+		return
+	}
+	load = math.Min(math.Max(load, 0), 1)
+
+	backend.mutex.Lock()
+	backend.load = reportedLoad{value: load, at: time.Now()}
+	backend.mutex.Unlock()
+}
+
+// currentLoad returns the backend's reported load after decay
+func (lb *LoadBalancer) currentLoad(backend *Backend, now time.Time) float64 {
+	backend.mutex.RLock()
+	load := backend.load
+	backend.mutex.RUnlock()
+
+	if load.at.IsZero() || lb.loadHalfLife <= 0 {
+		return 0
+	}
+	halfLives := now.Sub(load.at).Seconds() / lb.loadHalfLife.Seconds()
+	return load.value * math.Pow(0.5, halfLives)
+}
+
+// effectiveWeight is the configured weight scaled down by the reported load,
+// the health score and, while the backend warms up after recovering, by its
+// warmup factor
+func (lb *LoadBalancer) effectiveWeight(backend *Backend, now time.Time) float64 {
+	return float64(backend.getWeight()) * (1 - lb.currentLoad(backend, now)) * lb.healthScore(backend, now) * lb.warmupFactor(backend, now)
+}
+
+// weighted picks an available backend at random in proportion to its
+// effective weight. When every backend reports full load it falls back to
+// round-robin rather than refusing traffic.
+func (lb *LoadBalancer) weighted(backends []*Backend) *Backend {
+	now := time.Now()
+	available := make([]*Backend, 0, len(backends))
+	weights := make([]float64, 0, len(backends))
+	total := 0.0
+	for _, backend := range backends {
+		if !backend.isAvailable() {
+			continue
+		}
+		weight := lb.effectiveWeight(backend, now)
+		available = append(available, backend)
+		weights = append(weights, weight)
+		total += weight
+	}
+	if len(available) == 0 {
+		return nil
+	}
+	if total <= 0 {
+		return lb.roundRobin(available)
+	}
+
+	pick := rand.Float64() * total
+	for i, weight := range weights {
+		if pick < weight {
+			return available[i]
+		}
+		pick -= weight
+	}
+	return available[len(available)-1]
+}
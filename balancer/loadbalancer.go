@@ -1,11 +1,17 @@
 package balancer
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"regexp"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,195 +19,1020 @@ import (
 
 // LoadBalancer represents the load balancer structure
 type LoadBalancer struct {
-	backends       []*Backend
-	mutex          sync.RWMutex
+	backends        []*Backend
+	mutex           sync.RWMutex
 	roundRobinCount uint64
-	logger         *log.Logger
+	adminRoundRobin uint64
+	totalRequests   uint64
+	activeRequests  int64
+
+	// connectionsRefused counts connections closed by the per-IP limit
+	connectionsRefused uint64
+	nextBackendID      int
+
+	// adminMutex applies mutating admin operations one at a time, and
+	// idempotency deduplicates retried ones
+	adminMutex      sync.Mutex
+	idempotency     idempotencyCache
+	logger          Logger
+	logLevel        Level
+	transportConfig TransportConfig
+	validator       *JWTValidator
+
+	// Cookie and query parameter tokens are read from when the request has
+	// no Authorization header; empty skips the source
+	tokenCookie     string
+	tokenQueryParam string
+
+	// adminAPIPrefix is where the backend admin API is served; empty
+	// disables it
+	adminAPIPrefix string
+
+	// Prometheus metrics and the path they are served on
+	metrics     *metrics
+	metricsPath string
+
+	// Paths of the balancer's own probe endpoints; readiness fails while
+	// in lame-duck mode
+	livenessPath  string
+	readinessPath string
+	lameDuck      atomic.Bool
+
+	// Client IP access control
+	trustedProxies []*net.IPNet
+	ipAllowlist    []*net.IPNet
+	ipDenylist     []*net.IPNet
+
+	// recorder captures a sample of traffic for replay
+	recorder *TrafficRecorder
+
+	// shadow receives a copy of a share of the proxied requests
+	shadowConfig ShadowConfig
+	shadow       *shadowBackend
+
+	// completions receives a record of every finished request
+	completions *CompletionEmitter
+
+	// accessLog writes a Common or Combined Log Format line per request
+	accessLog *accessLog
+
+	// healthWebhook receives health events; set by PushHealthEvents
+	healthWebhook atomic.Pointer[HealthWebhook]
+
+	// bodyRewrite substitutes strings in response bodies; nil disables it
+	bodyRewrite *bodyRewriter
+
+	// publicURL replaces the backend's origin in Location headers; nil
+	// leaves them alone
+	publicURL *url.URL
+
+	// decodedSizeMetrics decompresses responses on the side for size metrics
+	decodedSizeMetrics bool
+
+	// debug adds routing details to responses; settable at runtime
+	debug atomic.Bool
+
+	// serverTiming adds Server-Timing headers to responses
+	serverTiming bool
+
+	// healthTimeouts holds the configured probe timeout per check type
+	healthTimeouts map[HealthCheckType]time.Duration
+
+	// healthChecksSkipped counts checks skipped because the backend's
+	// previous one was still running
+	healthChecksSkipped uint64
+	healthDebounce      time.Duration
+	healthJitter        time.Duration
+
+	// stateChange is called when a backend goes up or down
+	stateChange func(backend *Backend, nowAlive bool)
+
+	// maxRetries is how many other backends a failed request is retried on
+	maxRetries    int
+	retryOutcomes retryOutcomes
+
+	// requestTimeout is the deadline applied to each proxied request
+	requestTimeout time.Duration
+
+	// Retry-After sent while no backend is available, and the rate limited
+	// logging of such requests; lastOutageLog is in Unix nanoseconds
+	outageRetryAfter  time.Duration
+	outageJitter      time.Duration
+	outageLogInterval time.Duration
+	lastOutageLog     atomic.Int64
+	outageSuppressed  uint64
+
+	// removeTimeout bounds how long RemoveBackend waits for a backend's
+	// requests to finish
+	removeTimeout time.Duration
+
+	// slowStart is how long a recovered backend takes to reach full traffic
+	slowStart time.Duration
+
+	// loadHeader is the response header carrying backend-reported load,
+	// which loses half its weight every loadHalfLife
+	loadHeader   string
+	loadHalfLife time.Duration
+
+	// outlier configures error rate based ejection
+	outlier OutlierConfig
+
+	// scoring biases weighted selection by backend health; nil disables it
+	scoring *HealthScoring
+
+	// Circuit breaker settings applied to every backend
+	breakerThreshold int
+	breakerCooldown  time.Duration
+
+	// maxHops bounds how often a request may loop back through the balancer
+	maxHops int
+
+	// clientCertRole is the role granted to verified client certificates
+	// presented without a token; empty requires a token
+	clientCertRole string
+
+	// tenants configures tenant tagging; nil disables it
+	tenants *TenantConfig
+
+	// Header rules applied to proxied requests and responses
+	requestHeaderRules  []HeaderRule
+	responseHeaderRules []HeaderRule
+
+	// cors answers preflight requests and sets CORS headers; nil disables it
+	cors *CORSConfig
+
+	// strategy balances non-admin requests across backends, adminBalancing
+	// admin requests across the admin-capable ones
+	strategy       Strategy
+	adminBalancing AdminBalancing
+
+	// strategySelector is the strategy as a Selector, what selectBackend
+	// dispatches through
+	strategySelector Selector
+
+	// adminRole is the role pinned to the admin-capable backends
+	adminRole string
+
+	// reserveAdmin keeps non-admin requests off admin-capable backends
+	reserveAdmin bool
+
+	// Hash ring for the consistent-hash strategy, guarded by mutex
+	ring          *hashRing
+	virtualNodes  int
+	hashKeyHeader string
+
+	// roleRoutes maps roles to the backends allowed to serve them
+	roleRoutes map[string][]int
+
+	// roleHomes maps roles to the backend they prefer while it is available
+	roleHomes map[string]*roleHome
+
+	// accessRules restrict paths to specific roles
+	accessRules []AccessRule
+
+	// roleLimiters rate limit requests per JWT role, poolLimiters per
+	// backend pool
+	roleLimiters map[string]*tokenBucket
+	poolLimiters map[string]*poolLimiter
+
+	// Routing table and handling of unmatched requests
+	routes     []Route
+	pathRoutes []PathRoute
+	noRoute    NoRoutePolicy
+
+	// split divides unrouted traffic between the splitGroups
+	split       TrafficSplit
+	splitGroups []*splitGroup
+
+	// selector, when set, picks backends ahead of the strategy
+	selector Selector
+
+	// stickyCookieName enables cookie based session affinity when set
+	stickyCookieName string
+
+	// Per-backend connection limits and the overflow queue, whose waiting
+	// requests are kept in arrival order
+	maxConnections int64
+	queueCapacity  int64
+	queueTimeout   time.Duration
+	queueDepth     int64
+	waitMutex      sync.Mutex
+	waiters        []*slotWaiter
+
+	// Caps on request and response body sizes, zero when unlimited
+	maxRequestBody  int64
+	maxResponseBody int64
 }
 
 // Backend represents an individual backend server
 type Backend struct {
+	ID           int
 	URL          *url.URL
 	Proxy        *httputil.ReverseProxy
 	IsAdmin      bool
 	IsAlive      bool
+	Weight       int
 	mutex        sync.RWMutex
 	failCount    int
 	RequestCount uint64
+
+	// activeConnections counts requests currently being proxied
+	activeConnections int64
+	maxConnections    int64
+
+	// removing counts the RemoveBackend calls waiting for the backend to go
+	// idle, which closes idle once activeConnections reaches zero
+	removing atomic.Int32
+	idle     chan struct{}
+
+	// latency tracks how long proxied requests take
+	latency latencyTracker
+
+	// connections counts dialed versus reused upstream connections
+	connections connReuse
+
+	// transport is the backend's HTTP transport, whose open and idle
+	// connections pool counts
+	transport *http.Transport
+	pool      connPool
+
+	// outlier tracks the recent error rate for outlier ejection
+	outlier errorWindow
+
+	// statuses counts the responses sent back for the backend by class,
+	// including gateway errors written when it could not be reached
+	statuses statusClasses
+
+	// breaker stops traffic after consecutive failures
+	breaker circuitBreaker
+
+	// load is the latest load the backend reported
+	load reportedLoad
+
+	// healthCheckPath is the path probed by the health checker, healthCheck
+	// the kind of probe, healthTimeout and healthInterval its timeout and
+	// interval overrides, if any
+	healthCheckPath string
+	healthCheck     HealthCheckType
+	healthTimeout   time.Duration
+	healthInterval  time.Duration
+
+	// healthBody must appear in, and healthBodyPattern match, the body of
+	// a passing HTTP check when set
+	healthBody        string
+	healthBodyPattern *regexp.Regexp
+
+	// stripPrefix and addPrefix rewrite request paths before forwarding
+	stripPrefix string
+	addPrefix   string
+
+	// healthChecking is set while a check of the backend is running
+	healthChecking atomic.Bool
+
+	// healthClient sends HTTP probes over the backend's transport, so they
+	// share its TLS settings and idle connections
+	healthClient *http.Client
+
+	// disabled takes the backend out of rotation at an operator's request,
+	// draining only stops new requests while in-flight ones finish
+	disabled bool
+	draining bool
+
+	// rawAlive is the latest probe result and rawChangedAt when it last
+	// changed; IsAlive only follows it after the debounce window
+	rawAlive     bool
+	rawChangedAt time.Time
+
+	// unresolved is set while the backend's host name does not resolve
+	unresolved bool
+
+	// recoveredAt is when the backend last came back up, for slow start
+	recoveredAt time.Time
+
+	// config is what the backend was created from, for Reload to compare
+	config BackendConfig
 }
 
-// NewLoadBalancer creates a new load balancer instance
-func NewLoadBalancer(backendURLs []string, logger *log.Logger) *LoadBalancer {
-	backends := make([]*Backend, len(backendURLs))
-	for i, backendURL := range backendURLs {
-		parsedURL, err := url.Parse(backendURL)
+// NewLoadBalancer creates a new load balancer instance. It returns an error
+// if any backend URL is invalid. Entries are logged as text to logger unless
+// WithLogger supplies another Logger.
+func NewLoadBalancer(configs []BackendConfig, logger *log.Logger, opts ...Option) (*LoadBalancer, error) {
+	lb := &LoadBalancer{
+		logger:            NewTextLogger(logger),
+		transportConfig:   defaultTransportConfig(),
+		validator:         DefaultJWTValidator(),
+		metrics:           newMetrics(),
+		strategy:          StrategyRoundRobin,
+		adminBalancing:    AdminFailover,
+		adminRole:         DefaultAdminRole,
+		requestTimeout:    DefaultRequestTimeout,
+		removeTimeout:     DefaultRemoveTimeout,
+		outageRetryAfter:  DefaultOutageRetryAfter,
+		outageLogInterval: DefaultOutageLogInterval,
+		outlier:           OutlierConfig{Window: DefaultOutlierWindow},
+		livenessPath:      DefaultLivenessPath,
+		readinessPath:     DefaultReadinessPath,
+	}
+	for _, opt := range opts {
+		opt(lb)
+	}
+	if lb.logLevel != "" {
+		min, ok := levelRanks[lb.logLevel]
+		if !ok {
+			return nil, fmt.Errorf("unknown log level %q", lb.logLevel)
+		}
+		lb.logger = &levelLogger{logger: lb.logger, min: min}
+	}
+	lb.strategySelector = lb.builtinSelector(lb.strategy)
+	lb.applyRoleRoutes()
+	lb.applyAdminRole()
+	if err := lb.checkDefaultRole(len(configs)); err != nil {
+		return nil, err
+	}
+	if lb.shadowConfig.URL != "" {
+		shadow, err := lb.newShadowBackend(lb.shadowConfig)
 		if err != nil {
-			logger.Fatal(err)
+			return nil, fmt.Errorf("shadow backend: %w", err)
 		}
-		
-		proxy := httputil.NewSingleHostReverseProxy(parsedURL)
-
-		// Create logging transport for each backend
-		originalDirector := proxy.Director
-		backendIndex := i // Capture the backend index
-		
-		proxy.Director = func(req *http.Request) {
-			originalDirector(req)
-			logger.Printf("Request directed to backend %d: %s %s\n", 
-				backendIndex+1, req.Method, req.Host)
+		lb.shadow = shadow
+	}
+	if lb.completions != nil {
+		lb.completions.run(lb.logger)
+	}
+
+	backends := make([]*Backend, len(configs))
+	seen := make(map[string]int, len(configs))
+	for i, cfg := range configs {
+		backend, err := lb.newBackend(cfg, 0)
+		if err != nil {
+			return nil, fmt.Errorf("backend %d: %w", i+1, err)
 		}
-		
-		// Set up custom error handling
-		proxy.ErrorHandler = func(resp http.ResponseWriter, req *http.Request, err error) {
-			logger.Printf("Backend %d error: %v\n", backendIndex+1, err)
-			resp.WriteHeader(http.StatusBadGateway)
-			resp.Write([]byte(fmt.Sprintf("Backend server %d is not available", backendIndex+1)))
+		// Two proxies to one host would double its share of the traffic
+		key := backendKey(backend.URL)
+		if first, ok := seen[key]; ok {
+			return nil, fmt.Errorf("backend %d: duplicate URL %q, already listed as backend %d", i+1, cfg.URL, first)
 		}
-		
-		// First server is the only one that can handle admin requests
-		isAdmin := i == 0
-		
-		backends[i] = &Backend{
-			URL:      parsedURL,
-			Proxy:    proxy,
-			IsAdmin:  isAdmin,
-			IsAlive:  true,
+		seen[key] = i + 1
+		backends[i] = backend
+		lb.metrics.setBackendUp(backend, true)
+	}
+	lb.backends = backends
+	lb.bindPools(backends)
+	lb.rebuildRing()
+	lb.resolveBackends(backends)
+
+	return lb, nil
+}
+
+// newBackend parses the backend URL and sets up its reverse proxy with
+// request logging and custom error handling. The backend gets the given ID,
+// or the next free one if id is zero.
+func (lb *LoadBalancer) newBackend(cfg BackendConfig, id int) (*Backend, error) {
+	parsedURL, err := parseBackendURL(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	weight := cfg.Weight
+	if weight == 0 {
+		weight = 1
+	}
+	healthCheckPath := cfg.HealthCheckPath
+	if healthCheckPath == "" {
+		healthCheckPath = DefaultHealthCheckPath
+	}
+	maxConnections := lb.maxConnections
+	if cfg.MaxConnections > 0 {
+		maxConnections = int64(cfg.MaxConnections)
+	}
+	checkType, checkTimeout, err := parseHealthCheck(cfg)
+	if err != nil {
+		return nil, err
+	}
+	checkInterval, err := parseHealthCheckInterval(cfg)
+	if err != nil {
+		return nil, err
+	}
+	bodyPattern, err := parseHealthCheckBody(cfg)
+	if err != nil {
+		return nil, err
+	}
+	stripPrefix, addPrefix, err := parsePathPrefixes(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := newTransport(lb.transportConfig, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS settings for %s: %w", cfg.URL, err)
+	}
+	if cfg.InsecureSkipVerify {
+		lb.logger.Log(LevelWarn, "TLS verification disabled for backend", "url", cfg.URL)
+	}
+
+	backendID := id
+	if backendID == 0 {
+		lb.mutex.Lock()
+		lb.nextBackendID++
+		backendID = lb.nextBackendID
+		lb.mutex.Unlock()
+	}
+
+	backend := &Backend{
+		ID:                backendID,
+		URL:               parsedURL,
+		IsAdmin:           cfg.Admin,
+		IsAlive:           true,
+		rawAlive:          true,
+		Weight:            weight,
+		maxConnections:    maxConnections,
+		healthCheckPath:   healthCheckPath,
+		healthCheck:       checkType,
+		healthTimeout:     checkTimeout,
+		healthInterval:    checkInterval,
+		healthBody:        cfg.HealthCheckBody,
+		healthBodyPattern: bodyPattern,
+		stripPrefix:       stripPrefix,
+		addPrefix:         addPrefix,
+		breaker:           circuitBreaker{threshold: lb.breakerThreshold, cooldown: lb.breakerCooldown},
+		transport:         transport,
+		config:            cfg,
+	}
+	pooled := newPooledTransport(transport, &backend.pool)
+	backend.healthClient = &http.Client{Transport: pooled}
+
+	proxy := httputil.NewSingleHostReverseProxy(parsedURL)
+	proxy.Transport = pooled
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		return lb.modifyResponse(backend, resp)
+	}
+	backend.Proxy = proxy
+
+	// Create logging transport for each backend
+	originalDirector := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		rewritePath(req.URL, stripPrefix, addPrefix)
+		originalDirector(req)
+		// The reverse proxy appends the peer to X-Forwarded-For after this
+		lb.setForwardedHeaders(req)
+		lb.setTenantHeader(req)
+		req.Header.Set(RequestIDHeader, requestIDFromContext(req.Context()))
+		applyHeaderRules(req.Header, lb.requestHeaderRules)
+		lb.logRequest(req, LevelDebug, "Request directed to backend", "backend", backendID, "method", req.Method, "host", req.Host, "path", req.URL.Path)
+	}
+
+	// Set up custom error handling
+	proxy.ErrorHandler = func(resp http.ResponseWriter, req *http.Request, err error) {
+		lb.logRequest(req, LevelError, "Backend error", "backend", backendID, "path", req.URL.Path, "error", err)
+		// Leave the response to ServeHTTP if another backend will be tried
+		attempt := attemptFromContext(req.Context())
+		if attempt != nil {
+			attempt.err = err
+			// Once the request deadline has passed there is no time left to
+			// retry, and an oversized body would fail on every backend
+			if req.Context().Err() != nil || isRequestTooLarge(err) || errors.Is(err, errResponseTooLarge) {
+				attempt.retryable = false
+			}
+			if attempt.retryable {
+				return
+			}
+		}
+
+		if isRequestTooLarge(err) {
+			if attempt != nil {
+				attempt.status = http.StatusRequestEntityTooLarge
+			}
+			writeRequestTooLarge(resp)
+			return
+		}
+
+		status, message := http.StatusBadGateway, "Backend server %d is not available"
+		if isTimeoutError(err) {
+			status, message = http.StatusGatewayTimeout, "Backend server %d timed out"
+		} else if isHeaderTooLargeError(err) {
+			message = "Backend server %d sent oversized response headers"
+		} else if errors.Is(err, errResponseTooLarge) {
+			message = "Backend server %d sent an oversized response"
+		}
+		if attempt != nil {
+			attempt.status = status
 		}
+		lb.setDebugHeaders(resp.Header(), backend, attempt)
+		resp.WriteHeader(status)
+		resp.Write([]byte(fmt.Sprintf(message, backendID)))
+	}
+
+	return backend, nil
+}
+
+// modifyResponse adjusts a backend's response before it is sent to the client
+func (lb *LoadBalancer) modifyResponse(backend *Backend, resp *http.Response) error {
+	state := attemptFromContext(resp.Request.Context())
+	if state != nil {
+		state.status = resp.StatusCode
+	}
+	if lb.loadHeader != "" {
+		lb.recordReportedLoad(backend, resp)
+	}
+	if lb.serverTiming && state != nil {
+		addServerTiming(resp, state)
+	}
+	if lb.cors != nil {
+		stripCORSHeaders(resp.Header)
+	}
+	// Event streams stay open for as long as the backend keeps sending
+	if isEventStream(resp) {
+		liftRequestDeadline(resp.Request.Context())
+	}
+	lb.setDebugHeaders(resp.Header, backend, state)
+	lb.rewriteLocation(backend, resp)
+	applyHeaderRules(resp.Header, lb.responseHeaderRules)
+	if err := lb.limitResponseBody(resp); err != nil {
+		return err
+	}
+	lb.measureResponseBody(backend, resp)
+	if lb.bodyRewrite != nil {
+		return lb.bodyRewrite.rewrite(resp)
+	}
+	return nil
+}
+
+// AddBackend registers a new backend at runtime. It starts out alive and
+// the health checker schedules it like the others, first checking it once
+// its interval has passed.
+func (lb *LoadBalancer) AddBackend(backendURL string, isAdmin bool) error {
+	lb.adminMutex.Lock()
+	defer lb.adminMutex.Unlock()
+	return lb.addBackend(BackendConfig{URL: backendURL, Admin: isAdmin})
+}
+
+// addBackend creates a backend from its config and appends it to the pool.
+// The caller holds adminMutex.
+func (lb *LoadBalancer) addBackend(cfg BackendConfig) error {
+	if existing, err := lb.findBackend(cfg.URL); err == nil {
+		return fmt.Errorf("backend %s already exists as backend %d", cfg.URL, existing.ID)
 	}
-	
-	return &LoadBalancer{
-		backends: backends,
-		logger:   logger,
+	backend, err := lb.newBackend(cfg, 0)
+	if err != nil {
+		return err
 	}
+
+	lb.mutex.Lock()
+	// Copy on write so readers holding the old slice are never affected
+	backends := make([]*Backend, len(lb.backends), len(lb.backends)+1)
+	copy(backends, lb.backends)
+	lb.backends = append(backends, backend)
+	lb.rebuildRing()
+	lb.mutex.Unlock()
+	lb.metrics.setBackendUp(backend, true)
+
+	lb.logger.Log(LevelInfo, "Backend added", "backend", backend.ID, "url", backend.URL.String())
+	lb.resolveBackends([]*Backend{backend})
+	return nil
+}
+
+// RemoveBackend gracefully detaches the backend with the given URL from the
+// pool: it is set draining, so it gets no new requests, and detached once
+// the requests already being proxied to it have finished. If some are still
+// in flight after the remove timeout, ErrBackendBusy is returned and the
+// backend is left in the pool, draining.
+func (lb *LoadBalancer) RemoveBackend(backendURL string) error {
+	lb.adminMutex.Lock()
+	backend, err := lb.findBackend(backendURL)
+	if err != nil {
+		lb.adminMutex.Unlock()
+		return err
+	}
+	backend.mutex.Lock()
+	backend.draining = true
+	backend.mutex.Unlock()
+	lb.adminMutex.Unlock()
+
+	// Wait without holding adminMutex so other admin calls aren't blocked
+	if err := lb.awaitRemoval(backend); err != nil {
+		return err
+	}
+
+	lb.adminMutex.Lock()
+	defer lb.adminMutex.Unlock()
+	return lb.removeBackend(backend.URL.String())
+}
+
+// awaitRemoval waits for a backend set draining for removal to finish the
+// requests in flight, returning ErrBackendBusy if some still are once the
+// remove timeout has passed. The caller must not hold adminMutex.
+func (lb *LoadBalancer) awaitRemoval(backend *Backend) error {
+	lb.logger.Log(LevelInfo, "Backend draining for removal", "backend", backend.ID, "active", atomic.LoadInt64(&backend.activeConnections))
+	if !backend.waitIdle(lb.removeTimeout) {
+		active := atomic.LoadInt64(&backend.activeConnections)
+		lb.logger.Log(LevelWarn, "Backend removal timed out", "backend", backend.ID, "active", active, "timeout", lb.removeTimeout)
+		return fmt.Errorf("%w: %d requests to %s still in flight after %v", ErrBackendBusy, active, backend.URL, lb.removeTimeout)
+	}
+	return nil
+}
+
+// waitIdle waits up to timeout, or indefinitely when it is zero, for the
+// backend to have no requests in flight and reports whether it does
+func (b *Backend) waitIdle(timeout time.Duration) bool {
+	// Set before reading the count, so a release dropping it to zero
+	// afterwards is sure to see it
+	b.removing.Add(1)
+	defer b.removing.Add(-1)
+
+	b.mutex.Lock()
+	if b.idle == nil {
+		b.idle = make(chan struct{})
+	}
+	idle := b.idle
+	b.mutex.Unlock()
+
+	if atomic.LoadInt64(&b.activeConnections) == 0 {
+		return true
+	}
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-idle:
+		return true
+	case <-expired:
+		return atomic.LoadInt64(&b.activeConnections) == 0
+	}
+}
+
+// notifyIdle wakes RemoveBackend calls waiting for the backend to go idle
+func (b *Backend) notifyIdle() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.idle != nil {
+		close(b.idle)
+		b.idle = nil
+	}
+}
+
+// removeBackend detaches a backend; the caller holds adminMutex
+func (lb *LoadBalancer) removeBackend(backendURL string) error {
+	parsedURL, err := url.Parse(backendURL)
+	if err != nil {
+		return fmt.Errorf("invalid backend URL %q: %w", backendURL, err)
+	}
+
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	for i, backend := range lb.backends {
+		if backendKey(backend.URL) != backendKey(parsedURL) {
+			continue
+		}
+		// Build a fresh slice rather than shifting in place, since
+		// getBackendForRequest may still be iterating the old one
+		backends := make([]*Backend, 0, len(lb.backends)-1)
+		backends = append(backends, lb.backends[:i]...)
+		lb.backends = append(backends, lb.backends[i+1:]...)
+		lb.rebuildRing()
+		lb.metrics.forgetBackend(backend)
+		backend.transport.CloseIdleConnections()
+		lb.logger.Log(LevelInfo, "Backend removed", "backend", backend.ID, "url", backend.URL.String())
+		lb.checkRoleRoutes(backend)
+		return nil
+	}
+
+	return fmt.Errorf("backend %s not found", backendURL)
+}
+
+// getBackends returns a snapshot of the current backend list
+func (lb *LoadBalancer) getBackends() []*Backend {
+	lb.mutex.RLock()
+	defer lb.mutex.RUnlock()
+	return lb.backends
 }
 
 // ServeHTTP handles the http requests
 func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Extract and validate JWT token
-	role, err := ValidateJWT(r.Header.Get("Authorization"))
+	received := time.Now()
+
+	// Metrics are scraped and probes answered without a JWT
+	if lb.metricsPath != "" && r.URL.Path == lb.metricsPath {
+		lb.MetricsHandler().ServeHTTP(w, r)
+		return
+	}
+	if lb.serveProbe(w, r) {
+		return
+	}
+	lb.metrics.requestsTotal.Inc()
+	atomic.AddUint64(&lb.totalRequests, 1)
+	atomic.AddInt64(&lb.activeRequests, 1)
+	defer atomic.AddInt64(&lb.activeRequests, -1)
+	w, finish := lb.trackCompletion(w, &r, received)
+	defer finish()
+	r = withRequestID(w, r)
+
+	// Reject denied client IPs before doing any other work
+	if ip := lb.clientIP(r); !lb.isIPAllowed(ip) {
+		lb.logRequest(r, LevelInfo, "Denied request", "clientIP", ip.String(), "method", r.Method, "path", r.URL.Path, "status", http.StatusForbidden)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Access denied"))
+		return
+	}
+
+	// Browsers send preflight requests without credentials, so answer them
+	// before authenticating
+	if lb.servePreflight(w, r) {
+		return
+	}
+	lb.setCORSHeaders(w, r)
+
+	if lb.recorder != nil {
+		if err := lb.recorder.Record(r); err != nil {
+			lb.logRequest(r, LevelError, "Failed to record request", "path", r.URL.Path, "error", err)
+		}
+	}
+
+	// Stop requests that keep coming back through the balancer
+	if !lb.checkHops(w, r) {
+		return
+	}
+
+	// Authenticate with the JWT or, if enabled, the client certificate
+	claims, err := lb.authenticate(r)
+	if errors.Is(err, ErrForbiddenRole) {
+		lb.logRequest(r, LevelWarn, "JWT authorization error", "path", r.URL.Path, "status", http.StatusForbidden, "error", err)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Role not allowed"))
+		return
+	}
 	if err != nil {
-		lb.logger.Printf("JWT Validation error: %v\n", err)
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("Invalid or missing JWT token"))
+		lb.logRequest(r, LevelWarn, "JWT validation error", "path", r.URL.Path, "status", http.StatusUnauthorized, "error", err)
+		writeUnauthorized(w, err)
+		return
+	}
+	role := claims.Role
+	r = lb.withTenant(r, claims)
+	if completion := completionFromContext(r.Context()); completion != nil {
+		completion.subject = claims.Subject
+		completion.role = role
+	}
+
+	// The admin API is answered by the balancer itself
+	if lb.isAdminAPIRequest(r) {
+		lb.serveAdminAPI(w, r, role)
 		return
 	}
 
-	// Get appropriate backend based on role and round-robin
-	backend := lb.getBackendForRequest(role)
-	if backend == nil {
-		w.WriteHeader(http.StatusServiceUnavailable)
-		w.Write([]byte("No available backend servers"))
+	// An authenticated role may still be barred from the requested path
+	if !lb.isRoleAllowed(r, role) {
+		lb.logRequest(r, LevelWarn, "Role not allowed for path", "role", role, "path", r.URL.Path, "status", http.StatusForbidden)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Role not allowed for this path"))
 		return
 	}
 
+	// Apply the role's rate limit before any backend is involved
+	if !lb.checkRoleRateLimit(w, r, role) {
+		return
+	}
+
+	// Find the pool of backends the request may be sent to
+	poolName, pool, ok := lb.resolveRoute(r)
+	if !ok {
+		lb.logRequest(r, LevelInfo, "No route for request", "role", role, "method", r.Method, "path", r.URL.Path, "status", lb.noRoute.StatusCode)
+		w.WriteHeader(lb.noRoute.StatusCode)
+		w.Write([]byte(lb.noRoute.Body))
+		return
+	}
+	if poolName == DefaultPoolName && len(lb.splitGroups) > 0 {
+		pool = lb.splitPool(r, pool)
+	}
+
+	// Each pool may have its own budget, protecting slow pools from bursts
+	if !lb.checkPoolRateLimit(w, r, poolName) {
+		return
+	}
+
+	// Bound the request as a whole so a hung backend can't hold it forever
+	if lb.requestTimeout > 0 {
+		ctx, cancel := withRequestDeadline(r.Context(), lb.requestTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	// Reject oversized bodies before they reach a backend
+	if !lb.limitRequestBody(w, r) {
+		return
+	}
+
+	// Retries and the shadow backend need to send the body again, so buffer
+	// it up front
+	mirror := lb.shadow.sampled()
+	body, replayable := lb.bufferRequestBody(r, mirror)
+
+	var tried []*Backend
+	for attempt := 0; ; attempt++ {
+		// Pick a backend and claim a connection slot on it
+		backend := lb.acquireBackend(w, r, role, pool, tried)
+		if backend == nil {
+			// A retry that finds no backend leaves the request failed
+			if attempt > 0 {
+				lb.recordRetryOutcome(attempt, true)
+			}
+			return
+		}
+		tried = append(tried, backend)
+
+		// Mirror once the request is sure to be proxied, and only once
+		if mirror && attempt == 0 {
+			lb.mirrorAccepted(r, body, replayable)
+		}
+
+		retryable := replayable && attempt < lb.maxRetries && lb.hasRetryCandidate(role, pool, tried)
+		state := &attemptState{retryable: retryable, received: received, attempt: attempt + 1}
+		if lb.forward(w, r, backend, role, body, state) {
+			lb.recordRetryOutcome(state.attempt, state.err != nil)
+			return
+		}
+		lb.logRequest(r, LevelWarn, "Retrying request after backend failure", "role", role, "method", r.Method, "path", r.URL.Path, "backend", backend.ID, "attempt", attempt+1)
+	}
+}
+
+// forward proxies the request to a backend whose slot has already been
+// acquired. It returns false without writing a response if the attempt
+// failed and may be retried.
+func (lb *LoadBalancer) forward(w http.ResponseWriter, r *http.Request, backend *Backend, role string, body []byte, state *attemptState) bool {
+	defer lb.releaseBackend(backend)
+
+	state.strategy = lb.strategyName(role)
+	req := r.WithContext(context.WithValue(r.Context(), attemptKey{}, state))
+	if body != nil {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	req = lb.traceConnections(req, backend)
+	if completion := completionFromContext(r.Context()); completion != nil {
+		completion.backend = backend.URL.String()
+		completion.attempts = state.attempt
+	}
+
 	// Track the request count
 	atomic.AddUint64(&backend.RequestCount, 1)
-	
-	// Forward the request
-	backend.Proxy.ServeHTTP(w, r)
-}
-
-// getBackendForRequest returns the backend server based on the role and round-robin algorithm
-func (lb *LoadBalancer) getBackendForRequest(role string) *Backend {
-	// For Admin roles, always route to the first backend if it's available
-	if role == "Admin" {
-		lb.mutex.RLock()
-		adminBackend := lb.backends[0]
-		lb.mutex.RUnlock()
-		
-		if adminBackend.IsAlive {
-			lb.logger.Printf("Admin request routed to dedicated admin backend (Backend 1)")
-			return adminBackend
-		}
-		// If admin backend is down, we could fail the request or try other backends
-		// For this implementation, we'll fail the request
-		lb.logger.Printf("Admin request failed - admin backend is down")
+	lb.metrics.backendRequests.WithLabelValues(backend.URL.String()).Inc()
+
+	// Forward the request, timing how long the backend takes
+	state.started = time.Now()
+	backend.Proxy.ServeHTTP(w, req)
+	elapsed := time.Since(state.started)
+	backend.latency.observe(elapsed)
+	backend.statuses.record(state.status)
+	lb.recordBreakerOutcome(backend, state)
+	lb.recordOutlierOutcome(backend, state)
+	lb.metrics.requestDuration.WithLabelValues(backend.URL.String()).Observe(elapsed.Seconds())
+	if label := tenantLabelFromContext(r.Context()); label != "" {
+		lb.metrics.tenantDuration.WithLabelValues(label).Observe(elapsed.Seconds())
+	}
+	lb.logRequest(r, LevelInfo, "Request completed", "role", role, "method", r.Method, "path", r.URL.Path, "backend", backend.ID, "status", state.status, "latencyMs", durationMillis(elapsed))
+
+	return state.err == nil || !state.retryable
+}
+
+// ActiveRequests returns how many requests are being handled right now,
+// including those waiting in the overflow queue
+func (lb *LoadBalancer) ActiveRequests() int64 {
+	return atomic.LoadInt64(&lb.activeRequests)
+}
+
+// getBackendForRequest returns the backend server based on the role and the
+// configured strategy, skipping backends already tried for this request
+func (lb *LoadBalancer) getBackendForRequest(r *http.Request, role string, pool []int, tried []*Backend) *Backend {
+	backends := lb.candidateBackends(role, pool, tried)
+	if len(backends) == 0 {
+		lb.logRequest(r, LevelWarn, "Request failed - no eligible backends configured", "role", role, "path", r.URL.Path)
 		return nil
 	}
-	
-	// For User and Client roles, use round-robin
-	// Get the next backend index in a thread-safe manner
-	nextIndex := int(atomic.AddUint64(&lb.roundRobinCount, 1) % uint64(len(lb.backends)))
-	
-	// Try the selected backend and then others in sequence if it's not available
-	lb.mutex.RLock()
-	backends := lb.backends
-	lb.mutex.RUnlock()
-	
-	// Try up to the number of backends we have
-	for i := 0; i < len(backends); i++ {
-		idx := (nextIndex + i) % len(backends)
-		backend := backends[idx]
-		
-		backend.mutex.RLock()
-		isAlive := backend.IsAlive
-		backend.mutex.RUnlock()
-		
-		if isAlive {
-			lb.logger.Printf("%s request routed to Backend %d via round-robin", 
-				role, idx+1)
-			return backend
+
+	// Admin requests are spread over the admin-capable backends only. When
+	// none of them can take the request it fails rather than leaking to a
+	// regular backend.
+	if lb.usesAdminPinning(role) {
+		adminBackend := lb.selectAdminBackend(backends)
+		if adminBackend == nil {
+			lb.logRequest(r, LevelDebug, "Admin request found no admin backend - all are down or at capacity", "role", role, "path", r.URL.Path)
+			return nil
 		}
+		lb.logRequest(r, LevelDebug, "Admin request routed to admin backend", "role", role, "path", r.URL.Path, "backend", adminBackend.ID)
+		return adminBackend
 	}
-	
-	// No available backends
-	return nil
-}
 
-// HealthCheck periodically checks if backends are alive
-func (lb *LoadBalancer) HealthCheck(interval time.Duration) {
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-	
-	for range ticker.C {
-		for i, backend := range lb.backends {
-			status := "up"
-			client := &http.Client{
-				Timeout: 5 * time.Second,
-			}
-			
-			resp, err := client.Get(backend.URL.String() + "/health")
-			if err != nil || resp.StatusCode != http.StatusOK {
-				// Mark backend as down if it fails health check
-				backend.mutex.Lock()
-				backend.IsAlive = false
-				backend.failCount++
-				backend.mutex.Unlock()
-				status = "down"
-			} else {
-				// Mark backend as up
-				backend.mutex.Lock()
-				backend.IsAlive = true
-				backend.failCount = 0
-				backend.mutex.Unlock()
-			}
-			lb.logger.Printf("Backend %d health check: %s", i+1, status)
-		}
+	// For all other roles, use the custom selector or the configured strategy
+	if backend := lb.selectCustomBackend(r, role, backends); backend != nil {
+		lb.logRequest(r, LevelDebug, "Request routed by selector", "role", role, "path", r.URL.Path, "backend", backend.ID)
+		return backend
 	}
+	backend := lb.selectWarmBackend(r, role, backends)
+	if backend != nil {
+		lb.logRequest(r, LevelDebug, "Request routed", "role", role, "path", r.URL.Path, "backend", backend.ID, "strategy", string(lb.strategy))
+	}
+	return backend
+}
+
+// isRoutable reports whether the backend is healthy, has not been disabled
+// or put into draining by an operator and is not cut off by its circuit
+// breaker or ejected as an outlier
+func (b *Backend) isRoutable() bool {
+	now := time.Now()
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.IsAlive && !b.disabled && !b.draining && b.breaker.allows(now) && !b.outlier.ejected(now)
 }
 
 // GetStats returns statistics about the backends
 func (lb *LoadBalancer) GetStats() map[string]interface{} {
 	stats := make(map[string]interface{})
-	backends := make([]map[string]interface{}, len(lb.backends))
-	
-	lb.mutex.RLock()
-	for i, backend := range lb.backends {
-		backend.mutex.RLock()
-		backends[i] = map[string]interface{}{
-			"url":          backend.URL.String(),
-			"isAdmin":      backend.IsAdmin,
-			"isAlive":      backend.IsAlive,
-			"failCount":    backend.failCount,
-			"requestCount": backend.RequestCount,
-		}
-		backend.mutex.RUnlock()
+	current := lb.getBackends()
+	backends := make([]map[string]interface{}, len(current))
+	now := time.Now()
+
+	for i, backend := range current {
+		backends[i] = lb.backendStats(backend, now)
 	}
-	lb.mutex.RUnlock()
-	
+
 	stats["backends"] = backends
-	stats["totalRequests"] = lb.roundRobinCount
-	
+	stats["totalRequests"] = atomic.LoadUint64(&lb.totalRequests)
+	stats["activeRequests"] = lb.ActiveRequests()
+	stats["connectionsRefused"] = atomic.LoadUint64(&lb.connectionsRefused)
+	stats["queueDepth"] = atomic.LoadInt64(&lb.queueDepth)
+	stats["queueCapacity"] = lb.queueCapacity
+	stats["retryOutcomes"] = lb.retryOutcomeStats()
+	stats["healthChecksSkipped"] = atomic.LoadUint64(&lb.healthChecksSkipped)
+	stats["poolRateLimits"] = lb.poolRateLimitStats()
+	if lb.completions != nil {
+		stats["completionRecords"] = lb.completions.Stats()
+	}
+	if len(lb.splitGroups) > 0 {
+		stats["trafficSplit"] = lb.splitStats()
+	}
+	if len(lb.roleHomes) > 0 {
+		stats["roleHomes"] = lb.roleHomeStats()
+	}
+	if webhook := lb.healthWebhook.Load(); webhook != nil {
+		stats["healthEvents"] = webhook.Stats()
+	}
+	if lb.shadow != nil {
+		stats["shadow"] = lb.shadow.stats()
+	}
+
 	return stats
 }
 
+// backendStats reports the state and counters of a single backend
+func (lb *LoadBalancer) backendStats(backend *Backend, now time.Time) map[string]interface{} {
+	active := atomic.LoadInt64(&backend.activeConnections)
+	saturation := 0.0
+	if backend.maxConnections > 0 {
+		saturation = float64(active) / float64(backend.maxConnections)
+	}
+
+	// Computed before locking, they take the backend's lock themselves
+	load := lb.currentLoad(backend, now)
+	warmup := lb.warmupFactor(backend, now)
+	errorRate := lb.errorRate(backend, now)
+	score := lb.healthScore(backend, now)
+	open, idle, inUse := backend.pool.stats()
+
+	backend.mutex.RLock()
+	stats := map[string]interface{}{
+		"id":                backend.ID,
+		"url":               backend.URL.String(),
+		"isAdmin":           backend.IsAdmin,
+		"isAlive":           backend.IsAlive,
+		"rawAlive":          backend.rawAlive,
+		"disabled":          backend.disabled,
+		"draining":          backend.draining,
+		"unresolved":        backend.unresolved,
+		"weight":            backend.Weight,
+		"failCount":         backend.failCount,
+		"requestCount":      atomic.LoadUint64(&backend.RequestCount),
+		"statusCodes":       backend.statuses.snapshot(),
+		"activeConnections": active,
+		"maxConnections":    backend.maxConnections,
+		"saturation":        saturation,
+		"avgLatencyMs":      durationMillis(backend.latency.average()),
+		"p95LatencyMs":      durationMillis(backend.latency.percentile(95)),
+		"circuitState":      backend.breaker.state.String(),
+		"failureStreak":     backend.breaker.failures,
+		"ejected":           backend.outlier.ejected(now),
+		"ejections":         backend.outlier.ejections,
+		"errorRate":         errorRate,
+		"healthScore":       score,
+		"reportedLoad":      load,
+		"warmupFactor":      warmup,
+		"connectionsDialed": atomic.LoadUint64(&backend.connections.dialed),
+		"connectionsReused": atomic.LoadUint64(&backend.connections.reused),
+		"connReuseRatio":    backend.connections.ratio(),
+		"openConnections":   open,
+		"idleConnections":   idle,
+		"inUseConnections":  inUse,
+	}
+	backend.mutex.RUnlock()
+	return stats
+}
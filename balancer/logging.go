@@ -0,0 +1,161 @@
+package balancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry
+type Level string
+
+const (
+	LevelDebug Level = "debug"
+	LevelInfo  Level = "info"
+	LevelWarn  Level = "warn"
+	LevelError Level = "error"
+)
+
+// levelRanks orders the levels, least severe first
+var levelRanks = map[Level]int{
+	LevelDebug: 0,
+	LevelInfo:  1,
+	LevelWarn:  2,
+	LevelError: 3,
+}
+
+// ParseLevel validates a level name
+func ParseLevel(name string) (Level, error) {
+	level := Level(strings.ToLower(name))
+	if _, ok := levelRanks[level]; !ok {
+		return "", fmt.Errorf("unknown log level %q", name)
+	}
+	return level, nil
+}
+
+// Logger receives the balancer's log entries. Fields are alternating key
+// and value pairs, e.g. "backend", 2, "path", "/api". Common keys are
+// backend, role, path, method, status and latencyMs.
+type Logger interface {
+	Log(level Level, msg string, fields ...interface{})
+}
+
+// WithLogger replaces the logger passed to NewLoadBalancer, e.g. with a
+// JSON logger
+func WithLogger(logger Logger) Option {
+	return func(lb *LoadBalancer) {
+		lb.logger = logger
+	}
+}
+
+// WithLogLevel drops entries less severe than the given level, whichever
+// logger is used. Every entry is logged by default.
+func WithLogLevel(min Level) Option {
+	return func(lb *LoadBalancer) {
+		lb.logLevel = min
+	}
+}
+
+// levelLogger passes on the entries at or above its minimum level
+type levelLogger struct {
+	logger Logger
+	min    int
+}
+
+func (l *levelLogger) Log(level Level, msg string, fields ...interface{}) {
+	if levelRanks[level] < l.min {
+		return
+	}
+	l.logger.Log(level, msg, fields...)
+}
+
+// textLogger renders entries as readable lines on a standard logger
+type textLogger struct {
+	logger *log.Logger
+}
+
+// NewTextLogger writes entries as "LEVEL message key=value ..." lines
+func NewTextLogger(logger *log.Logger) Logger {
+	return &textLogger{logger: logger}
+}
+
+func (l *textLogger) Log(level Level, msg string, fields ...interface{}) {
+	var line strings.Builder
+	line.WriteString(strings.ToUpper(string(level)))
+	line.WriteByte(' ')
+	line.WriteString(msg)
+	for i := 0; i < len(fields); i += 2 {
+		key, value := fieldPair(fields, i)
+		fmt.Fprintf(&line, " %s=%v", key, value)
+	}
+	l.logger.Print(line.String())
+}
+
+// jsonLogger writes one JSON object per entry
+type jsonLogger struct {
+	mutex sync.Mutex
+	out   io.Writer
+}
+
+// NewJSONLogger writes each entry as a JSON object on its own line, with
+// level, time and msg alongside the entry's fields
+func NewJSONLogger(out io.Writer) Logger {
+	return &jsonLogger{out: out}
+}
+
+func (l *jsonLogger) Log(level Level, msg string, fields ...interface{}) {
+	entry := make(map[string]interface{}, 3+len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		key, value := fieldPair(fields, i)
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		entry[key] = value
+	}
+	entry["level"] = level
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["msg"] = msg
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		data, _ = json.Marshal(map[string]interface{}{
+			"level": LevelError,
+			"time":  entry["time"],
+			"msg":   "failed to encode log entry: " + err.Error(),
+		})
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.out.Write(append(data, '\n'))
+}
+
+// fieldPair returns the key and value starting at index i. A trailing key
+// without a value is logged with a nil value.
+func fieldPair(fields []interface{}, i int) (string, interface{}) {
+	key := fmt.Sprint(fields[i])
+	if i+1 >= len(fields) {
+		return key, nil
+	}
+	return key, fields[i+1]
+}
+
+// logRequest logs an entry about a request, adding its ID, tenant and
+// verified client certificate
+func (lb *LoadBalancer) logRequest(r *http.Request, level Level, msg string, fields ...interface{}) {
+	if id := requestIDFromContext(r.Context()); id != "" {
+		fields = append(fields, "requestId", id)
+	}
+	if tenant := tenantFromContext(r.Context()); tenant != "" {
+		fields = append(fields, "tenant", tenant)
+	}
+	if identity := clientCertIdentity(r); identity != "" {
+		fields = append(fields, "clientCert", identity)
+	}
+	lb.logger.Log(level, msg, fields...)
+}
@@ -0,0 +1,266 @@
+package balancer
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatedTimeFormat stamps rotated files, sorting them oldest first by name
+const rotatedTimeFormat = "20060102-150405.000"
+
+// RotationConfig controls when a RotatingFile starts a new file and which
+// of the old ones it keeps
+type RotationConfig struct {
+	// MaxSize rotates the file before it grows past this many bytes, zero
+	// disables size based rotation
+	MaxSize int64
+	// Interval rotates the file once it has been written to for this long,
+	// zero disables time based rotation
+	Interval time.Duration
+	// MaxBackups is how many rotated files are kept, zero keeps them all
+	MaxBackups int
+	// Compress gzips rotated files in the background
+	Compress bool
+}
+
+// Enabled reports whether the file is ever rotated
+func (c RotationConfig) Enabled() bool {
+	return c.MaxSize > 0 || c.Interval > 0
+}
+
+// RotatingFile is a log file that renames itself to path.<time>, e.g.
+// lb.log.20240102-150405.000, and starts over when it gets too large or too
+// old. It is safe for concurrent use.
+type RotatingFile struct {
+	path   string
+	config RotationConfig
+
+	mutex  sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+	// reopen is set once the file in use is no longer at path, renamed or
+	// moved away, until a new file could be opened there; renamed is the
+	// name it was rotated to, if the rename was ours
+	reopen  bool
+	renamed string
+
+	// cleanup serializes compressing and pruning rotated files, pending
+	// lets Close wait for it
+	cleanup sync.Mutex
+	pending sync.WaitGroup
+}
+
+// OpenRotatingFile opens the file at path for appending, creating it if
+// needed
+func OpenRotatingFile(path string, config RotationConfig) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, config: config}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the current file and notes its size. The file in use, if
+// any, is only closed once the new one is open. The caller holds the
+// mutex, if needed.
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if f.file != nil {
+		f.file.Close()
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+// Write appends p, rotating the file first if p would take it past the
+// maximum size or it is due for rotation. A single write is never split.
+// If a new file can't be opened, p is appended to the one in use and
+// opening it is tried again on the next write.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.reopen || f.dueForRotation(int64(len(p))) {
+		// Losing entries would be worse than a late rotation
+		f.rotate()
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// dueForRotation reports whether the file should be rotated before writing
+// n more bytes. An empty file never is, however large the write.
+func (f *RotatingFile) dueForRotation(n int64) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.config.MaxSize > 0 && f.size+n > f.config.MaxSize {
+		return true
+	}
+	return f.config.Interval > 0 && time.Since(f.opened) >= f.config.Interval
+}
+
+// Rotate starts a new file right away, e.g. on SIGHUP. A file already
+// moved away by a tool such as logrotate is not renamed again; a new one is
+// simply opened in its place.
+func (f *RotatingFile) Rotate() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return os.ErrClosed
+	}
+	return f.rotate()
+}
+
+// rotate renames the current file and opens a new one. Until that
+// succeeds the old file stays open and in use. The caller holds the mutex.
+func (f *RotatingFile) rotate() error {
+	if !f.reopen {
+		rotated := f.rotatedName()
+		err := os.Rename(f.path, rotated)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rotate %s: %w", f.path, err)
+		}
+		if err == nil {
+			f.renamed = rotated
+		}
+		f.reopen = true
+	}
+	if err := f.open(); err != nil {
+		return fmt.Errorf("failed to reopen %s: %w", f.path, err)
+	}
+	f.reopen = false
+	rotated := f.renamed
+	f.renamed = ""
+	if rotated == "" {
+		return nil
+	}
+
+	f.pending.Add(1)
+	go func() {
+		defer f.pending.Done()
+		f.cleanup.Lock()
+		defer f.cleanup.Unlock()
+		if f.config.Compress {
+			compressFile(rotated)
+		}
+		f.prune()
+	}()
+	return nil
+}
+
+// rotatedName returns the name for the file rotated now, stepping past the
+// names of files rotated in the same millisecond
+func (f *RotatingFile) rotatedName() string {
+	for stamp := time.Now(); ; stamp = stamp.Add(time.Millisecond) {
+		name := f.path + "." + stamp.Format(rotatedTimeFormat)
+		if !fileExists(name) && !fileExists(name+".gz") {
+			return name
+		}
+	}
+}
+
+// fileExists reports whether anything exists at path
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// compressFile replaces the file with a gzipped copy, leaving it as it is
+// if that fails
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if closeErr := gz.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// prune removes the oldest rotated files beyond the number of backups kept
+func (f *RotatingFile) prune() {
+	if f.config.MaxBackups <= 0 {
+		return
+	}
+	backups := f.backups()
+	for len(backups) > f.config.MaxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+}
+
+// backups lists the rotated files, oldest first
+func (f *RotatingFile) backups() []string {
+	dir, base := filepath.Split(f.path)
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var backups []string
+	for _, entry := range entries {
+		stamp, ok := strings.CutPrefix(entry.Name(), base+".")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(rotatedTimeFormat, strings.TrimSuffix(stamp, ".gz")); err == nil {
+			backups = append(backups, filepath.Join(dir, entry.Name()))
+		}
+	}
+	sort.Strings(backups)
+	return backups
+}
+
+// Close closes the current file after any compression and pruning still
+// running has finished
+func (f *RotatingFile) Close() error {
+	f.mutex.Lock()
+	var err error
+	if f.file != nil {
+		err = f.file.Close()
+		f.file = nil
+	}
+	f.mutex.Unlock()
+	f.pending.Wait()
+	return err
+}
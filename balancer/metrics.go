@@ -0,0 +1,127 @@
+package balancer
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics holds the Prometheus collectors for a load balancer. Each load
+// balancer uses its own registry so several can coexist in one process.
+type metrics struct {
+	registry             *prometheus.Registry
+	requestsTotal        prometheus.Counter
+	backendRequests      *prometheus.CounterVec
+	backendUp            *prometheus.GaugeVec
+	healthCheckFailures  *prometheus.CounterVec
+	requestDuration      *prometheus.HistogramVec
+	backendConnections   *prometheus.CounterVec
+	responseBytes        *prometheus.CounterVec
+	responseDecodedBytes *prometheus.CounterVec
+	tenantRequests       *prometheus.CounterVec
+	tenantDuration       *prometheus.HistogramVec
+	retryOutcomes        *prometheus.CounterVec
+}
+
+// newMetrics creates and registers the load balancer's collectors
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requestsTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "lb_requests_total",
+			Help: "Total number of requests received by the load balancer.",
+		}),
+		backendRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lb_backend_requests_total",
+			Help: "Number of requests forwarded to each backend.",
+		}, []string{"backend"}),
+		backendUp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "lb_backend_up",
+			Help: "Whether the backend is considered alive (1) or down (0).",
+		}, []string{"backend"}),
+		healthCheckFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lb_health_check_failures_total",
+			Help: "Number of failed health checks per backend.",
+		}, []string{"backend"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "lb_request_duration_seconds",
+			Help:    "Time taken by backends to serve proxied requests.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"backend"}),
+		backendConnections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lb_backend_connections_total",
+			Help: "Connections obtained for proxied requests, by whether an idle connection was reused.",
+		}, []string{"backend", "reused"}),
+		responseBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lb_backend_response_bytes_total",
+			Help: "Response body bytes received from each backend, as sent on the wire.",
+		}, []string{"backend"}),
+		responseDecodedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lb_backend_response_decoded_bytes_total",
+			Help: "Response body bytes from each backend after decompression; equal to the wire size unless decoded size metrics are enabled.",
+		}, []string{"backend"}),
+		tenantRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lb_tenant_requests_total",
+			Help: "Number of authenticated requests per tenant.",
+		}, []string{"tenant"}),
+		tenantDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "lb_tenant_request_duration_seconds",
+			Help:    "Time taken by backends to serve proxied requests, per tenant.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"tenant"}),
+		retryOutcomes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lb_retry_outcomes_total",
+			Help: "Proxied requests by whether they succeeded on the first try, after retries, or failed.",
+		}, []string{"outcome"}),
+	}
+
+	m.registry.MustRegister(
+		m.requestsTotal,
+		m.backendRequests,
+		m.backendUp,
+		m.healthCheckFailures,
+		m.requestDuration,
+		m.backendConnections,
+		m.responseBytes,
+		m.responseDecodedBytes,
+		m.tenantRequests,
+		m.tenantDuration,
+		m.retryOutcomes,
+	)
+	return m
+}
+
+// WithMetricsPath serves Prometheus metrics on the given path, ahead of JWT
+// validation. An empty path disables the endpoint.
+func WithMetricsPath(path string) Option {
+	return func(lb *LoadBalancer) {
+		lb.metricsPath = path
+	}
+}
+
+// MetricsHandler returns the HTTP handler exposing the load balancer's metrics
+func (lb *LoadBalancer) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(lb.metrics.registry, promhttp.HandlerOpts{})
+}
+
+// setBackendUp records the backend's health state
+func (m *metrics) setBackendUp(backend *Backend, alive bool) {
+	value := 0.0
+	if alive {
+		value = 1
+	}
+	m.backendUp.WithLabelValues(backend.URL.String()).Set(value)
+}
+
+// forgetBackend drops the series of a backend that has been removed
+func (m *metrics) forgetBackend(backend *Backend) {
+	label := backend.URL.String()
+	m.backendRequests.DeleteLabelValues(label)
+	m.backendUp.DeleteLabelValues(label)
+	m.healthCheckFailures.DeleteLabelValues(label)
+	m.requestDuration.DeleteLabelValues(label)
+	m.backendConnections.DeletePartialMatch(prometheus.Labels{"backend": label})
+	m.responseBytes.DeleteLabelValues(label)
+	m.responseDecodedBytes.DeleteLabelValues(label)
+}
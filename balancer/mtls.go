@@ -0,0 +1,62 @@
+package balancer
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+// ServerTLSConfig returns the TLS settings for the balancer's listener that
+// verify client certificates against the CA bundle at clientCAFile. With
+// require set, clients without a valid certificate fail the handshake;
+// otherwise a certificate is optional but still verified when presented.
+func ServerTLSConfig(clientCAFile string, require bool) (*tls.Config, error) {
+	pool, err := LoadCAPool(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	clientAuth := tls.VerifyClientCertIfGiven
+	if require {
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: clientAuth,
+	}, nil
+}
+
+// WithClientCertAuth accepts a verified client certificate in place of a
+// JWT. Requests that present one but no Authorization header are admitted
+// with role and the certificate's common name as subject; requests that also
+// carry a token are validated by the token as usual.
+func WithClientCertAuth(role string) Option {
+	return func(lb *LoadBalancer) {
+		lb.clientCertRole = role
+	}
+}
+
+// authenticate returns the claims the request is authorized with, from its
+// JWT or, if enabled and no token was sent, its client certificate
+func (lb *LoadBalancer) authenticate(r *http.Request) (*Claims, error) {
+	token := lb.requestToken(r)
+	if token == "" && lb.clientCertRole != "" {
+		if identity := clientCertIdentity(r); identity != "" {
+			claims := &Claims{Role: lb.clientCertRole}
+			claims.Subject = identity
+			return claims, nil
+		}
+	}
+	return lb.validator.ValidateClaims(token)
+}
+
+// clientCertIdentity names the verified client certificate of the request
+// by its common name, or its full subject if it has none
+func clientCertIdentity(r *http.Request) string {
+	cert := verifiedClientCert(r)
+	if cert == nil {
+		return ""
+	}
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	return cert.Subject.String()
+}
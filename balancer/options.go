@@ -0,0 +1,83 @@
+package balancer
+
+import (
+	"crypto/tls"
+	"time"
+)
+
+// Option configures optional LoadBalancer behaviour at construction time
+type Option func(*LoadBalancer)
+
+// WithResponseHeaderTimeout limits how long the balancer waits for a backend
+// to send response headers once the request has been written. A backend that
+// exceeds it is answered with 504 Gateway Timeout. Zero disables the limit.
+func WithResponseHeaderTimeout(timeout time.Duration) Option {
+	return func(lb *LoadBalancer) {
+		lb.transportConfig.ResponseHeaderTimeout = timeout
+	}
+}
+
+// WithBackendTLSConfig sets the TLS configuration used to connect to https
+// backends, e.g. to trust an internal CA. Backends can still override the CA
+// and verification in their own config.
+func WithBackendTLSConfig(tlsConfig *tls.Config) Option {
+	return func(lb *LoadBalancer) {
+		lb.transportConfig.TLS = tlsConfig
+	}
+}
+
+// WithRequestTimeout sets the deadline for a whole request, from routing
+// through retries to the end of the backend response. A request still
+// waiting for response headers when it passes is answered with 504 Gateway
+// Timeout. Server-Sent Events streams are exempt once their headers arrive.
+// Zero disables the deadline.
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(lb *LoadBalancer) {
+		lb.requestTimeout = timeout
+	}
+}
+
+// WithRemoveTimeout sets how long RemoveBackend waits for the requests in
+// flight to a backend to finish before giving up. Zero waits indefinitely.
+func WithRemoveTimeout(timeout time.Duration) Option {
+	return func(lb *LoadBalancer) {
+		lb.removeTimeout = timeout
+	}
+}
+
+// WithMaxResponseHeaderBytes caps the size of the response headers a backend
+// may send. A backend exceeding it is answered with 502 Bad Gateway instead
+// of passing the headers on. Zero keeps the net/http default of 10 MB.
+func WithMaxResponseHeaderBytes(max int64) Option {
+	return func(lb *LoadBalancer) {
+		lb.transportConfig.MaxResponseHeaderBytes = max
+	}
+}
+
+// WithIdleConnections sets how many idle connections each backend's
+// transport keeps for reuse, in total and per host, and for how long.
+// Zero counts mean no limit and a zero timeout keeps them indefinitely.
+func WithIdleConnections(maxIdle, maxIdlePerHost int, timeout time.Duration) Option {
+	return func(lb *LoadBalancer) {
+		lb.transportConfig.MaxIdleConns = maxIdle
+		lb.transportConfig.MaxIdleConnsPerHost = maxIdlePerHost
+		lb.transportConfig.IdleConnTimeout = timeout
+	}
+}
+
+// WithDialTimeout bounds how long connecting to a backend may take, apart
+// from the request timeout, so a backend that doesn't answer fails over
+// quickly. Zero removes the bound.
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(lb *LoadBalancer) {
+		lb.transportConfig.DialTimeout = timeout
+	}
+}
+
+// WithKeepAlives controls whether connections to backends are reused.
+// They are by default.
+func WithKeepAlives(enabled bool) Option {
+	return func(lb *LoadBalancer) {
+		lb.transportConfig.DisableKeepAlives = !enabled
+	}
+}
@@ -0,0 +1,61 @@
+package balancer
+
+import (
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for answering requests while no backend is available
+const (
+	DefaultOutageRetryAfter  = 5 * time.Second
+	DefaultOutageLogInterval = 10 * time.Second
+)
+
+// WithOutageRetryAfter sets the Retry-After sent with the 503 answering a
+// request no backend is available for. A random jitter of up to jitter is
+// added so clients don't all come back at the same moment. A zero
+// retryAfter leaves the header out.
+func WithOutageRetryAfter(retryAfter, jitter time.Duration) Option {
+	return func(lb *LoadBalancer) {
+		lb.outageRetryAfter = retryAfter
+		lb.outageJitter = jitter
+	}
+}
+
+// WithOutageLogInterval logs requests failing because no backend is
+// available at most once per interval, with the number left out since the
+// last entry, so an outage doesn't flood the log. Zero logs every request.
+func WithOutageLogInterval(interval time.Duration) Option {
+	return func(lb *LoadBalancer) {
+		lb.outageLogInterval = interval
+	}
+}
+
+// writeNoBackend answers a request that no backend is available for
+func (lb *LoadBalancer) writeNoBackend(w http.ResponseWriter, r *http.Request, role string) {
+	lb.logOutage(r, role)
+	if lb.outageRetryAfter > 0 {
+		wait := lb.outageRetryAfter
+		if lb.outageJitter > 0 {
+			wait += time.Duration(rand.Int63n(int64(lb.outageJitter) + 1))
+		}
+		setRetryAfter(w, wait)
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte("No available backend servers"))
+}
+
+// logOutage logs the failed request unless another one was logged within
+// the outage log interval, in which case it is only counted
+func (lb *LoadBalancer) logOutage(r *http.Request, role string) {
+	now := time.Now().UnixNano()
+	last := lb.lastOutageLog.Load()
+	if lb.outageLogInterval > 0 && (now-last < int64(lb.outageLogInterval) || !lb.lastOutageLog.CompareAndSwap(last, now)) {
+		atomic.AddUint64(&lb.outageSuppressed, 1)
+		return
+	}
+	suppressed := atomic.SwapUint64(&lb.outageSuppressed, 0)
+	lb.logRequest(r, LevelWarn, "Request failed - no backend available", "role", role, "path", r.URL.Path, "status", http.StatusServiceUnavailable, "suppressed", suppressed)
+}
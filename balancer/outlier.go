@@ -0,0 +1,179 @@
+package balancer
+
+import (
+	"net/http"
+	"time"
+)
+
+// Outlier detection defaults
+const (
+	DefaultOutlierWindow       = 30 * time.Second
+	DefaultOutlierMinRequests  = 20
+	DefaultOutlierEjectionTime = 30 * time.Second
+)
+
+// maxEjectedShare bounds the share of backends ejected at once so a
+// cluster-wide problem does not take every backend out of rotation
+const maxEjectedShare = 0.5
+
+// OutlierConfig configures ejection of backends with a high error rate
+type OutlierConfig struct {
+	// ErrorRate is the share of failed requests, between 0 and 1, at which
+	// a backend is ejected. Failures are 5xx responses and proxy errors.
+	ErrorRate float64
+	// Window is the period the error rate is measured over
+	Window time.Duration
+	// MinRequests is how many requests the window needs before the backend
+	// can be ejected
+	MinRequests int
+	// EjectionTime is how long an ejected backend is kept out of rotation
+	EjectionTime time.Duration
+}
+
+// WithOutlierDetection ejects backends whose error rate over the window
+// reaches the configured threshold, even while their health check passes.
+// Zero fields use the defaults; a zero ErrorRate disables detection.
+func WithOutlierDetection(cfg OutlierConfig) Option {
+	return func(lb *LoadBalancer) {
+		if cfg.Window <= 0 {
+			cfg.Window = DefaultOutlierWindow
+		}
+		if cfg.MinRequests <= 0 {
+			cfg.MinRequests = DefaultOutlierMinRequests
+		}
+		if cfg.EjectionTime <= 0 {
+			cfg.EjectionTime = DefaultOutlierEjectionTime
+		}
+		lb.outlier = cfg
+	}
+}
+
+// errorWindow tracks a backend's recent error rate as a sliding window made
+// of the current and the previous period. Its fields are guarded by the
+// owning backend's mutex.
+type errorWindow struct {
+	start                    time.Time
+	requests, errors         int
+	prevRequests, prevErrors int
+
+	ejectedUntil time.Time
+	ejections    int
+}
+
+// advance moves the window forward to now
+func (w *errorWindow) advance(now time.Time, period time.Duration) {
+	if w.start.IsZero() {
+		w.start = now
+		return
+	}
+	elapsed := now.Sub(w.start)
+	if elapsed < period {
+		return
+	}
+	if elapsed < 2*period {
+		w.prevRequests, w.prevErrors = w.requests, w.errors
+		w.start = w.start.Add(period)
+	} else {
+		w.prevRequests, w.prevErrors = 0, 0
+		w.start = now
+	}
+	w.requests, w.errors = 0, 0
+}
+
+// rate returns the number of requests and the error rate over the last
+// period, weighting the previous period by how much of it still overlaps
+func (w *errorWindow) rate(now time.Time, period time.Duration) (float64, float64) {
+	overlap := 1 - float64(now.Sub(w.start))/float64(period)
+	if overlap < 0 {
+		overlap = 0
+	}
+	requests := float64(w.requests) + float64(w.prevRequests)*overlap
+	errs := float64(w.errors) + float64(w.prevErrors)*overlap
+	if requests == 0 {
+		return 0, 0
+	}
+	return requests, errs / requests
+}
+
+// ejected reports whether the backend is currently ejected
+func (w *errorWindow) ejected(now time.Time) bool {
+	return now.Before(w.ejectedUntil)
+}
+
+// tracksErrors reports whether backends' error rates are needed, for
+// outlier detection or health scoring
+func (lb *LoadBalancer) tracksErrors() bool {
+	return lb.outlier.ErrorRate > 0 || lb.scoring != nil
+}
+
+// recordOutlierOutcome feeds the result of a proxied request to the
+// backend's error window and ejects the backend once its error rate reaches
+// the threshold. Failures caused by the client, such as abandoned or
+// oversized requests, are not counted.
+func (lb *LoadBalancer) recordOutlierOutcome(backend *Backend, state *attemptState) {
+	if !lb.tracksErrors() || clientFault(state.err) {
+		return
+	}
+	now := time.Now()
+	failed := state.err != nil || state.status >= http.StatusInternalServerError
+
+	backend.mutex.Lock()
+	w := &backend.outlier
+	w.advance(now, lb.outlier.Window)
+	w.requests++
+	if failed {
+		w.errors++
+	}
+	requests, rate := w.rate(now, lb.outlier.Window)
+	outlier := lb.outlier.ErrorRate > 0 && failed && !w.ejected(now) &&
+		requests >= float64(lb.outlier.MinRequests) && rate >= lb.outlier.ErrorRate
+	backend.mutex.Unlock()
+
+	if !outlier {
+		return
+	}
+	if !lb.canEject(now) {
+		lb.logger.Log(LevelWarn, "Outlier not ejected - too many backends ejected already", "backend", backend.ID, "errorRate", rate)
+		return
+	}
+
+	backend.mutex.Lock()
+	w.ejectedUntil = now.Add(lb.outlier.EjectionTime)
+	w.ejections++
+	// Start over so the backend is judged on fresh traffic once back
+	w.requests, w.errors, w.prevRequests, w.prevErrors = 0, 0, 0, 0
+	w.start = w.ejectedUntil
+	backend.mutex.Unlock()
+
+	lb.logger.Log(LevelWarn, "Backend ejected as outlier", "backend", backend.ID, "errorRate", rate, "ejectionMs", durationMillis(lb.outlier.EjectionTime))
+	time.AfterFunc(lb.outlier.EjectionTime, func() {
+		lb.logger.Log(LevelInfo, "Backend reinstated after ejection", "backend", backend.ID)
+	})
+}
+
+// errorRate returns the backend's error rate over the outlier window
+func (lb *LoadBalancer) errorRate(backend *Backend, now time.Time) float64 {
+	if !lb.tracksErrors() {
+		return 0
+	}
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	backend.outlier.advance(now, lb.outlier.Window)
+	_, rate := backend.outlier.rate(now, lb.outlier.Window)
+	return rate
+}
+
+// canEject reports whether one more backend may be ejected without
+// exceeding maxEjectedShare
+func (lb *LoadBalancer) canEject(now time.Time) bool {
+	backends := lb.getBackends()
+	ejected := 0
+	for _, backend := range backends {
+		backend.mutex.RLock()
+		if backend.outlier.ejected(now) {
+			ejected++
+		}
+		backend.mutex.RUnlock()
+	}
+	return float64(ejected+1) <= float64(len(backends))*maxEjectedShare
+}
@@ -0,0 +1,53 @@
+package balancer
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// parsePathPrefixes validates a backend's path rewrite and returns its strip
+// and add prefixes without trailing slashes
+func parsePathPrefixes(cfg BackendConfig) (strip, add string, err error) {
+	for _, prefix := range []struct{ name, value string }{
+		{"stripPrefix", cfg.StripPrefix},
+		{"addPrefix", cfg.AddPrefix},
+	} {
+		if prefix.value != "" && !strings.HasPrefix(prefix.value, "/") {
+			return "", "", fmt.Errorf("%s %q must start with /", prefix.name, prefix.value)
+		}
+	}
+	return strings.TrimRight(cfg.StripPrefix, "/"), strings.TrimRight(cfg.AddPrefix, "/"), nil
+}
+
+// rewritePath strips the prefix strip from the URL's path, if it starts with
+// it, and then puts add in front. Prefixes match whole path segments, so
+// stripping /api leaves /apis alone, and the path stays rooted: stripping
+// /api from /api gives /, adding /v1 to / gives /v1/. The query is untouched.
+func rewritePath(u *url.URL, strip, add string) {
+	if strip == "" && add == "" {
+		return
+	}
+	// Work on the escaped form so encoded slashes survive
+	path := u.EscapedPath()
+	if strip != "" && (path == strip || strings.HasPrefix(path, strip+"/")) {
+		path = strings.TrimPrefix(path, strip)
+		if path == "" {
+			path = "/"
+		}
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	path = add + path
+
+	unescaped, err := url.PathUnescape(path)
+	if err != nil {
+		return
+	}
+	u.Path = unescaped
+	u.RawPath = ""
+	if u.EscapedPath() != path {
+		u.RawPath = path
+	}
+}
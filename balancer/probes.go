@@ -0,0 +1,65 @@
+package balancer
+
+import "net/http"
+
+// Default paths of the balancer's own liveness and readiness endpoints
+const (
+	DefaultLivenessPath  = "/livez"
+	DefaultReadinessPath = "/readyz"
+)
+
+// WithProbePaths sets the paths answering liveness and readiness probes for
+// the balancer itself, ahead of JWT validation. An empty path disables the
+// endpoint and passes the path through to the backends.
+func WithProbePaths(liveness, readiness string) Option {
+	return func(lb *LoadBalancer) {
+		lb.livenessPath = liveness
+		lb.readinessPath = readiness
+	}
+}
+
+// SetLameDuck makes the readiness endpoint fail, e.g. while shutting down,
+// so the orchestrator stops sending new traffic. Requests are still served.
+func (lb *LoadBalancer) SetLameDuck(enabled bool) {
+	lb.lameDuck.Store(enabled)
+	lb.logger.Log(LevelInfo, "Lame-duck mode changed", "enabled", enabled)
+}
+
+// Ready reports whether the balancer can serve traffic: it is not in
+// lame-duck mode and at least one backend can take requests
+func (lb *LoadBalancer) Ready() bool {
+	if lb.lameDuck.Load() {
+		return false
+	}
+	for _, backend := range lb.getBackends() {
+		if backend.isRoutable() {
+			return true
+		}
+	}
+	return false
+}
+
+// serveProbe answers liveness and readiness probes and reports whether the
+// request was one
+func (lb *LoadBalancer) serveProbe(w http.ResponseWriter, r *http.Request) bool {
+	switch {
+	case lb.livenessPath != "" && r.URL.Path == lb.livenessPath:
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	case lb.readinessPath != "" && r.URL.Path == lb.readinessPath:
+		switch {
+		case lb.lameDuck.Load():
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("draining"))
+		case !lb.Ready():
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("no backends available"))
+		default:
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("ready"))
+		}
+	default:
+		return false
+	}
+	return true
+}
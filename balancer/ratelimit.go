@@ -0,0 +1,168 @@
+package balancer
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimit describes a token bucket: Rate tokens are added per second up
+// to a maximum of Burst
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// tokenBucket is a thread-safe token bucket limiter
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket creates a full bucket for the given limit
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = math.Max(1, math.Ceil(limit.Rate))
+	}
+	return &tokenBucket{
+		rate:   limit.Rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// allow takes a token if one is available. Otherwise it returns how long
+// until the next token is added.
+func (b *tokenBucket) allow() (bool, time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if b.rate <= 0 {
+		return false, time.Second
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// available returns the tokens in the bucket as of now without taking one
+func (b *tokenBucket) available() float64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return math.Min(b.burst, b.tokens+time.Since(b.last).Seconds()*b.rate)
+}
+
+// poolLimiter is a pool's token bucket along with how it has been used
+type poolLimiter struct {
+	bucket   *tokenBucket
+	limit    RateLimit
+	allowed  uint64
+	rejected uint64
+}
+
+// WithRoleRateLimits limits requests per JWT role. Roles without an entry
+// are not limited.
+func WithRoleRateLimits(limits map[string]RateLimit) Option {
+	return func(lb *LoadBalancer) {
+		// The map is built once here and only read afterwards, so lookups
+		// need no locking; each bucket guards its own state
+		lb.roleLimiters = make(map[string]*tokenBucket, len(limits))
+		for role, limit := range limits {
+			lb.roleLimiters[role] = newTokenBucket(limit)
+		}
+	}
+}
+
+// WithPoolRateLimits limits requests per backend pool, keyed by route name
+// or DefaultPoolName for requests matching no route. Pools without an entry
+// are not limited.
+func WithPoolRateLimits(limits map[string]RateLimit) Option {
+	return func(lb *LoadBalancer) {
+		lb.poolLimiters = make(map[string]*poolLimiter, len(limits))
+		for pool, limit := range limits {
+			lb.poolLimiters[pool] = &poolLimiter{bucket: newTokenBucket(limit), limit: limit}
+		}
+	}
+}
+
+// checkPoolRateLimit reports whether a request for the pool may proceed and
+// otherwise writes a 429 response with Retry-After
+func (lb *LoadBalancer) checkPoolRateLimit(w http.ResponseWriter, r *http.Request, pool string) bool {
+	limiter, ok := lb.poolLimiters[pool]
+	if !ok {
+		return true
+	}
+	allowed, wait := limiter.bucket.allow()
+	if allowed {
+		atomic.AddUint64(&limiter.allowed, 1)
+		return true
+	}
+
+	atomic.AddUint64(&limiter.rejected, 1)
+	lb.logRequest(r, LevelInfo, "Request rate limited for pool", "pool", pool, "path", r.URL.Path, "status", http.StatusTooManyRequests, "retryAfterMs", durationMillis(wait))
+	writeRateLimited(w, wait)
+	return false
+}
+
+// poolRateLimitStats reports the limit and usage of each rate limited pool
+func (lb *LoadBalancer) poolRateLimitStats() map[string]interface{} {
+	stats := make(map[string]interface{}, len(lb.poolLimiters))
+	for pool, limiter := range lb.poolLimiters {
+		stats[pool] = map[string]interface{}{
+			"rate":            limiter.limit.Rate,
+			"burst":           limiter.bucket.burst,
+			"tokensAvailable": limiter.bucket.available(),
+			"allowed":         atomic.LoadUint64(&limiter.allowed),
+			"rejected":        atomic.LoadUint64(&limiter.rejected),
+		}
+	}
+	return stats
+}
+
+// setRetryAfter tells the client how long to wait, in whole seconds and at
+// least one
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+}
+
+// checkRoleRateLimit reports whether a request for the role may proceed and
+// otherwise writes a 429 response with Retry-After
+func (lb *LoadBalancer) checkRoleRateLimit(w http.ResponseWriter, r *http.Request, role string) bool {
+	limiter, ok := lb.roleLimiters[role]
+	if !ok {
+		return true
+	}
+	allowed, wait := limiter.allow()
+	if allowed {
+		return true
+	}
+
+	lb.logRequest(r, LevelInfo, "Request rate limited", "role", role, "path", r.URL.Path, "status", http.StatusTooManyRequests, "retryAfterMs", durationMillis(wait))
+	writeRateLimited(w, wait)
+	return false
+}
+
+// writeRateLimited answers with 429 and a Retry-After rounded up to whole seconds
+func writeRateLimited(w http.ResponseWriter, wait time.Duration) {
+	setRetryAfter(w, wait)
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte("Rate limit exceeded"))
+}
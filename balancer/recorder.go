@@ -0,0 +1,175 @@
+package balancer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redactedValue replaces the value of sensitive headers in recordings
+const redactedValue = "REDACTED"
+
+// defaultRedactedHeaders are always scrubbed from recordings
+var defaultRedactedHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-Api-Key",
+}
+
+// RecordedRequest is a single captured request
+type RecordedRequest struct {
+	Time          time.Time   `json:"time"`
+	Method        string      `json:"method"`
+	URI           string      `json:"uri"`
+	Headers       http.Header `json:"headers"`
+	Body          []byte      `json:"body,omitempty"`
+	BodyTruncated bool        `json:"bodyTruncated,omitempty"`
+}
+
+// RecorderConfig controls which requests are recorded and how much of them
+type RecorderConfig struct {
+	// SampleRate is the fraction of requests recorded, between 0 and 1
+	SampleRate float64
+	// MaxBodyBytes caps how much of each body is kept
+	MaxBodyBytes int64
+	// RedactHeaders lists extra headers to scrub on top of the defaults
+	RedactHeaders []string
+	// RedactQueryParams lists query parameters to scrub, e.g. one carrying
+	// the token
+	RedactQueryParams []string
+}
+
+// TrafficRecorder writes a sample of requests as JSON lines
+type TrafficRecorder struct {
+	mutex   sync.Mutex
+	encoder *json.Encoder
+	config  RecorderConfig
+	redact  map[string]bool
+}
+
+// NewTrafficRecorder creates a recorder writing to w
+func NewTrafficRecorder(w io.Writer, config RecorderConfig) *TrafficRecorder {
+	redact := make(map[string]bool)
+	for _, name := range append(defaultRedactedHeaders, config.RedactHeaders...) {
+		redact[http.CanonicalHeaderKey(name)] = true
+	}
+	return &TrafficRecorder{
+		encoder: json.NewEncoder(w),
+		config:  config,
+		redact:  redact,
+	}
+}
+
+// WithTrafficRecorder records a sample of incoming requests
+func WithTrafficRecorder(recorder *TrafficRecorder) Option {
+	return func(lb *LoadBalancer) {
+		lb.recorder = recorder
+	}
+}
+
+// Record captures the request if it is sampled. The body is read up to the
+// configured cap and then restored so the request can still be proxied.
+func (t *TrafficRecorder) Record(r *http.Request) error {
+	if rand.Float64() >= t.config.SampleRate {
+		return nil
+	}
+
+	rec := RecordedRequest{
+		Time:    time.Now(),
+		Method:  r.Method,
+		URI:     t.redactURI(r.URL),
+		Headers: make(http.Header, len(r.Header)),
+	}
+	for name, values := range r.Header {
+		if t.redact[http.CanonicalHeaderKey(name)] {
+			rec.Headers[name] = []string{redactedValue}
+			continue
+		}
+		rec.Headers[name] = append([]string(nil), values...)
+	}
+
+	if r.Body != nil && r.Body != http.NoBody && t.config.MaxBodyBytes > 0 {
+		body, err := io.ReadAll(io.LimitReader(r.Body, t.config.MaxBodyBytes+1))
+		if err != nil {
+			return fmt.Errorf("failed to read request body: %w", err)
+		}
+		// Put back what was consumed in front of the unread remainder
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+
+		if int64(len(body)) > t.config.MaxBodyBytes {
+			body = body[:t.config.MaxBodyBytes]
+			rec.BodyTruncated = true
+		}
+		rec.Body = body
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.encoder.Encode(rec)
+}
+
+// redactURI returns the request URI with the redacted query parameters
+// scrubbed
+func (t *TrafficRecorder) redactURI(u *url.URL) string {
+	if len(t.config.RedactQueryParams) == 0 || u.RawQuery == "" {
+		return u.RequestURI()
+	}
+	query := u.Query()
+	for _, name := range t.config.RedactQueryParams {
+		if query.Has(name) {
+			query.Set(name, redactedValue)
+		}
+	}
+	redacted := *u
+	redacted.RawQuery = query.Encode()
+	return redacted.RequestURI()
+}
+
+// ReadRecording parses a recording written by TrafficRecorder
+func ReadRecording(r io.Reader) ([]RecordedRequest, error) {
+	var recs []RecordedRequest
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var rec RecordedRequest
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs, scanner.Err()
+}
+
+// NewReplayRequest rebuilds a recorded request against the target base URL.
+// Redacted headers are dropped so the caller can supply fresh credentials.
+func NewReplayRequest(target string, rec RecordedRequest) (*http.Request, error) {
+	req, err := http.NewRequest(rec.Method, strings.TrimSuffix(target, "/")+rec.URI, bytes.NewReader(rec.Body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range rec.Headers {
+		if len(values) == 1 && values[0] == redactedValue {
+			continue
+		}
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	return req, nil
+}
@@ -0,0 +1,132 @@
+package balancer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// maxRetryBodyBytes is the largest request body buffered for retries.
+// Requests with bigger bodies are only attempted once.
+const maxRetryBodyBytes = 1 << 20
+
+// WithRetries retries a request on another eligible backend up to n times
+// when proxying fails before any response was sent. Admin requests fail
+// over to the other admin-capable backends.
+func WithRetries(n int) Option {
+	return func(lb *LoadBalancer) {
+		lb.maxRetries = n
+	}
+}
+
+// Outcomes of proxied requests with respect to retries
+const (
+	OutcomeFirstTrySuccess = "first_try_success"
+	OutcomeFirstTryFailure = "first_try_failure"
+	OutcomeRetrySuccess    = "retry_success"
+	OutcomeRetryExhausted  = "retry_exhausted"
+)
+
+// retryOutcomes counts proxied requests by outcome
+type retryOutcomes struct {
+	firstTrySuccess uint64
+	firstTryFailure uint64
+	retrySuccess    uint64
+	retryExhausted  uint64
+}
+
+// recordRetryOutcome counts a proxied request once it is done. attempts is
+// how many backends it was sent to and failed whether the last one failed
+// too; a request that got a response from a backend counts as a success
+// whatever its status.
+func (lb *LoadBalancer) recordRetryOutcome(attempts int, failed bool) {
+	var outcome string
+	var counter *uint64
+	switch {
+	case attempts <= 1 && !failed:
+		outcome, counter = OutcomeFirstTrySuccess, &lb.retryOutcomes.firstTrySuccess
+	case attempts <= 1:
+		outcome, counter = OutcomeFirstTryFailure, &lb.retryOutcomes.firstTryFailure
+	case !failed:
+		outcome, counter = OutcomeRetrySuccess, &lb.retryOutcomes.retrySuccess
+	default:
+		outcome, counter = OutcomeRetryExhausted, &lb.retryOutcomes.retryExhausted
+	}
+	atomic.AddUint64(counter, 1)
+	lb.metrics.retryOutcomes.WithLabelValues(outcome).Inc()
+}
+
+// retryOutcomeStats reports the request counts per retry outcome
+func (lb *LoadBalancer) retryOutcomeStats() map[string]uint64 {
+	return map[string]uint64{
+		OutcomeFirstTrySuccess: atomic.LoadUint64(&lb.retryOutcomes.firstTrySuccess),
+		OutcomeFirstTryFailure: atomic.LoadUint64(&lb.retryOutcomes.firstTryFailure),
+		OutcomeRetrySuccess:    atomic.LoadUint64(&lb.retryOutcomes.retrySuccess),
+		OutcomeRetryExhausted:  atomic.LoadUint64(&lb.retryOutcomes.retryExhausted),
+	}
+}
+
+// attemptKey is the context key for the state of the current proxy attempt
+type attemptKey struct{}
+
+// attemptState carries per-attempt details to the proxy hooks. It lets the
+// error handler hand a failure back to ServeHTTP instead of answering the
+// client, so the request can be retried.
+type attemptState struct {
+	retryable bool
+	err       error
+	status    int
+
+	// attempt numbers the tries of a request from 1, strategy names how
+	// the backend was chosen
+	attempt  int
+	strategy string
+
+	// received is when the balancer got the request, started when this
+	// attempt was handed to the backend proxy
+	received time.Time
+	started  time.Time
+}
+
+// attemptFromContext returns the attempt state attached to the request, if any
+func attemptFromContext(ctx context.Context) *attemptState {
+	state, _ := ctx.Value(attemptKey{}).(*attemptState)
+	return state
+}
+
+// bufferRequestBody reads the body into memory so it can be sent again on
+// retry, or to the shadow backend when mirrored is set. It reports false,
+// leaving the body intact, when retries are disabled and the request isn't
+// mirrored, or the body is too large.
+func (lb *LoadBalancer) bufferRequestBody(r *http.Request, mirrored bool) ([]byte, bool) {
+	if lb.maxRetries <= 0 && !mirrored {
+		return nil, false
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if r.ContentLength > maxRetryBodyBytes {
+		return nil, false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRetryBodyBytes+1))
+	if err != nil || len(body) > maxRetryBodyBytes {
+		// Put back what was consumed so the single attempt still sees it all
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false
+	}
+	r.Body.Close()
+	return body, true
+}
+
+// hasRetryCandidate reports whether a backend not yet tried could take the
+// request if the current attempt fails
+func (lb *LoadBalancer) hasRetryCandidate(role string, pool []int, tried []*Backend) bool {
+	return lb.hasAliveBackend(role, pool, tried)
+}
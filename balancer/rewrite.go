@@ -0,0 +1,181 @@
+package balancer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// DefaultBodyRewriteMaxBytes caps the size of response bodies that are
+// rewritten when no limit is configured
+const DefaultBodyRewriteMaxBytes = 1 << 20
+
+// defaultRewriteContentTypes are the text media types rewritten when none
+// are configured
+var defaultRewriteContentTypes = []string{
+	"text/html",
+	"text/plain",
+	"text/css",
+	"text/javascript",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+}
+
+// BodyRewriteRule replaces every occurrence of From in a response body with To
+type BodyRewriteRule struct {
+	From string
+	To   string
+}
+
+// BodyRewriteConfig controls rewriting of backend response bodies
+type BodyRewriteConfig struct {
+	// Rules are applied in a single pass; earlier rules win on overlaps
+	Rules []BodyRewriteRule
+	// ContentTypes lists the media types rewritten, defaulting to common
+	// text types. Parameters such as charset are ignored.
+	ContentTypes []string
+	// MaxBytes skips bodies larger than this, defaulting to
+	// DefaultBodyRewriteMaxBytes
+	MaxBytes int64
+}
+
+// WithBodyRewrite substitutes strings in text response bodies, e.g. to
+// replace internal host names that backends embed in links with the
+// balancer's public address. Compressed and oversized bodies are passed on
+// untouched. Rewriting buffers each matching body, so it is off by default.
+func WithBodyRewrite(cfg BodyRewriteConfig) Option {
+	return func(lb *LoadBalancer) {
+		if len(cfg.Rules) == 0 {
+			return
+		}
+		if len(cfg.ContentTypes) == 0 {
+			cfg.ContentTypes = defaultRewriteContentTypes
+		}
+		if cfg.MaxBytes <= 0 {
+			cfg.MaxBytes = DefaultBodyRewriteMaxBytes
+		}
+		pairs := make([]string, 0, 2*len(cfg.Rules))
+		for _, rule := range cfg.Rules {
+			pairs = append(pairs, rule.From, rule.To)
+		}
+		lb.bodyRewrite = &bodyRewriter{config: cfg, replacer: strings.NewReplacer(pairs...)}
+	}
+}
+
+// bodyRewriter applies the configured substitutions
+type bodyRewriter struct {
+	config   BodyRewriteConfig
+	replacer *strings.Replacer
+}
+
+// applies reports whether the response is eligible for rewriting
+func (rw *bodyRewriter) applies(resp *http.Response) bool {
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return false
+	}
+	if resp.ContentLength > rw.config.MaxBytes {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, contentType := range rw.config.ContentTypes {
+		if strings.EqualFold(mediaType, contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewrite replaces the response body with its rewritten form. Bodies that
+// turn out to exceed the size cap are passed on unchanged.
+func (rw *bodyRewriter) rewrite(resp *http.Response) error {
+	if !rw.applies(resp) {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, rw.config.MaxBytes+1))
+	if err != nil {
+		return fmt.Errorf("failed to read response body for rewriting: %w", err)
+	}
+	if int64(len(body)) > rw.config.MaxBytes {
+		// Put back what was consumed in front of the unread remainder
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+
+	rewritten := rw.replacer.Replace(string(body))
+	resp.Body = io.NopCloser(strings.NewReader(rewritten))
+	resp.ContentLength = int64(len(rewritten))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(rewritten)))
+	// The representation changed, so validators for the original are wrong
+	if rewritten != string(body) {
+		resp.Header.Del("ETag")
+	}
+	return nil
+}
+
+// WithLocationRewrite rewrites absolute Location headers that point at the
+// backend itself, e.g. on redirects, to the balancer's public URL so clients
+// aren't sent to an address they can't reach. A path the backend URL has is
+// replaced with the public URL's path, as is a backend's path rewrite.
+// Relative locations and those pointing elsewhere are left alone.
+func WithLocationRewrite(publicURL *url.URL) Option {
+	return func(lb *LoadBalancer) {
+		lb.publicURL = publicURL
+	}
+}
+
+// rewriteLocation applies the Location rewrite to a backend response
+func (lb *LoadBalancer) rewriteLocation(backend *Backend, resp *http.Response) {
+	location := resp.Header.Get("Location")
+	if lb.publicURL == nil || location == "" {
+		return
+	}
+	target, err := url.Parse(location)
+	if err != nil || !target.IsAbs() || !sameOrigin(target, backend.URL) {
+		return
+	}
+	basePath := strings.TrimSuffix(backend.URL.Path, "/") + backend.addPrefix
+	if basePath != "" && target.Path != basePath && !strings.HasPrefix(target.Path, basePath+"/") {
+		return
+	}
+
+	rewritten := *target
+	rewritten.Scheme = lb.publicURL.Scheme
+	rewritten.Host = lb.publicURL.Host
+	rewritten.Path = strings.TrimSuffix(lb.publicURL.Path, "/") + backend.stripPrefix + strings.TrimPrefix(target.Path, basePath)
+	rewritten.RawPath = ""
+	resp.Header.Set("Location", rewritten.String())
+	lb.logRequest(resp.Request, LevelDebug, "Location rewritten", "backend", backend.ID, "from", location, "to", rewritten.String())
+}
+
+// sameOrigin reports whether both URLs have the same scheme, host and port,
+// filling in the scheme's default port
+func sameOrigin(a, b *url.URL) bool {
+	return strings.EqualFold(a.Scheme, b.Scheme) &&
+		strings.EqualFold(a.Hostname(), b.Hostname()) &&
+		originPort(a) == originPort(b)
+}
+
+// originPort returns the URL's port, or the default port of its scheme
+func originPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	if strings.EqualFold(u.Scheme, "https") {
+		return "443"
+	}
+	return "80"
+}
@@ -0,0 +1,463 @@
+package balancer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// AdminBalancing names how admin requests are spread over the admin-capable
+// backends
+type AdminBalancing string
+
+const (
+	// AdminFailover sends admin requests to the first available admin
+	// backend in configuration order, so the others act as standbys
+	AdminFailover AdminBalancing = "failover"
+	// AdminRoundRobin rotates admin requests over the available admin backends
+	AdminRoundRobin AdminBalancing = "round-robin"
+)
+
+// ParseAdminBalancing validates an admin balancing mode name
+func ParseAdminBalancing(name string) (AdminBalancing, error) {
+	switch mode := AdminBalancing(name); mode {
+	case AdminFailover, AdminRoundRobin:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown admin balancing mode %q", name)
+	}
+}
+
+// DefaultAdminRole is the role pinned to the admin backends when no other
+// admin role is configured
+const DefaultAdminRole = "Admin"
+
+// WithAdminRole names the privileged role whose requests are pinned to the
+// admin-capable backends and that may use the admin API, e.g.
+// "administrator". The default validator accepts it in place of
+// DefaultAdminRole.
+func WithAdminRole(role string) Option {
+	return func(lb *LoadBalancer) {
+		if role != "" {
+			lb.adminRole = role
+		}
+	}
+}
+
+// applyAdminRole makes a validator that accepts DefaultAdminRole accept the
+// configured admin role instead. Role routes set the accepted roles
+// themselves and are left alone.
+func (lb *LoadBalancer) applyAdminRole() {
+	if lb.adminRole == DefaultAdminRole || len(lb.roleRoutes) > 0 {
+		return
+	}
+	roles := make([]string, 0, len(lb.validator.Roles))
+	replaced := false
+	for _, role := range lb.validator.Roles {
+		switch role {
+		case lb.adminRole:
+			return
+		case DefaultAdminRole:
+			role = lb.adminRole
+			replaced = true
+		}
+		roles = append(roles, role)
+	}
+	if !replaced {
+		return
+	}
+	// Copy so a validator shared with other balancers is left untouched
+	validator := *lb.validator
+	validator.Roles = roles
+	validator.RolePriority = make([]string, len(lb.validator.RolePriority))
+	for i, role := range lb.validator.RolePriority {
+		if role == DefaultAdminRole {
+			role = lb.adminRole
+		}
+		validator.RolePriority[i] = role
+	}
+	lb.validator = &validator
+}
+
+// WithAdminBalancing selects how admin requests are spread over the
+// backends flagged as admin. The default is failover.
+func WithAdminBalancing(mode AdminBalancing) Option {
+	return func(lb *LoadBalancer) {
+		lb.adminBalancing = mode
+	}
+}
+
+// DefaultPoolName names the pool of requests that match no route
+const DefaultPoolName = "default"
+
+// Route sends matching requests to a subset of the backends
+type Route struct {
+	// Name identifies the route in logs
+	Name string
+	// Match reports whether the request belongs to this route
+	Match func(r *http.Request) bool
+	// Backends lists the indices of the backends eligible for the route in
+	// the configuration passed to NewLoadBalancer, see bindPools
+	Backends []int
+}
+
+// MatchHeader returns a route matcher for requests carrying the header with
+// one of values, e.g. MatchHeader("X-Canary", "true") for canary routing.
+// Without values any request carrying the header matches.
+func MatchHeader(name string, values ...string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		got := r.Header.Values(name)
+		if len(values) == 0 {
+			return len(got) > 0
+		}
+		for _, value := range got {
+			for _, want := range values {
+				if value == want {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// MatchHost returns a route matcher for requests whose Host header, without
+// the port, is one of hosts. Hosts are compared case-insensitively and a
+// leading "*." matches exactly one extra label, as with MatchSNI.
+func MatchHost(hosts ...string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(host)
+		for _, name := range hosts {
+			if matchServerName(strings.ToLower(name), host) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// PathRoute sends requests whose path starts with Prefix to a subset of the
+// backends
+type PathRoute struct {
+	Prefix string
+	// Backends lists the indices of the backends eligible for the route,
+	// as for Route
+	Backends []int
+}
+
+// NoRoutePolicy controls requests that match none of the configured routes
+type NoRoutePolicy struct {
+	// Reject answers unmatched requests with StatusCode and Body instead of
+	// falling through to the default pool
+	Reject bool
+	// DefaultBackends lists the indices of the backends unmatched requests
+	// fall through to, as for Route. Nil means every backend, including
+	// those added at runtime.
+	DefaultBackends []int
+	// StatusCode defaults to 404 Not Found
+	StatusCode int
+	// Body defaults to "No route matches the request"
+	Body string
+}
+
+// WithRoutes configures the routes consulted, in order, for each request
+func WithRoutes(routes ...Route) Option {
+	return func(lb *LoadBalancer) {
+		// Copied, bindPools rewrites the backends
+		lb.routes = append([]Route(nil), routes...)
+	}
+}
+
+// WithPathRoutes configures prefix-based routing. When several prefixes
+// match a request the longest one wins. Path routes are consulted after the
+// routes set with WithRoutes, and the prefix names the pool.
+func WithPathRoutes(routes ...PathRoute) Option {
+	return func(lb *LoadBalancer) {
+		lb.pathRoutes = append([]PathRoute(nil), routes...)
+	}
+}
+
+// bindPools replaces the backend indices of the routes, the default pool,
+// the traffic split groups, the role routes and the role homes with the
+// IDs of the backends at those positions, once the initial backends exist.
+// Pools are resolved by ID when a request is served, so they keep naming
+// the same backends while others are added, removed or reloaded: a removed
+// backend drops out of its pools and an added one joins none, except those
+// left nil.
+func (lb *LoadBalancer) bindPools(backends []*Backend) {
+	for i := range lb.routes {
+		lb.routes[i].Backends = backendIDs(backends, lb.routes[i].Backends)
+	}
+	for i := range lb.pathRoutes {
+		lb.pathRoutes[i].Backends = backendIDs(backends, lb.pathRoutes[i].Backends)
+	}
+	lb.noRoute.DefaultBackends = backendIDs(backends, lb.noRoute.DefaultBackends)
+	for _, group := range lb.splitGroups {
+		group.backends = backendIDs(backends, group.backends)
+	}
+	for role, indices := range lb.roleRoutes {
+		lb.roleRoutes[role] = backendIDs(backends, indices)
+	}
+	lb.bindRoleHomes(backends)
+}
+
+// backendIDs returns the IDs of the backends at the given indices, ignoring
+// any index that is out of range. Nil stays nil.
+func backendIDs(backends []*Backend, indices []int) []int {
+	if indices == nil {
+		return nil
+	}
+	ids := make([]int, 0, len(indices))
+	for _, idx := range indices {
+		if idx >= 0 && idx < len(backends) {
+			ids = append(ids, backends[idx].ID)
+		}
+	}
+	return ids
+}
+
+// matchPathRoute returns the path route with the longest prefix matching
+// the path, or nil. Prefixes match whole segments, so /api/users covers
+// /api/users/1 but not /api/usersettings.
+func (lb *LoadBalancer) matchPathRoute(path string) *PathRoute {
+	var match *PathRoute
+	for i, route := range lb.pathRoutes {
+		if path != route.Prefix && !strings.HasPrefix(path, strings.TrimRight(route.Prefix, "/")+"/") {
+			continue
+		}
+		if match == nil || len(route.Prefix) > len(match.Prefix) {
+			match = &lb.pathRoutes[i]
+		}
+	}
+	return match
+}
+
+// WithNoRoutePolicy configures how requests matching no route are handled
+func WithNoRoutePolicy(policy NoRoutePolicy) Option {
+	return func(lb *LoadBalancer) {
+		if policy.StatusCode == 0 {
+			policy.StatusCode = http.StatusNotFound
+		}
+		if policy.Body == "" {
+			policy.Body = "No route matches the request"
+		}
+		lb.noRoute = policy
+	}
+}
+
+// WithReservedAdminBackends keeps non-admin requests off the admin-capable
+// backends so their capacity stays free for admin requests. Role routes
+// that explicitly list an admin backend still use it.
+func WithReservedAdminBackends(reserved bool) Option {
+	return func(lb *LoadBalancer) {
+		lb.reserveAdmin = reserved
+	}
+}
+
+// WithRoleRoutes maps each role to the indices of the backends that may
+// serve it, positions in the initial backend list. Like the routes, they
+// are bound to those backends' IDs, so a role never moves onto another
+// backend when the list changes; a role whose backends are all removed is
+// refused. Once configured, only the listed roles are accepted in tokens.
+// A mapping for the admin role replaces routing to the admin-capable
+// backends.
+func WithRoleRoutes(routes map[string][]int) Option {
+	return func(lb *LoadBalancer) {
+		// Copied, bindPools rewrites the backends
+		lb.roleRoutes = make(map[string][]int, len(routes))
+		for role, indices := range routes {
+			lb.roleRoutes[role] = indices
+		}
+	}
+}
+
+// checkRoleRoutes warns about the roles whose route lost its last backend
+// with the removed one. Their requests are refused from now on. The caller
+// holds the mutex.
+func (lb *LoadBalancer) checkRoleRoutes(removed *Backend) {
+	for role, ids := range lb.roleRoutes {
+		for _, id := range ids {
+			if id == removed.ID && len(backendsByID(lb.backends, ids)) == 0 {
+				lb.logger.Log(LevelWarn, "Role has no backends left", "role", role, "backend", removed.ID)
+				break
+			}
+		}
+	}
+}
+
+// applyRoleRoutes restricts the validator to the roles that have a route
+func (lb *LoadBalancer) applyRoleRoutes() {
+	if len(lb.roleRoutes) == 0 {
+		return
+	}
+	roles := make([]string, 0, len(lb.roleRoutes))
+	for role := range lb.roleRoutes {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+
+	// Copy so a validator shared with other balancers is left untouched
+	validator := *lb.validator
+	validator.Roles = roles
+	lb.validator = &validator
+}
+
+// checkDefaultRole makes sure the default role can't hand tokens without
+// an accepted role more than a regular role: it may not be the admin role,
+// and it must be accepted and, with role routes, have a backend to go to
+func (lb *LoadBalancer) checkDefaultRole(backendCount int) error {
+	role := lb.validator.DefaultRole
+	if role == "" {
+		return nil
+	}
+	if role == lb.adminRole {
+		return fmt.Errorf("default role %q is the admin role", role)
+	}
+	if !lb.validator.isKnownRole(role) {
+		return fmt.Errorf("default role %q is not an accepted role", role)
+	}
+	indices, mapped := lb.roleRoutes[role]
+	if !mapped {
+		return nil
+	}
+	for _, idx := range indices {
+		if idx >= 0 && idx < backendCount {
+			return nil
+		}
+	}
+	return fmt.Errorf("default role %q has no backends in its role route", role)
+}
+
+// usesAdminPinning reports whether the role is routed to the admin-capable
+// backends rather than through a role route
+func (lb *LoadBalancer) usesAdminPinning(role string) bool {
+	_, mapped := lb.roleRoutes[role]
+	return role == lb.adminRole && !mapped
+}
+
+// selectAdminBackend picks an available admin backend according to the
+// admin balancing mode
+func (lb *LoadBalancer) selectAdminBackend(admins []*Backend) *Backend {
+	if lb.adminBalancing == AdminRoundRobin {
+		return rotate(&lb.adminRoundRobin, admins)
+	}
+	for _, backend := range admins {
+		if backend.isAvailable() {
+			return backend
+		}
+	}
+	return nil
+}
+
+// resolveRoute returns the name and backend IDs of the pool for the
+// request and whether it may be served at all. A nil pool means every
+// backend is eligible. Requests matching no route use the DefaultPoolName pool.
+func (lb *LoadBalancer) resolveRoute(r *http.Request) (string, []int, bool) {
+	for _, route := range lb.routes {
+		if route.Match(r) {
+			lb.logRequest(r, LevelDebug, "Request matched route", "method", r.Method, "path", r.URL.Path, "route", route.Name)
+			return route.Name, route.Backends, true
+		}
+	}
+	if route := lb.matchPathRoute(r.URL.Path); route != nil {
+		lb.logRequest(r, LevelDebug, "Request matched path route", "method", r.Method, "path", r.URL.Path, "prefix", route.Prefix)
+		return route.Prefix, route.Backends, true
+	}
+	if lb.noRoute.Reject {
+		return "", nil, false
+	}
+	return DefaultPoolName, lb.noRoute.DefaultBackends, true
+}
+
+// eligibleBackends returns the backends allowed to serve a request for the
+// role within the pool. Admin requests may only go to admin-capable
+// backends regardless of the pool, in configuration order.
+// Roles with a role route are limited to the backends it lists; other roles
+// skip the admin-capable backends when they are reserved.
+func (lb *LoadBalancer) eligibleBackends(role string, pool []int) []*Backend {
+	backends := lb.getBackends()
+
+	if lb.usesAdminPinning(role) {
+		var admins []*Backend
+		for _, backend := range backends {
+			if backend.IsAdmin {
+				admins = append(admins, backend)
+			}
+		}
+		return admins
+	}
+
+	eligible := backends
+	if pool != nil {
+		eligible = backendsByID(backends, pool)
+	}
+	roleRoute, hasRoleRoute := lb.roleRoutes[role]
+	if lb.reserveAdmin && !hasRoleRoute {
+		regular := make([]*Backend, 0, len(eligible))
+		for _, backend := range eligible {
+			if !backend.IsAdmin {
+				regular = append(regular, backend)
+			}
+		}
+		eligible = regular
+	}
+	if hasRoleRoute {
+		allowed := backendsByID(backends, roleRoute)
+		filtered := make([]*Backend, 0, len(eligible))
+		for _, backend := range eligible {
+			if containsBackend(allowed, backend) {
+				filtered = append(filtered, backend)
+			}
+		}
+		eligible = filtered
+	}
+	return eligible
+}
+
+// backendsByID returns the backends with the given IDs, in the order of
+// backends, skipping IDs of backends that are gone
+func backendsByID(backends []*Backend, ids []int) []*Backend {
+	selected := make([]*Backend, 0, len(ids))
+	for _, backend := range backends {
+		for _, id := range ids {
+			if backend.ID == id {
+				selected = append(selected, backend)
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// candidateBackends returns the eligible backends not yet tried for the
+// request
+func (lb *LoadBalancer) candidateBackends(role string, pool []int, tried []*Backend) []*Backend {
+	eligible := lb.eligibleBackends(role, pool)
+	if len(tried) == 0 {
+		return eligible
+	}
+
+	candidates := make([]*Backend, 0, len(eligible))
+	for _, backend := range eligible {
+		if !containsBackend(tried, backend) {
+			candidates = append(candidates, backend)
+		}
+	}
+	return candidates
+}
+
+// containsBackend reports whether the backend is in the list
+func containsBackend(backends []*Backend, backend *Backend) bool {
+	for _, b := range backends {
+		if b == backend {
+			return true
+		}
+	}
+	return false
+}
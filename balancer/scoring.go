@@ -0,0 +1,69 @@
+package balancer
+
+import (
+	"math"
+	"time"
+)
+
+// DefaultLatencyTarget is the average latency at or below which a backend
+// loses no health score for being slow
+const DefaultLatencyTarget = 100 * time.Millisecond
+
+// minHealthScore keeps a trickle of traffic on badly scored backends so
+// they can show they have recovered
+const minHealthScore = 0.01
+
+// HealthScoring weighs the signals combined into a backend's health score.
+// Each signal is a factor between 0 and 1; the score is their product with
+// each factor raised to its weight, so a weight of 0 ignores the signal and
+// higher weights make it count more.
+type HealthScoring struct {
+	// CheckWeight applies to recent active health check failures that have
+	// not yet marked the backend down
+	CheckWeight float64
+	// ErrorWeight applies to the share of successful requests over the
+	// outlier detection window
+	ErrorWeight float64
+	// LatencyWeight applies to LatencyTarget divided by the average
+	// latency, when the backend is slower than the target
+	LatencyWeight float64
+	// LatencyTarget defaults to DefaultLatencyTarget
+	LatencyTarget time.Duration
+}
+
+// WithHealthScoring scales each backend's weight by a composite health
+// score, so a degrading backend gets proportionally less traffic from the
+// weighted strategy instead of being cut off outright.
+func WithHealthScoring(scoring HealthScoring) Option {
+	return func(lb *LoadBalancer) {
+		if scoring.LatencyTarget <= 0 {
+			scoring.LatencyTarget = DefaultLatencyTarget
+		}
+		lb.scoring = &scoring
+	}
+}
+
+// healthScore returns the backend's composite health score between
+// minHealthScore and 1, or 1 when scoring is disabled
+func (lb *LoadBalancer) healthScore(backend *Backend, now time.Time) float64 {
+	if lb.scoring == nil {
+		return 1
+	}
+
+	backend.mutex.RLock()
+	failCount := backend.failCount
+	backend.mutex.RUnlock()
+	check := 1 / float64(1+failCount)
+
+	errorFactor := 1 - lb.errorRate(backend, now)
+
+	latency := 1.0
+	if average := backend.latency.average(); average > lb.scoring.LatencyTarget {
+		latency = float64(lb.scoring.LatencyTarget) / float64(average)
+	}
+
+	score := math.Pow(check, lb.scoring.CheckWeight) *
+		math.Pow(errorFactor, lb.scoring.ErrorWeight) *
+		math.Pow(latency, lb.scoring.LatencyWeight)
+	return math.Max(score, minHealthScore)
+}
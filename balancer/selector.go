@@ -0,0 +1,59 @@
+package balancer
+
+import "net/http"
+
+// Selector picks the backend for a request, e.g. from a lookup of the
+// tenant's home backend. The built-in strategies implement it too. backends
+// holds the candidates for the request: those its role and route allow,
+// less the ones already tried. Candidates may be down or at capacity, see
+// Backend.Available. Returning nil, or a backend that is down, leaves the
+// choice to the configured strategy.
+//
+// Select is called concurrently and must not block for long, it runs
+// before every attempt of every request.
+type Selector interface {
+	Select(r *http.Request, role string, backends []*Backend) *Backend
+}
+
+// SelectorFunc adapts an ordinary function to a Selector
+type SelectorFunc func(r *http.Request, role string, backends []*Backend) *Backend
+
+// Select calls f
+func (f SelectorFunc) Select(r *http.Request, role string, backends []*Backend) *Backend {
+	return f(r, role, backends)
+}
+
+// WithSelector lets selector choose the backend for non-admin requests
+// ahead of the built-in strategy, which handles the requests it passes on.
+// Admin requests stay pinned to the admin backends.
+func WithSelector(selector Selector) Option {
+	return func(lb *LoadBalancer) {
+		lb.selector = selector
+	}
+}
+
+// Available reports whether the backend can take a request right now: it is
+// healthy, not disabled, draining or cut off, and has a free slot
+func (b *Backend) Available() bool {
+	return b.isAvailable()
+}
+
+// selectCustomBackend asks the custom selector, if any, for a backend. A
+// backend that isn't a candidate is ignored, so a selector can't route
+// around role restrictions or retry a backend that already failed, and so is
+// one that is down, leaving the request to the strategy.
+func (lb *LoadBalancer) selectCustomBackend(r *http.Request, role string, backends []*Backend) *Backend {
+	if lb.selector == nil {
+		return nil
+	}
+	backend := lb.selector.Select(r, role, backends)
+	if backend != nil && !containsBackend(backends, backend) {
+		lb.logRequest(r, LevelWarn, "Selector picked a backend that is not a candidate", "role", role, "path", r.URL.Path, "backend", backend.ID)
+		return nil
+	}
+	if backend != nil && !backend.isRoutable() {
+		lb.logRequest(r, LevelDebug, "Selected backend is unavailable, falling back to the strategy", "role", role, "path", r.URL.Path, "backend", backend.ID)
+		return nil
+	}
+	return backend
+}
@@ -0,0 +1,26 @@
+package balancer
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// WithServerTiming adds a Server-Timing header to proxied responses showing
+// the backend's time to respond and the balancer's own overhead. It is off
+// by default since it reveals timing details to clients.
+func WithServerTiming(enabled bool) Option {
+	return func(lb *LoadBalancer) {
+		lb.serverTiming = enabled
+	}
+}
+
+// addServerTiming appends the balancer's timings to the response headers
+func addServerTiming(resp *http.Response, state *attemptState) {
+	now := time.Now()
+	overhead := state.started.Sub(state.received)
+	backend := now.Sub(state.started)
+	resp.Header.Add("Server-Timing", fmt.Sprintf(
+		`lb;desc="load balancer";dur=%.3f, backend;desc="backend";dur=%.3f`,
+		durationMillis(overhead), durationMillis(backend)))
+}
@@ -0,0 +1,226 @@
+package balancer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Shadow traffic defaults
+const (
+	DefaultShadowTimeout     = 10 * time.Second
+	DefaultShadowConcurrency = 100
+)
+
+// ShadowHeader is set on mirrored requests so the shadow backend can tell
+// them from live traffic
+const ShadowHeader = "X-Shadow-Request"
+
+// shadowHopHeaders are connection-specific and not copied to mirrored
+// requests
+var shadowHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// shadowCredentialHeaders carry the client's credentials and are stripped
+// from mirrored requests unless ShadowConfig.KeepCredentials is set
+var shadowCredentialHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"X-Api-Key",
+}
+
+// ShadowConfig mirrors a share of the proxied requests to a shadow backend,
+// e.g. a new version being tried on live traffic. Mirrored requests are sent
+// in the background and their responses discarded: the client only ever
+// sees the response of the regular backend. Only requests accepted for
+// proxying are mirrored, not those refused by a limit or finding no
+// backend.
+type ShadowConfig struct {
+	// URL is the shadow backend's base URL
+	URL string
+	// Percent of the proxied requests mirrored, between 0 and 100
+	Percent float64
+	// Timeout bounds each mirrored request, DefaultShadowTimeout when zero
+	Timeout time.Duration
+	// MaxConcurrent caps the mirrored requests in flight, so a slow shadow
+	// can't pile them up; requests over it are not mirrored.
+	// DefaultShadowConcurrency when zero.
+	MaxConcurrent int
+	// KeepCredentials forwards the Authorization, Proxy-Authorization,
+	// Cookie and X-Api-Key headers to the shadow backend, which otherwise
+	// never sees the client's credentials
+	KeepCredentials bool
+}
+
+// WithShadow mirrors a share of the requests to a shadow backend. Requests
+// whose body is too large to buffer are not mirrored.
+func WithShadow(config ShadowConfig) Option {
+	return func(lb *LoadBalancer) {
+		lb.shadowConfig = config
+	}
+}
+
+// shadowBackend sends mirrored requests
+type shadowBackend struct {
+	target          *url.URL
+	percent         float64
+	timeout         time.Duration
+	keepCredentials bool
+	client          *http.Client
+	slots           chan struct{}
+
+	mirrored uint64
+	skipped  uint64
+	failed   uint64
+}
+
+// newShadowBackend sets up the shadow backend with a transport of its own,
+// configured like those of the regular backends
+func (lb *LoadBalancer) newShadowBackend(config ShadowConfig) (*shadowBackend, error) {
+	target, err := parseBackendURL(config.URL)
+	if err != nil {
+		return nil, err
+	}
+	if config.Percent < 0 || config.Percent > 100 {
+		return nil, fmt.Errorf("percent must be between 0 and 100, got %v", config.Percent)
+	}
+	transport, err := newTransport(lb.transportConfig, BackendConfig{URL: config.URL})
+	if err != nil {
+		return nil, err
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = DefaultShadowTimeout
+	}
+	concurrency := config.MaxConcurrent
+	if concurrency <= 0 {
+		concurrency = DefaultShadowConcurrency
+	}
+	return &shadowBackend{
+		target:          target,
+		percent:         config.Percent,
+		timeout:         timeout,
+		keepCredentials: config.KeepCredentials,
+		client: &http.Client{
+			Transport: transport,
+			// Redirects are the client's business, not the shadow's
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		slots: make(chan struct{}, concurrency),
+	}, nil
+}
+
+// sampled reports whether the request should be mirrored
+func (s *shadowBackend) sampled() bool {
+	return s != nil && rand.Float64()*100 < s.percent
+}
+
+// mirror sends a copy of the request with the buffered body to the shadow
+// backend in the background. The copy is made before mirror returns, so the
+// request may be proxied and modified meanwhile. Whatever happens to the
+// copy is only logged and counted.
+func (lb *LoadBalancer) mirror(r *http.Request, body []byte) {
+	s := lb.shadow
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		atomic.AddUint64(&s.skipped, 1)
+		lb.logRequest(r, LevelDebug, "Shadow request skipped - too many in flight", "path", r.URL.Path)
+		return
+	}
+
+	// Not tied to the client's request, which may well finish first
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	req, err := s.newRequest(ctx, r, body)
+	if err != nil {
+		cancel()
+		<-s.slots
+		atomic.AddUint64(&s.failed, 1)
+		lb.logRequest(r, LevelWarn, "Failed to build shadow request", "path", r.URL.Path, "error", err)
+		return
+	}
+
+	go func() {
+		defer func() { <-s.slots }()
+		defer cancel()
+		atomic.AddUint64(&s.mirrored, 1)
+		started := time.Now()
+		resp, err := s.client.Do(req)
+		if err != nil {
+			atomic.AddUint64(&s.failed, 1)
+			lb.logRequest(r, LevelDebug, "Shadow request failed", "method", req.Method, "path", req.URL.Path, "error", err)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		lb.logRequest(r, LevelDebug, "Shadow request completed", "method", req.Method, "path", req.URL.Path, "status", resp.StatusCode, "latencyMs", durationMillis(time.Since(started)))
+	}()
+}
+
+// mirrorAccepted mirrors a sampled request that has been accepted for
+// proxying, unless its body couldn't be buffered
+func (lb *LoadBalancer) mirrorAccepted(r *http.Request, body []byte, replayable bool) {
+	if !replayable {
+		atomic.AddUint64(&lb.shadow.skipped, 1)
+		lb.logRequest(r, LevelDebug, "Shadow request skipped - body too large to buffer", "path", r.URL.Path)
+		return
+	}
+	lb.mirror(r, body)
+}
+
+// newRequest copies the request for the shadow backend, joining the paths
+// the way the regular backends' proxies do
+func (s *shadowBackend) newRequest(ctx context.Context, r *http.Request, body []byte) (*http.Request, error) {
+	u := *s.target
+	u.Path = strings.TrimRight(s.target.Path, "/") + r.URL.Path
+	u.RawPath = ""
+	u.RawQuery = r.URL.RawQuery
+
+	var reader io.Reader
+	if len(body) > 0 {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, r.Method, u.String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = r.Header.Clone()
+	for _, name := range shadowHopHeaders {
+		req.Header.Del(name)
+	}
+	if !s.keepCredentials {
+		for _, name := range shadowCredentialHeaders {
+			req.Header.Del(name)
+		}
+	}
+	req.Header.Set(ShadowHeader, "1")
+	return req, nil
+}
+
+// stats reports how many requests were mirrored, skipped and failed
+func (s *shadowBackend) stats() map[string]interface{} {
+	return map[string]interface{}{
+		"url":      s.target.String(),
+		"percent":  s.percent,
+		"mirrored": atomic.LoadUint64(&s.mirrored),
+		"skipped":  atomic.LoadUint64(&s.skipped),
+		"failed":   atomic.LoadUint64(&s.failed),
+	}
+}
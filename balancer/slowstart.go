@@ -0,0 +1,69 @@
+package balancer
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// slowStartFloor is the share of its normal traffic a backend receives right
+// after it recovers
+const slowStartFloor = 0.1
+
+// WithSlowStart ramps the traffic of a backend that has just become healthy
+// again linearly from a small fraction to its full share over window, giving
+// cold caches and connection pools time to warm up. Zero disables it.
+func WithSlowStart(window time.Duration) Option {
+	return func(lb *LoadBalancer) {
+		lb.slowStart = window
+	}
+}
+
+// warmupFactor returns the share of its normal traffic the backend should
+// get, between slowStartFloor and 1
+func (lb *LoadBalancer) warmupFactor(backend *Backend, now time.Time) float64 {
+	if lb.slowStart <= 0 {
+		return 1
+	}
+	backend.mutex.RLock()
+	recoveredAt := backend.recoveredAt
+	backend.mutex.RUnlock()
+
+	if recoveredAt.IsZero() {
+		return 1
+	}
+	elapsed := now.Sub(recoveredAt)
+	if elapsed >= lb.slowStart {
+		return 1
+	}
+	progress := float64(elapsed) / float64(lb.slowStart)
+	return slowStartFloor + (1-slowStartFloor)*progress
+}
+
+// selectWarmBackend applies the strategy and, if it picks a backend that is
+// still warming up, passes the request on to another backend with the
+// probability the backend is not yet ready for. The weighted strategy
+// already scales weights by the warmup factor.
+func (lb *LoadBalancer) selectWarmBackend(r *http.Request, role string, backends []*Backend) *Backend {
+	backend := lb.selectBackend(r, role, backends)
+	if backend == nil || lb.slowStart <= 0 || lb.strategy == StrategyWeighted {
+		return backend
+	}
+	if rand.Float64() < lb.warmupFactor(backend, time.Now()) {
+		return backend
+	}
+
+	others := make([]*Backend, 0, len(backends)-1)
+	for _, other := range backends {
+		if other != backend {
+			others = append(others, other)
+		}
+	}
+	if len(others) == 0 {
+		return backend
+	}
+	if alternative := lb.selectBackend(r, role, others); alternative != nil {
+		return alternative
+	}
+	return backend
+}
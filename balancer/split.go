@@ -0,0 +1,139 @@
+package balancer
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+)
+
+// SplitGroup is a group of backends receiving a share of the traffic
+type SplitGroup struct {
+	Name string
+	// Backends lists the indices of the backends in the group, as for
+	// Route
+	Backends []int
+	// Weight is the group's share relative to the other groups, e.g. 95
+	// and 5 for a 95/5 split
+	Weight int
+}
+
+// TrafficSplit divides the requests that match no route between backend
+// groups, e.g. to roll a new version out gradually. Each request is first
+// assigned a group, then balanced within it with the configured strategy.
+type TrafficSplit struct {
+	Groups []SplitGroup
+	// HashHeader names a header whose value assigns the group, e.g. a user
+	// ID, so the same value always lands in the same group. Requests
+	// without it are assigned by client IP.
+	HashHeader string
+	// Random assigns every request a group at random instead
+	Random bool
+}
+
+// splitGroup is a configured group whose weight can change at runtime
+type splitGroup struct {
+	name string
+	// backends holds backend IDs once bound, see bindPools
+	backends []int
+	weight   atomic.Int64
+	requests uint64
+}
+
+// WithTrafficSplit splits unrouted traffic between backend groups. Admin
+// requests pinned to the admin-capable backends are not affected.
+func WithTrafficSplit(split TrafficSplit) Option {
+	return func(lb *LoadBalancer) {
+		lb.split = split
+		lb.splitGroups = make([]*splitGroup, len(split.Groups))
+		for i, group := range split.Groups {
+			lb.splitGroups[i] = &splitGroup{name: group.Name, backends: group.Backends}
+			lb.splitGroups[i].weight.Store(int64(group.Weight))
+		}
+	}
+}
+
+// SetSplitWeights changes the weights of traffic split groups, by name,
+// while the balancer is running. Groups that are not listed keep theirs.
+func (lb *LoadBalancer) SetSplitWeights(weights map[string]int) error {
+	lb.adminMutex.Lock()
+	defer lb.adminMutex.Unlock()
+
+	for name, weight := range weights {
+		if weight < 0 {
+			return fmt.Errorf("weight of group %s must not be negative", name)
+		}
+		if lb.findSplitGroup(name) == nil {
+			return fmt.Errorf("traffic split group %s not found", name)
+		}
+	}
+	for name, weight := range weights {
+		lb.findSplitGroup(name).weight.Store(int64(weight))
+		lb.logger.Log(LevelInfo, "Traffic split weight changed", "group", name, "weight", weight)
+	}
+	return nil
+}
+
+// findSplitGroup returns the traffic split group with the given name
+func (lb *LoadBalancer) findSplitGroup(name string) *splitGroup {
+	for _, group := range lb.splitGroups {
+		if group.name == name {
+			return group
+		}
+	}
+	return nil
+}
+
+// splitPool assigns the request to a traffic split group and returns the
+// group's backends, or pool unchanged when no split applies
+func (lb *LoadBalancer) splitPool(r *http.Request, pool []int) []int {
+	var total int64
+	for _, group := range lb.splitGroups {
+		total += group.weight.Load()
+	}
+	if total <= 0 {
+		return pool
+	}
+
+	pick := lb.splitDraw(r, total)
+	for _, group := range lb.splitGroups {
+		pick -= group.weight.Load()
+		if pick < 0 {
+			atomic.AddUint64(&group.requests, 1)
+			lb.logRequest(r, LevelDebug, "Request assigned to traffic split group", "path", r.URL.Path, "group", group.name)
+			return group.backends
+		}
+	}
+	// The weights changed while drawing
+	return pool
+}
+
+// splitDraw returns a number in [0, total) for the request, random or
+// derived from its hash key
+func (lb *LoadBalancer) splitDraw(r *http.Request, total int64) int64 {
+	if lb.split.Random {
+		return rand.Int63n(total)
+	}
+	hash := fnv.New32a()
+	if key := r.Header.Get(lb.split.HashHeader); lb.split.HashHeader != "" && key != "" {
+		hash.Write([]byte(key))
+	} else if ip := lb.clientIP(r); ip != nil {
+		hash.Write(ip)
+	} else {
+		hash.Write([]byte(r.RemoteAddr))
+	}
+	return int64(hash.Sum32()) % total
+}
+
+// splitStats reports the weight and request count of each split group
+func (lb *LoadBalancer) splitStats() map[string]interface{} {
+	stats := make(map[string]interface{}, len(lb.splitGroups))
+	for _, group := range lb.splitGroups {
+		stats[group.name] = map[string]interface{}{
+			"weight":   group.weight.Load(),
+			"requests": atomic.LoadUint64(&group.requests),
+		}
+	}
+	return stats
+}
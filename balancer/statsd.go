@@ -0,0 +1,166 @@
+package balancer
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// maxStatsDPacket keeps each UDP datagram below a typical network MTU
+const maxStatsDPacket = 1432
+
+// StatsDExporter periodically pushes the balancer's metrics to a StatsD
+// server. It reads the same registry that backs the Prometheus endpoint:
+// counters are sent as the increase since the last push, gauges as their
+// current value and histograms as the mean observation of the interval.
+type StatsDExporter struct {
+	lb       *LoadBalancer
+	conn     net.Conn
+	previous map[string]float64
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// PushStatsD starts pushing metrics to the StatsD server at addr (host:port,
+// UDP) every interval
+func (lb *LoadBalancer) PushStatsD(addr string, interval time.Duration) (*StatsDExporter, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("statsd push interval must be positive")
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to statsd: %w", err)
+	}
+
+	exporter := &StatsDExporter{
+		lb:       lb,
+		conn:     conn,
+		previous: make(map[string]float64),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go exporter.run(interval)
+	lb.logger.Log(LevelInfo, "Pushing metrics to statsd", "addr", addr, "interval", interval.String())
+	return exporter, nil
+}
+
+// Close pushes a final batch and stops the exporter
+func (e *StatsDExporter) Close() error {
+	close(e.stop)
+	<-e.done
+	return e.conn.Close()
+}
+
+// run pushes on every tick until stopped
+func (e *StatsDExporter) run(interval time.Duration) {
+	defer close(e.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			e.push()
+		case <-e.stop:
+			e.push()
+			return
+		}
+	}
+}
+
+// push gathers the registry and sends it in as few packets as possible
+func (e *StatsDExporter) push() {
+	families, err := e.lb.metrics.registry.Gather()
+	if err != nil {
+		e.lb.logger.Log(LevelError, "Failed to gather metrics for statsd", "error", err)
+		return
+	}
+
+	var packet strings.Builder
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			for _, line := range e.lines(family, metric) {
+				if packet.Len() > 0 && packet.Len()+len(line)+1 > maxStatsDPacket {
+					e.send(packet.String())
+					packet.Reset()
+				}
+				if packet.Len() > 0 {
+					packet.WriteByte('\n')
+				}
+				packet.WriteString(line)
+			}
+		}
+	}
+	if packet.Len() > 0 {
+		e.send(packet.String())
+	}
+}
+
+// send writes one packet. StatsD is best effort, so failures are only logged.
+func (e *StatsDExporter) send(packet string) {
+	if _, err := e.conn.Write([]byte(packet)); err != nil {
+		e.lb.logger.Log(LevelWarn, "Failed to push metrics to statsd", "error", err)
+	}
+}
+
+// lines renders a single metric as StatsD lines
+func (e *StatsDExporter) lines(family *dto.MetricFamily, metric *dto.Metric) []string {
+	name := statsDName(family.GetName(), metric.GetLabel())
+
+	switch family.GetType() {
+	case dto.MetricType_COUNTER:
+		if delta := e.delta(name, metric.GetCounter().GetValue()); delta > 0 {
+			return []string{fmt.Sprintf("%s:%g|c", name, delta)}
+		}
+	case dto.MetricType_GAUGE:
+		return []string{fmt.Sprintf("%s:%g|g", name, metric.GetGauge().GetValue())}
+	case dto.MetricType_HISTOGRAM:
+		histogram := metric.GetHistogram()
+		count := e.delta(name+".count", float64(histogram.GetSampleCount()))
+		sum := e.delta(name+".sum", histogram.GetSampleSum())
+		if count > 0 {
+			return []string{
+				fmt.Sprintf("%s.count:%g|c", name, count),
+				fmt.Sprintf("%s:%g|ms", name, sum/count*1000),
+			}
+		}
+	}
+	return nil
+}
+
+// delta returns how much a cumulative value grew since the last push. A
+// value that went down, e.g. after a backend was removed and re-added,
+// counts from zero.
+func (e *StatsDExporter) delta(name string, value float64) float64 {
+	previous, seen := e.previous[name]
+	e.previous[name] = value
+	if !seen || value < previous {
+		return value
+	}
+	return value - previous
+}
+
+// statsDName flattens a metric name and its labels into a dotted StatsD
+// bucket, e.g. lb_backend_up.backend.http___localhost_8081
+func statsDName(name string, labels []*dto.LabelPair) string {
+	parts := []string{name}
+	for _, label := range labels {
+		parts = append(parts, sanitizeStatsD(label.GetName()), sanitizeStatsD(label.GetValue()))
+	}
+	return strings.Join(parts, ".")
+}
+
+// sanitizeStatsD replaces characters StatsD treats as separators
+func sanitizeStatsD(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-':
+			return r
+		default:
+			return '_'
+		}
+	}, value)
+}
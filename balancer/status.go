@@ -0,0 +1,27 @@
+package balancer
+
+import "sync/atomic"
+
+// statusClasses counts a backend's responses by status class, 2xx to 5xx
+type statusClasses struct {
+	counts [4]uint64
+}
+
+// record counts the status. Informational and invalid codes are ignored.
+func (s *statusClasses) record(status int) {
+	class := status/100 - 2
+	if class < 0 || class >= len(s.counts) {
+		return
+	}
+	atomic.AddUint64(&s.counts[class], 1)
+}
+
+// snapshot returns the counts keyed by class name
+func (s *statusClasses) snapshot() map[string]uint64 {
+	return map[string]uint64{
+		"2xx": atomic.LoadUint64(&s.counts[0]),
+		"3xx": atomic.LoadUint64(&s.counts[1]),
+		"4xx": atomic.LoadUint64(&s.counts[2]),
+		"5xx": atomic.LoadUint64(&s.counts[3]),
+	}
+}
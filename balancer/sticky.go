@@ -0,0 +1,63 @@
+package balancer
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// DefaultStickyCookieName is the cookie used to pin clients when no name is configured
+const DefaultStickyCookieName = "lb_backend"
+
+// WithStickySessions pins each client to the backend that served its first
+// request using a cookie holding the backend ID. An empty name uses
+// DefaultStickyCookieName.
+func WithStickySessions(cookieName string) Option {
+	return func(lb *LoadBalancer) {
+		if cookieName == "" {
+			cookieName = DefaultStickyCookieName
+		}
+		lb.stickyCookieName = cookieName
+	}
+}
+
+// stickyBackend returns the backend pinned by the request's sticky cookie,
+// or nil if there is no cookie or the pinned backend can no longer serve the
+// request
+func (lb *LoadBalancer) stickyBackend(r *http.Request, role string, pool []int) *Backend {
+	if lb.stickyCookieName == "" {
+		return nil
+	}
+	cookie, err := r.Cookie(lb.stickyCookieName)
+	if err != nil {
+		return nil
+	}
+	backendID, err := strconv.Atoi(cookie.Value)
+	if err != nil {
+		return nil
+	}
+
+	for _, backend := range lb.getBackends() {
+		if backend.ID != backendID {
+			continue
+		}
+		if !backend.isRoutable() || !containsBackend(lb.eligibleBackends(role, pool), backend) {
+			lb.logRequest(r, LevelInfo, "Sticky backend unavailable, selecting a new one", "backend", backendID)
+			return nil
+		}
+		lb.logRequest(r, LevelDebug, "Request routed to sticky backend", "role", role, "path", r.URL.Path, "backend", backendID)
+		return backend
+	}
+	return nil
+}
+
+// setStickyCookie pins the client to the given backend. Any cookie set for
+// an earlier failed attempt is replaced.
+func (lb *LoadBalancer) setStickyCookie(w http.ResponseWriter, backend *Backend) {
+	w.Header().Del("Set-Cookie")
+	http.SetCookie(w, &http.Cookie{
+		Name:     lb.stickyCookieName,
+		Value:    strconv.Itoa(backend.ID),
+		Path:     "/",
+		HttpOnly: true,
+	})
+}
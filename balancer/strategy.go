@@ -0,0 +1,240 @@
+package balancer
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+)
+
+// Strategy names a backend selection algorithm
+type Strategy string
+
+const (
+	// StrategyRoundRobin cycles through the backends in order
+	StrategyRoundRobin Strategy = "round-robin"
+	// StrategyLeastConnections picks the backend with the fewest active requests
+	StrategyLeastConnections Strategy = "least-connections"
+	// StrategyIPHash pins each client IP to a backend without cookies
+	StrategyIPHash Strategy = "ip-hash"
+	// StrategyConsistentHash maps a request key onto a hash ring so pool
+	// changes only move a small share of keys
+	StrategyConsistentHash Strategy = "consistent-hash"
+	// StrategyWeighted spreads requests in proportion to backend weights,
+	// reduced by the load backends report
+	StrategyWeighted Strategy = "weighted"
+	// StrategyWeightedLeastConnections picks the backend with the fewest
+	// active requests relative to its weight
+	StrategyWeightedLeastConnections Strategy = "weighted-least-connections"
+	// StrategyRandom picks an available backend at random
+	StrategyRandom Strategy = "random"
+	// StrategyPowerOfTwo picks two available backends at random and uses the
+	// one with fewer active requests
+	StrategyPowerOfTwo Strategy = "p2c"
+)
+
+// ParseStrategy validates a strategy name
+func ParseStrategy(name string) (Strategy, error) {
+	switch strategy := Strategy(name); strategy {
+	case StrategyRoundRobin, StrategyLeastConnections, StrategyIPHash, StrategyConsistentHash, StrategyWeighted, StrategyWeightedLeastConnections, StrategyRandom, StrategyPowerOfTwo:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("unknown strategy %q", name)
+	}
+}
+
+// WithStrategy selects the algorithm used to balance non-admin requests
+func WithStrategy(strategy Strategy) Option {
+	return func(lb *LoadBalancer) {
+		lb.strategy = strategy
+	}
+}
+
+// isAvailable reports whether the backend can take a new request right now
+func (b *Backend) isAvailable() bool {
+	return b.isRoutable() && b.hasCapacity()
+}
+
+// getWeight returns the backend's weight, which admins may change at runtime
+func (b *Backend) getWeight() int {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.Weight
+}
+
+// selectBackend applies the configured strategy to the candidates
+func (lb *LoadBalancer) selectBackend(r *http.Request, role string, backends []*Backend) *Backend {
+	return lb.strategySelector.Select(r, role, backends)
+}
+
+// builtinSelector returns the built-in strategy as a Selector, so the
+// strategies implement the same interface as a custom selector. Unknown
+// strategies fall back to round-robin.
+func (lb *LoadBalancer) builtinSelector(strategy Strategy) Selector {
+	switch strategy {
+	case StrategyLeastConnections:
+		return candidateSelector(lb.leastConnections)
+	case StrategyIPHash:
+		return requestSelector(lb.ipHash)
+	case StrategyConsistentHash:
+		return requestSelector(lb.consistentHash)
+	case StrategyWeighted:
+		return candidateSelector(lb.weighted)
+	case StrategyWeightedLeastConnections:
+		return candidateSelector(lb.weightedLeastConnections)
+	case StrategyRandom:
+		return candidateSelector(lb.random)
+	case StrategyPowerOfTwo:
+		return candidateSelector(lb.powerOfTwo)
+	default:
+		return candidateSelector(lb.roundRobin)
+	}
+}
+
+// candidateSelector adapts a strategy that only looks at the candidates
+func candidateSelector(pick func(backends []*Backend) *Backend) Selector {
+	return SelectorFunc(func(_ *http.Request, _ string, backends []*Backend) *Backend {
+		return pick(backends)
+	})
+}
+
+// requestSelector adapts a strategy that also keys on the request
+func requestSelector(pick func(r *http.Request, backends []*Backend) *Backend) Selector {
+	return SelectorFunc(func(r *http.Request, _ string, backends []*Backend) *Backend {
+		return pick(r, backends)
+	})
+}
+
+// roundRobin picks the next backend in turn, skipping unavailable ones
+func (lb *LoadBalancer) roundRobin(backends []*Backend) *Backend {
+	return rotate(&lb.roundRobinCount, backends)
+}
+
+// rotate advances the counter and returns the next available backend from
+// that position
+func rotate(counter *uint64, backends []*Backend) *Backend {
+	// Get the next backend index in a thread-safe manner. The modulo is taken
+	// against the snapshot so a shrinking slice can never index out of range.
+	nextIndex := int(atomic.AddUint64(counter, 1) % uint64(len(backends)))
+
+	// Try the selected backend and then others in sequence if it's not available
+	for i := 0; i < len(backends); i++ {
+		backend := backends[(nextIndex+i)%len(backends)]
+		if backend.isAvailable() {
+			return backend
+		}
+	}
+	return nil
+}
+
+// leastConnections picks the available backend with the fewest active
+// requests, preferring the earliest one on ties
+func (lb *LoadBalancer) leastConnections(backends []*Backend) *Backend {
+	var best *Backend
+	var bestActive int64
+	for _, backend := range backends {
+		if !backend.isAvailable() {
+			continue
+		}
+		active := atomic.LoadInt64(&backend.activeConnections)
+		if best == nil || active < bestActive {
+			best, bestActive = backend, active
+		}
+	}
+	return best
+}
+
+// weightedLeastConnections picks the available backend minimizing
+// (active+1)/weight, so a backend with twice the weight carries about twice
+// the requests and idle backends are filled heaviest first. Ties go to the
+// earliest backend.
+func (lb *LoadBalancer) weightedLeastConnections(backends []*Backend) *Backend {
+	var best *Backend
+	var bestLoad, bestWeight int64
+	for _, backend := range backends {
+		weight := int64(backend.getWeight())
+		if !backend.isAvailable() || weight <= 0 {
+			continue
+		}
+		load := atomic.LoadInt64(&backend.activeConnections) + 1
+		// load/weight < bestLoad/bestWeight without floating point
+		if best == nil || load*bestWeight < bestLoad*weight {
+			best, bestLoad, bestWeight = backend, load, weight
+		}
+	}
+	return best
+}
+
+// availableBackends returns the backends that can take a request right now
+func availableBackends(backends []*Backend) []*Backend {
+	available := make([]*Backend, 0, len(backends))
+	for _, backend := range backends {
+		if backend.isAvailable() {
+			available = append(available, backend)
+		}
+	}
+	return available
+}
+
+// random picks an available backend uniformly at random
+func (lb *LoadBalancer) random(backends []*Backend) *Backend {
+	available := availableBackends(backends)
+	if len(available) == 0 {
+		return nil
+	}
+	return available[rand.Intn(len(available))]
+}
+
+// powerOfTwo picks two distinct available backends at random and returns
+// the one with fewer active requests, the first one on ties. It gets close
+// to least-connections while only comparing two counters.
+func (lb *LoadBalancer) powerOfTwo(backends []*Backend) *Backend {
+	available := availableBackends(backends)
+	switch len(available) {
+	case 0:
+		return nil
+	case 1:
+		return available[0]
+	}
+	i := rand.Intn(len(available))
+	j := rand.Intn(len(available) - 1)
+	if j >= i {
+		j++
+	}
+	first, second := available[i], available[j]
+	if atomic.LoadInt64(&second.activeConnections) < atomic.LoadInt64(&first.activeConnections) {
+		return second
+	}
+	return first
+}
+
+// ipHash hashes the client IP onto the alive backends. If the chosen one is
+// at capacity the next alive backend is used, so the fallback is stable too.
+func (lb *LoadBalancer) ipHash(r *http.Request, backends []*Backend) *Backend {
+	alive := make([]*Backend, 0, len(backends))
+	for _, backend := range backends {
+		if backend.isRoutable() {
+			alive = append(alive, backend)
+		}
+	}
+	if len(alive) == 0 {
+		return nil
+	}
+
+	hash := fnv.New32a()
+	if ip := lb.clientIP(r); ip != nil {
+		hash.Write(ip)
+	} else {
+		hash.Write([]byte(r.RemoteAddr))
+	}
+	start := int(hash.Sum32() % uint32(len(alive)))
+
+	for i := 0; i < len(alive); i++ {
+		backend := alive[(start+i)%len(alive)]
+		if backend.hasCapacity() {
+			return backend
+		}
+	}
+	return nil
+}
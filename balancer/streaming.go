@@ -0,0 +1,66 @@
+package balancer
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// requestDeadline bounds a request like context.WithTimeout, except the
+// deadline can be lifted once a long-lived stream such as Server-Sent Events
+// has started, so the stream isn't cut off after the request timeout
+type requestDeadline struct {
+	context.Context
+	timer   *time.Timer
+	expired atomic.Bool
+}
+
+// requestDeadlineKey is the context key the request's deadline answers to
+type requestDeadlineKey struct{}
+
+// withRequestDeadline returns a context that is canceled with
+// context.DeadlineExceeded after timeout unless the deadline is lifted, and
+// a function releasing it
+func withRequestDeadline(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(parent)
+	d := &requestDeadline{Context: ctx}
+	d.timer = time.AfterFunc(timeout, func() {
+		d.expired.Store(true)
+		// The transport reports the cause, which must read as a timeout
+		cancel(context.DeadlineExceeded)
+	})
+	return d, func() {
+		d.timer.Stop()
+		cancel(nil)
+	}
+}
+
+func (d *requestDeadline) Err() error {
+	if d.expired.Load() {
+		return context.DeadlineExceeded
+	}
+	return d.Context.Err()
+}
+
+func (d *requestDeadline) Value(key interface{}) interface{} {
+	if key == (requestDeadlineKey{}) {
+		return d
+	}
+	return d.Context.Value(key)
+}
+
+// liftRequestDeadline stops the request deadline, if it hasn't passed yet
+func liftRequestDeadline(ctx context.Context) {
+	if d, ok := ctx.Value(requestDeadlineKey{}).(*requestDeadline); ok {
+		d.timer.Stop()
+	}
+}
+
+// isEventStream reports whether the response is a Server-Sent Events
+// stream. The reverse proxy flushes those after every write.
+func isEventStream(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
@@ -0,0 +1,110 @@
+package balancer
+
+import (
+	"context"
+	"net/http"
+)
+
+// DefaultTenantHeader carries the tenant ID to backends
+const DefaultTenantHeader = "X-Tenant-ID"
+
+// MaxTenantLength caps tenants read from the request header; longer ones
+// are ignored
+const MaxTenantLength = 64
+
+// OtherTenant labels the metrics of tenants that don't get their own series
+const OtherTenant = "other"
+
+// TenantConfig controls how the tenant of a request is determined and
+// passed on. The token's tenant claim always wins over the request header.
+type TenantConfig struct {
+	// Header is read for the tenant when the token has no tenant claim.
+	// Empty only trusts the claim.
+	Header string
+	// PropagateHeader carries the tenant to backends. Any value the client
+	// sent in it is replaced. Defaults to DefaultTenantHeader.
+	PropagateHeader string
+	// MetricTenants lists tenants that get their own metric series even
+	// when read from the header. Tenants from the token claim always do.
+	MetricTenants []string
+}
+
+// WithTenants tags each request with its tenant, forwards it to backends
+// and adds it to the request's log entries and per-tenant metrics. Since
+// clients choose the header freely, a tenant read from it is counted under
+// OtherTenant unless listed in MetricTenants, so it can't create unbounded
+// metric series.
+func WithTenants(cfg TenantConfig) Option {
+	return func(lb *LoadBalancer) {
+		if cfg.PropagateHeader == "" {
+			cfg.PropagateHeader = DefaultTenantHeader
+		}
+		lb.tenants = &cfg
+	}
+}
+
+// tenantKey is the context key for the request's tenant
+type tenantKey struct{}
+
+// requestTenant is the tenant of a request and the label of its metrics
+type requestTenant struct {
+	id    string
+	label string
+}
+
+// tenantFromContext returns the tenant attached to the request, if any
+func tenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(requestTenant)
+	return tenant.id
+}
+
+// tenantLabelFromContext returns the metrics label of the request's tenant,
+// if any
+func tenantLabelFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(requestTenant)
+	return tenant.label
+}
+
+// withTenant determines the request's tenant and attaches it to the request
+func (lb *LoadBalancer) withTenant(r *http.Request, claims *Claims) *http.Request {
+	if lb.tenants == nil {
+		return r
+	}
+	tenant := requestTenant{id: claims.Tenant, label: claims.Tenant}
+	if tenant.id == "" && lb.tenants.Header != "" {
+		tenant.id = r.Header.Get(lb.tenants.Header)
+		if len(tenant.id) > MaxTenantLength {
+			lb.logRequest(r, LevelDebug, "Tenant header too long, ignored", "length", len(tenant.id))
+			tenant.id = ""
+		}
+		tenant.label = lb.tenantLabel(tenant.id)
+	}
+	if tenant.id == "" {
+		return r
+	}
+	lb.metrics.tenantRequests.WithLabelValues(tenant.label).Inc()
+	return r.WithContext(context.WithValue(r.Context(), tenantKey{}, tenant))
+}
+
+// tenantLabel returns the metrics label for a tenant read from the header:
+// its own name if listed in MetricTenants, else OtherTenant
+func (lb *LoadBalancer) tenantLabel(tenant string) string {
+	for _, listed := range lb.tenants.MetricTenants {
+		if tenant == listed {
+			return tenant
+		}
+	}
+	return OtherTenant
+}
+
+// setTenantHeader replaces the tenant header of an outgoing request with the
+// tenant determined by the balancer
+func (lb *LoadBalancer) setTenantHeader(req *http.Request) {
+	if lb.tenants == nil {
+		return
+	}
+	req.Header.Del(lb.tenants.PropagateHeader)
+	if tenant := tenantFromContext(req.Context()); tenant != "" {
+		req.Header.Set(lb.tenants.PropagateHeader, tenant)
+	}
+}
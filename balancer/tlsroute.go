@@ -0,0 +1,65 @@
+package balancer
+
+import (
+	"crypto/x509"
+	"net/http"
+	"strings"
+)
+
+// MatchSNI returns a route matcher for TLS requests whose SNI server name is
+// one of names. Names are compared case-insensitively and a leading "*."
+// matches exactly one extra label, e.g. "*.example.com" matches
+// "api.example.com". Plain HTTP requests never match.
+func MatchSNI(names ...string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		if r.TLS == nil || r.TLS.ServerName == "" {
+			return false
+		}
+		serverName := strings.ToLower(r.TLS.ServerName)
+		for _, name := range names {
+			if matchServerName(strings.ToLower(name), serverName) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// matchServerName matches a server name against a name that may start with
+// a "*." wildcard
+func matchServerName(pattern, serverName string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		label, rest, found := strings.Cut(serverName, ".")
+		return found && label != "" && rest == suffix
+	}
+	return pattern == serverName
+}
+
+// MatchClientCertSubject returns a route matcher for requests presenting a
+// verified client certificate whose subject common name, or full subject in
+// RFC 2253 form such as "CN=billing,O=Acme", is one of subjects. Certificates
+// that were not verified against the client CA never match, so the listener
+// must be configured to verify them.
+func MatchClientCertSubject(subjects ...string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		cert := verifiedClientCert(r)
+		if cert == nil {
+			return false
+		}
+		for _, subject := range subjects {
+			if subject == cert.Subject.CommonName || subject == cert.Subject.String() {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// verifiedClientCert returns the client certificate of the request if it
+// chains to a trusted client CA
+func verifiedClientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
@@ -0,0 +1,202 @@
+package balancer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Protocols a backend may be configured to speak
+const (
+	ProtocolHTTP1 = "http1"
+	ProtocolHTTP2 = "http2"
+)
+
+// DefaultResponseHeaderTimeout is used when no response header timeout is configured
+const DefaultResponseHeaderTimeout = 30 * time.Second
+
+// DefaultRequestTimeout bounds a whole proxied request when no timeout is configured
+const DefaultRequestTimeout = 30 * time.Second
+
+// DefaultRemoveTimeout bounds how long RemoveBackend waits for in-flight
+// requests when no timeout is configured
+const DefaultRemoveTimeout = 30 * time.Second
+
+// DefaultDialTimeout bounds connecting to a backend when no timeout is
+// configured, well below the request timeout so a dead backend fails fast
+// and the request can be retried elsewhere
+const DefaultDialTimeout = 2 * time.Second
+
+// dialKeepAlive is the TCP keep-alive period of backend connections, as in
+// the net/http default transport
+const dialKeepAlive = 30 * time.Second
+
+// Idle connection defaults, well above the net/http ones (2 idle
+// connections per host) so a busy backend doesn't churn connections
+const (
+	DefaultMaxIdleConns        = 512
+	DefaultMaxIdleConnsPerHost = 256
+	DefaultIdleConnTimeout     = 90 * time.Second
+)
+
+// TransportConfig holds the settings applied to every backend's HTTP transport
+type TransportConfig struct {
+	// ResponseHeaderTimeout bounds the wait for response headers after the
+	// request is fully written. It does not cover dialing or reading the body.
+	ResponseHeaderTimeout time.Duration
+	// TLS is the base TLS configuration for https backends. Nil uses the
+	// system roots with full verification.
+	TLS *tls.Config
+	// RequestGzip lets the transport ask for gzip when the client did not
+	// and decompress the response for it
+	RequestGzip bool
+	// MaxResponseHeaderBytes caps the size of backend response headers.
+	// Zero uses the net/http default.
+	MaxResponseHeaderBytes int64
+	// MaxIdleConns and MaxIdleConnsPerHost cap the idle connections kept
+	// for reuse, IdleConnTimeout how long one is kept. Each backend has its
+	// own transport, so they apply per backend.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	// DisableKeepAlives opens a new connection for every request
+	DisableKeepAlives bool
+	// DialTimeout bounds establishing a new connection, TCP only; TLS
+	// handshakes have their own timeout. Reused connections are not
+	// affected. Zero leaves it to the request timeout and the OS.
+	DialTimeout time.Duration
+}
+
+// defaultTransportConfig returns the transport settings used when no options override them
+func defaultTransportConfig() TransportConfig {
+	return TransportConfig{
+		ResponseHeaderTimeout: DefaultResponseHeaderTimeout,
+		MaxIdleConns:          DefaultMaxIdleConns,
+		MaxIdleConnsPerHost:   DefaultMaxIdleConnsPerHost,
+		IdleConnTimeout:       DefaultIdleConnTimeout,
+		DialTimeout:           DefaultDialTimeout,
+	}
+}
+
+// newTransport builds a backend transport from the default transport, the
+// shared config and the backend's own TLS overrides
+func newTransport(cfg TransportConfig, backend BackendConfig) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = cfg.ResponseHeaderTimeout
+	transport.DisableCompression = !cfg.RequestGzip
+	if cfg.MaxResponseHeaderBytes > 0 {
+		transport.MaxResponseHeaderBytes = cfg.MaxResponseHeaderBytes
+	}
+	transport.MaxIdleConns = cfg.MaxIdleConns
+	transport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = cfg.IdleConnTimeout
+	transport.DisableKeepAlives = cfg.DisableKeepAlives
+	// The dial also gives up when the request's context ends, whichever
+	// comes first
+	transport.DialContext = (&net.Dialer{
+		Timeout:   cfg.DialTimeout,
+		KeepAlive: dialKeepAlive,
+	}).DialContext
+
+	tlsConfig, err := backendTLSConfig(cfg.TLS, backend)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	parsedURL, err := parseBackendURL(backend.URL)
+	if err != nil {
+		return nil, err
+	}
+	protocols, err := backendProtocols(backend, parsedURL)
+	if err != nil {
+		return nil, err
+	}
+	transport.Protocols = protocols
+	return transport, nil
+}
+
+// backendProtocols returns the protocols the transport may use for the
+// backend, nil for the net/http defaults. HTTP/2 over cleartext can't be
+// negotiated, so h2c backends are spoken to with prior knowledge.
+func backendProtocols(backend BackendConfig, backendURL *url.URL) (*http.Protocols, error) {
+	protocols := new(http.Protocols)
+	switch backend.Protocol {
+	case "":
+		return nil, nil
+	case ProtocolHTTP1:
+		protocols.SetHTTP1(true)
+	case ProtocolHTTP2:
+		if backendURL.Scheme == "https" {
+			protocols.SetHTTP2(true)
+		} else {
+			protocols.SetUnencryptedHTTP2(true)
+		}
+	default:
+		return nil, fmt.Errorf("unknown protocol %q, use %s or %s", backend.Protocol, ProtocolHTTP1, ProtocolHTTP2)
+	}
+	return protocols, nil
+}
+
+// backendTLSConfig layers the backend's CA bundle and verification setting
+// on top of the shared TLS config
+func backendTLSConfig(base *tls.Config, backend BackendConfig) (*tls.Config, error) {
+	if backend.CAFile == "" && !backend.InsecureSkipVerify {
+		return base, nil
+	}
+
+	var tlsConfig *tls.Config
+	if base != nil {
+		tlsConfig = base.Clone()
+	} else {
+		tlsConfig = &tls.Config{}
+	}
+	if backend.CAFile != "" {
+		pool, err := LoadCAPool(backend.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if backend.InsecureSkipVerify {
+		tlsConfig.InsecureSkipVerify = true
+	}
+	return tlsConfig, nil
+}
+
+// LoadCAPool reads a PEM bundle of CA certificates
+func LoadCAPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// isTimeoutError reports whether a proxy error was caused by a timeout
+func isTimeoutError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// isHeaderTooLargeError reports whether a proxy error was caused by the
+// backend's response headers exceeding the configured limit. net/http has no
+// sentinel for it, so the message is matched.
+func isHeaderTooLargeError(err error) bool {
+	return strings.Contains(err.Error(), "server response headers exceeded")
+}
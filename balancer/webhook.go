@@ -0,0 +1,186 @@
+package balancer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"sync/atomic"
+	"time"
+)
+
+// Delivery settings for health events
+const (
+	healthEventQueue    = 256
+	healthEventAttempts = 3
+	healthEventRetry    = 500 * time.Millisecond
+	healthEventTimeout  = 5 * time.Second
+)
+
+// HealthEvent is posted to the health webhook when a backend's effective
+// state changes, or after every check when all checks are reported
+type HealthEvent struct {
+	Time      time.Time `json:"time"`
+	Backend   string    `json:"backend"`
+	BackendID int       `json:"backendId"`
+	OldState  string    `json:"oldState"`
+	NewState  string    `json:"newState"`
+	// Probe is the result of this check, which the effective state only
+	// follows once it has been stable for the debounce window
+	Probe      string `json:"probe"`
+	FailCount  int    `json:"failCount"`
+	Transition bool   `json:"transition"`
+}
+
+// HealthWebhook posts health events as JSON to a URL. Events are queued so
+// the health checker never waits on the webhook; a failed post is retried a
+// few times and events are dropped when the queue is full.
+type HealthWebhook struct {
+	lb         *LoadBalancer
+	url        string
+	everyCheck bool
+	client     *http.Client
+	events     chan HealthEvent
+	stop       chan struct{}
+	done       chan struct{}
+
+	delivered uint64
+	failed    uint64
+	dropped   uint64
+}
+
+// PushHealthEvents starts posting health state transitions to url. With
+// everyCheck, the result of every check is posted as well.
+func (lb *LoadBalancer) PushHealthEvents(url string, everyCheck bool) (*HealthWebhook, error) {
+	if parsed, err := neturl.Parse(url); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid health webhook URL %q: must include scheme and host", url)
+	}
+
+	webhook := &HealthWebhook{
+		lb:         lb,
+		url:        url,
+		everyCheck: everyCheck,
+		client:     &http.Client{Timeout: healthEventTimeout},
+		events:     make(chan HealthEvent, healthEventQueue),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go webhook.run()
+	lb.healthWebhook.Store(webhook)
+	lb.logger.Log(LevelInfo, "Pushing health events to webhook", "url", url, "everyCheck", everyCheck)
+	return webhook, nil
+}
+
+// Close stops queueing new events and delivers the ones already queued,
+// without further retries
+func (h *HealthWebhook) Close() error {
+	h.lb.healthWebhook.CompareAndSwap(h, nil)
+	close(h.stop)
+	<-h.done
+	return nil
+}
+
+// Stats reports delivery progress
+func (h *HealthWebhook) Stats() map[string]interface{} {
+	return map[string]interface{}{
+		"pending":   len(h.events),
+		"delivered": atomic.LoadUint64(&h.delivered),
+		"failed":    atomic.LoadUint64(&h.failed),
+		"dropped":   atomic.LoadUint64(&h.dropped),
+	}
+}
+
+// notify queues an event without blocking
+func (h *HealthWebhook) notify(event HealthEvent) {
+	if !event.Transition && !h.everyCheck {
+		return
+	}
+	select {
+	case h.events <- event:
+	default:
+		atomic.AddUint64(&h.dropped, 1)
+		h.lb.logger.Log(LevelWarn, "Health event queue full, dropping event", "backend", event.BackendID)
+	}
+}
+
+// run delivers queued events until stopped
+func (h *HealthWebhook) run() {
+	defer close(h.done)
+	for {
+		select {
+		case event := <-h.events:
+			h.deliver(event)
+		case <-h.stop:
+			for {
+				select {
+				case event := <-h.events:
+					h.deliver(event)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliver posts an event, retrying with backoff unless the webhook is
+// closing
+func (h *HealthWebhook) deliver(event HealthEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	err = h.post(body)
+	backoff := healthEventRetry
+retry:
+	for attempt := 1; err != nil && attempt < healthEventAttempts; attempt++ {
+		select {
+		case <-time.After(backoff):
+		case <-h.stop:
+			break retry
+		}
+		backoff *= 2
+		err = h.post(body)
+	}
+	if err == nil {
+		atomic.AddUint64(&h.delivered, 1)
+		return
+	}
+	atomic.AddUint64(&h.failed, 1)
+	h.lb.logger.Log(LevelError, "Failed to deliver health event", "backend", event.BackendID, "newState", event.NewState, "error", err)
+}
+
+// post sends a single event
+func (h *HealthWebhook) post(body []byte) error {
+	resp, err := h.client.Post(h.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
+
+// reportHealth hands a check's outcome to the health webhook, if any
+func (lb *LoadBalancer) reportHealth(backend *Backend, wasAlive, alive, healthy bool, failCount int) {
+	webhook := lb.healthWebhook.Load()
+	if webhook == nil {
+		return
+	}
+	webhook.notify(HealthEvent{
+		Time:       time.Now(),
+		Backend:    backend.URL.String(),
+		BackendID:  backend.ID,
+		OldState:   healthStatus(wasAlive),
+		NewState:   healthStatus(alive),
+		Probe:      healthStatus(healthy),
+		FailCount:  failCount,
+		Transition: wasAlive != alive,
+	})
+}
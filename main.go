@@ -1,11 +1,19 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -15,51 +23,988 @@ import (
 func main() {
 	// Command line flags for configuration
 	port := flag.String("port", "8080", "Port to run the load balancer on")
-	backend1 := flag.String("backend1", "http://localhost:8081", "URL of backend server 1")
-	backend2 := flag.String("backend2", "http://localhost:8082", "URL of backend server 2")
-	backend3 := flag.String("backend3", "http://localhost:8083", "URL of backend server 3")
+	var backendURLs repeatedFlag
+	flag.Var(&backendURLs, "backend", "URL of a backend server; repeat for each backend, the first one handles admin requests")
+	backend1 := flag.String("backend1", "http://localhost:8081", "URL of backend server 1 (deprecated, use -backend)")
+	backend2 := flag.String("backend2", "http://localhost:8082", "URL of backend server 2 (deprecated, use -backend)")
+	backend3 := flag.String("backend3", "http://localhost:8083", "URL of backend server 3 (deprecated, use -backend)")
+	configFile := flag.String("config", "", "Path to a JSON or YAML file listing the backends (overrides -backend)")
 	logFile := flag.String("log", "", "Path to log file (empty for stdout)")
+	logMaxSize := flag.Int64("log-max-size", 0, "Rotate the -log and -access-log files before they exceed this many megabytes (0 disables)")
+	logRotateEvery := flag.Duration("log-rotate-every", 0, "Rotate the -log and -access-log files at this interval, e.g. 24h (0 disables)")
+	logMaxBackups := flag.Int("log-max-backups", 0, "Number of rotated log files to keep (0 keeps all)")
+	logCompress := flag.Bool("log-compress", false, "Gzip rotated log files")
+	logFormat := flag.String("log-format", "text", "Balancer log format: text or json")
+	logLevel := flag.String("log-level", string(balancer.LevelInfo), "Least severe balancer log entries written: debug, info, warn or error")
+	lameDuck := flag.Duration("lame-duck", 10*time.Second, "How long to keep serving after SIGTERM while /readyz reports not ready")
+	responseHeaderTimeout := flag.Duration("response-header-timeout", balancer.DefaultResponseHeaderTimeout, "Maximum time to wait for a backend's response headers (0 for no limit)")
+	trustedProxies := flag.String("trusted-proxies", "", "Comma-separated CIDRs of proxies whose X-Forwarded-For and X-Forwarded-Proto are trusted")
+	allowIPs := flag.String("allow-ips", "", "Comma-separated client IPs/CIDRs to allow (empty allows all)")
+	denyIPs := flag.String("deny-ips", "", "Comma-separated client IPs/CIDRs to deny")
+	stickyCookie := flag.String("sticky-cookie", "", "Enable sticky sessions using this cookie name (empty disables)")
+	maxConns := flag.Int("max-conns-per-backend", 0, "Maximum concurrent requests per backend (0 for unlimited)")
+	queueDepth := flag.Int("queue-depth", 0, "Requests allowed to wait when all backends are at capacity")
+	queueTimeout := flag.Duration("queue-timeout", 5*time.Second, "Maximum time a request waits in the overflow queue")
+	jwtAlgs := flag.String("jwt-algs", "HS256", "Comma-separated JWT signing algorithms to accept")
+	roleClaim := flag.String("role-claim", balancer.DefaultRoleClaim, "JWT claim holding the role, a string or an array; of several accepted roles the one ranked highest by -role-priority is used")
+	rolePriority := flag.String("role-priority", strings.Join(balancer.DefaultRolePriority, ","), "Comma-separated roles, highest privilege first, picking the role of tokens carrying several")
+	jwtLeeway := flag.Duration("jwt-leeway", 0, "Clock skew allowed when checking JWT exp, nbf and iat claims")
+	jwtPublicKey := flag.String("jwt-public-key", "", "PEM file with the RSA/ECDSA public key for verifying tokens")
+	jwksURL := flag.String("jwks-url", "", "JWKS URL to fetch RSA/ECDSA verification keys from by kid (add e.g. RS256 to -jwt-algs)")
+	jwksTTL := flag.Duration("jwks-ttl", balancer.DefaultJWKSTTL, "How long fetched JWKS keys are cached")
+	metricsPath := flag.String("metrics-path", "/metrics", "Path serving Prometheus metrics (empty disables)")
+	livezPath := flag.String("livez-path", balancer.DefaultLivenessPath, "Path answering liveness probes for the load balancer itself (empty disables)")
+	readyzPath := flag.String("readyz-path", balancer.DefaultReadinessPath, "Path answering readiness probes, failing when every backend is down (empty disables)")
+	recordFile := flag.String("record", "", "Record a sample of requests to this file for later replay")
+	recordSample := flag.Float64("record-sample", 0.01, "Fraction of requests to record")
+	recordMaxBody := flag.Int64("record-max-body", 4096, "Maximum bytes of each request body to record")
+	shadowBackend := flag.String("shadow-backend", "", "Backend URL to mirror a copy of requests to, discarding its responses (empty disables)")
+	shadowPercent := flag.Float64("shadow-percent", 100, "Percentage of requests mirrored to -shadow-backend")
+	shadowTimeout := flag.Duration("shadow-timeout", balancer.DefaultShadowTimeout, "Maximum time for each mirrored request")
+	shadowCredentials := flag.Bool("shadow-keep-credentials", false, "Forward the Authorization, Cookie and API key headers to -shadow-backend")
+	rateLimits := flag.String("rate-limits", "", "Per-role limits in requests/second, e.g. User=100,Client=20 (unlisted roles are unlimited)")
+	poolRateLimits := flag.String("pool-rate-limits", "", "Per-pool limits in requests/second by route name, e.g. default=1000 (unlisted pools are unlimited)")
+	maxHops := flag.Int("max-hops", 10, "Reject requests that passed through the balancer this many times (0 disables)")
+	backendCA := flag.String("backend-ca", "", "PEM bundle of CAs trusted for https backends")
+	backendInsecure := flag.Bool("backend-insecure-skip-verify", false, "Skip TLS verification for https backends (development only)")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file; serve HTTPS when set together with -tls-key")
+	tlsKey := flag.String("tls-key", "", "TLS private key file; serve HTTPS when set together with -tls-cert")
+	clientCA := flag.String("client-ca", "", "CA bundle used to verify client certificates presented over TLS")
+	clientCertRequired := flag.Bool("client-cert-required", false, "Reject TLS clients without a certificate signed by -client-ca at the handshake")
+	clientCertRole := flag.String("client-cert-role", "", "Role granted to requests with a verified client certificate and no JWT (empty always requires a JWT)")
+	sniRoutes := flag.String("sni-routes", "", "Route TLS requests by SNI name, e.g. api.example.com=0|1,*.internal.example.com=2 (0-based backend indices)")
+	certRoutes := flag.String("client-cert-routes", "", "Route requests by verified client certificate subject, e.g. billing=1|2 (requires -client-ca)")
+	retries := flag.Int("retries", 0, "Times a failed request is retried on another backend (admin requests only on other admin backends)")
+	serverTiming := flag.Bool("server-timing", false, "Add Server-Timing headers with backend and balancer durations")
+	accessRules := flag.String("access-rules", "", "Path prefixes restricted to roles, e.g. /admin/=Admin,/reports/=Admin|User")
+	headerRoutes := flag.String("header-routes", "", "Route requests carrying a header, e.g. X-Canary:true=3 for canaries or X-Beta=2 for any value (0-based backend indices)")
+	trafficSplit := flag.String("traffic-split", "", "Split unrouted traffic between backend groups, e.g. stable=0|1:95,canary=2:5 (0-based indices, relative weights)")
+	splitHeader := flag.String("traffic-split-header", "", "Header whose value assigns the -traffic-split group, instead of the client IP")
+	hostRoutes := flag.String("host-routes", "", "Route requests by Host header, e.g. foo.example.com=0|1,*.bar.example.com=2 (0-based backend indices)")
+	pathRoutes := flag.String("path-routes", "", "Route requests by path prefix, longest prefix first, e.g. /api/users=0|1,/api/orders=2 (0-based backend indices)")
+	defaultBackends := flag.String("default-backends", "", "Backend indices (0-based) serving requests that match no route, e.g. 0|1 (empty means every backend)")
+	rejectUnrouted := flag.Bool("reject-unrouted", false, "Answer requests that match no route, e.g. for an unknown host, with 404 instead of using the default backends")
+	roleRoutes := flag.String("role-routes", "", "Backend indices (0-based) per role, e.g. Admin=0,Auditor=1|2; only listed roles are accepted")
+	roleHomes := flag.String("role-homes", "", "Home backend index (0-based) per role, used whenever it is available, e.g. Admin=0,Client=2")
+	httpCheckTimeout := flag.Duration("health-timeout-http", balancer.DefaultHealthCheckTimeout, "Timeout of HTTP health checks")
+	tcpCheckTimeout := flag.Duration("health-timeout-tcp", balancer.DefaultHealthCheckTimeout, "Timeout of TCP connect health checks")
+	healthDebounce := flag.Duration("health-debounce", 0, "How long a backend's health must be stable before its state changes")
+	healthJitter := flag.Duration("health-jitter", 0, "Maximum random offset each health check is moved forward by, to spread probes out (0 disables)")
+	strategyName := flag.String("strategy", string(balancer.StrategyRoundRobin), "Balancing strategy: round-robin, least-connections, ip-hash, consistent-hash, weighted, weighted-least-connections, random or p2c")
+	virtualNodes := flag.Int("hash-virtual-nodes", balancer.DefaultVirtualNodes, "Virtual nodes per backend for consistent-hash")
+	hashKeyHeader := flag.String("hash-key-header", "", "Request header used as the consistent-hash key (default client IP)")
+	adminBalancingName := flag.String("admin-balancing", string(balancer.AdminFailover), "How admin requests use the admin backends: failover or round-robin")
+	adminRole := flag.String("admin-role", balancer.DefaultAdminRole, "Role whose requests are pinned to the admin backends and may use the admin API")
+	reserveAdmin := flag.Bool("reserve-admin", false, "Keep User and Client requests off the admin backends")
+	adminSocket := flag.String("admin-socket", "", "Path of a Unix socket for local admin commands (empty disables)")
+	defaultRole := flag.String("default-role", "", "Role assigned to valid tokens without a recognized role (empty rejects them); must be an accepted, non-admin role")
+	loadHeader := flag.String("load-header", "", "Response header backends report their load (0-1) in, e.g. "+balancer.DefaultLoadHeader+" (empty disables)")
+	loadHalfLife := flag.Duration("load-half-life", balancer.DefaultLoadHalfLife, "How quickly a reported backend load decays")
+	breakerThreshold := flag.Int("breaker-threshold", 0, "Consecutive failures that open a backend's circuit breaker (0 disables)")
+	breakerCooldown := flag.Duration("breaker-cooldown", balancer.DefaultBreakerCooldown, "How long an open circuit rejects traffic before a probe request")
+	dialTimeout := flag.Duration("dial-timeout", balancer.DefaultDialTimeout, "Maximum time to establish a connection to a backend (0 disables)")
+	requestTimeout := flag.Duration("request-timeout", balancer.DefaultRequestTimeout, "Deadline for a whole proxied request, including retries (0 disables)")
+	statsdAddr := flag.String("statsd", "", "StatsD server (host:port) to push metrics to over UDP (empty disables)")
+	statsdInterval := flag.Duration("statsd-interval", 10*time.Second, "How often metrics are pushed to StatsD")
+	healthWebhook := flag.String("health-webhook", "", "URL to POST a JSON event to whenever a backend goes up or down (empty disables)")
+	healthWebhookAll := flag.Bool("health-webhook-all-checks", false, "Also POST the result of every health check to -health-webhook")
+	tenants := flag.Bool("tenants", false, "Tag requests with the token's tenant claim and forward it to backends")
+	tenantHeader := flag.String("tenant-header", "", "Request header read for the tenant when the token has none (empty trusts only the claim)")
+	tenantPropagateHeader := flag.String("tenant-propagate-header", balancer.DefaultTenantHeader, "Header carrying the tenant to backends")
+	tenantMetrics := flag.String("tenant-metrics", "", "Comma-separated tenants read from -tenant-header that get their own metric series; others are counted as \"other\"")
+	debug := flag.Bool("debug", false, "Start with X-Debug-* routing headers on responses (toggle at runtime via the admin socket)")
+	backendGzip := flag.Bool("backend-gzip", false, "Ask backends for gzip even if the client does not accept it (decompressed for the client)")
+	decodedSizeMetrics := flag.Bool("decoded-size-metrics", false, "Decompress gzip/deflate responses on the side to record their decoded size")
+	completionLog := flag.String("completion-log", "", "File to append a JSON completion record per request to, e.g. for billing (empty disables)")
+	accessLogFile := flag.String("access-log", "", "File to append an access log line per request to, - for stdout (empty disables)")
+	accessLogFormat := flag.String("access-log-format", string(balancer.AccessLogCommon), "Access log format: common or combined")
+	drainLogInterval := flag.Duration("drain-log-interval", 5*time.Second, "How often to log the number of requests still draining during shutdown (0 disables)")
+	maxConnsPerIP := flag.Int("max-conns-per-ip", 0, "Maximum simultaneous connections per client IP, trusted proxies exempt (0 means unlimited)")
+	slowStart := flag.Duration("slow-start", 0, "Ramp traffic to a recovered backend up over this period (0 disables)")
+	maxIdleConns := flag.Int("max-idle-conns", balancer.DefaultMaxIdleConns, "Idle connections kept for reuse per backend (0 means no limit)")
+	maxIdleConnsPerHost := flag.Int("max-idle-conns-per-host", balancer.DefaultMaxIdleConnsPerHost, "Idle connections kept per backend host; net/http defaults to 2")
+	idleConnTimeout := flag.Duration("idle-conn-timeout", balancer.DefaultIdleConnTimeout, "How long an idle backend connection is kept (0 keeps it indefinitely)")
+	disableKeepAlives := flag.Bool("disable-keepalives", false, "Open a new backend connection for every request")
+	maxRequestBody := flag.Int64("max-request-body-bytes", 0, "Largest request body accepted, larger ones get 413 (0 means unlimited)")
+	maxResponseBody := flag.Int64("max-response-body-bytes", 0, "Largest backend response body passed on (0 means unlimited)")
+	var requestHeaders, responseHeaders repeatedFlag
+	flag.Var(&requestHeaders, "request-header", "Header rule for proxied requests: set:Name=value, add:Name=value or remove:Name; repeat to apply several in order")
+	flag.Var(&responseHeaders, "response-header", "Header rule for proxied responses, in the same form as -request-header")
+	publicURL := flag.String("public-url", "", "Public base URL of the load balancer, e.g. https://www.example.com; Location headers pointing at a backend are rewritten to it")
+	adminAPIPrefix := flag.String("admin-api-prefix", "", "Serve the backend admin API for admin-role tokens under this path, e.g. /lb (empty disables)")
+	outageRetryAfter := flag.Duration("outage-retry-after", balancer.DefaultOutageRetryAfter, "Retry-After sent when no backend is available (0 leaves it out)")
+	outageRetryJitter := flag.Duration("outage-retry-jitter", 0, "Maximum random time added to -outage-retry-after")
+	outageLogInterval := flag.Duration("outage-log-interval", balancer.DefaultOutageLogInterval, "Log requests failing for lack of a backend at most once per interval (0 logs each)")
+	removeTimeout := flag.Duration("remove-timeout", balancer.DefaultRemoveTimeout, "How long removing a backend waits for its in-flight requests to finish (0 waits indefinitely)")
+	tokenCookie := flag.String("token-cookie", "", "Cookie to read the JWT from when there is no Authorization header")
+	tokenQuery := flag.String("token-query-param", "", "Query parameter to read the JWT from when there is no Authorization header or token cookie")
+	corsOrigins := flag.String("cors-origins", "", "Comma-separated origins allowed to make cross-origin requests, * for any; enables CORS handling")
+	corsMethods := flag.String("cors-methods", strings.Join(balancer.DefaultCORSMethods, ","), "Comma-separated methods allowed in cross-origin requests")
+	corsHeaders := flag.String("cors-headers", strings.Join(balancer.DefaultCORSHeaders, ","), "Comma-separated request headers allowed in cross-origin requests")
+	corsExpose := flag.String("cors-expose-headers", "", "Comma-separated response headers exposed to cross-origin scripts")
+	corsCredentials := flag.Bool("cors-credentials", false, "Allow cross-origin requests with cookies")
+	corsMaxAge := flag.Duration("cors-max-age", 10*time.Minute, "How long browsers may cache CORS preflight responses")
+	maxResponseHeaderBytes := flag.Int64("max-response-header-bytes", 0, "Answer 502 when a backend's response headers exceed this many bytes (0 uses the 10 MB default)")
+	outlierErrorRate := flag.Float64("outlier-error-rate", 0, "Eject a backend whose share of 5xx/failed requests reaches this rate, e.g. 0.5 (0 disables)")
+	outlierWindow := flag.Duration("outlier-window", balancer.DefaultOutlierWindow, "Period the outlier error rate is measured over")
+	outlierMinRequests := flag.Int("outlier-min-requests", balancer.DefaultOutlierMinRequests, "Requests needed in the window before a backend can be ejected")
+	outlierEjection := flag.Duration("outlier-ejection", balancer.DefaultOutlierEjectionTime, "How long an outlier is kept out of rotation")
+	healthScoring := flag.String("health-scoring", "", "Scale weights by health score from check=W,errors=W,latency=W weights, e.g. check=1,errors=2,latency=1 (empty disables)")
+	latencyTarget := flag.Duration("latency-target", balancer.DefaultLatencyTarget, "Average latency above which a backend's health score drops")
+	bodyRewrite := flag.String("body-rewrite", "", "Replace strings in text response bodies, e.g. http://backend1.internal:8081=https://lb.example.com (empty disables)")
+	bodyRewriteMax := flag.Int64("body-rewrite-max-bytes", balancer.DefaultBodyRewriteMaxBytes, "Largest response body that is rewritten")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "Maximum time to wait for in-flight requests to finish on shutdown")
 	flag.Parse()
 
+	if *logFormat != "text" && *logFormat != "json" {
+		log.Fatalf("Invalid -log-format %q: must be text or json", *logFormat)
+	}
+	accessFormat, err := balancer.ParseAccessLogFormat(*accessLogFormat)
+	if err != nil {
+		log.Fatalf("Invalid -access-log-format: %v", err)
+	}
+	minLevel, err := balancer.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatalf("Invalid -log-level: %v", err)
+	}
+
+	// TLS needs both the certificate and the key
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatalf("Both -tls-cert and -tls-key must be set to enable TLS")
+	}
+
 	// Setup logger
-	var logger *log.Logger
-	if *logFile != "" {
+	rotation := balancer.RotationConfig{
+		MaxSize:    *logMaxSize << 20,
+		Interval:   *logRotateEvery,
+		MaxBackups: *logMaxBackups,
+		Compress:   *logCompress,
+	}
+	var logOutput io.Writer = os.Stdout
+	// rotating lists the log files rotated on SIGHUP
+	var rotating []*balancer.RotatingFile
+	if *logFile != "" && rotation.Enabled() {
+		file, err := balancer.OpenRotatingFile(*logFile, rotation)
+		if err != nil {
+			log.Fatalf("Failed to open log file: %v", err)
+		}
+		defer file.Close()
+		rotating = append(rotating, file)
+		logOutput = file
+	} else if *logFile != "" {
 		file, err := os.Create(*logFile)
 		if err != nil {
 			log.Fatalf("Failed to create log file: %v", err)
 		}
 		defer file.Close()
-		logger = log.New(file, "loadbalancer: ", log.LstdFlags)
+		logOutput = file
+	}
+	logger := log.New(logOutput, "loadbalancer: ", log.LstdFlags)
+
+	// Load the backend list, either from the config file or the individual flags
+	legacyBackends := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "backend1" || f.Name == "backend2" || f.Name == "backend3" {
+			legacyBackends = true
+		}
+	})
+	if legacyBackends && len(backendURLs) > 0 {
+		logger.Fatalf("-backend cannot be combined with -backend1..3")
+	}
+	if legacyBackends {
+		logger.Printf("-backend1..3 are deprecated and will be removed, use a repeated -backend flag instead")
+	}
+	var backends []balancer.BackendConfig
+	if *configFile != "" {
+		var err error
+		backends, err = balancer.LoadConfig(*configFile)
+		if err != nil {
+			logger.Fatalf("Failed to load config: %v", err)
+		}
 	} else {
-		logger = log.New(os.Stdout, "loadbalancer: ", log.LstdFlags)
+		if len(backendURLs) == 0 {
+			backendURLs = repeatedFlag{*backend1, *backend2, *backend3}
+		}
+		// First server is the only one that can handle admin requests
+		for i, backendURL := range backendURLs {
+			backends = append(backends, balancer.BackendConfig{URL: backendURL, Admin: i == 0})
+		}
+	}
+
+	// Parse client IP access control lists
+	trusted, err := balancer.ParseCIDRs(strings.Split(*trustedProxies, ","))
+	if err != nil {
+		logger.Fatalf("Invalid -trusted-proxies: %v", err)
+	}
+	allowlist, err := balancer.ParseCIDRs(strings.Split(*allowIPs, ","))
+	if err != nil {
+		logger.Fatalf("Invalid -allow-ips: %v", err)
+	}
+	denylist, err := balancer.ParseCIDRs(strings.Split(*denyIPs, ","))
+	if err != nil {
+		logger.Fatalf("Invalid -deny-ips: %v", err)
+	}
+
+	// Configure which token signing algorithms are accepted
+	validator := balancer.DefaultJWTValidator()
+	validator.Algorithms = strings.Split(*jwtAlgs, ",")
+	validator.DefaultRole = *defaultRole
+	validator.RoleClaim = *roleClaim
+	validator.Leeway = *jwtLeeway
+	if *rolePriority != "" {
+		validator.RolePriority = strings.Split(*rolePriority, ",")
+	}
+	if *jwtPublicKey != "" {
+		validator.PublicKey, err = balancer.LoadPublicKey(*jwtPublicKey)
+		if err != nil {
+			logger.Fatalf("Invalid -jwt-public-key: %v", err)
+		}
+	}
+	if *jwksURL != "" {
+		validator.JWKS = balancer.NewJWKS(*jwksURL, *jwksTTL)
+	}
+
+	roleLimits, err := parseRateLimits(*rateLimits)
+	if err != nil {
+		logger.Fatalf("Invalid -rate-limits: %v", err)
+	}
+	poolLimits, err := parseRateLimits(*poolRateLimits)
+	if err != nil {
+		logger.Fatalf("Invalid -pool-rate-limits: %v", err)
+	}
+
+	rules, err := parseAccessRules(*accessRules)
+	if err != nil {
+		logger.Fatalf("Invalid -access-rules: %v", err)
+	}
+
+	routesByRole, err := parseRoleRoutes(*roleRoutes)
+	if err != nil {
+		logger.Fatalf("Invalid -role-routes: %v", err)
+	}
+
+	homesByRole, err := parseRoleHomes(*roleHomes)
+	if err != nil {
+		logger.Fatalf("Invalid -role-homes: %v", err)
+	}
+
+	strategy, err := balancer.ParseStrategy(*strategyName)
+	if err != nil {
+		logger.Fatalf("Invalid -strategy: %v", err)
+	}
+
+	adminBalancing, err := balancer.ParseAdminBalancing(*adminBalancingName)
+	if err != nil {
+		logger.Fatalf("Invalid -admin-balancing: %v", err)
+	}
+
+	options := []balancer.Option{
+		balancer.WithStrategy(strategy),
+		balancer.WithAdminBalancing(adminBalancing),
+		balancer.WithAdminRole(*adminRole),
+		balancer.WithConsistentHash(*virtualNodes, *hashKeyHeader),
+		balancer.WithCircuitBreaker(*breakerThreshold, *breakerCooldown),
+		balancer.WithBackendLoadReporting(*loadHeader, *loadHalfLife),
+		balancer.WithRoleRoutes(routesByRole),
+		balancer.WithRoleHomeBackends(homesByRole),
+		balancer.WithAccessRules(rules...),
+		balancer.WithRoleRateLimits(roleLimits),
+		balancer.WithPoolRateLimits(poolLimits),
+		balancer.WithJWTValidator(validator),
+		balancer.WithTokenSources(*tokenCookie, *tokenQuery),
+		balancer.WithResponseHeaderTimeout(*responseHeaderTimeout),
+		balancer.WithRequestTimeout(*requestTimeout),
+		balancer.WithDialTimeout(*dialTimeout),
+		balancer.WithReservedAdminBackends(*reserveAdmin),
+		balancer.WithSlowStart(*slowStart),
+		balancer.WithOutlierDetection(balancer.OutlierConfig{
+			ErrorRate:    *outlierErrorRate,
+			Window:       *outlierWindow,
+			MinRequests:  *outlierMinRequests,
+			EjectionTime: *outlierEjection,
+		}),
+		balancer.WithMaxResponseHeaderBytes(*maxResponseHeaderBytes),
+		balancer.WithIdleConnections(*maxIdleConns, *maxIdleConnsPerHost, *idleConnTimeout),
+		balancer.WithKeepAlives(!*disableKeepAlives),
+		balancer.WithMaxRequestBodyBytes(*maxRequestBody),
+		balancer.WithMaxResponseBodyBytes(*maxResponseBody),
+		balancer.WithBackendGzip(*backendGzip),
+		balancer.WithDecodedSizeMetrics(*decodedSizeMetrics),
+		balancer.WithTrustedProxies(trusted),
+		balancer.WithIPAllowlist(allowlist),
+		balancer.WithIPDenylist(denylist),
+		balancer.WithMaxConnectionsPerBackend(*maxConns),
+		balancer.WithOverflowQueue(*queueDepth, *queueTimeout),
+		balancer.WithMetricsPath(*metricsPath),
+		balancer.WithAdminAPI(*adminAPIPrefix),
+		balancer.WithRemoveTimeout(*removeTimeout),
+		balancer.WithOutageRetryAfter(*outageRetryAfter, *outageRetryJitter),
+		balancer.WithOutageLogInterval(*outageLogInterval),
+		balancer.WithProbePaths(*livezPath, *readyzPath),
+		balancer.WithMaxHops(*maxHops),
+		balancer.WithRetries(*retries),
+		balancer.WithServerTiming(*serverTiming),
+		balancer.WithHealthDebounce(*healthDebounce),
+		balancer.WithHealthCheckJitter(*healthJitter),
+		balancer.WithHealthCheckTimeout(balancer.HealthCheckHTTP, *httpCheckTimeout),
+		balancer.WithHealthCheckTimeout(balancer.HealthCheckTCP, *tcpCheckTimeout),
+	}
+	if *healthScoring != "" {
+		scoring, err := parseHealthScoring(*healthScoring)
+		if err != nil {
+			logger.Fatalf("Invalid -health-scoring: %v", err)
+		}
+		scoring.LatencyTarget = *latencyTarget
+		options = append(options, balancer.WithHealthScoring(scoring))
+	}
+	if *bodyRewrite != "" {
+		rules, err := parseBodyRewriteRules(*bodyRewrite)
+		if err != nil {
+			logger.Fatalf("Invalid -body-rewrite: %v", err)
+		}
+		options = append(options, balancer.WithBodyRewrite(balancer.BodyRewriteConfig{
+			Rules:    rules,
+			MaxBytes: *bodyRewriteMax,
+		}))
+	}
+	if *publicURL != "" {
+		parsed, err := url.Parse(*publicURL)
+		if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			logger.Fatalf("Invalid -public-url %q: must be an absolute URL", *publicURL)
+		}
+		options = append(options, balancer.WithLocationRewrite(parsed))
+	}
+	requestRules, err := parseHeaderRules(requestHeaders)
+	if err != nil {
+		logger.Fatalf("Invalid -request-header: %v", err)
+	}
+	responseRules, err := parseHeaderRules(responseHeaders)
+	if err != nil {
+		logger.Fatalf("Invalid -response-header: %v", err)
+	}
+	options = append(options, balancer.WithHeaderRules(balancer.HeaderRules{
+		Request:  requestRules,
+		Response: responseRules,
+	}))
+	if *corsOrigins != "" {
+		options = append(options, balancer.WithCORS(balancer.CORSConfig{
+			AllowedOrigins:   splitList(*corsOrigins),
+			AllowedMethods:   splitList(*corsMethods),
+			AllowedHeaders:   splitList(*corsHeaders),
+			ExposedHeaders:   splitList(*corsExpose),
+			AllowCredentials: *corsCredentials,
+			MaxAge:           *corsMaxAge,
+		}))
+	}
+	if *tenants {
+		options = append(options, balancer.WithTenants(balancer.TenantConfig{
+			Header:          *tenantHeader,
+			PropagateHeader: *tenantPropagateHeader,
+			MetricTenants:   splitList(*tenantMetrics),
+		}))
+	}
+	if *logFormat == "json" {
+		options = append(options, balancer.WithLogger(balancer.NewJSONLogger(logOutput)))
+	}
+	options = append(options, balancer.WithLogLevel(minLevel))
+	if (*certRoutes != "" || *clientCertRequired || *clientCertRole != "") && *clientCA == "" {
+		logger.Fatalf("-client-cert-routes, -client-cert-required and -client-cert-role require -client-ca")
+	}
+	if *clientCA != "" && *tlsCert == "" {
+		logger.Fatalf("-client-ca needs TLS termination, set -tls-cert and -tls-key")
+	}
+	if *clientCertRole != "" {
+		options = append(options, balancer.WithClientCertAuth(*clientCertRole))
+	}
+	byHeader, err := parseHeaderRoutes(*headerRoutes)
+	if err != nil {
+		logger.Fatalf("Invalid -header-routes: %v", err)
+	}
+	var routes []balancer.Route
+	sni, err := parseNamedRoutes(*sniRoutes, "sni", balancer.MatchSNI)
+	if err != nil {
+		logger.Fatalf("Invalid -sni-routes: %v", err)
+	}
+	certs, err := parseNamedRoutes(*certRoutes, "cert", balancer.MatchClientCertSubject)
+	if err != nil {
+		logger.Fatalf("Invalid -client-cert-routes: %v", err)
+	}
+	routes = append(routes, certs...)
+	routes = append(routes, sni...)
+	if len(routes) > 0 && *tlsCert == "" {
+		logger.Fatalf("TLS routes need TLS termination, set -tls-cert and -tls-key")
+	}
+	byHost, err := parseNamedRoutes(*hostRoutes, "host", balancer.MatchHost)
+	if err != nil {
+		logger.Fatalf("Invalid -host-routes: %v", err)
+	}
+	routes = append(byHost, routes...)
+	routes = append(byHeader, routes...)
+	if len(routes) > 0 {
+		options = append(options, balancer.WithRoutes(routes...))
+	}
+	byPath, err := parsePathRoutes(*pathRoutes)
+	if err != nil {
+		logger.Fatalf("Invalid -path-routes: %v", err)
+	}
+	options = append(options, balancer.WithPathRoutes(byPath...))
+	if *trafficSplit != "" {
+		groups, err := parseSplitGroups(*trafficSplit)
+		if err != nil {
+			logger.Fatalf("Invalid -traffic-split: %v", err)
+		}
+		options = append(options, balancer.WithTrafficSplit(balancer.TrafficSplit{Groups: groups, HashHeader: *splitHeader}))
+	}
+	if *defaultBackends != "" || *rejectUnrouted {
+		policy := balancer.NoRoutePolicy{Reject: *rejectUnrouted}
+		if *defaultBackends != "" {
+			policy.DefaultBackends, err = parseIndices(*defaultBackends)
+			if err != nil {
+				logger.Fatalf("Invalid -default-backends: %v", err)
+			}
+		}
+		options = append(options, balancer.WithNoRoutePolicy(policy))
+	}
+	if *backendCA != "" || *backendInsecure {
+		tlsConfig := &tls.Config{InsecureSkipVerify: *backendInsecure}
+		if *backendCA != "" {
+			tlsConfig.RootCAs, err = balancer.LoadCAPool(*backendCA)
+			if err != nil {
+				logger.Fatalf("Invalid -backend-ca: %v", err)
+			}
+		}
+		if *backendInsecure {
+			logger.Printf("WARNING: TLS verification disabled for all https backends")
+		}
+		options = append(options, balancer.WithBackendTLSConfig(tlsConfig))
+	}
+	if *recordFile != "" {
+		file, err := os.Create(*recordFile)
+		if err != nil {
+			logger.Fatalf("Failed to create recording file: %v", err)
+		}
+		defer file.Close()
+		options = append(options, balancer.WithTrafficRecorder(balancer.NewTrafficRecorder(file, balancer.RecorderConfig{
+			SampleRate:        *recordSample,
+			MaxBodyBytes:      *recordMaxBody,
+			RedactQueryParams: splitList(*tokenQuery),
+		})))
+	}
+	if *stickyCookie != "" {
+		options = append(options, balancer.WithStickySessions(*stickyCookie))
+	}
+	if *shadowBackend != "" {
+		options = append(options, balancer.WithShadow(balancer.ShadowConfig{
+			URL:             *shadowBackend,
+			Percent:         *shadowPercent,
+			Timeout:         *shadowTimeout,
+			KeepCredentials: *shadowCredentials,
+		}))
+	}
+	var completions *balancer.CompletionEmitter
+	if *completionLog != "" {
+		file, err := os.OpenFile(*completionLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			logger.Fatalf("Failed to open completion log: %v", err)
+		}
+		defer file.Close()
+		completions = balancer.NewCompletionEmitter(balancer.NewJSONLinesSink(file))
+		options = append(options, balancer.WithCompletionRecords(completions))
+	}
+	switch *accessLogFile {
+	case "":
+	case "-":
+		options = append(options, balancer.WithAccessLog(os.Stdout, accessFormat))
+	default:
+		var file io.WriteCloser
+		if rotation.Enabled() {
+			var rotatingFile *balancer.RotatingFile
+			rotatingFile, err = balancer.OpenRotatingFile(*accessLogFile, rotation)
+			if err == nil {
+				rotating = append(rotating, rotatingFile)
+				file = rotatingFile
+			}
+		} else {
+			file, err = os.OpenFile(*accessLogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		}
+		if err != nil {
+			logger.Fatalf("Failed to open access log: %v", err)
+		}
+		defer file.Close()
+		options = append(options, balancer.WithAccessLog(file, accessFormat))
 	}
 
 	// Create load balancer
-	lb := balancer.NewLoadBalancer([]string{*backend1, *backend2, *backend3}, logger)
+	lb, err := balancer.NewLoadBalancer(backends, logger, options...)
+	if err != nil {
+		logger.Fatalf("Failed to create load balancer: %v", err)
+	}
+	if *debug {
+		lb.SetDebug(true)
+	}
 
-	// Start health check in a goroutine
-	go lb.HealthCheck(10 * time.Second)
+	// Local admin interface; reload re-reads the config file
+	if *adminSocket != "" {
+		var reload func() (balancer.ReloadResult, error)
+		if *configFile != "" {
+			reload = func() (balancer.ReloadResult, error) {
+				configs, err := balancer.LoadConfig(*configFile)
+				if err != nil {
+					return balancer.ReloadResult{}, err
+				}
+				return lb.Reload(configs)
+			}
+		}
+		socket, err := lb.ServeAdminSocket(*adminSocket, reload)
+		if err != nil {
+			logger.Fatalf("Failed to start admin socket: %v", err)
+		}
+		defer socket.Close()
+	}
+
+	if *statsdAddr != "" {
+		exporter, err := lb.PushStatsD(*statsdAddr, *statsdInterval)
+		if err != nil {
+			logger.Fatalf("Failed to start statsd exporter: %v", err)
+		}
+		defer exporter.Close()
+	}
+
+	if *healthWebhook != "" {
+		webhook, err := lb.PushHealthEvents(*healthWebhook, *healthWebhookAll)
+		if err != nil {
+			logger.Fatalf("Failed to start health webhook: %v", err)
+		}
+		defer webhook.Close()
+	}
+
+	// Start health check in a goroutine, stopped once the server is down
+	healthCtx, stopHealthCheck := context.WithCancel(context.Background())
+	defer stopHealthCheck()
+	go lb.HealthCheck(healthCtx, 10*time.Second)
 
 	// Setup server
 	server := &http.Server{
 		Addr:    ":" + *port,
 		Handler: lb,
 	}
+	if *clientCA != "" {
+		server.TLSConfig, err = balancer.ServerTLSConfig(*clientCA, *clientCertRequired)
+		if err != nil {
+			logger.Fatalf("Invalid -client-ca: %v", err)
+		}
+	}
+
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		logger.Fatalf("Could not listen on port %s: %v\n", *port, err)
+	}
+	if *maxConnsPerIP > 0 {
+		listener = lb.LimitConnectionsPerIP(listener, *maxConnsPerIP)
+	}
 
 	// Start server in a goroutine
 	go func() {
-		logger.Printf("Starting load balancer on port %s\n", *port)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if *tlsCert != "" {
+			logger.Printf("Starting load balancer with TLS on port %s\n", *port)
+			err = server.ServeTLS(listener, *tlsCert, *tlsKey)
+		} else {
+			logger.Printf("Starting load balancer on port %s\n", *port)
+			err = server.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
 			logger.Fatalf("Could not start server: %v\n", err)
 		}
 	}()
 
+	// SIGHUP starts new log files right away, e.g. after logrotate moved them
+	if len(rotating) > 0 {
+		go rotateOnSignal(logger, rotating)
+	}
+
 	// Wait for interrupt signal to gracefully shutdown the server
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
-	<-quit
+	sig := <-quit
+
+	// On SIGTERM enter lame-duck mode: keep serving in-flight and new
+	// requests while readiness fails, giving the orchestrator time to
+	// notice. A second signal skips the remaining grace period.
+	if sig == syscall.SIGTERM && *lameDuck > 0 {
+		lb.SetLameDuck(true)
+		logger.Printf("Received %v, entering lame-duck mode for %v\n", sig, *lameDuck)
+		select {
+		case <-time.After(*lameDuck):
+		case sig = <-quit:
+			logger.Printf("Received %v during lame-duck period, shutting down now\n", sig)
+		}
+	}
 	logger.Println("Shutting down server...")
-	
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	drained := make(chan struct{})
+	if *drainLogInterval > 0 {
+		go logDrainProgress(ctx, logger, lb, *drainLogInterval, drained)
+	}
+	err = server.Shutdown(ctx)
+	close(drained)
+	stopHealthCheck()
+	if err != nil {
+		logger.Printf("Graceful shutdown did not complete, %d requests still in flight: %v\n", lb.ActiveRequests(), err)
+	} else {
+		logger.Println("All in-flight requests drained")
+	}
+	if completions != nil {
+		if err := completions.Close(ctx); err != nil {
+			logger.Printf("Failed to flush completion records: %v\n", err)
+		}
+	}
+
 	logger.Println("Server stopped")
 }
 
+// rotateOnSignal rotates the log files on every SIGHUP
+func rotateOnSignal(logger *log.Logger, files []*balancer.RotatingFile) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		for _, file := range files {
+			if err := file.Rotate(); err != nil {
+				logger.Printf("Failed to rotate log file: %v\n", err)
+			}
+		}
+	}
+}
+
+// logDrainProgress logs how many requests are still in flight and how long
+// is left until the shutdown deadline, every interval until drained closes
+func logDrainProgress(ctx context.Context, logger *log.Logger, lb *balancer.LoadBalancer, interval time.Duration, drained <-chan struct{}) {
+	deadline, _ := ctx.Deadline()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	logger.Printf("Draining %d in-flight requests, timeout in %v\n", lb.ActiveRequests(), time.Until(deadline).Round(time.Second))
+	for {
+		select {
+		case <-ticker.C:
+			logger.Printf("Draining: %d requests still in flight, timeout in %v\n", lb.ActiveRequests(), time.Until(deadline).Round(time.Second))
+		case <-drained:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// parseRateLimits parses a comma-separated list of name=rate pairs, where
+// the name is a role or a pool
+func parseRateLimits(value string) (map[string]balancer.RateLimit, error) {
+	limits := make(map[string]balancer.RateLimit)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, rate, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected name=rate, got %q", pair)
+		}
+		perSecond, err := strconv.ParseFloat(rate, 64)
+		if err != nil || perSecond < 0 {
+			return nil, fmt.Errorf("invalid rate for %s: %q", name, rate)
+		}
+		limits[name] = balancer.RateLimit{Rate: perSecond}
+	}
+	return limits, nil
+}
+
+// parseNamedRoutes parses a comma-separated list of name=index|index routes
+// matched by name, such as SNI names or hosts. The name is split off at the
+// last "=" so certificate subjects may contain one.
+func parseNamedRoutes(value, kind string, match func(...string) func(*http.Request) bool) ([]balancer.Route, error) {
+	var routes []balancer.Route
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, "=")
+		if i <= 0 || i == len(pair)-1 {
+			return nil, fmt.Errorf("expected name=index|index, got %q", pair)
+		}
+		name, indices := pair[:i], pair[i+1:]
+		var backends []int
+		for _, index := range strings.Split(indices, "|") {
+			idx, err := strconv.Atoi(index)
+			if err != nil || idx < 0 {
+				return nil, fmt.Errorf("invalid backend index %q for %s", index, name)
+			}
+			backends = append(backends, idx)
+		}
+		routes = append(routes, balancer.Route{
+			Name:     kind + ":" + name,
+			Match:    match(name),
+			Backends: backends,
+		})
+	}
+	return routes, nil
+}
+
+// parseHeaderRoutes parses a comma-separated list of Name:value=index|index
+// routes. Without ":value" any request carrying the header matches.
+func parseHeaderRoutes(value string) ([]balancer.Route, error) {
+	var routes []balancer.Route
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, "=")
+		if i <= 0 || i == len(pair)-1 {
+			return nil, fmt.Errorf("expected Name:value=index|index, got %q", pair)
+		}
+		header, indices := pair[:i], pair[i+1:]
+		backends, err := parseIndices(indices)
+		if err != nil {
+			return nil, fmt.Errorf("%w for %s", err, header)
+		}
+		match := balancer.MatchHeader(header)
+		if name, want, ok := strings.Cut(header, ":"); ok {
+			match = balancer.MatchHeader(name, want)
+		}
+		routes = append(routes, balancer.Route{
+			Name:     "header:" + header,
+			Match:    match,
+			Backends: backends,
+		})
+	}
+	return routes, nil
+}
+
+// parsePathRoutes parses a comma-separated list of prefix=index|index routes
+func parsePathRoutes(value string) ([]balancer.PathRoute, error) {
+	var routes []balancer.PathRoute
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		prefix, indices, ok := strings.Cut(pair, "=")
+		if !ok || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("expected /prefix=index|index, got %q", pair)
+		}
+		backends, err := parseIndices(indices)
+		if err != nil {
+			return nil, fmt.Errorf("%w for %s", err, prefix)
+		}
+		routes = append(routes, balancer.PathRoute{Prefix: prefix, Backends: backends})
+	}
+	return routes, nil
+}
+
+// parseSplitGroups parses a comma-separated list of name=index|index:weight
+// traffic split groups
+func parseSplitGroups(value string) ([]balancer.SplitGroup, error) {
+	var groups []balancer.SplitGroup
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, rest, ok := strings.Cut(entry, "=")
+		indices, weight, hasWeight := strings.Cut(rest, ":")
+		if !ok || name == "" || !hasWeight {
+			return nil, fmt.Errorf("expected name=index|index:weight, got %q", entry)
+		}
+		backends, err := parseIndices(indices)
+		if err != nil {
+			return nil, fmt.Errorf("%w for %s", err, name)
+		}
+		w, err := strconv.Atoi(weight)
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("invalid weight %q for %s", weight, name)
+		}
+		groups = append(groups, balancer.SplitGroup{Name: name, Backends: backends, Weight: w})
+	}
+	return groups, nil
+}
+
+// parseIndices parses a |-separated list of 0-based backend indices
+func parseIndices(value string) ([]int, error) {
+	var indices []int
+	for _, index := range strings.Split(value, "|") {
+		idx, err := strconv.Atoi(index)
+		if err != nil || idx < 0 {
+			return nil, fmt.Errorf("invalid backend index %q", index)
+		}
+		indices = append(indices, idx)
+	}
+	return indices, nil
+}
+
+// parseHealthScoring parses comma-separated signal=weight pairs for the
+// check, errors and latency signals
+func parseHealthScoring(value string) (balancer.HealthScoring, error) {
+	var scoring balancer.HealthScoring
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		signal, weight, ok := strings.Cut(pair, "=")
+		if !ok {
+			return scoring, fmt.Errorf("expected signal=weight, got %q", pair)
+		}
+		w, err := strconv.ParseFloat(weight, 64)
+		if err != nil || w < 0 {
+			return scoring, fmt.Errorf("invalid weight for %s: %q", signal, weight)
+		}
+		switch signal {
+		case "check":
+			scoring.CheckWeight = w
+		case "errors":
+			scoring.ErrorWeight = w
+		case "latency":
+			scoring.LatencyWeight = w
+		default:
+			return scoring, fmt.Errorf("unknown signal %q", signal)
+		}
+	}
+	return scoring, nil
+}
+
+// parseBodyRewriteRules parses a comma-separated list of from=to pairs,
+// split at the first "="
+func parseBodyRewriteRules(value string) ([]balancer.BodyRewriteRule, error) {
+	var rules []balancer.BodyRewriteRule
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(pair, "=")
+		if !ok || from == "" {
+			return nil, fmt.Errorf("expected from=to, got %q", pair)
+		}
+		rules = append(rules, balancer.BodyRewriteRule{From: from, To: to})
+	}
+	return rules, nil
+}
+
+// parseAccessRules parses a comma-separated list of prefix=role|role rules
+func parseAccessRules(value string) ([]balancer.AccessRule, error) {
+	var rules []balancer.AccessRule
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		prefix, roles, ok := strings.Cut(pair, "=")
+		if !ok || prefix == "" || roles == "" {
+			return nil, fmt.Errorf("expected prefix=role|role, got %q", pair)
+		}
+		rules = append(rules, balancer.AccessRule{
+			PathPrefix: prefix,
+			Roles:      strings.Split(roles, "|"),
+		})
+	}
+	return rules, nil
+}
+
+// parseRoleHomes parses a comma-separated list of role=index pairs
+func parseRoleHomes(value string) (map[string]int, error) {
+	homes := make(map[string]int)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		role, index, ok := strings.Cut(pair, "=")
+		if !ok || role == "" {
+			return nil, fmt.Errorf("expected role=index, got %q", pair)
+		}
+		idx, err := strconv.Atoi(index)
+		if err != nil || idx < 0 {
+			return nil, fmt.Errorf("invalid backend index %q for role %s", index, role)
+		}
+		homes[role] = idx
+	}
+	return homes, nil
+}
+
+// parseRoleRoutes parses a comma-separated list of role=index|index mappings
+func parseRoleRoutes(value string) (map[string][]int, error) {
+	routes := make(map[string][]int)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		role, indices, ok := strings.Cut(pair, "=")
+		if !ok || role == "" {
+			return nil, fmt.Errorf("expected role=index|index, got %q", pair)
+		}
+		for _, index := range strings.Split(indices, "|") {
+			idx, err := strconv.Atoi(index)
+			if err != nil || idx < 0 {
+				return nil, fmt.Errorf("invalid backend index %q for role %s", index, role)
+			}
+			routes[role] = append(routes[role], idx)
+		}
+	}
+	return routes, nil
+}
+
+// splitList splits a comma separated flag value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseHeaderRules parses header rules such as "set:X-LB-Version=2",
+// "add:Via=lb" or "remove:X-Debug"
+func parseHeaderRules(specs []string) ([]balancer.HeaderRule, error) {
+	var rules []balancer.HeaderRule
+	for _, spec := range specs {
+		action, header, ok := strings.Cut(spec, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid rule %q, expected action:header", spec)
+		}
+		rule := balancer.HeaderRule{Action: balancer.HeaderAction(action)}
+		switch rule.Action {
+		case balancer.HeaderSet, balancer.HeaderAdd:
+			rule.Name, rule.Value, ok = strings.Cut(header, "=")
+			if !ok {
+				return nil, fmt.Errorf("invalid rule %q, expected %s:Name=value", spec, action)
+			}
+		case balancer.HeaderRemove:
+			rule.Name = header
+		default:
+			return nil, fmt.Errorf("invalid rule %q, action must be set, add or remove", spec)
+		}
+		if rule.Name = strings.TrimSpace(rule.Name); rule.Name == "" {
+			return nil, fmt.Errorf("invalid rule %q, header name missing", spec)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// repeatedFlag collects the values of a flag given several times
+type repeatedFlag []string
+
+func (f *repeatedFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *repeatedFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
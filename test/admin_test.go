@@ -0,0 +1,414 @@
+package test
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"loadBalancer/balancer"
+)
+
+func TestAdminSocketIdempotency(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: "http://127.0.0.1:1"}}, logger)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	var reloads int32
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	socket, err := lb.ServeAdminSocket(path, func() (balancer.ReloadResult, error) {
+		atomic.AddInt32(&reloads, 1)
+		return balancer.ReloadResult{Added: []string{"http://127.0.0.1:2"}}, nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to start admin socket: %v", err)
+	}
+	defer socket.Close()
+
+	send := func(command string) string {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Errorf("Failed to connect to admin socket: %v", err)
+			return ""
+		}
+		defer conn.Close()
+		fmt.Fprintln(conn, command)
+		reply, _ := bufio.NewReader(conn).ReadString('\n')
+		return strings.TrimSpace(reply)
+	}
+
+	// Duplicates of a keyed command, concurrent or retried, apply it once
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if reply := send("key=deploy-42 reload"); reply != "OK reloaded: 1 added, 0 replaced, 0 removed" {
+				t.Errorf("Expected the reload summary, got %q", reply)
+			}
+		}()
+	}
+	wg.Wait()
+	if reply := send("key=deploy-42 reload"); reply != "OK reloaded: 1 added, 0 replaced, 0 removed" {
+		t.Errorf("Expected the retried command to succeed, got %q", reply)
+	}
+	if n := atomic.LoadInt32(&reloads); n != 1 {
+		t.Errorf("Expected 1 reload for one key, got %d", n)
+	}
+
+	// A key belongs to its command and arguments
+	if reply := send("key=ops-7 disable 1"); reply != "OK disabled" {
+		t.Errorf("Expected the backend disabled, got %q", reply)
+	}
+	for _, command := range []string{"key=ops-7 enable 1", "key=ops-7 disable 2", "key=deploy-42 enable 1"} {
+		if reply := send(command); !strings.HasPrefix(reply, "ERR") || !strings.Contains(reply, "already used") {
+			t.Errorf("%s: expected the reused key refused, got %q", command, reply)
+		}
+	}
+	stats := lb.GetStats()["backends"].([]map[string]interface{})[0]
+	if stats["disabled"] != true {
+		t.Errorf("Expected the backend to stay disabled, got %v", stats["disabled"])
+	}
+	if reply := send("key=ops-7 disable 1"); reply != "OK disabled" {
+		t.Errorf("Expected the retried command answered, got %q", reply)
+	}
+
+	// Commands without a key are applied every time
+	send("reload")
+	send("reload")
+	if n := atomic.LoadInt32(&reloads); n != 3 {
+		t.Errorf("Expected 3 reloads, got %d", n)
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: "http://127.0.0.1:1", Admin: true}}, logger,
+		balancer.WithAdminAPI("/lb"),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	call := func(role, method, path, body string) (int, string) {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if role != "" {
+			token, err := balancer.GenerateJWT(role)
+			if err != nil {
+				t.Fatalf("Error generating token: %v", err)
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error calling %s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+	list := func() []map[string]interface{} {
+		status, body := call("Admin", "GET", "/lb/backends", "")
+		if status != http.StatusOK {
+			t.Fatalf("Expected %d listing backends, got %d: %s", http.StatusOK, status, body)
+		}
+		var backends []map[string]interface{}
+		if err := json.Unmarshal([]byte(body), &backends); err != nil {
+			t.Fatalf("Invalid backend list %q: %v", body, err)
+		}
+		return backends
+	}
+
+	// The API needs an Admin token
+	if status, _ := call("", "GET", "/lb/backends", ""); status != http.StatusUnauthorized {
+		t.Errorf("Expected %d without a token, got %d", http.StatusUnauthorized, status)
+	}
+	if status, _ := call("User", "GET", "/lb/backends", ""); status != http.StatusForbidden {
+		t.Errorf("Expected %d for a User token, got %d", http.StatusForbidden, status)
+	}
+
+	status, body := call("Admin", "POST", "/lb/backends", fmt.Sprintf(`{"url": %q, "weight": 3}`, backend.URL))
+	if status != http.StatusCreated {
+		t.Fatalf("Expected %d adding a backend, got %d: %s", http.StatusCreated, status, body)
+	}
+	if status, _ := call("Admin", "POST", "/lb/backends", fmt.Sprintf(`{"url": %q}`, backend.URL)); status != http.StatusConflict {
+		t.Errorf("Expected %d adding a backend twice, got %d", http.StatusConflict, status)
+	}
+	if status, _ := call("Admin", "POST", "/lb/backends", `{"url": "not a url"}`); status != http.StatusBadRequest {
+		t.Errorf("Expected %d for an invalid backend, got %d", http.StatusBadRequest, status)
+	}
+	backends := list()
+	if len(backends) != 2 || backends[1]["url"] != backend.URL || backends[1]["weight"] != 3.0 {
+		t.Fatalf("Unexpected backends after adding one: %v", backends)
+	}
+
+	// The new backend takes traffic
+	if status, body := sendWithRole(t, server.URL, "User"); status != http.StatusOK || body != "ok" {
+		t.Errorf("Expected the added backend to serve requests, got %d %q", status, body)
+	}
+
+	path := "/lb/backends?url=" + url.QueryEscape(backend.URL)
+	status, body = call("Admin", "PATCH", path, `{"draining": true, "weight": 5}`)
+	if status != http.StatusOK {
+		t.Fatalf("Expected %d patching a backend, got %d: %s", http.StatusOK, status, body)
+	}
+	backends = list()
+	if backends[1]["draining"] != true || backends[1]["weight"] != 5.0 {
+		t.Errorf("Expected the backend draining with weight 5, got %v", backends[1])
+	}
+	if status, _ := call("Admin", "PATCH", "/lb/backends?url=http://unknown:1", `{"draining": true}`); status != http.StatusNotFound {
+		t.Errorf("Expected %d patching an unknown backend, got %d", http.StatusNotFound, status)
+	}
+
+	if status, _ := call("Admin", "DELETE", path, ""); status != http.StatusNoContent {
+		t.Errorf("Expected %d removing a backend, got %d", http.StatusNoContent, status)
+	}
+	if backends := list(); len(backends) != 1 {
+		t.Errorf("Expected one backend left, got %v", backends)
+	}
+}
+
+func TestGracefulRemoveBackend(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("done"))
+	}))
+	defer backend.Close()
+
+	// start serves a load balancer in front of the backend and sends it a
+	// request, returning once the request has reached the backend
+	start := func(removeTimeout time.Duration) (*balancer.LoadBalancer, <-chan int) {
+		lb, err := balancer.NewLoadBalancer(
+			[]balancer.BackendConfig{{URL: backend.URL}},
+			logger,
+			balancer.WithRemoveTimeout(removeTimeout),
+		)
+		if err != nil {
+			t.Fatalf("Failed to create load balancer: %v", err)
+		}
+		server := httptest.NewServer(lb)
+		t.Cleanup(server.Close)
+
+		done := make(chan int, 1)
+		go func() {
+			token, _ := balancer.GenerateJWT("User")
+			req, _ := http.NewRequest("GET", server.URL+"/slow", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				done <- 0
+				return
+			}
+			resp.Body.Close()
+			done <- resp.StatusCode
+		}()
+		for deadline := time.Now().Add(2 * time.Second); lb.GetStats()["backends"].([]map[string]interface{})[0]["activeConnections"] != int64(1); time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Request never reached the backend")
+			}
+		}
+		return lb, done
+	}
+
+	// Requests outlasting the timeout keep the backend in the pool, draining
+	lb, first := start(100 * time.Millisecond)
+	if err := lb.RemoveBackend(backend.URL); !errors.Is(err, balancer.ErrBackendBusy) {
+		t.Errorf("Expected ErrBackendBusy once the timeout passed, got %v", err)
+	}
+	stats := lb.GetStats()["backends"].([]map[string]interface{})
+	if len(stats) != 1 || stats[0]["draining"] != true {
+		t.Errorf("Expected the backend kept and draining, got %v", stats)
+	}
+	release <- struct{}{}
+	if status := <-first; status != http.StatusOK {
+		t.Errorf("Expected the in-flight request to finish with %d, got %d", http.StatusOK, status)
+	}
+
+	// Without a timeout the backend is detached once its last request ends
+	lb, second := start(0)
+	removed := make(chan error, 1)
+	go func() {
+		removed <- lb.RemoveBackend(backend.URL)
+	}()
+	select {
+	case err := <-removed:
+		t.Fatalf("Expected removal to wait for the request in flight, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if n := len(lb.GetStats()["backends"].([]map[string]interface{})); n != 1 {
+		t.Errorf("Expected the backend to stay while its request is in flight, got %d backends", n)
+	}
+
+	release <- struct{}{}
+	if status := <-second; status != http.StatusOK {
+		t.Errorf("Expected the in-flight request to finish with %d, got %d", http.StatusOK, status)
+	}
+	select {
+	case err := <-removed:
+		if err != nil {
+			t.Errorf("Expected the backend to be removed, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Removal did not finish after the request did")
+	}
+	if n := len(lb.GetStats()["backends"].([]map[string]interface{})); n != 0 {
+		t.Errorf("Expected no backends left, got %d", n)
+	}
+}
+
+func TestReloadDrainsRemovedBackends(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+	fresh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fresh"))
+	}))
+	defer fresh.Close()
+
+	lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: slow.URL}}, logger,
+		balancer.WithRemoveTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	done := make(chan int, 1)
+	go func() {
+		token, _ := balancer.GenerateJWT("User")
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			done <- 0
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	for deadline := time.Now().Add(2 * time.Second); lb.GetStats()["backends"].([]map[string]interface{})[0]["activeConnections"] != int64(1); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Request never reached the backend")
+		}
+	}
+
+	// A backend still busy once the timeout passes is kept, draining, and
+	// reported rather than dropped under its request
+	configs := []balancer.BackendConfig{{URL: fresh.URL}}
+	if _, err := lb.Reload(configs); !errors.Is(err, balancer.ErrBackendBusy) {
+		t.Errorf("Expected ErrBackendBusy for the busy backend, got %v", err)
+	}
+	stats := lb.GetStats()["backends"].([]map[string]interface{})
+	if len(stats) != 2 || stats[0]["draining"] != true {
+		t.Fatalf("Expected the busy backend kept and draining next to the new one, got %v", stats)
+	}
+	if _, body := sendWithRole(t, server.URL, "User"); body != "fresh" {
+		t.Errorf("Expected new requests on the new backend, got %q", body)
+	}
+
+	close(release)
+	if status := <-done; status != http.StatusOK {
+		t.Errorf("Expected the in-flight request to finish with %d, got %d", http.StatusOK, status)
+	}
+
+	// Once idle it is removed by the next reload
+	if _, err := lb.Reload(configs); err != nil {
+		t.Errorf("Expected the reload to succeed, got %v", err)
+	}
+	stats = lb.GetStats()["backends"].([]map[string]interface{})
+	if len(stats) != 1 || stats[0]["url"] != fresh.URL {
+		t.Errorf("Expected only the new backend left, got %v", stats)
+	}
+}
+
+func TestReloadReplacesChangedBackends(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	})
+	routed := httptest.NewServer(echo)
+	defer routed.Close()
+	other := httptest.NewServer(echo)
+	defer other.Close()
+
+	configs := []balancer.BackendConfig{{URL: routed.URL}, {URL: other.URL}}
+	lb, err := balancer.NewLoadBalancer(configs, logger,
+		balancer.WithPathRoutes(balancer.PathRoute{Prefix: "/orders", Backends: []int{0}}))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+	if err := lb.DisableBackend(other.URL); err != nil {
+		t.Fatalf("Failed to disable backend: %v", err)
+	}
+
+	// Unchanged backends are left alone
+	result, err := lb.Reload(configs)
+	if err != nil || result.String() != "0 added, 0 replaced, 0 removed" {
+		t.Fatalf("Expected an unchanged reload to do nothing, got %v, %v", result, err)
+	}
+
+	changed := []balancer.BackendConfig{
+		{URL: routed.URL, Weight: 5, MaxConnections: 3, AddPrefix: "/v1"},
+		{URL: other.URL, Weight: 2},
+	}
+	result, err = lb.Reload(changed)
+	if err != nil {
+		t.Fatalf("Expected the reload to succeed, got %v", err)
+	}
+	if len(result.Replaced) != 2 || len(result.Added) != 0 || len(result.Removed) != 0 {
+		t.Errorf("Expected both backends reported replaced, got %+v", result)
+	}
+
+	// The new settings apply under the same IDs, and the operator's
+	// disabled flag carries over
+	stats := lb.GetStats()["backends"].([]map[string]interface{})
+	if stats[0]["id"] != 1 || stats[0]["weight"] != 5 || stats[0]["maxConnections"] != int64(3) {
+		t.Errorf("Expected backend 1 with weight 5 and 3 connections, got %v", stats[0])
+	}
+	if stats[1]["id"] != 2 || stats[1]["weight"] != 2 || stats[1]["disabled"] != true {
+		t.Errorf("Expected backend 2 disabled with weight 2, got %v", stats[1])
+	}
+
+	// The path route still names the replaced backend, which now adds its
+	// prefix
+	if code, body := sendWithRole(t, server.URL+"/orders/7", "User"); code != http.StatusOK || body != "/v1/orders/7" {
+		t.Errorf("Expected the route to reach the replaced backend with its prefix, got %d %q", code, body)
+	}
+
+	if result, err := lb.Reload(changed); err != nil || len(result.Replaced) != 0 {
+		t.Errorf("Expected a repeated reload to replace nothing, got %v, %v", result, err)
+	}
+}
@@ -0,0 +1,82 @@
+package test
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"loadBalancer/balancer"
+)
+
+// BenchmarkServeHTTP drives the load balancer's handler directly against
+// three local backends at increasing concurrency. Besides the usual ns/op
+// it reports req/s and the backend connections the run ended up with; a
+// connection count close to the concurrency means requests are waiting on
+// connections rather than on the backends.
+//
+//	go test ./test -run '^$' -bench ServeHTTP
+func BenchmarkServeHTTP(b *testing.B) {
+	logger := log.New(io.Discard, "", 0)
+
+	body := []byte("ok")
+	var configs []balancer.BackendConfig
+	for i := 0; i < 3; i++ {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(body)
+		}))
+		defer backend.Close()
+		configs = append(configs, balancer.BackendConfig{URL: backend.URL})
+	}
+
+	token, err := balancer.GenerateJWT("User")
+	if err != nil {
+		b.Fatalf("Error generating token: %v", err)
+	}
+
+	for _, concurrency := range []int{1, 8, 64, 256} {
+		b.Run(fmt.Sprintf("concurrency-%d", concurrency), func(b *testing.B) {
+			lb, err := balancer.NewLoadBalancer(configs, logger)
+			if err != nil {
+				b.Fatalf("Failed to create load balancer: %v", err)
+			}
+
+			var next int64
+			var failed int64
+			var wg sync.WaitGroup
+			b.ReportAllocs()
+			b.ResetTimer()
+			for g := 0; g < concurrency; g++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for atomic.AddInt64(&next, 1) <= int64(b.N) {
+						req := httptest.NewRequest("GET", "/bench", nil)
+						req.Header.Set("Authorization", "Bearer "+token)
+						rec := httptest.NewRecorder()
+						lb.ServeHTTP(rec, req)
+						if rec.Code != http.StatusOK {
+							atomic.AddInt64(&failed, 1)
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			b.StopTimer()
+
+			if failed > 0 {
+				b.Fatalf("%d of %d requests failed", failed, b.N)
+			}
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "req/s")
+			var open int64
+			for _, stats := range lb.GetStats()["backends"].([]map[string]interface{}) {
+				open += stats["openConnections"].(int64)
+			}
+			b.ReportMetric(float64(open), "conns")
+		})
+	}
+}
@@ -0,0 +1,607 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"loadBalancer/balancer"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	var failing atomic.Bool
+	failing.Store(true)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	cooldown := 100 * time.Millisecond
+	lb, err := balancer.NewLoadBalancer(
+		[]balancer.BackendConfig{{URL: backend.URL}},
+		logger,
+		balancer.WithCircuitBreaker(2, cooldown),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		if status, _ := sendWithRole(t, server.URL, "User"); status != http.StatusInternalServerError {
+			t.Fatalf("Expected backend error to pass through, got %d", status)
+		}
+	}
+
+	// The circuit is open, so the backend is not even tried
+	if status, _ := sendWithRole(t, server.URL, "User"); status != http.StatusServiceUnavailable {
+		t.Fatalf("Expected %d while the circuit is open, got %d", http.StatusServiceUnavailable, status)
+	}
+
+	// After the cooldown a successful probe closes the circuit again
+	failing.Store(false)
+	time.Sleep(cooldown)
+	for i := 0; i < 2; i++ {
+		if status, body := sendWithRole(t, server.URL, "User"); status != http.StatusOK {
+			t.Fatalf("Expected recovered backend to answer, got %d %q", status, body)
+		}
+	}
+}
+
+func TestOutlierEjection(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	healthy := httptest.NewServer(createBackendHandler(1, logger))
+	defer healthy.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	lb, err := balancer.NewLoadBalancer(
+		[]balancer.BackendConfig{{URL: healthy.URL}, {URL: failing.URL}},
+		logger,
+		balancer.WithOutlierDetection(balancer.OutlierConfig{
+			ErrorRate:    0.5,
+			MinRequests:  3,
+			EjectionTime: time.Minute,
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	// Round-robin alternates until the failing backend has enough requests
+	for i := 0; i < 6; i++ {
+		sendWithRole(t, server.URL, "User")
+	}
+	for i := 0; i < 4; i++ {
+		if status, _ := sendWithRole(t, server.URL, "User"); status != http.StatusOK {
+			t.Errorf("Expected the ejected backend to get no traffic, got %d", status)
+		}
+	}
+
+	stats := lb.GetStats()["backends"].([]map[string]interface{})
+	if stats[1]["ejected"] != true || stats[1]["ejections"] != 1 {
+		t.Errorf("Expected the failing backend to be ejected once, got %v", stats[1])
+	}
+	if stats[0]["ejected"] != false {
+		t.Error("Expected the healthy backend to stay in rotation")
+	}
+}
+
+func TestHealthCheckReusesConnections(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	var connections, probes int64
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&probes, 1)
+		w.Write([]byte("healthy"))
+	}))
+	backend.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&connections, 1)
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+
+	lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: backend.URL}}, logger)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		lb.HealthCheck(ctx, 5*time.Millisecond)
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Error("HealthCheck did not return after its context was cancelled")
+		}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&probes) < 20 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt64(&probes); n < 20 {
+		t.Fatalf("Expected at least 20 health checks, got %d", n)
+	}
+	// Closed and drained probe responses let one connection serve them all
+	if n := atomic.LoadInt64(&connections); n > 2 {
+		t.Errorf("Expected health checks to reuse their connection, %d were opened", n)
+	}
+}
+
+func TestHealthWebhook(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	var failing atomic.Bool
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("healthy"))
+	}))
+	defer backend.Close()
+
+	// The webhook rejects its first delivery, which must be retried
+	var mutex sync.Mutex
+	var posts int
+	var events []balancer.HealthEvent
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		posts++
+		if posts == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var event balancer.HealthEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("Invalid health event: %v", err)
+		}
+		events = append(events, event)
+	}))
+	defer webhook.Close()
+
+	lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: backend.URL}}, logger)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	hook, err := lb.PushHealthEvents(webhook.URL, false)
+	if err != nil {
+		t.Fatalf("Failed to start health webhook: %v", err)
+	}
+	defer hook.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lb.HealthCheck(ctx, 5*time.Millisecond)
+
+	received := func(n int) []balancer.HealthEvent {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			mutex.Lock()
+			got := append([]balancer.HealthEvent(nil), events...)
+			mutex.Unlock()
+			if len(got) >= n {
+				return got
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Expected %d health events", n)
+		return nil
+	}
+
+	// Healthy checks are not transitions and are not posted
+	time.Sleep(50 * time.Millisecond)
+	mutex.Lock()
+	if posts != 0 {
+		t.Errorf("Expected no health events while the backend is healthy, got %d posts", posts)
+	}
+	mutex.Unlock()
+
+	failing.Store(true)
+	down := received(1)[0]
+	if down.Backend != backend.URL || down.OldState != "up" || down.NewState != "down" || down.FailCount < 1 || !down.Transition {
+		t.Errorf("Unexpected down event: %+v", down)
+	}
+
+	failing.Store(false)
+	up := received(2)[1]
+	if up.OldState != "down" || up.NewState != "up" || up.FailCount != 0 {
+		t.Errorf("Unexpected up event: %+v", up)
+	}
+}
+
+func TestBackendStateChange(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	var failing atomic.Bool
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer backend.Close()
+
+	type change struct {
+		url      string
+		nowAlive bool
+	}
+	changes := make(chan change, 10)
+	var lb *balancer.LoadBalancer
+	lb, err := balancer.NewLoadBalancer(
+		[]balancer.BackendConfig{{URL: backend.URL}},
+		logger,
+		balancer.WithBackendStateChange(func(b *balancer.Backend, nowAlive bool) {
+			// Calling back into the balancer must not deadlock
+			lb.GetStats()
+			changes <- change{b.URL.String(), nowAlive}
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lb.HealthCheck(ctx, 5*time.Millisecond)
+
+	next := func() change {
+		select {
+		case c := <-changes:
+			return c
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No state change reported")
+			return change{}
+		}
+	}
+
+	// Passing checks are not transitions
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case c := <-changes:
+		t.Errorf("Expected no state change while the backend is healthy, got %+v", c)
+	default:
+	}
+
+	failing.Store(true)
+	if c := next(); c.url != backend.URL || c.nowAlive {
+		t.Errorf("Expected the backend reported down, got %+v", c)
+	}
+	// Further failing checks are not reported again
+	time.Sleep(50 * time.Millisecond)
+	failing.Store(false)
+	if c := next(); c.url != backend.URL || !c.nowAlive {
+		t.Errorf("Expected the backend reported up, got %+v", c)
+	}
+}
+
+func TestHealthCheckSchedule(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	var fastProbes, slowProbes int64
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&fastProbes, 1)
+	}))
+	defer fast.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&slowProbes, 1)
+	}))
+	defer slow.Close()
+
+	lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{
+		{URL: fast.URL, HealthCheckInterval: "10ms"},
+		{URL: slow.URL},
+	}, logger, balancer.WithHealthCheckJitter(40*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go lb.HealthCheck(ctx, 100*time.Millisecond)
+	time.Sleep(450 * time.Millisecond)
+	cancel()
+
+	// Jitter only brings checks forward, so the slow backend is checked at
+	// least once per 100ms and at most once per 50ms
+	if n := atomic.LoadInt64(&slowProbes); n < 4 || n > 9 {
+		t.Errorf("Expected 4 to 9 checks of the backend on the default interval, got %d", n)
+	}
+	if n := atomic.LoadInt64(&fastProbes); n < 20 {
+		t.Errorf("Expected at least 20 checks of the backend with a 10ms interval, got %d", n)
+	}
+
+	if _, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: fast.URL, HealthCheckInterval: "soon"}}, logger); err == nil {
+		t.Error("Expected an invalid health check interval to be rejected")
+	}
+}
+
+func TestHealthCheckBody(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	// The backend always answers 200 and reports its real health in the body
+	var status atomic.Value
+	status.Store("ok")
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status": "` + status.Load().(string) + `"}`))
+	}))
+	defer backend.Close()
+
+	lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{
+		{URL: backend.URL},
+		{URL: backend.URL + "/substring", HealthCheckBody: `"status": "ok"`},
+		{URL: backend.URL + "/pattern", HealthCheckBodyPattern: `"status":\s*"(ok|warming)"`},
+	}, logger)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lb.HealthCheck(ctx, 5*time.Millisecond)
+
+	waitForAlive := func(want ...bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			backends := lb.GetStats()["backends"].([]map[string]interface{})
+			matched := true
+			for i, alive := range want {
+				if backends[i]["isAlive"] != alive {
+					matched = false
+				}
+			}
+			if matched {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected backends alive %v, got %v, %v, %v", want, backends[0]["isAlive"], backends[1]["isAlive"], backends[2]["isAlive"])
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// A status-only check passes whatever the body says
+	status.Store("degraded")
+	waitForAlive(true, false, false)
+	status.Store("warming")
+	waitForAlive(true, false, true)
+	status.Store("ok")
+	waitForAlive(true, true, true)
+
+	_, err = balancer.NewLoadBalancer([]balancer.BackendConfig{
+		{URL: backend.URL, HealthCheckType: "tcp", HealthCheckBody: "ok"},
+	}, logger)
+	if err == nil {
+		t.Error("Expected a body check on a tcp health check to be rejected")
+	}
+	if err := balancer.ValidateBackendConfigs([]balancer.BackendConfig{{URL: backend.URL, HealthCheckBodyPattern: "("}}); err == nil {
+		t.Error("Expected an invalid body pattern to be rejected")
+	}
+}
+
+func TestHealthDebounce(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	// failNext is how many of the coming probes fail, -1 fails them all
+	var failNext, failed atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n := failNext.Load(); n != 0 {
+			failNext.CompareAndSwap(n, max(n-1, -1))
+			failed.Add(1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer backend.Close()
+
+	const debounce = 100 * time.Millisecond
+	changes := make(chan bool, 10)
+	lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: backend.URL}}, logger,
+		balancer.WithHealthDebounce(debounce),
+		balancer.WithBackendStateChange(func(b *balancer.Backend, nowAlive bool) {
+			changes <- nowAlive
+		}))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	state := func() (alive, raw bool) {
+		stats := lb.GetStats()["backends"].([]map[string]interface{})[0]
+		return stats["isAlive"].(bool), stats["rawAlive"].(bool)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lb.HealthCheck(ctx, 10*time.Millisecond)
+
+	// A single failed probe is recovered from before the window is up
+	failNext.Store(1)
+	time.Sleep(debounce + 50*time.Millisecond)
+	if failed.Load() != 1 {
+		t.Fatalf("Expected one failed probe, got %d", failed.Load())
+	}
+	select {
+	case alive := <-changes:
+		t.Errorf("Expected a single failed probe not to change the state, got alive=%v", alive)
+	default:
+	}
+	if alive, raw := state(); !alive || !raw {
+		t.Errorf("Expected the backend up after recovering, got alive=%v raw=%v", alive, raw)
+	}
+
+	// Failures that last the whole window take the backend down
+	failed.Store(0)
+	started := time.Now()
+	failNext.Store(-1)
+	for {
+		if alive, raw := state(); !raw {
+			if !alive && time.Since(started) < debounce {
+				t.Errorf("Expected the backend still up within the window")
+			}
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case alive := <-changes:
+		if alive {
+			t.Fatalf("Expected the backend reported down")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected consecutive failures to take the backend down")
+	}
+	if elapsed := time.Since(started); elapsed < debounce {
+		t.Errorf("Expected the backend to go down after the %v window, took %v", debounce, elapsed)
+	}
+	if n := failed.Load(); n < 2 {
+		t.Errorf("Expected several consecutive failed probes before going down, got %d", n)
+	}
+	if alive, raw := state(); alive || raw {
+		t.Errorf("Expected the backend down, got alive=%v raw=%v", alive, raw)
+	}
+}
+
+func TestHealthCheckTypes(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	// waitAlive waits until the backend at index reaches the state
+	waitAlive := func(lb *balancer.LoadBalancer, index int, alive bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for lb.GetStats()["backends"].([]map[string]interface{})[index]["isAlive"].(bool) != alive {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected backend %d to become alive=%v", index+1, alive)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// A TCP check only needs the port to accept connections, the listener
+	// doesn't speak HTTP
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// The stalled backends answer health checks after the delay
+	const delay = 300 * time.Millisecond
+	stalled := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(delay):
+		}
+	})
+	short := httptest.NewServer(stalled)
+	defer short.Close()
+	overridden := httptest.NewServer(stalled)
+	defer overridden.Close()
+
+	lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{
+		{URL: "http://" + listener.Addr().String(), HealthCheckType: "tcp"},
+		{URL: short.URL},
+		{URL: overridden.URL, HealthCheckTimeout: "2s"},
+	}, logger,
+		balancer.WithHealthCheckTimeout(balancer.HealthCheckHTTP, 50*time.Millisecond),
+		balancer.WithHealthCheckTimeout(balancer.HealthCheckTCP, time.Second))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lb.HealthCheck(ctx, 10*time.Millisecond)
+
+	// The HTTP timeout is shorter than the delay, so the backend is down,
+	// unless its own config allows it more time
+	waitAlive(lb, 1, false)
+	time.Sleep(2 * delay)
+	stats := lb.GetStats()["backends"].([]map[string]interface{})
+	if !stats[0]["isAlive"].(bool) {
+		t.Errorf("Expected the TCP backend to pass its check")
+	}
+	if !stats[2]["isAlive"].(bool) || stats[2]["failCount"].(int) != 0 {
+		t.Errorf("Expected the backend timeout to override the type's, got alive=%v failCount=%v", stats[2]["isAlive"], stats[2]["failCount"])
+	}
+
+	// Once nothing listens the TCP check fails
+	listener.Close()
+	waitAlive(lb, 0, false)
+}
+
+func TestUnresolvedBackend(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	var configs []balancer.BackendConfig
+	configs = append(configs, balancer.BackendConfig{URL: "http://backend.invalid:8080"})
+	for i := 2; i <= 3; i++ {
+		server := httptest.NewServer(createBackendHandler(i, logger))
+		defer server.Close()
+		configs = append(configs, balancer.BackendConfig{URL: server.URL})
+	}
+
+	// A name that doesn't resolve is no reason to refuse to start
+	lb, err := balancer.NewLoadBalancer(configs, logger)
+	if err != nil {
+		t.Fatalf("Expected the balancer to start with an unresolvable backend, got %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	stats := lb.GetStats()["backends"].([]map[string]interface{})
+	if !stats[0]["unresolved"].(bool) || stats[0]["isAlive"].(bool) {
+		t.Errorf("Expected the backend unresolved and down, got unresolved=%v alive=%v", stats[0]["unresolved"], stats[0]["isAlive"])
+	}
+	for i := 1; i <= 2; i++ {
+		if stats[i]["unresolved"].(bool) || !stats[i]["isAlive"].(bool) {
+			t.Errorf("Expected backend %d to be up, got unresolved=%v alive=%v", i+1, stats[i]["unresolved"], stats[i]["isAlive"])
+		}
+	}
+
+	// The other backends serve every request
+	served := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		code, body := sendWithRole(t, server.URL, "User")
+		if code != http.StatusOK {
+			t.Fatalf("Expected %d, got %d", http.StatusOK, code)
+		}
+		served[body]++
+	}
+	if served["Response from Backend 2"] == 0 || served["Response from Backend 3"] == 0 {
+		t.Errorf("Expected the resolvable backends to share the requests, got %v", served)
+	}
+	if count := lb.GetStats()["backends"].([]map[string]interface{})[0]["requestCount"].(uint64); count != 0 {
+		t.Errorf("Expected no requests for the unresolved backend, got %d", count)
+	}
+}
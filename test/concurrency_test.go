@@ -0,0 +1,111 @@
+package test
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"loadBalancer/balancer"
+)
+
+func TestOverflowQueueFairness(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	// Each backend holds its requests until released
+	started := make(chan string, 10)
+	release := []chan struct{}{make(chan struct{}), make(chan struct{})}
+	var configs []balancer.BackendConfig
+	for i := range release {
+		i := i
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- fmt.Sprintf("%d:%s", i, r.URL.Query().Get("req"))
+			<-release[i]
+		}))
+		defer server.Close()
+		configs = append(configs, balancer.BackendConfig{URL: server.URL})
+	}
+
+	lb, err := balancer.NewLoadBalancer(configs, logger,
+		balancer.WithMaxConnectionsPerBackend(1),
+		balancer.WithOverflowQueue(10, 5*time.Second),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+	// Let held requests finish before the servers shut down
+	defer func() {
+		for _, ch := range release {
+			select {
+			case <-ch:
+			default:
+				close(ch)
+			}
+		}
+	}()
+
+	token, err := balancer.GenerateJWT("User")
+	if err != nil {
+		t.Fatalf("Error generating token: %v", err)
+	}
+	send := func(req int) {
+		go func() {
+			r, _ := http.NewRequest("GET", fmt.Sprintf("%s/?req=%d", server.URL, req), nil)
+			r.Header.Set("Authorization", "Bearer "+token)
+			resp, err := http.DefaultClient.Do(r)
+			if err != nil {
+				t.Errorf("Error sending request %d: %v", req, err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	next := func() string {
+		select {
+		case s := <-started:
+			return s
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for a request to reach a backend")
+			return ""
+		}
+	}
+	waitForQueue := func(depth int64) {
+		deadline := time.Now().Add(5 * time.Second)
+		for lb.GetStats()["queueDepth"] != depth {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %d queued requests", depth)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	send(1)
+	first := next()
+	send(2)
+	second := next()
+	if first[0] == second[0] {
+		t.Fatalf("Expected the first two requests on different backends, got %s and %s", first, second)
+	}
+
+	// Both backends are saturated, so the next requests wait in order
+	send(3)
+	waitForQueue(1)
+	send(4)
+	waitForQueue(2)
+
+	// Whichever backend frees up first takes the queued requests, oldest
+	// first, while the other one is still busy
+	free := int(second[0] - '0')
+	close(release[free])
+	want := []string{fmt.Sprintf("%d:3", free), fmt.Sprintf("%d:4", free)}
+	for _, w := range want {
+		if got := next(); got != w {
+			t.Errorf("Expected %s next, got %s", w, got)
+		}
+	}
+}
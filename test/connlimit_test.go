@@ -0,0 +1,69 @@
+package test
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"loadBalancer/balancer"
+)
+
+func TestConnectionsPerIP(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: "http://127.0.0.1:1"}}, logger)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := &http.Server{Handler: lb}
+	go server.Serve(lb.LimitConnectionsPerIP(listener, 1))
+	defer server.Close()
+
+	// isOpen reports whether the server keeps the connection open
+	isOpen := func(conn net.Conn) bool {
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, err := conn.Read(make([]byte, 1))
+		netErr, ok := err.(net.Error)
+		return ok && netErr.Timeout()
+	}
+
+	first, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if !isOpen(first) {
+		t.Fatal("Expected the first connection to be accepted")
+	}
+
+	second, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer second.Close()
+	if isOpen(second) {
+		t.Error("Expected the second connection from the same IP to be refused")
+	}
+
+	// Closing the first connection frees the slot
+	first.Close()
+	time.Sleep(50 * time.Millisecond)
+	third, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer third.Close()
+	if !isOpen(third) {
+		t.Error("Expected a new connection once the first one closed")
+	}
+
+	if refused := lb.GetStats()["connectionsRefused"]; refused != uint64(1) {
+		t.Errorf("Expected 1 refused connection in stats, got %v", refused)
+	}
+}
@@ -0,0 +1,1348 @@
+package test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+
+	"loadBalancer/balancer"
+)
+
+func TestForwardingHeaders(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	received := make(chan http.Header, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	send := func(options ...balancer.Option) http.Header {
+		lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: backend.URL}}, logger, options...)
+		if err != nil {
+			t.Fatalf("Failed to create load balancer: %v", err)
+		}
+		server := httptest.NewServer(lb)
+		defer server.Close()
+
+		token, err := balancer.GenerateJWT("User")
+		if err != nil {
+			t.Fatalf("Error generating token: %v", err)
+		}
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			t.Fatalf("Error creating request: %v", err)
+		}
+		req.Header.Add("Authorization", "Bearer "+token)
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		req.Header.Set("X-Forwarded-Proto", "https")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error sending request: %v", err)
+		}
+		resp.Body.Close()
+		return <-received
+	}
+
+	// A client that is not a trusted proxy cannot inject forwarding headers
+	headers := send()
+	if got := headers.Get("X-Forwarded-For"); got != "127.0.0.1" {
+		t.Errorf("Expected untrusted X-Forwarded-For to be replaced, got %q", got)
+	}
+	if got := headers.Get("X-Real-IP"); got != "127.0.0.1" {
+		t.Errorf("Expected X-Real-IP 127.0.0.1, got %q", got)
+	}
+	if got := headers.Get("X-Forwarded-Proto"); got != "http" {
+		t.Errorf("Expected X-Forwarded-Proto http, got %q", got)
+	}
+
+	// A trusted proxy's headers are kept and the peer appended
+	loopback := []*net.IPNet{{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)}}
+	headers = send(balancer.WithTrustedProxies(loopback))
+	if got := headers.Get("X-Forwarded-For"); got != "203.0.113.7, 127.0.0.1" {
+		t.Errorf("Expected trusted X-Forwarded-For to be appended to, got %q", got)
+	}
+	if got := headers.Get("X-Real-IP"); got != "203.0.113.7" {
+		t.Errorf("Expected X-Real-IP 203.0.113.7, got %q", got)
+	}
+	if got := headers.Get("X-Forwarded-Proto"); got != "https" {
+		t.Errorf("Expected trusted X-Forwarded-Proto to be kept, got %q", got)
+	}
+}
+
+func TestTenantPropagation(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	received := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get(balancer.DefaultTenantHeader)
+	}))
+	defer backend.Close()
+
+	secret := []byte("tenant-test-secret")
+	validator := balancer.DefaultJWTValidator()
+	validator.Secret = secret
+	lb, err := balancer.NewLoadBalancer(
+		[]balancer.BackendConfig{{URL: backend.URL}},
+		logger,
+		balancer.WithJWTValidator(validator),
+		balancer.WithTenants(balancer.TenantConfig{Header: "X-Customer"}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	send := func(tenantClaim string, headers map[string]string) string {
+		claims := balancer.Claims{
+			Role:   "User",
+			Tenant: tenantClaim,
+			RegisteredClaims: jwt.RegisteredClaims{
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			},
+		}
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secret)
+		if err != nil {
+			t.Fatalf("Error signing token: %v", err)
+		}
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			t.Fatalf("Error creating request: %v", err)
+		}
+		req.Header.Add("Authorization", "Bearer "+token)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error sending request: %v", err)
+		}
+		resp.Body.Close()
+		return <-received
+	}
+
+	tests := []struct {
+		name    string
+		claim   string
+		headers map[string]string
+		want    string
+	}{
+		{"claim", "acme", nil, "acme"},
+		{"claim wins over header", "acme", map[string]string{"X-Customer": "globex"}, "acme"},
+		{"header fallback", "", map[string]string{"X-Customer": "globex"}, "globex"},
+		{"spoofed propagate header dropped", "", map[string]string{balancer.DefaultTenantHeader: "initech"}, ""},
+		{"header too long ignored", "", map[string]string{"X-Customer": strings.Repeat("x", balancer.MaxTenantLength+1)}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := send(tt.claim, tt.headers); got != tt.want {
+				t.Errorf("Expected backend to see tenant %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestTenantMetrics(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	validator := balancer.DefaultJWTValidator()
+	lb, err := balancer.NewLoadBalancer(
+		[]balancer.BackendConfig{{URL: backend.URL}},
+		logger,
+		balancer.WithTenants(balancer.TenantConfig{Header: "X-Customer", MetricTenants: []string{"globex"}}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	send := func(tenantClaim, header string) {
+		claims := balancer.Claims{
+			Role:   "User",
+			Tenant: tenantClaim,
+			RegisteredClaims: jwt.RegisteredClaims{
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			},
+		}
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(validator.Secret)
+		if err != nil {
+			t.Fatalf("Error signing token: %v", err)
+		}
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("X-Customer", header)
+		lb.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	send("acme", "")
+	send("", "globex")
+	// Made up tenants share one series however many there are
+	for i := 0; i < 5; i++ {
+		send("", "tenant-"+strconv.Itoa(i))
+	}
+
+	rec := httptest.NewRecorder()
+	lb.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	metrics := rec.Body.String()
+	for _, series := range []string{
+		`lb_tenant_requests_total{tenant="acme"} 1`,
+		`lb_tenant_requests_total{tenant="globex"} 1`,
+		`lb_tenant_requests_total{tenant="other"} 5`,
+		`lb_tenant_request_duration_seconds_count{tenant="other"} 5`,
+	} {
+		if !strings.Contains(metrics, series) {
+			t.Errorf("Expected %s in the metrics", series)
+		}
+	}
+	if strings.Contains(metrics, `tenant="tenant-`) {
+		t.Errorf("Expected header tenants not listed to get no series of their own")
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	received := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get(balancer.RequestIDHeader)
+	}))
+	defer backend.Close()
+
+	lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: backend.URL}}, logger)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	send := func(id string) (echoed, forwarded string) {
+		token, err := balancer.GenerateJWT("User")
+		if err != nil {
+			t.Fatalf("Error generating token: %v", err)
+		}
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			t.Fatalf("Error creating request: %v", err)
+		}
+		req.Header.Add("Authorization", "Bearer "+token)
+		if id != "" {
+			req.Header.Set(balancer.RequestIDHeader, id)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error sending request: %v", err)
+		}
+		resp.Body.Close()
+		return resp.Header.Get(balancer.RequestIDHeader), <-received
+	}
+
+	echoed, forwarded := send("")
+	if echoed == "" || echoed != forwarded {
+		t.Errorf("Expected a generated ID in both response and backend request, got %q and %q", echoed, forwarded)
+	}
+
+	echoed, forwarded = send("trace-abc-123")
+	if echoed != "trace-abc-123" || forwarded != "trace-abc-123" {
+		t.Errorf("Expected the client's ID to be kept, got %q and %q", echoed, forwarded)
+	}
+}
+
+func TestDebugHeaders(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	// The backend tries to emit a debug header of its own
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(balancer.DebugBackendHeader, "spoofed")
+	}))
+	defer backend.Close()
+
+	lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: backend.URL}}, logger)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	send := func() http.Header {
+		token, err := balancer.GenerateJWT("User")
+		if err != nil {
+			t.Fatalf("Error generating token: %v", err)
+		}
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			t.Fatalf("Error creating request: %v", err)
+		}
+		req.Header.Add("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error sending request: %v", err)
+		}
+		resp.Body.Close()
+		return resp.Header
+	}
+
+	if got := send().Get(balancer.DebugBackendHeader); got != "" {
+		t.Errorf("Expected no debug header with debug off, got %q", got)
+	}
+
+	lb.SetDebug(true)
+	headers := send()
+	if got := headers.Get(balancer.DebugBackendHeader); got != "1" {
+		t.Errorf("Expected %s 1, got %q", balancer.DebugBackendHeader, got)
+	}
+	if got := headers.Get(balancer.DebugStrategyHeader); got != string(balancer.StrategyRoundRobin) {
+		t.Errorf("Expected %s %s, got %q", balancer.DebugStrategyHeader, balancer.StrategyRoundRobin, got)
+	}
+	if got := headers.Get(balancer.DebugAttemptsHeader); got != "1" {
+		t.Errorf("Expected %s 1, got %q", balancer.DebugAttemptsHeader, got)
+	}
+}
+
+// flakySink fails its first delivery and records every later one
+type flakySink struct {
+	mutex   sync.Mutex
+	calls   int
+	records []balancer.CompletionRecord
+}
+
+func (s *flakySink) Emit(ctx context.Context, records []balancer.CompletionRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.calls++
+	if s.calls == 1 {
+		return errors.New("sink unavailable")
+	}
+	s.records = append(s.records, records...)
+	return nil
+}
+
+func TestCompletionRecords(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+
+	sink := &flakySink{}
+	emitter := balancer.NewCompletionEmitter(sink)
+	lb, err := balancer.NewLoadBalancer(
+		[]balancer.BackendConfig{{URL: backend.URL}},
+		logger,
+		balancer.WithCompletionRecords(emitter),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	claims := balancer.Claims{
+		Role: "User",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "alice",
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("your-secret-key-replace-in-production"))
+	if err != nil {
+		t.Fatalf("Error signing token: %v", err)
+	}
+
+	req, _ := http.NewRequest("POST", server.URL+"/upload", strings.NewReader("payload"))
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	// Rejected requests are recorded too
+	resp, err = http.Get(server.URL + "/upload")
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	// Close retries the batch the sink refused
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := emitter.Close(ctx); err != nil {
+		t.Fatalf("Failed to flush completion records: %v", err)
+	}
+
+	if len(sink.records) != 2 {
+		t.Fatalf("Expected 2 completion records, got %d", len(sink.records))
+	}
+	ok, rejected := sink.records[0], sink.records[1]
+	if ok.Status != http.StatusOK {
+		ok, rejected = rejected, ok
+	}
+	if ok.Subject != "alice" || ok.Status != http.StatusOK || ok.BytesIn != 7 || ok.BytesOut != 5 || ok.Backend != backend.URL || ok.RequestID == "" {
+		t.Errorf("Unexpected record for the proxied request: %+v", ok)
+	}
+	if rejected.Status != http.StatusUnauthorized || rejected.Backend != "" {
+		t.Errorf("Unexpected record for the rejected request: %+v", rejected)
+	}
+}
+
+func TestBodyRewrite(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/image" {
+			w.Header().Set("Content-Type", "image/png")
+		} else {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		}
+		w.Write([]byte(`{"next":"http://backend1.internal:8081/page/2"}`))
+	}))
+	defer backend.Close()
+
+	lb, err := balancer.NewLoadBalancer(
+		[]balancer.BackendConfig{{URL: backend.URL}},
+		logger,
+		balancer.WithBodyRewrite(balancer.BodyRewriteConfig{
+			Rules: []balancer.BodyRewriteRule{{From: "http://backend1.internal:8081", To: "https://lb.example.com"}},
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	if _, body := sendWithRole(t, server.URL+"/api", "User"); body != `{"next":"https://lb.example.com/page/2"}` {
+		t.Errorf("Expected the internal URL to be rewritten, got %s", body)
+	}
+	if _, body := sendWithRole(t, server.URL+"/image", "User"); body != `{"next":"http://backend1.internal:8081/page/2"}` {
+		t.Errorf("Expected other content types to pass through, got %s", body)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	var received int
+	var mu sync.Mutex
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		received++
+		mu.Unlock()
+		w.Header().Set("Access-Control-Allow-Origin", "https://backend.example.com")
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	lb, err := balancer.NewLoadBalancer(
+		[]balancer.BackendConfig{{URL: backend.URL}},
+		logger,
+		balancer.WithCORS(balancer.CORSConfig{
+			AllowedOrigins: []string{"https://app.example.com"},
+			MaxAge:         time.Minute,
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	preflight := func(origin, method, headers string) *http.Response {
+		req, _ := http.NewRequest("OPTIONS", server.URL+"/api", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", method)
+		if headers != "" {
+			req.Header.Set("Access-Control-Request-Headers", headers)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error sending preflight: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// Preflight requests are answered without a token or a backend
+	resp := preflight("https://app.example.com", "POST", "authorization, content-type")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected %d for an allowed preflight, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("Unexpected Access-Control-Allow-Origin %q", got)
+	}
+	if got := resp.Header.Get("Access-Control-Allow-Methods"); !strings.Contains(got, "POST") {
+		t.Errorf("Expected POST among the allowed methods, got %q", got)
+	}
+	if got := resp.Header.Get("Access-Control-Max-Age"); got != "60" {
+		t.Errorf("Expected Access-Control-Max-Age 60, got %q", got)
+	}
+
+	for _, c := range []struct{ origin, method, headers string }{
+		{"https://evil.example.com", "POST", ""},
+		{"https://app.example.com", "TRACE", ""},
+		{"https://app.example.com", "GET", "X-Custom"},
+	} {
+		resp := preflight(c.origin, c.method, c.headers)
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("Expected %d for preflight %v, got %d", http.StatusForbidden, c, resp.StatusCode)
+		}
+		if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "" {
+			t.Errorf("Expected no Access-Control-Allow-Origin for preflight %v, got %q", c, got)
+		}
+	}
+	mu.Lock()
+	if received != 0 {
+		t.Errorf("Expected preflight requests not to reach the backend, got %d", received)
+	}
+	mu.Unlock()
+
+	send := func(token string) *http.Response {
+		req, _ := http.NewRequest("GET", server.URL+"/api", nil)
+		req.Header.Set("Origin", "https://app.example.com")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error sending request: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// Other requests still need a token, and the rejection carries the CORS
+	// headers so scripts can read it
+	resp = send("")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected %d without a token, got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("Unexpected Access-Control-Allow-Origin %q on a rejection", got)
+	}
+
+	// The balancer's CORS headers replace the backend's
+	token, _ := balancer.GenerateJWT("User")
+	resp = send(token)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected %d with a token, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if got := resp.Header.Values("Access-Control-Allow-Origin"); len(got) != 1 || got[0] != "https://app.example.com" {
+		t.Errorf("Unexpected Access-Control-Allow-Origin %q on a proxied response", got)
+	}
+}
+
+func TestHeaderRules(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	received := make(chan http.Header, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+		w.Header().Set("X-Powered-By", "backend")
+		w.Header().Set("X-Internal-Host", "node-7")
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	lb, err := balancer.NewLoadBalancer(
+		[]balancer.BackendConfig{{URL: backend.URL}},
+		logger,
+		balancer.WithHeaderRules(balancer.HeaderRules{
+			Request: []balancer.HeaderRule{
+				{Action: balancer.HeaderRemove, Name: "x-debug"},
+				{Action: balancer.HeaderSet, Name: "x-lb-version", Value: "2"},
+				// Later rules see the result of earlier ones
+				{Action: balancer.HeaderSet, Name: "X-Env", Value: "staging"},
+				{Action: balancer.HeaderRemove, Name: "X-ENV"},
+				{Action: balancer.HeaderAdd, Name: "x-env", Value: "prod"},
+				{Action: balancer.HeaderAdd, Name: "Via", Value: "lb"},
+			},
+			Response: []balancer.HeaderRule{
+				{Action: balancer.HeaderRemove, Name: "x-powered-by"},
+				{Action: balancer.HeaderSet, Name: "X-Internal-Host", Value: "hidden"},
+			},
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	token, _ := balancer.GenerateJWT("User")
+	req, _ := http.NewRequest("GET", server.URL+"/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-Debug", "1")
+	req.Header.Set("X-LB-Version", "spoofed")
+	req.Header.Set("Via", "1.1 client-proxy")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	resp.Body.Close()
+
+	header := <-received
+	if header.Get("X-Debug") != "" {
+		t.Errorf("Expected X-Debug to be removed, got %q", header.Get("X-Debug"))
+	}
+	if got := header.Values("X-Lb-Version"); len(got) != 1 || got[0] != "2" {
+		t.Errorf("Expected X-LB-Version to be replaced with 2, got %q", got)
+	}
+	if got := header.Values("X-Env"); len(got) != 1 || got[0] != "prod" {
+		t.Errorf("Expected rules to apply in order leaving X-Env prod, got %q", got)
+	}
+	if got := header.Values("Via"); len(got) != 2 || got[1] != "lb" {
+		t.Errorf("Expected lb appended to Via, got %q", got)
+	}
+
+	if got := resp.Header.Get("X-Powered-By"); got != "" {
+		t.Errorf("Expected X-Powered-By to be removed, got %q", got)
+	}
+	if got := resp.Header.Get("X-Internal-Host"); got != "hidden" {
+		t.Errorf("Expected X-Internal-Host to be replaced, got %q", got)
+	}
+}
+
+func TestLocationRewrite(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", r.URL.Query().Get("to"))
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer backend.Close()
+
+	publicURL, _ := url.Parse("https://www.example.com/shop")
+	lb, err := balancer.NewLoadBalancer(
+		[]balancer.BackendConfig{{URL: backend.URL}},
+		logger,
+		balancer.WithLocationRewrite(publicURL),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	token, _ := balancer.GenerateJWT("User")
+	backendHost := strings.TrimPrefix(backend.URL, "http://")
+	for _, c := range []struct{ location, want string }{
+		{backend.URL + "/login?next=%2Fcart", "https://www.example.com/shop/login?next=%2Fcart"},
+		{"HTTP://" + strings.ToUpper(backendHost) + "/", "https://www.example.com/shop/"},
+		// Relative locations and other origins are left alone
+		{"/login", "/login"},
+		{"https://" + backendHost + "/login", "https://" + backendHost + "/login"},
+		{"https://auth.example.com/login", "https://auth.example.com/login"},
+	} {
+		req, _ := http.NewRequest("GET", server.URL+"/?to="+url.QueryEscape(c.location), nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Error sending request: %v", err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("Location"); got != c.want {
+			t.Errorf("Expected Location %s to become %s, got %s", c.location, c.want, got)
+		}
+	}
+}
+
+// lineWriter hands each write to a channel
+type lineWriter chan string
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestAccessLog(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Streamed in chunks, without a Content-Length
+		for i := 0; i < 3; i++ {
+			w.Write([]byte("chunk\n"))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer backend.Close()
+
+	lines := make(lineWriter, 10)
+	lb, err := balancer.NewLoadBalancer(
+		[]balancer.BackendConfig{{URL: backend.URL}},
+		logger,
+		balancer.WithAccessLog(lines, balancer.AccessLogCombined),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	next := func() string {
+		select {
+		case line := <-lines:
+			return line
+		case <-time.After(2 * time.Second):
+			t.Fatalf("No access log line written")
+			return ""
+		}
+	}
+
+	claims := balancer.Claims{
+		Role: "User",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "alice",
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("your-secret-key-replace-in-production"))
+	if err != nil {
+		t.Fatalf("Error signing token: %v", err)
+	}
+	req, _ := http.NewRequest("GET", server.URL+"/stream?q=1", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Referer", "https://example.com/")
+	req.Header.Set("User-Agent", `agent "quoted"`)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	line := next()
+	if !strings.HasPrefix(line, "127.0.0.1 - alice [") {
+		t.Errorf("Expected the client IP and subject to start the line, got %q", line)
+	}
+	want := `] "GET /stream?q=1 HTTP/1.1" 200 18 "https://example.com/" "agent \"quoted\""` + "\n"
+	if !strings.HasSuffix(line, want) {
+		t.Errorf("Expected the line to end with %q, got %q", want, line)
+	}
+	stamp := line[strings.Index(line, "[")+1 : strings.Index(line, "]")]
+	if _, err := time.Parse("02/Jan/2006:15:04:05 -0700", stamp); err != nil {
+		t.Errorf("Expected a Common Log Format timestamp, got %q", stamp)
+	}
+
+	// Requests the balancer rejects are logged too
+	resp, err = http.Get(server.URL + "/private")
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	resp.Body.Close()
+	line = next()
+	if !strings.Contains(line, `- - [`) || !strings.Contains(line, `"GET /private HTTP/1.1" 401 `) {
+		t.Errorf("Expected an anonymous 401 line, got %q", line)
+	}
+	if !strings.HasSuffix(line, `"-" "Go-http-client/1.1"`+"\n") {
+		t.Errorf("Expected a missing Referer to be logged as \"-\", got %q", line)
+	}
+}
+
+func TestPathPrefixRewrite(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RequestURI()))
+	}))
+	defer backend.Close()
+
+	lb, err := balancer.NewLoadBalancer(
+		[]balancer.BackendConfig{{URL: backend.URL, StripPrefix: "/api/", AddPrefix: "/v1/"}},
+		logger,
+	)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	for _, c := range []struct{ path, want string }{
+		{"/api/users?page=2", "/v1/users?page=2"},
+		{"/api", "/v1/"},
+		{"/api/", "/v1/"},
+		{"/", "/v1/"},
+		// Only whole segments are stripped
+		{"/apis/users", "/v1/apis/users"},
+		{"/users", "/v1/users"},
+		{"/api/files/a%2Fb", "/v1/files/a%2Fb"},
+	} {
+		status, body := sendWithRole(t, server.URL+c.path, "User")
+		if status != http.StatusOK || body != c.want {
+			t.Errorf("Expected %s to reach the backend as %s, got %d %s", c.path, c.want, status, body)
+		}
+	}
+
+	if _, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: backend.URL, AddPrefix: "v1"}}, logger); err == nil {
+		t.Error("Expected a prefix without a leading slash to be rejected")
+	}
+}
+
+func TestShadowTraffic(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	primaryBodies := make(chan string, 10)
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		primaryBodies <- string(body)
+		w.Write([]byte("primary"))
+	}))
+	defer primary.Close()
+
+	type mirrored struct {
+		method, uri, body, header, auth, cookie string
+	}
+	shadowed := make(chan mirrored, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		shadowed <- mirrored{r.Method, r.URL.RequestURI(), string(body), r.Header.Get(balancer.ShadowHeader), r.Header.Get("Authorization"), r.Header.Get("Cookie")}
+		// Whatever the shadow answers must not reach the client
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("shadow"))
+	}))
+	defer shadow.Close()
+
+	token, _ := balancer.GenerateJWT("User")
+	post := func(lb *balancer.LoadBalancer) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/orders?id=7", strings.NewReader("payload"))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Cookie", "session=secret")
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || rec.Body.String() != "primary" {
+			t.Errorf("Expected the primary's response, got %d %q", rec.Code, rec.Body.String())
+		}
+		if body := <-primaryBodies; body != "payload" {
+			t.Errorf("Expected the primary to get the body, got %q", body)
+		}
+	}
+
+	lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: primary.URL}}, logger,
+		balancer.WithShadow(balancer.ShadowConfig{URL: shadow.URL + "/v2", Percent: 100}))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	post(lb)
+	select {
+	case got := <-shadowed:
+		// The client's credentials stay with the regular backend
+		want := mirrored{"POST", "/v2/orders?id=7", "payload", "1", "", ""}
+		if got != want {
+			t.Errorf("Expected the shadow to get %+v, got %+v", want, got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shadow backend did not receive the mirrored request")
+	}
+
+	// Requests the balancer refuses are not mirrored
+	if err := lb.DisableBackend("1"); err != nil {
+		t.Fatalf("Failed to disable backend: %v", err)
+	}
+	req := httptest.NewRequest("POST", "/orders", strings.NewReader("payload"))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	lb.ServeHTTP(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected %d without a backend, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+	select {
+	case got := <-shadowed:
+		t.Errorf("Expected a refused request not to be mirrored, got %+v", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if mirroredCount := lb.GetStats()["shadow"].(map[string]interface{})["mirrored"]; mirroredCount != uint64(1) {
+		t.Errorf("Expected one mirrored request, got %v", mirroredCount)
+	}
+
+	// Credentials are forwarded only when asked for
+	keep, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: primary.URL}}, logger,
+		balancer.WithShadow(balancer.ShadowConfig{URL: shadow.URL, Percent: 100, KeepCredentials: true}))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	post(keep)
+	select {
+	case got := <-shadowed:
+		if got.auth != "Bearer "+token || got.cookie != "session=secret" {
+			t.Errorf("Expected the credentials forwarded, got %+v", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shadow backend did not receive the mirrored request")
+	}
+
+	// Nothing is mirrored at 0%
+	none, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: primary.URL}}, logger,
+		balancer.WithShadow(balancer.ShadowConfig{URL: shadow.URL, Percent: 0}))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	post(none)
+	select {
+	case got := <-shadowed:
+		t.Errorf("Expected nothing mirrored at 0%%, got %+v", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// A shadow that is down doesn't affect the client, the failure is only
+	// counted
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	failing, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: primary.URL}}, logger,
+		balancer.WithShadow(balancer.ShadowConfig{URL: down.URL, Percent: 100}))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	post(failing)
+	var stats map[string]interface{}
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		stats = failing.GetStats()["shadow"].(map[string]interface{})
+		if stats["failed"] == uint64(1) {
+			break
+		}
+	}
+	if stats["mirrored"] != uint64(1) || stats["failed"] != uint64(1) {
+		t.Errorf("Expected one mirrored and failed request, got %v", stats)
+	}
+
+	if _, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: primary.URL}}, logger,
+		balancer.WithShadow(balancer.ShadowConfig{URL: "not a url", Percent: 100})); err == nil {
+		t.Error("Expected an invalid shadow URL to be rejected")
+	}
+}
+
+func TestIPAllowDenyLists(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	backend := httptest.NewServer(createBackendHandler(1, logger))
+	defer backend.Close()
+
+	networks := func(values ...string) []*net.IPNet {
+		nets, err := balancer.ParseCIDRs(values)
+		if err != nil {
+			t.Fatalf("Failed to parse networks: %v", err)
+		}
+		return nets
+	}
+	token, _ := balancer.GenerateJWT("User")
+	send := func(lb *balancer.LoadBalancer, ip string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = net.JoinHostPort(ip, "40000")
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: backend.URL}}, logger,
+		balancer.WithIPAllowlist(networks("10.0.0.0/8", "192.168.1.5")),
+		balancer.WithIPDenylist(networks("10.1.0.0/16")))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+
+	tests := []struct {
+		ip     string
+		status int
+	}{
+		// Inside an allowed network or the allowed single host
+		{"10.2.3.4", http.StatusOK},
+		{"192.168.1.5", http.StatusOK},
+		// Outside every allowed network
+		{"192.168.1.6", http.StatusForbidden},
+		{"172.16.0.1", http.StatusForbidden},
+		// The deny list wins over an allow list that also matches
+		{"10.1.2.3", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if status := send(lb, tt.ip); status != tt.status {
+			t.Errorf("Client %s: expected %d, got %d", tt.ip, tt.status, status)
+		}
+	}
+
+	// Without an allow list everyone not denied gets in
+	denyOnly, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: backend.URL}}, logger,
+		balancer.WithIPDenylist(networks("2001:db8::/32")))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	if status := send(denyOnly, "203.0.113.7"); status != http.StatusOK {
+		t.Errorf("Expected a client outside the deny list to get in, got %d", status)
+	}
+	if status := send(denyOnly, "2001:db8::1"); status != http.StatusForbidden {
+		t.Errorf("Expected an IPv6 client in the denied network to be rejected, got %d", status)
+	}
+}
+
+func TestTrafficRecorderRedaction(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	received := make(chan *http.Request, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(strings.NewReader(string(body)))
+		received <- r
+		w.Write(body)
+	}))
+	defer backend.Close()
+
+	var recording strings.Builder
+	recorder := balancer.NewTrafficRecorder(&recording, balancer.RecorderConfig{
+		SampleRate:        1,
+		MaxBodyBytes:      1024,
+		RedactHeaders:     []string{"X-Session"},
+		RedactQueryParams: []string{"access_token"},
+	})
+	lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: backend.URL}}, logger, balancer.WithTrafficRecorder(recorder))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+
+	token, _ := balancer.GenerateJWT("User")
+	req := httptest.NewRequest("POST", "/orders?access_token=secret&page=2", strings.NewReader("payload"))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Proxy-Authorization", "Basic c2VjcmV0")
+	req.Header.Set("Cookie", "session=secret")
+	req.Header.Set("X-Api-Key", "secret")
+	req.Header.Set("x-session", "secret")
+	req.Header.Set("X-Trace", "kept")
+	rec := httptest.NewRecorder()
+	lb.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "payload" {
+		t.Fatalf("Expected the request to be proxied intact, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	// Only the recording is scrubbed, the backend sees the real request
+	forwarded := <-received
+	if forwarded.Header.Get("Authorization") != "Bearer "+token || forwarded.URL.Query().Get("access_token") != "secret" {
+		t.Errorf("Expected the backend to get the credentials unchanged, got %v", forwarded.URL)
+	}
+
+	recs, err := balancer.ReadRecording(strings.NewReader(recording.String()))
+	if err != nil || len(recs) != 1 {
+		t.Fatalf("Expected one recorded request, got %d: %v", len(recs), err)
+	}
+	recorded := recs[0]
+	for _, name := range []string{"Authorization", "Proxy-Authorization", "Cookie", "X-Api-Key", "X-Session"} {
+		if got := recorded.Headers.Get(name); got != "REDACTED" {
+			t.Errorf("Expected %s to be redacted, got %q", name, got)
+		}
+	}
+	if strings.Contains(recording.String(), "secret") || strings.Contains(recording.String(), token) {
+		t.Errorf("Expected no credential in the recording, got %s", recording.String())
+	}
+	if got := recorded.Headers.Get("X-Trace"); got != "kept" {
+		t.Errorf("Expected other headers to be recorded as is, got %q", got)
+	}
+	if recorded.URI != "/orders?access_token=REDACTED&page=2" {
+		t.Errorf("Expected the token query parameter to be redacted, got %q", recorded.URI)
+	}
+	if string(recorded.Body) != "payload" {
+		t.Errorf("Expected the body to be recorded, got %q", recorded.Body)
+	}
+}
+
+func TestHopLimit(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	hops := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hops <- r.Header.Get(balancer.HopHeader)
+	}))
+	defer backend.Close()
+
+	lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: backend.URL}}, logger, balancer.WithMaxHops(3))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	token, _ := balancer.GenerateJWT("User")
+	send := func(lb http.Handler, hopHeader string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if hopHeader != "" {
+			req.Header.Set(balancer.HopHeader, hopHeader)
+		}
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	tests := []struct {
+		sent, forwarded string
+	}{
+		{"", "1"},
+		{"1", "2"},
+		{"2", "3"},
+		// A garbled count starts over
+		{"lots", "1"},
+	}
+	for _, tt := range tests {
+		if code := send(lb, tt.sent); code != http.StatusOK {
+			t.Errorf("Hops %q: expected %d, got %d", tt.sent, http.StatusOK, code)
+			continue
+		}
+		if got := <-hops; got != tt.forwarded {
+			t.Errorf("Hops %q: expected the backend to see %q, got %q", tt.sent, tt.forwarded, got)
+		}
+	}
+	if code := send(lb, "3"); code != http.StatusLoopDetected {
+		t.Errorf("Expected %d at the hop limit, got %d", http.StatusLoopDetected, code)
+	}
+	select {
+	case got := <-hops:
+		t.Errorf("Expected a request at the hop limit not to be proxied, backend saw hops %q", got)
+	default:
+	}
+
+	// A balancer that is its own backend stops the loop at the limit
+	var self http.Handler
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		self.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	self, err = balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: server.URL}}, logger, balancer.WithMaxHops(3))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	if code := send(self, ""); code != http.StatusLoopDetected {
+		t.Errorf("Expected the loop to end with %d, got %d", http.StatusLoopDetected, code)
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Header().Set("Server-Timing", `db;dur=5`)
+	}))
+	defer backend.Close()
+
+	token, _ := balancer.GenerateJWT("User")
+	get := func(lb http.Handler) http.Header {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected %d, got %d", http.StatusOK, rec.Code)
+		}
+		return rec.Header()
+	}
+
+	lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: backend.URL}}, logger)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	if got := get(lb).Values("Server-Timing"); len(got) != 1 || got[0] != "db;dur=5" {
+		t.Errorf("Expected only the backend's Server-Timing by default, got %q", got)
+	}
+
+	lb, err = balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: backend.URL}}, logger, balancer.WithServerTiming(true))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	got := get(lb).Values("Server-Timing")
+	if len(got) != 2 || got[0] != "db;dur=5" {
+		t.Fatalf("Expected the backend's Server-Timing followed by the balancer's, got %q", got)
+	}
+	format := regexp.MustCompile(`^lb;desc="load balancer";dur=(\d+\.\d{3}), backend;desc="backend";dur=(\d+\.\d{3})$`)
+	match := format.FindStringSubmatch(got[1])
+	if match == nil {
+		t.Fatalf("Unexpected Server-Timing format: %q", got[1])
+	}
+	if overhead, _ := strconv.ParseFloat(match[1], 64); overhead < 0 || overhead >= 20 {
+		t.Errorf("Expected a small balancer overhead, got %vms", overhead)
+	}
+	if duration, _ := strconv.ParseFloat(match[2], 64); duration < 20 {
+		t.Errorf("Expected the backend duration to cover its 20ms delay, got %vms", duration)
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	extra := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer extra.Close()
+
+	// logs returns what the balancer logged while adding a backend, an info
+	// entry, and refusing a request for a path, a warning
+	logs := func(opts ...balancer.Option) string {
+		var out strings.Builder
+		opts = append(opts, balancer.WithAccessRules(balancer.AccessRule{PathPrefix: "/admin", Roles: []string{"Admin"}}))
+		lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: backend.URL}}, log.New(&out, "", 0), opts...)
+		if err != nil {
+			t.Fatalf("Failed to create load balancer: %v", err)
+		}
+		if err := lb.AddBackend(extra.URL, false); err != nil {
+			t.Fatalf("Failed to add backend: %v", err)
+		}
+		token, _ := balancer.GenerateJWT("User")
+		req := httptest.NewRequest("GET", "/admin", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		lb.ServeHTTP(httptest.NewRecorder(), req)
+		return out.String()
+	}
+
+	all := logs()
+	if !strings.Contains(all, "INFO Backend added") || !strings.Contains(all, "WARN Role not allowed for path") {
+		t.Errorf("Expected every entry logged by default, got:\n%s", all)
+	}
+	warnings := logs(balancer.WithLogLevel(balancer.LevelWarn))
+	if strings.Contains(warnings, "INFO ") || strings.Contains(warnings, "DEBUG ") {
+		t.Errorf("Expected entries below warn skipped, got:\n%s", warnings)
+	}
+	if !strings.Contains(warnings, "WARN Role not allowed for path") {
+		t.Errorf("Expected warnings still logged, got:\n%s", warnings)
+	}
+
+	if level, err := balancer.ParseLevel("WARN"); err != nil || level != balancer.LevelWarn {
+		t.Errorf("Expected WARN to parse as %q, got %q and error %v", balancer.LevelWarn, level, err)
+	}
+	if _, err := balancer.ParseLevel("verbose"); err == nil {
+		t.Errorf("Expected an unknown level to be rejected")
+	}
+	if _, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: backend.URL}}, log.New(io.Discard, "", 0), balancer.WithLogLevel("verbose")); err == nil {
+		t.Errorf("Expected NewLoadBalancer to reject an unknown log level")
+	}
+}
+
+func TestBackendCompression(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	plain := []byte(strings.Repeat("compressible payload ", 500))
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(plain)
+	writer.Close()
+
+	// The backend compresses whenever the request accepts gzip
+	var gzipped atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			gzipped.Add(1)
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(compressed.Bytes())
+			return
+		}
+		w.Write(plain)
+	}))
+	defer backend.Close()
+
+	token, err := balancer.GenerateJWT("User")
+	if err != nil {
+		t.Fatalf("Error generating token: %v", err)
+	}
+	// fetch sends a request without transparent decompression
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	fetch := func(url, acceptEncoding string) (*http.Response, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Failed to read the response: %v", err)
+		}
+		return resp, body
+	}
+
+	lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: backend.URL}}, logger,
+		balancer.WithDecodedSizeMetrics(true),
+		balancer.WithMetricsPath("/metrics"))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	// A client accepting gzip gets the backend's bytes untouched
+	resp, body := fetch(server.URL, "gzip")
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "gzip" {
+		t.Errorf("Expected Content-Encoding gzip to be kept, got %q", encoding)
+	}
+	if !bytes.Equal(body, compressed.Bytes()) {
+		t.Errorf("Expected the compressed body byte for byte, got %d bytes instead of %d", len(body), compressed.Len())
+	}
+
+	// The wire size and the decoded size are recorded separately. The body
+	// is counted once the proxy has read it to the end, which may be just
+	// after the client has it all.
+	label := fmt.Sprintf(`{backend=%q}`, backend.URL)
+	want := []string{
+		fmt.Sprintf("lb_backend_response_bytes_total%s %d\n", label, compressed.Len()),
+		fmt.Sprintf("lb_backend_response_decoded_bytes_total%s %d\n", label, len(plain)),
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, metrics := fetch(server.URL+"/metrics", "")
+		missing := ""
+		for _, series := range want {
+			if !strings.Contains(string(metrics), series) {
+				missing = series
+			}
+		}
+		if missing == "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected series %q in:\n%s", missing, metrics)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Without backend gzip a client that doesn't accept it gets plain text
+	// from the backend, with it the balancer asks for gzip and decodes it
+	for _, backendGzip := range []bool{false, true} {
+		lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: backend.URL}}, logger, balancer.WithBackendGzip(backendGzip))
+		if err != nil {
+			t.Fatalf("Failed to create load balancer: %v", err)
+		}
+		server := httptest.NewServer(lb)
+		before := gzipped.Load()
+		resp, body := fetch(server.URL, "")
+		server.Close()
+		if sentGzip := gzipped.Load() > before; sentGzip != backendGzip {
+			t.Errorf("backend gzip %v: expected a compressed backend response %v, got %v", backendGzip, backendGzip, sentGzip)
+		}
+		if encoding := resp.Header.Get("Content-Encoding"); encoding != "" {
+			t.Errorf("backend gzip %v: expected no Content-Encoding, got %q", backendGzip, encoding)
+		}
+		if !bytes.Equal(body, plain) {
+			t.Errorf("backend gzip %v: expected the plain body, got %d bytes", backendGzip, len(body))
+		}
+	}
+}
@@ -0,0 +1,424 @@
+package test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+
+	"loadBalancer/balancer"
+)
+
+// signToken signs a User token with the given method and key
+func signToken(t *testing.T, method jwt.SigningMethod, key interface{}) string {
+	claims := balancer.Claims{
+		Role: "User",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}
+	token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatalf("Error signing token: %v", err)
+	}
+	return token
+}
+
+func TestJWTAlgorithmAllowlist(t *testing.T) {
+	validator := balancer.DefaultJWTValidator()
+
+	valid, err := balancer.GenerateJWT("User")
+	if err != nil {
+		t.Fatalf("Error generating token: %v", err)
+	}
+	if _, err := validator.Validate("Bearer " + valid); err != nil {
+		t.Errorf("HS256 token should be accepted: %v", err)
+	}
+
+	// Same secret, different HMAC variant
+	hs512 := signToken(t, jwt.SigningMethodHS512, validator.Secret)
+	if _, err := validator.Validate(hs512); err == nil {
+		t.Error("HS512 token should be rejected by the default allowlist")
+	}
+
+	unsigned := signToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType)
+	if _, err := validator.Validate(unsigned); err == nil {
+		t.Error("Unsigned token should be rejected")
+	}
+
+	validator.Algorithms = []string{"HS512"}
+	if _, err := validator.Validate(hs512); err != nil {
+		t.Errorf("HS512 token should be accepted once allowed: %v", err)
+	}
+	if _, err := validator.Validate(valid); err == nil {
+		t.Error("HS256 token should be rejected once removed from the allowlist")
+	}
+}
+
+func TestExpiredToken(t *testing.T) {
+	validator := balancer.DefaultJWTValidator()
+
+	claims := balancer.Claims{
+		Role: "User",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute)),
+		},
+	}
+	expired, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(validator.Secret)
+	if err != nil {
+		t.Fatalf("Error signing token: %v", err)
+	}
+	if _, err := validator.Validate(expired); !errors.Is(err, balancer.ErrTokenExpired) {
+		t.Errorf("Expected ErrTokenExpired, got %v", err)
+	}
+	if _, err := validator.Validate("not-a-token"); !errors.Is(err, balancer.ErrInvalidToken) {
+		t.Errorf("Expected ErrInvalidToken, got %v", err)
+	}
+	if _, err := validator.Validate(""); !errors.Is(err, balancer.ErrNoToken) {
+		t.Errorf("Expected ErrNoToken, got %v", err)
+	}
+
+	lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: "http://127.0.0.1:1"}}, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+expired)
+	rec := httptest.NewRecorder()
+	lb.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected %d for an expired token, got %d", http.StatusUnauthorized, rec.Code)
+	}
+	want := `Bearer error="invalid_token", error_description="expired"`
+	if got := rec.Header().Get("WWW-Authenticate"); got != want {
+		t.Errorf("Expected WWW-Authenticate %q, got %q", want, got)
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	oldKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	newKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	// The provider publishes the old key first and rotates to the new one
+	var mutex sync.Mutex
+	published := map[string]*rsa.PrivateKey{"old": oldKey}
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		var keys []map[string]string
+		for kid, key := range published {
+			keys = append(keys, map[string]string{
+				"kty": "RSA",
+				"kid": kid,
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	defer provider.Close()
+
+	sign := func(kid string, key *rsa.PrivateKey) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, balancer.Claims{
+			Role:             "User",
+			RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+		})
+		token.Header["kid"] = kid
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("Error signing token: %v", err)
+		}
+		return signed
+	}
+
+	validator := balancer.DefaultJWTValidator()
+	validator.Algorithms = []string{"RS256", "HS256"}
+	validator.JWKS = balancer.NewJWKS(provider.URL, time.Hour)
+	validator.JWKS.MinRefresh = 0
+
+	if _, err := validator.Validate(sign("old", oldKey)); err != nil {
+		t.Errorf("Token signed with the published key should be accepted: %v", err)
+	}
+	if _, err := validator.Validate(sign("old", newKey)); err == nil {
+		t.Error("Token with a signature from another key should be rejected")
+	}
+
+	// An unknown kid refreshes the cached key set
+	mutex.Lock()
+	published["new"] = newKey
+	mutex.Unlock()
+	if _, err := validator.Validate(sign("new", newKey)); err != nil {
+		t.Errorf("Token signed with a rotated key should be accepted: %v", err)
+	}
+
+	// HMAC tokens still work alongside the JWKS
+	hmac, _ := balancer.GenerateJWT("User")
+	if _, err := validator.Validate(hmac); err != nil {
+		t.Errorf("HS256 token should still be accepted: %v", err)
+	}
+
+	// Without the provider, tokens needing a fetch are rejected
+	provider.Close()
+	if _, err := validator.Validate(sign("unknown", newKey)); err == nil {
+		t.Error("Token should be rejected when the JWKS cannot be fetched")
+	}
+}
+
+func TestTokenSources(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	queries := make(chan string, 10)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.RawQuery
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	token, err := balancer.GenerateJWT("User")
+	if err != nil {
+		t.Fatalf("Error generating token: %v", err)
+	}
+	send := func(lb *balancer.LoadBalancer, query string, cookie *http.Cookie) int {
+		server := httptest.NewServer(lb)
+		defer server.Close()
+		req, _ := http.NewRequest("GET", server.URL+"/events?"+query, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error sending request: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Only the Authorization header is read by default
+	lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: backend.URL}}, logger)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	if status := send(lb, "access_token="+token, &http.Cookie{Name: "session", Value: token}); status != http.StatusUnauthorized {
+		t.Errorf("Expected %d without configured token sources, got %d", http.StatusUnauthorized, status)
+	}
+
+	lb, err = balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: backend.URL}}, logger,
+		balancer.WithTokenSources("session", "access_token"),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	if status := send(lb, "", &http.Cookie{Name: "session", Value: token}); status != http.StatusOK {
+		t.Errorf("Expected %d with a token cookie, got %d", http.StatusOK, status)
+	}
+	<-queries
+
+	// A query token is taken off the URL before the request is proxied
+	if status := send(lb, "access_token="+token+"&last=5", nil); status != http.StatusOK {
+		t.Errorf("Expected %d with a token query parameter, got %d", http.StatusOK, status)
+	}
+	if query := <-queries; query != "last=5" {
+		t.Errorf("Expected the token removed from the query, got %q", query)
+	}
+
+	// The cookie is read before the query parameter
+	if status := send(lb, "access_token="+token, &http.Cookie{Name: "session", Value: "bogus"}); status != http.StatusUnauthorized {
+		t.Errorf("Expected %d for an invalid token cookie, got %d", http.StatusUnauthorized, status)
+	}
+}
+
+func TestRoleClaim(t *testing.T) {
+	validator := balancer.DefaultJWTValidator()
+	sign := func(claims jwt.MapClaims) string {
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(validator.Secret)
+		if err != nil {
+			t.Fatalf("Error signing token: %v", err)
+		}
+		return token
+	}
+
+	tests := []struct {
+		name      string
+		roleClaim string
+		claims    jwt.MapClaims
+		role      string
+	}{
+		{"default claim", "", jwt.MapClaims{"role": "User"}, "User"},
+		{"default claim as array", "", jwt.MapClaims{"role": []string{"Client", "User"}}, "Client"},
+		{"array claim", "roles", jwt.MapClaims{"roles": []string{"Admin", "User"}}, "Admin"},
+		{"namespaced claim", "https://example.com/role", jwt.MapClaims{"https://example.com/role": "Client", "role": "User"}, "Client"},
+		{"configured claim missing", "roles", jwt.MapClaims{"role": "User"}, ""},
+		{"empty array", "roles", jwt.MapClaims{"roles": []string{}}, ""},
+		{"not a string", "roles", jwt.MapClaims{"roles": []int{1}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validator.RoleClaim = tt.roleClaim
+			role, err := validator.Validate(sign(tt.claims))
+			if tt.role == "" {
+				if !errors.Is(err, balancer.ErrForbiddenRole) {
+					t.Errorf("Expected ErrForbiddenRole, got role %q and error %v", role, err)
+				}
+				return
+			}
+			if err != nil || role != tt.role {
+				t.Errorf("Expected role %q, got %q and error %v", tt.role, role, err)
+			}
+		})
+	}
+}
+
+func TestRolePriority(t *testing.T) {
+	validator := balancer.DefaultJWTValidator()
+	validator.RoleClaim = "roles"
+	sign := func(roles ...string) string {
+		claims := jwt.MapClaims{"roles": roles, "exp": time.Now().Add(time.Hour).Unix()}
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(validator.Secret)
+		if err != nil {
+			t.Fatalf("Error signing token: %v", err)
+		}
+		return token
+	}
+
+	tests := []struct {
+		roles    []string
+		priority []string
+		role     string
+	}{
+		{[]string{"User", "Admin"}, nil, "Admin"},
+		{[]string{"User", "Client"}, nil, "Client"},
+		{[]string{"Guest", "User"}, nil, "User"},
+		{[]string{"Admin", "User"}, []string{"User", "Admin"}, "User"},
+		// Unranked roles follow the token's order
+		{[]string{"Client", "User"}, []string{"Admin"}, "Client"},
+		{[]string{"Guest", "Auditor"}, nil, ""},
+	}
+	for _, tt := range tests {
+		validator.RolePriority = balancer.DefaultRolePriority
+		if tt.priority != nil {
+			validator.RolePriority = tt.priority
+		}
+		role, err := validator.Validate(sign(tt.roles...))
+		if tt.role == "" {
+			if !errors.Is(err, balancer.ErrForbiddenRole) {
+				t.Errorf("Roles %v: expected ErrForbiddenRole, got role %q and error %v", tt.roles, role, err)
+			}
+			continue
+		}
+		if err != nil || role != tt.role {
+			t.Errorf("Roles %v with priority %v: expected %q, got %q and error %v", tt.roles, validator.RolePriority, tt.role, role, err)
+		}
+	}
+}
+
+func TestJWTLeeway(t *testing.T) {
+	validator := balancer.DefaultJWTValidator()
+	sign := func(registered jwt.RegisteredClaims) string {
+		claims := balancer.Claims{Role: "User", RegisteredClaims: registered}
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(validator.Secret)
+		if err != nil {
+			t.Fatalf("Error signing token: %v", err)
+		}
+		return token
+	}
+	// Tokens from an issuer whose clock is a few seconds off either way
+	justExpired := sign(jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(-3 * time.Second))})
+	fromTheFuture := sign(jwt.RegisteredClaims{
+		IssuedAt:  jwt.NewNumericDate(time.Now().Add(3 * time.Second)),
+		NotBefore: jwt.NewNumericDate(time.Now().Add(3 * time.Second)),
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	})
+	longExpired := sign(jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute))})
+
+	if _, err := validator.Validate(justExpired); !errors.Is(err, balancer.ErrTokenExpired) {
+		t.Errorf("Expected ErrTokenExpired without leeway, got %v", err)
+	}
+	if _, err := validator.Validate(fromTheFuture); !errors.Is(err, balancer.ErrInvalidToken) {
+		t.Errorf("Expected ErrInvalidToken for a token not valid yet without leeway, got %v", err)
+	}
+
+	validator.Leeway = 10 * time.Second
+	if _, err := validator.Validate(justExpired); err != nil {
+		t.Errorf("Token expired within the leeway should be accepted: %v", err)
+	}
+	if _, err := validator.Validate(fromTheFuture); err != nil {
+		t.Errorf("Token issued within the leeway should be accepted: %v", err)
+	}
+	if _, err := validator.Validate(longExpired); !errors.Is(err, balancer.ErrTokenExpired) {
+		t.Errorf("Expected ErrTokenExpired past the leeway, got %v", err)
+	}
+}
+
+func TestDefaultRole(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	var configs []balancer.BackendConfig
+	for i := 1; i <= 2; i++ {
+		server := httptest.NewServer(createBackendHandler(i, logger))
+		defer server.Close()
+		configs = append(configs, balancer.BackendConfig{URL: server.URL, Admin: i == 1})
+	}
+	withDefault := func(role string) balancer.Option {
+		validator := balancer.DefaultJWTValidator()
+		validator.DefaultRole = role
+		return balancer.WithJWTValidator(validator)
+	}
+
+	// A default role must not grant more than a regular role
+	invalid := []struct {
+		name string
+		opts []balancer.Option
+	}{
+		{"admin role", []balancer.Option{withDefault("Admin")}},
+		{"unknown role", []balancer.Option{withDefault("Guest")}},
+		{"role without a route", []balancer.Option{withDefault("Client"), balancer.WithRoleRoutes(map[string][]int{"User": {1}})}},
+		{"route without backends", []balancer.Option{withDefault("User"), balancer.WithRoleRoutes(map[string][]int{"User": {5}})}},
+	}
+	for _, tt := range invalid {
+		if _, err := balancer.NewLoadBalancer(configs, logger, tt.opts...); err == nil {
+			t.Errorf("Expected a default %s to be rejected", tt.name)
+		}
+	}
+
+	lb, err := balancer.NewLoadBalancer(configs, logger, withDefault("User"),
+		balancer.WithRoleRoutes(map[string][]int{"Admin": {0}, "User": {1}}))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	send := func(claims jwt.MapClaims) (int, string) {
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(balancer.DefaultJWTValidator().Secret)
+		if err != nil {
+			t.Fatalf("Error signing token: %v", err)
+		}
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+
+	// Tokens without an accepted role fall back to the default role's
+	// backends, never the admin one
+	for _, claims := range []jwt.MapClaims{{"role": "Guest"}, {"role": "Client"}, {}} {
+		if status, body := send(claims); status != http.StatusOK || body != "Response from Backend 2" {
+			t.Errorf("Claims %v: expected the default role's backend, got %d %q", claims, status, body)
+		}
+	}
+	if _, body := send(jwt.MapClaims{"role": "Admin"}); body != "Response from Backend 1" {
+		t.Errorf("Expected an admin token to keep its role, got %q", body)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -56,10 +58,17 @@ func TestLoadBalancer(t *testing.T) {
 	defer backend3.Close()
 
 	// Create the load balancer with its own logger
-	lb := balancer.NewLoadBalancer(
-		[]string{backend1.URL, backend2.URL, backend3.URL},
+	lb, err := balancer.NewLoadBalancer(
+		[]balancer.BackendConfig{
+			{URL: backend1.URL, Admin: true},
+			{URL: backend2.URL},
+			{URL: backend3.URL},
+		},
 		lbLogger,
 	)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
 
 	// Start the load balancer server
 	lbServer := httptest.NewServer(lb)
@@ -219,6 +228,142 @@ func TestLoadBalancer(t *testing.T) {
 	}
 }
 
+func TestNewLoadBalancerInvalidURL(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+
+	lb, err := balancer.NewLoadBalancer(
+		[]balancer.BackendConfig{
+			{URL: "http://localhost:8081"},
+			{URL: "http://[::1"},
+		},
+		logger,
+	)
+	if err == nil {
+		t.Fatal("Expected an error for an invalid backend URL")
+	}
+	if lb != nil {
+		t.Error("Expected no load balancer to be returned on error")
+	}
+	if !strings.Contains(err.Error(), "http://[::1") {
+		t.Errorf("Error should name the invalid URL, got: %v", err)
+	}
+}
+
+func TestDuplicateBackendURLs(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+
+	for _, dup := range []string{
+		"http://localhost:8081",
+		"http://LOCALHOST:8081/",
+		"HTTP://localhost:8081//",
+	} {
+		_, err := balancer.NewLoadBalancer(
+			[]balancer.BackendConfig{{URL: "http://localhost:8081"}, {URL: dup}},
+			logger,
+		)
+		if err == nil || !strings.Contains(err.Error(), "duplicate") {
+			t.Errorf("Expected %s to be rejected as a duplicate, got %v", dup, err)
+		}
+	}
+	if err := balancer.ValidateBackendConfigs([]balancer.BackendConfig{{URL: "https://example.com"}, {URL: "https://example.com:443/"}}); err == nil {
+		t.Error("Expected a URL with the default port to be rejected as a duplicate")
+	}
+
+	lb, err := balancer.NewLoadBalancer(
+		[]balancer.BackendConfig{{URL: "http://localhost/api"}, {URL: "http://localhost:8080/api"}},
+		logger,
+	)
+	if err != nil {
+		t.Fatalf("Expected different ports to be different backends, got %v", err)
+	}
+	if err := lb.AddBackend("http://localhost:80/api/", false); err == nil {
+		t.Error("Expected AddBackend to reject a duplicate URL")
+	}
+	if err := lb.AddBackend("http://localhost/other", false); err != nil {
+		t.Errorf("Expected a different path to be added, got %v", err)
+	}
+	if err := lb.RemoveBackend("http://LOCALHOST:8080/api/"); err != nil {
+		t.Errorf("Expected RemoveBackend to match the normalized URL, got %v", err)
+	}
+	if n := len(lb.GetStats()["backends"].([]map[string]interface{})); n != 2 {
+		t.Errorf("Expected 2 backends, got %d", n)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		return path
+	}
+
+	want := []balancer.BackendConfig{
+		{URL: "http://localhost:8081", Weight: 2, Admin: true, HealthCheckPath: "/healthz"},
+		{URL: "http://localhost:8082", Weight: 1, MaxConnections: 50},
+	}
+	valid := map[string]string{
+		"backends.json": `{"backends": [
+			{"url": "http://localhost:8081", "weight": 2, "admin": true, "healthCheckPath": "/healthz"},
+			{"url": "http://localhost:8082", "weight": 1, "maxConnections": 50}
+		]}`,
+		"backends.yaml": `backends:
+  - url: http://localhost:8081
+    weight: 2
+    admin: true
+    healthCheckPath: /healthz
+  - url: http://localhost:8082
+    weight: 1
+    maxConnections: 50
+`,
+		"backends.YML": `backends: [{url: "http://localhost:8081", weight: 2, admin: true, healthCheckPath: /healthz}, {url: "http://localhost:8082", weight: 1, maxConnections: 50}]`,
+	}
+	for name, content := range valid {
+		configs, err := balancer.LoadConfig(write(name, content))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+			continue
+		}
+		if len(configs) != len(want) {
+			t.Errorf("%s: expected %d backends, got %d", name, len(want), len(configs))
+			continue
+		}
+		for i := range want {
+			if configs[i] != want[i] {
+				t.Errorf("%s: expected backend %d to be %+v, got %+v", name, i+1, want[i], configs[i])
+			}
+		}
+	}
+
+	invalid := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"backends.toml", `backends = []`, "unsupported config file extension"},
+		{"backends", `backends: []`, "unsupported config file extension"},
+		{"broken.json", `{"backends": [`, "failed to parse"},
+		{"broken.yaml", "backends:\n  - url: [", "failed to parse"},
+		{"empty.yaml", `backends: []`, "no backends configured"},
+		{"relative.json", `{"backends": [{"url": "localhost:8081"}]}`, "must include scheme and host"},
+		{"duplicate.yaml", "backends:\n  - url: http://localhost:8081\n  - url: http://LOCALHOST:8081/\n", "duplicate URL"},
+		{"negative.json", `{"backends": [{"url": "http://localhost:8081", "weight": -1}]}`, "weight must not be negative"},
+		{"tcp.yaml", "backends:\n  - url: http://localhost:8081\n    healthCheckType: udp\n", "backend 1"},
+	}
+	for _, tc := range invalid {
+		_, err := balancer.LoadConfig(write(tc.name, tc.content))
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected an error containing %q, got %v", tc.name, tc.err, err)
+		}
+	}
+
+	if _, err := balancer.LoadConfig(filepath.Join(dir, "missing.yaml")); err == nil || !strings.Contains(err.Error(), "failed to read") {
+		t.Errorf("Expected a missing file to be reported, got %v", err)
+	}
+}
+
 // Creates a test backend handler that reports which backend it is
 func createBackendHandler(backendID int, logger *log.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
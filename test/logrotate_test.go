@@ -0,0 +1,170 @@
+package test
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"loadBalancer/balancer"
+)
+
+// rotatedFiles lists the rotated copies of the log at path, oldest first
+func rotatedFiles(t *testing.T, path string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatalf("Failed to list rotated files: %v", err)
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+// readLog returns the contents of a log file, gunzipping rotated ones
+func readLog(t *testing.T, path string) string {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+	var reader io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatalf("Failed to gunzip %s: %v", path, err)
+		}
+		reader = gz
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", path, err)
+	}
+	return string(data)
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lb.log")
+	os.WriteFile(path, []byte("old\n"), 0644)
+
+	// Each line is 10 bytes, so two fit in a file
+	file, err := balancer.OpenRotatingFile(path, balancer.RotationConfig{MaxSize: 20, MaxBackups: 2, Compress: true})
+	if err != nil {
+		t.Fatalf("Failed to open log file: %v", err)
+	}
+	for i := 1; i <= 6; i++ {
+		if _, err := fmt.Fprintf(file, "line-%04d\n", i); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// The existing file was appended to, then rotated three times; only the
+	// two newest backups are kept, compressed
+	if got := readLog(t, path); got != "line-0006\n" {
+		t.Errorf("Expected the current file to hold the last line, got %q", got)
+	}
+	backups := rotatedFiles(t, path)
+	if len(backups) != 2 {
+		t.Fatalf("Expected 2 backups, got %v", backups)
+	}
+	for _, backup := range backups {
+		if !strings.HasSuffix(backup, ".gz") {
+			t.Errorf("Expected %s to be compressed", backup)
+		}
+	}
+	if got := readLog(t, backups[0]); got != "line-0002\nline-0003\n" {
+		t.Errorf("Unexpected older backup %q", got)
+	}
+	if got := readLog(t, backups[1]); got != "line-0004\nline-0005\n" {
+		t.Errorf("Unexpected newer backup %q", got)
+	}
+}
+
+func TestRotatingFileInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	file, err := balancer.OpenRotatingFile(path, balancer.RotationConfig{Interval: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to open log file: %v", err)
+	}
+	defer file.Close()
+
+	file.Write([]byte("first\n"))
+	file.Write([]byte("second\n"))
+	if backups := rotatedFiles(t, path); len(backups) != 0 {
+		t.Fatalf("Expected no rotation within the interval, got %v", backups)
+	}
+	time.Sleep(250 * time.Millisecond)
+	file.Write([]byte("third\n"))
+
+	backups := rotatedFiles(t, path)
+	if len(backups) != 1 {
+		t.Fatalf("Expected one rotation after the interval, got %v", backups)
+	}
+	if got := readLog(t, backups[0]); got != "first\nsecond\n" {
+		t.Errorf("Unexpected backup %q", got)
+	}
+	if got := readLog(t, path); got != "third\n" {
+		t.Errorf("Unexpected current file %q", got)
+	}
+}
+
+func TestRotatingFileReopen(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	os.Mkdir(dir, 0755)
+	path := filepath.Join(dir, "lb.log")
+
+	file, err := balancer.OpenRotatingFile(path, balancer.RotationConfig{MaxSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("Failed to open log file: %v", err)
+	}
+	defer file.Close()
+	write := func(line string) {
+		t.Helper()
+		if _, err := file.Write([]byte(line + "\n")); err != nil {
+			t.Fatalf("Failed to write %q: %v", line, err)
+		}
+	}
+
+	// A file moved away, as logrotate does, is replaced rather than renamed
+	write("first")
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatalf("Failed to move log file: %v", err)
+	}
+	write("second")
+	if err := file.Rotate(); err != nil {
+		t.Fatalf("Failed to rotate: %v", err)
+	}
+	write("third")
+	if got := readLog(t, path+".1"); got != "first\nsecond\n" {
+		t.Errorf("Expected the moved file to keep the entries before the rotation, got %q", got)
+	}
+	if got := readLog(t, path); got != "third\n" {
+		t.Errorf("Expected a new file after the rotation, got %q", got)
+	}
+	if rotated := rotatedFiles(t, path); len(rotated) != 1 {
+		t.Errorf("Expected no rotated copies besides the moved one, got %v", rotated)
+	}
+
+	// When no new file can be opened, writes keep going to the old one
+	// and the file is reopened once possible
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("Failed to remove log directory: %v", err)
+	}
+	if err := file.Rotate(); err == nil {
+		t.Errorf("Expected the rotation to fail without a log directory")
+	}
+	write("lost directory")
+	os.Mkdir(dir, 0755)
+	write("fourth")
+	if got := readLog(t, path); got != "fourth\n" {
+		t.Errorf("Expected the file reopened on the next write, got %q", got)
+	}
+}
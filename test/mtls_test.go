@@ -0,0 +1,123 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"loadBalancer/balancer"
+)
+
+// issueCert creates a certificate for commonName signed by parent, or
+// self-signed as a CA when parent is nil
+func issueCert(t *testing.T, commonName string, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, interface{}(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestMutualTLS(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	backend := httptest.NewServer(createBackendHandler(1, logger))
+	defer backend.Close()
+
+	ca := issueCert(t, "Test Client CA", nil)
+	caFile := filepath.Join(t.TempDir(), "clients.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]}), 0600); err != nil {
+		t.Fatalf("Failed to write CA bundle: %v", err)
+	}
+	clientCert := issueCert(t, "billing", &ca)
+
+	lb, err := balancer.NewLoadBalancer(
+		[]balancer.BackendConfig{{URL: backend.URL}},
+		logger,
+		balancer.WithClientCertAuth("Client"),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	tlsConfig, err := balancer.ServerTLSConfig(caFile, true)
+	if err != nil {
+		t.Fatalf("Failed to build TLS config: %v", err)
+	}
+	server := httptest.NewUnstartedServer(lb)
+	server.TLS = tlsConfig
+	server.Config.ErrorLog = logger
+	server.StartTLS()
+	defer server.Close()
+
+	newClient := func(certs ...tls.Certificate) *http.Client {
+		client := server.Client()
+		transport := client.Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.Certificates = certs
+		client.Transport = transport
+		return client
+	}
+
+	// The handshake fails without a client certificate
+	if resp, err := newClient().Get(server.URL); err == nil {
+		resp.Body.Close()
+		t.Fatalf("Expected the handshake to fail without a client certificate, got %d", resp.StatusCode)
+	}
+
+	// A verified certificate authenticates without a JWT
+	resp, err := newClient(clientCert).Get(server.URL)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "Response from Backend 1" {
+		t.Errorf("Expected the certificate to be accepted, got %d %q", resp.StatusCode, body)
+	}
+
+	// A token sent alongside the certificate is still validated
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Authorization", "Bearer invalid")
+	resp, err = newClient(clientCert).Do(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected an invalid token to be rejected, got %d", resp.StatusCode)
+	}
+}
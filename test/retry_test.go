@@ -0,0 +1,96 @@
+package test
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"loadBalancer/balancer"
+)
+
+func TestAdminFailoverOnProxyError(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	// The primary admin backend is still marked alive but refuses connections
+	primary := httptest.NewServer(createBackendHandler(1, logger))
+	primary.Close()
+	standby := httptest.NewServer(createBackendHandler(2, logger))
+	defer standby.Close()
+
+	newLB := func(options ...balancer.Option) *httptest.Server {
+		lb, err := balancer.NewLoadBalancer(
+			[]balancer.BackendConfig{
+				{URL: primary.URL, Admin: true},
+				{URL: standby.URL, Admin: true},
+			},
+			logger,
+			options...,
+		)
+		if err != nil {
+			t.Fatalf("Failed to create load balancer: %v", err)
+		}
+		return httptest.NewServer(lb)
+	}
+
+	withoutRetries := newLB()
+	defer withoutRetries.Close()
+	if status, _ := sendWithRole(t, withoutRetries.URL, "Admin"); status != http.StatusBadGateway {
+		t.Errorf("Expected %d without retries, got %d", http.StatusBadGateway, status)
+	}
+
+	withRetries := newLB(balancer.WithRetries(1))
+	defer withRetries.Close()
+	status, body := sendWithRole(t, withRetries.URL, "Admin")
+	if status != http.StatusOK {
+		t.Fatalf("Expected admin request to fail over, got status %d", status)
+	}
+	if body != "Response from Backend 2" {
+		t.Errorf("Expected the standby admin backend to answer, got %q", body)
+	}
+}
+
+func TestRetryOutcomes(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	dead := httptest.NewServer(createBackendHandler(1, logger))
+	dead.Close()
+	alsoDead := httptest.NewServer(createBackendHandler(2, logger))
+	alsoDead.Close()
+	alive := httptest.NewServer(createBackendHandler(3, logger))
+	defer alive.Close()
+
+	outcomes := func(urls []string, retries int, requests int) map[string]uint64 {
+		var configs []balancer.BackendConfig
+		for _, url := range urls {
+			configs = append(configs, balancer.BackendConfig{URL: url})
+		}
+		lb, err := balancer.NewLoadBalancer(configs, logger, balancer.WithRetries(retries))
+		if err != nil {
+			t.Fatalf("Failed to create load balancer: %v", err)
+		}
+		server := httptest.NewServer(lb)
+		defer server.Close()
+		for i := 0; i < requests; i++ {
+			sendWithRole(t, server.URL, "User")
+		}
+		return lb.GetStats()["retryOutcomes"].(map[string]uint64)
+	}
+
+	// Round robin alternates the first try between the two backends
+	got := outcomes([]string{dead.URL, alive.URL}, 1, 2)
+	if got[balancer.OutcomeFirstTrySuccess] != 1 || got[balancer.OutcomeRetrySuccess] != 1 {
+		t.Errorf("Expected one first-try and one retry success, got %v", got)
+	}
+
+	got = outcomes([]string{dead.URL, alsoDead.URL}, 1, 1)
+	if got[balancer.OutcomeRetryExhausted] != 1 {
+		t.Errorf("Expected retries to be exhausted, got %v", got)
+	}
+
+	got = outcomes([]string{dead.URL}, 0, 1)
+	if got[balancer.OutcomeFirstTryFailure] != 1 {
+		t.Errorf("Expected a first-try failure without retries, got %v", got)
+	}
+}
@@ -0,0 +1,1099 @@
+package test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"loadBalancer/balancer"
+)
+
+// sendWithRole sends a GET request to the URL carrying a token for the role
+// and returns the status code and body
+func sendWithRole(t *testing.T, url, role string) (int, string) {
+	t.Helper()
+	token, err := balancer.GenerateJWT(role)
+	if err != nil {
+		t.Fatalf("Error generating token: %v", err)
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Error reading response: %v", err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestNoRouteHandling(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	backend := httptest.NewServer(createBackendHandler(1, logger))
+	defer backend.Close()
+
+	apiRoute := balancer.Route{
+		Name:     "api",
+		Match:    func(r *http.Request) bool { return strings.HasPrefix(r.URL.Path, "/api/") },
+		Backends: []int{0},
+	}
+
+	tests := []struct {
+		name       string
+		policy     *balancer.NoRoutePolicy
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"matched route", &balancer.NoRoutePolicy{Reject: true}, "/api/users", http.StatusOK, "Response from Backend 1"},
+		{"default 404", &balancer.NoRoutePolicy{Reject: true}, "/other", http.StatusNotFound, "No route matches the request"},
+		{"custom response", &balancer.NoRoutePolicy{Reject: true, StatusCode: http.StatusGone, Body: "gone"}, "/other", http.StatusGone, "gone"},
+		{"fall through", nil, "/other", http.StatusOK, "Response from Backend 1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := []balancer.Option{balancer.WithRoutes(apiRoute)}
+			if tt.policy != nil {
+				options = append(options, balancer.WithNoRoutePolicy(*tt.policy))
+			}
+			lb, err := balancer.NewLoadBalancer(
+				[]balancer.BackendConfig{{URL: backend.URL}},
+				logger,
+				options...,
+			)
+			if err != nil {
+				t.Fatalf("Failed to create load balancer: %v", err)
+			}
+			lbServer := httptest.NewServer(lb)
+			defer lbServer.Close()
+
+			status, body := sendWithRole(t, lbServer.URL+tt.path, "User")
+			if status != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, status)
+			}
+			if body != tt.wantBody {
+				t.Errorf("Expected body %q, got %q", tt.wantBody, body)
+			}
+		})
+	}
+}
+
+func TestOutageResponses(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	var logs strings.Builder
+	lb, err := balancer.NewLoadBalancer(
+		[]balancer.BackendConfig{{URL: "http://127.0.0.1:1"}, {URL: "http://127.0.0.1:2", Admin: true}},
+		logger,
+		balancer.WithLogger(balancer.NewJSONLogger(&logs)),
+		balancer.WithOutageRetryAfter(2*time.Second, 3*time.Second),
+		balancer.WithOutageLogInterval(time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	for _, ref := range []string{"1", "2"} {
+		if err := lb.DisableBackend(ref); err != nil {
+			t.Fatalf("Failed to disable backend: %v", err)
+		}
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	// Both regular and admin requests find no backend
+	for i := 0; i < 5; i++ {
+		role := "User"
+		if i%2 == 1 {
+			role = "Admin"
+		}
+		token, _ := balancer.GenerateJWT(role)
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error sending request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("Expected status %d, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+		}
+		// 2s plus up to 3s of jitter
+		if retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || retryAfter < 2 || retryAfter > 5 {
+			t.Errorf("Expected Retry-After between 2 and 5 seconds, got %q", resp.Header.Get("Retry-After"))
+		}
+	}
+
+	// The whole outage is logged once within the interval
+	if n := strings.Count(logs.String(), "no backend available"); n != 1 {
+		t.Errorf("Expected the outage logged once, got %d entries:\n%s", n, logs.String())
+	}
+}
+
+func TestAdminBalancing(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	var servers []*httptest.Server
+	for i := 1; i <= 3; i++ {
+		server := httptest.NewServer(createBackendHandler(i, logger))
+		defer server.Close()
+		servers = append(servers, server)
+	}
+	configs := []balancer.BackendConfig{
+		{URL: servers[0].URL, Admin: true},
+		{URL: servers[1].URL, Admin: true},
+		{URL: servers[2].URL},
+	}
+
+	newLB := func(mode balancer.AdminBalancing) (*balancer.LoadBalancer, *httptest.Server) {
+		lb, err := balancer.NewLoadBalancer(configs, logger, balancer.WithAdminBalancing(mode))
+		if err != nil {
+			t.Fatalf("Failed to create load balancer: %v", err)
+		}
+		return lb, httptest.NewServer(lb)
+	}
+
+	// Failover prefers the primary admin and moves to the standby once it is out
+	failover, failoverServer := newLB(balancer.AdminFailover)
+	defer failoverServer.Close()
+	if _, body := sendWithRole(t, failoverServer.URL, "Admin"); body != "Response from Backend 1" {
+		t.Errorf("Expected the primary admin backend, got %q", body)
+	}
+	if err := failover.DisableBackend("1"); err != nil {
+		t.Fatalf("Failed to disable backend: %v", err)
+	}
+	if _, body := sendWithRole(t, failoverServer.URL, "Admin"); body != "Response from Backend 2" {
+		t.Errorf("Expected the standby admin backend, got %q", body)
+	}
+	if err := failover.DisableBackend("2"); err != nil {
+		t.Fatalf("Failed to disable backend: %v", err)
+	}
+	if status, _ := sendWithRole(t, failoverServer.URL, "Admin"); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected %d with no admin backend left, got %d", http.StatusServiceUnavailable, status)
+	}
+
+	// Round-robin uses both admin backends but never the regular one
+	_, roundRobinServer := newLB(balancer.AdminRoundRobin)
+	defer roundRobinServer.Close()
+	seen := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		_, body := sendWithRole(t, roundRobinServer.URL, "Admin")
+		seen[body]++
+	}
+	if seen["Response from Backend 1"] != 2 || seen["Response from Backend 2"] != 2 {
+		t.Errorf("Expected admin requests split evenly over the admin backends, got %v", seen)
+	}
+}
+
+func TestAdminRoleName(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	var configs []balancer.BackendConfig
+	for i := 1; i <= 3; i++ {
+		server := httptest.NewServer(createBackendHandler(i, logger))
+		defer server.Close()
+		configs = append(configs, balancer.BackendConfig{URL: server.URL, Admin: i == 1})
+	}
+
+	lb, err := balancer.NewLoadBalancer(configs, logger, balancer.WithAdminRole("administrator"), balancer.WithAdminAPI("/lb"))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	for i := 0; i < 3; i++ {
+		if status, body := sendWithRole(t, server.URL, "administrator"); status != http.StatusOK || body != "Response from Backend 1" {
+			t.Errorf("Expected administrator requests pinned to the admin backend, got %d %q", status, body)
+		}
+	}
+	if status, _ := sendWithRole(t, server.URL+"/lb/backends", "administrator"); status != http.StatusOK {
+		t.Errorf("Expected the administrator role to use the admin API, got %d", status)
+	}
+	// The built-in name is no longer privileged or accepted
+	if status, _ := sendWithRole(t, server.URL, "Admin"); status != http.StatusForbidden {
+		t.Errorf("Expected %d for the Admin role, got %d", http.StatusForbidden, status)
+	}
+	if status, _ := sendWithRole(t, server.URL, "User"); status != http.StatusOK {
+		t.Errorf("Expected other roles to be accepted still, got %d", status)
+	}
+}
+
+func TestPoolRateLimits(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	backend := httptest.NewServer(createBackendHandler(1, logger))
+	defer backend.Close()
+
+	lb, err := balancer.NewLoadBalancer(
+		[]balancer.BackendConfig{{URL: backend.URL}},
+		logger,
+		balancer.WithRoutes(balancer.Route{
+			Name:  "reports",
+			Match: func(r *http.Request) bool { return strings.HasPrefix(r.URL.Path, "/reports/") },
+		}),
+		// One request for the reports pool, then nothing more for a while
+		balancer.WithPoolRateLimits(map[string]balancer.RateLimit{
+			"reports": {Rate: 0.001, Burst: 1},
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	if status, _ := sendWithRole(t, server.URL+"/reports/daily", "User"); status != http.StatusOK {
+		t.Fatalf("Expected first reports request to pass, got %d", status)
+	}
+	if status, _ := sendWithRole(t, server.URL+"/reports/daily", "User"); status != http.StatusTooManyRequests {
+		t.Errorf("Expected reports pool to be limited, got %d", status)
+	}
+	// The default pool has its own, unlimited budget
+	if status, _ := sendWithRole(t, server.URL+"/api/items", "User"); status != http.StatusOK {
+		t.Errorf("Expected default pool to be unaffected, got %d", status)
+	}
+
+	usage := lb.GetStats()["poolRateLimits"].(map[string]interface{})["reports"].(map[string]interface{})
+	if usage["allowed"] != uint64(1) || usage["rejected"] != uint64(1) {
+		t.Errorf("Expected 1 allowed and 1 rejected in stats, got %v", usage)
+	}
+}
+
+func TestReservedAdminBackends(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	var configs []balancer.BackendConfig
+	for i := 1; i <= 3; i++ {
+		server := httptest.NewServer(createBackendHandler(i, logger))
+		defer server.Close()
+		configs = append(configs, balancer.BackendConfig{URL: server.URL, Admin: i == 1})
+	}
+
+	lb, err := balancer.NewLoadBalancer(configs, logger, balancer.WithReservedAdminBackends(true))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	seen := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		_, body := sendWithRole(t, server.URL, "User")
+		seen[body]++
+	}
+	if seen["Response from Backend 1"] != 0 || seen["Response from Backend 2"] != 3 || seen["Response from Backend 3"] != 3 {
+		t.Errorf("Expected user requests split over the regular backends only, got %v", seen)
+	}
+	if _, body := sendWithRole(t, server.URL, "Admin"); body != "Response from Backend 1" {
+		t.Errorf("Expected admin request on the admin backend, got %q", body)
+	}
+}
+
+func TestTLSRouting(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	var configs []balancer.BackendConfig
+	for i := 1; i <= 3; i++ {
+		server := httptest.NewServer(createBackendHandler(i, logger))
+		defer server.Close()
+		configs = append(configs, balancer.BackendConfig{URL: server.URL})
+	}
+
+	lb, err := balancer.NewLoadBalancer(configs, logger,
+		balancer.WithRoutes(
+			balancer.Route{Name: "billing", Match: balancer.MatchClientCertSubject("billing"), Backends: []int{2}},
+			balancer.Route{Name: "api", Match: balancer.MatchSNI("*.api.example.com"), Backends: []int{1}},
+		),
+		balancer.WithNoRoutePolicy(balancer.NoRoutePolicy{DefaultBackends: []int{0}}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewUnstartedServer(lb)
+	server.StartTLS()
+	defer server.Close()
+
+	token, err := balancer.GenerateJWT("User")
+	if err != nil {
+		t.Fatalf("Error generating token: %v", err)
+	}
+	sendWithSNI := func(serverName string) string {
+		client := server.Client()
+		transport := client.Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.ServerName = serverName
+		transport.TLSClientConfig.InsecureSkipVerify = true
+		client.Transport = transport
+
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Error sending request: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	if body := sendWithSNI("eu.api.example.com"); body != "Response from Backend 2" {
+		t.Errorf("Expected SNI route to backend 2, got %q", body)
+	}
+	if body := sendWithSNI("www.example.com"); body != "Response from Backend 1" {
+		t.Errorf("Expected unmatched SNI to use the default pool, got %q", body)
+	}
+
+	// A verified client certificate selects the billing route
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "billing"}}
+	req := httptest.NewRequest("GET", "https://lb.example.com/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert}},
+	}
+	rec := httptest.NewRecorder()
+	lb.ServeHTTP(rec, req)
+	if body := rec.Body.String(); body != "Response from Backend 3" {
+		t.Errorf("Expected client certificate route to backend 3, got %q", body)
+	}
+
+	// The same certificate unverified must not be trusted
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	rec = httptest.NewRecorder()
+	lb.ServeHTTP(rec, req)
+	if body := rec.Body.String(); body != "Response from Backend 1" {
+		t.Errorf("Expected unverified certificate to use the default pool, got %q", body)
+	}
+}
+
+func TestRoleHomeBackends(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	var configs []balancer.BackendConfig
+	for i := 1; i <= 3; i++ {
+		server := httptest.NewServer(createBackendHandler(i, logger))
+		defer server.Close()
+		configs = append(configs, balancer.BackendConfig{URL: server.URL})
+	}
+
+	lb, err := balancer.NewLoadBalancer(configs, logger, balancer.WithRoleHomeBackends(map[string]int{"Client": 2}))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, body := sendWithRole(t, server.URL, "Client"); body != "Response from Backend 3" {
+			t.Errorf("Expected client request on its home backend, got %q", body)
+		}
+	}
+
+	// Roles without a home are balanced as usual
+	seen := make(map[string]int)
+	for i := 0; i < 3; i++ {
+		_, body := sendWithRole(t, server.URL, "User")
+		seen[body]++
+	}
+	if len(seen) != 3 {
+		t.Errorf("Expected user requests spread over every backend, got %v", seen)
+	}
+
+	// Requests fall back while the home backend is out of rotation
+	if err := lb.DisableBackend("3"); err != nil {
+		t.Fatalf("Failed to disable backend: %v", err)
+	}
+	seen = make(map[string]int)
+	for i := 0; i < 4; i++ {
+		_, body := sendWithRole(t, server.URL, "Client")
+		seen[body]++
+	}
+	if seen["Response from Backend 1"] != 2 || seen["Response from Backend 2"] != 2 {
+		t.Errorf("Expected client requests to fall back over the other backends, got %v", seen)
+	}
+
+	if err := lb.EnableBackend("3"); err != nil {
+		t.Fatalf("Failed to enable backend: %v", err)
+	}
+	if _, body := sendWithRole(t, server.URL, "Client"); body != "Response from Backend 3" {
+		t.Errorf("Expected client request back on its home backend, got %q", body)
+	}
+
+	stats := lb.GetStats()["roleHomes"].(map[string]interface{})["Client"].(map[string]interface{})
+	if stats["honored"] != uint64(4) || stats["fallbacks"] != uint64(4) || stats["backend"] != 3 {
+		t.Errorf("Expected backend 3 with 4 honored and 4 fallbacks, got %v", stats)
+	}
+
+	// The home stays with its backend when the ones before it are removed
+	if err := lb.RemoveBackend(configs[0].URL); err != nil {
+		t.Fatalf("Failed to remove backend: %v", err)
+	}
+	if _, body := sendWithRole(t, server.URL, "Client"); body != "Response from Backend 3" {
+		t.Errorf("Expected client request to stay on its home backend, got %q", body)
+	}
+
+	// and the role falls back for good once its home is removed
+	if err := lb.RemoveBackend(configs[2].URL); err != nil {
+		t.Fatalf("Failed to remove backend: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if status, body := sendWithRole(t, server.URL, "Client"); status != http.StatusOK || body != "Response from Backend 2" {
+			t.Errorf("Expected client request to fall back to backend 2, got %d %q", status, body)
+		}
+	}
+}
+
+func TestProbeEndpoints(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	backend := httptest.NewServer(createBackendHandler(1, logger))
+	defer backend.Close()
+
+	lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: backend.URL}}, logger)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+
+	// Probes need no token
+	probe := func(lb *balancer.LoadBalancer, path string) int {
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Code
+	}
+	if code := probe(lb, "/livez"); code != http.StatusOK {
+		t.Errorf("Expected /livez to answer %d, got %d", http.StatusOK, code)
+	}
+	if code := probe(lb, "/readyz"); code != http.StatusOK {
+		t.Errorf("Expected /readyz to answer %d, got %d", http.StatusOK, code)
+	}
+
+	if err := lb.DisableBackend("1"); err != nil {
+		t.Fatalf("Failed to disable backend: %v", err)
+	}
+	if code := probe(lb, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected /readyz to fail without backends, got %d", code)
+	}
+	if code := probe(lb, "/livez"); code != http.StatusOK {
+		t.Errorf("Expected /livez to pass without backends, got %d", code)
+	}
+
+	lb.EnableBackend("1")
+	lb.SetLameDuck(true)
+	if code := probe(lb, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected /readyz to fail in lame-duck mode, got %d", code)
+	}
+
+	// Custom paths leave the defaults to the backends, which need a token
+	custom, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: backend.URL}}, logger,
+		balancer.WithProbePaths("/-/alive", ""))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	if code := probe(custom, "/-/alive"); code != http.StatusOK {
+		t.Errorf("Expected the custom liveness path to answer %d, got %d", http.StatusOK, code)
+	}
+	if code := probe(custom, "/livez"); code != http.StatusUnauthorized {
+		t.Errorf("Expected /livez to be proxied and need a token, got %d", code)
+	}
+	if code := probe(custom, "/readyz"); code != http.StatusUnauthorized {
+		t.Errorf("Expected a disabled readiness path to be proxied, got %d", code)
+	}
+}
+
+func TestPathRoutes(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	var configs []balancer.BackendConfig
+	for i := 1; i <= 3; i++ {
+		server := httptest.NewServer(createBackendHandler(i, logger))
+		defer server.Close()
+		configs = append(configs, balancer.BackendConfig{URL: server.URL})
+	}
+
+	lb, err := balancer.NewLoadBalancer(configs, logger,
+		balancer.WithPathRoutes(
+			balancer.PathRoute{Prefix: "/api/", Backends: []int{0}},
+			balancer.PathRoute{Prefix: "/api/orders/", Backends: []int{1}},
+			balancer.PathRoute{Prefix: "/shop/users", Backends: []int{1}},
+		),
+		balancer.WithNoRoutePolicy(balancer.NoRoutePolicy{DefaultBackends: []int{2}}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	cases := map[string]string{
+		"/api/users/1":   "Response from Backend 1",
+		"/api/orders/7":  "Response from Backend 2",
+		"/api/orders":    "Response from Backend 1",
+		"/static/app.js": "Response from Backend 3",
+		// Prefixes match whole path segments
+		"/shop/users":        "Response from Backend 2",
+		"/shop/users/1":      "Response from Backend 2",
+		"/shop/usersettings": "Response from Backend 3",
+	}
+	for path, want := range cases {
+		if _, body := sendWithRole(t, server.URL+path, "User"); body != want {
+			t.Errorf("Expected %s to be served by %q, got %q", path, want, body)
+		}
+	}
+}
+
+func TestHeaderRouting(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	var configs []balancer.BackendConfig
+	for i := 1; i <= 3; i++ {
+		server := httptest.NewServer(createBackendHandler(i, logger))
+		defer server.Close()
+		configs = append(configs, balancer.BackendConfig{URL: server.URL})
+	}
+
+	lb, err := balancer.NewLoadBalancer(configs, logger,
+		balancer.WithRoutes(balancer.Route{Name: "canary", Match: balancer.MatchHeader("X-Canary", "true"), Backends: []int{2}}),
+		balancer.WithNoRoutePolicy(balancer.NoRoutePolicy{DefaultBackends: []int{0, 1}}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+
+	token, _ := balancer.GenerateJWT("User")
+	send := func(canary string) (int, string) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if canary != "" {
+			req.Header.Set("X-Canary", canary)
+		}
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, body := send("true"); body != "Response from Backend 3" {
+			t.Errorf("Expected canary request on the canary backend, got %q", body)
+		}
+		if _, body := send("false"); body == "Response from Backend 3" {
+			t.Error("Expected a request with another header value to skip the canary backend")
+		}
+		if _, body := send(""); body == "Response from Backend 3" {
+			t.Error("Expected a request without the header to skip the canary backend")
+		}
+	}
+
+	// The canary backend is only used while it is up
+	lb.DisableBackend("3")
+	if status, _ := send("true"); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected %d while the canary backend is out, got %d", http.StatusServiceUnavailable, status)
+	}
+}
+
+func TestTrafficSplit(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	var configs []balancer.BackendConfig
+	for i := 1; i <= 3; i++ {
+		server := httptest.NewServer(createBackendHandler(i, logger))
+		defer server.Close()
+		configs = append(configs, balancer.BackendConfig{URL: server.URL})
+	}
+
+	lb, err := balancer.NewLoadBalancer(configs, logger, balancer.WithTrafficSplit(balancer.TrafficSplit{
+		Groups: []balancer.SplitGroup{
+			{Name: "stable", Backends: []int{0, 1}, Weight: 100},
+			{Name: "new", Backends: []int{2}, Weight: 0},
+		},
+		HashHeader: "X-User",
+	}))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+
+	token, _ := balancer.GenerateJWT("User")
+	send := func(user string) string {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("X-User", user)
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+	count := func(users int) map[string]int {
+		seen := make(map[string]int)
+		for i := 0; i < users; i++ {
+			seen[send(fmt.Sprintf("user-%d", i))]++
+		}
+		return seen
+	}
+
+	if seen := count(20); seen["Response from Backend 3"] != 0 {
+		t.Errorf("Expected no traffic on the new group, got %v", seen)
+	}
+
+	// Weights change at runtime
+	if err := lb.SetSplitWeights(map[string]int{"stable": 0, "new": 1}); err != nil {
+		t.Fatalf("Failed to change split weights: %v", err)
+	}
+	if seen := count(20); seen["Response from Backend 3"] != 20 {
+		t.Errorf("Expected all traffic on the new group, got %v", seen)
+	}
+	if err := lb.SetSplitWeights(map[string]int{"missing": 1}); err == nil {
+		t.Error("Expected an unknown group to be rejected")
+	}
+
+	// The same user always lands in the same group
+	lb.SetSplitWeights(map[string]int{"stable": 1, "new": 1})
+	first := send("user-42") == "Response from Backend 3"
+	for i := 0; i < 10; i++ {
+		if (send("user-42") == "Response from Backend 3") != first {
+			t.Fatal("Expected a user to stay in one group")
+		}
+	}
+	seen := count(200)
+	if n := seen["Response from Backend 3"]; n < 60 || n > 140 {
+		t.Errorf("Expected about half the users on the new group, got %d of 200", n)
+	}
+
+	stats := lb.GetStats()["trafficSplit"].(map[string]interface{})["new"].(map[string]interface{})
+	if stats["weight"] != int64(1) {
+		t.Errorf("Expected the new weight in stats, got %v", stats)
+	}
+}
+
+func TestHostRouting(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	var configs []balancer.BackendConfig
+	for i := 1; i <= 3; i++ {
+		server := httptest.NewServer(createBackendHandler(i, logger))
+		defer server.Close()
+		configs = append(configs, balancer.BackendConfig{URL: server.URL})
+	}
+
+	lb, err := balancer.NewLoadBalancer(configs, logger,
+		balancer.WithRoutes(
+			balancer.Route{Name: "foo", Match: balancer.MatchHost("foo.example.com"), Backends: []int{0, 1}},
+			balancer.Route{Name: "bar", Match: balancer.MatchHost("*.bar.example.com"), Backends: []int{2}},
+		),
+		balancer.WithNoRoutePolicy(balancer.NoRoutePolicy{Reject: true}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+
+	token, _ := balancer.GenerateJWT("User")
+	send := func(host string) (int, string) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = host
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+
+	seen := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		_, body := send("FOO.example.com:8080")
+		seen[body]++
+	}
+	if seen["Response from Backend 1"] != 2 || seen["Response from Backend 2"] != 2 {
+		t.Errorf("Expected foo requests balanced over its pool, got %v", seen)
+	}
+	if _, body := send("api.bar.example.com"); body != "Response from Backend 3" {
+		t.Errorf("Expected bar request on its pool, got %q", body)
+	}
+	if status, _ := send("unknown.example.com"); status != http.StatusNotFound {
+		t.Errorf("Expected %d for an unknown host, got %d", http.StatusNotFound, status)
+	}
+}
+
+func TestLameDuck(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: backend.URL}}, logger)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	probe := func(path string) int {
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Code
+	}
+
+	// A request in flight when lame-duck mode starts still completes
+	inFlight := make(chan int, 1)
+	go func() {
+		code, _ := sendWithRole(t, server.URL+"/slow", "User")
+		inFlight <- code
+	}()
+	<-started
+	lb.SetLameDuck(true)
+
+	if code := probe("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected /readyz to fail in lame-duck mode, got %d", code)
+	}
+	if code := probe("/livez"); code != http.StatusOK {
+		t.Errorf("Expected /livez to pass in lame-duck mode, got %d", code)
+	}
+	// New requests are still served during the grace period
+	if code, body := sendWithRole(t, server.URL+"/", "User"); code != http.StatusOK || body != "ok" {
+		t.Errorf("Expected new requests to be served in lame-duck mode, got %d %q", code, body)
+	}
+	close(release)
+	if code := <-inFlight; code != http.StatusOK {
+		t.Errorf("Expected the in-flight request to complete, got %d", code)
+	}
+
+	lb.SetLameDuck(false)
+	if code := probe("/readyz"); code != http.StatusOK {
+		t.Errorf("Expected /readyz to pass after leaving lame-duck mode, got %d", code)
+	}
+}
+
+func TestStickySessions(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	var servers []*httptest.Server
+	var configs []balancer.BackendConfig
+	for i := 1; i <= 3; i++ {
+		server := httptest.NewServer(createBackendHandler(i, logger))
+		defer server.Close()
+		servers = append(servers, server)
+		configs = append(configs, balancer.BackendConfig{URL: server.URL})
+	}
+	lb, err := balancer.NewLoadBalancer(configs, logger, balancer.WithStickySessions("lb_backend"))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+
+	token, _ := balancer.GenerateJWT("User")
+	// send makes a request with the given sticky cookie, if any, and returns
+	// the response body and the cookie set in return, if any
+	send := func(pinned string) (string, string) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if pinned != "" {
+			req.AddCookie(&http.Cookie{Name: "lb_backend", Value: pinned})
+		}
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected %d, got %d", http.StatusOK, rec.Code)
+		}
+		for _, cookie := range rec.Result().Cookies() {
+			if cookie.Name == "lb_backend" {
+				return rec.Body.String(), cookie.Value
+			}
+		}
+		return rec.Body.String(), ""
+	}
+
+	// The first request is assigned a backend and pinned to it
+	first, cookie := send("")
+	if cookie == "" {
+		t.Fatal("Expected the first request to set the sticky cookie")
+	}
+	for i := 0; i < 5; i++ {
+		body, reissued := send(cookie)
+		if body != first {
+			t.Errorf("Expected pinned requests to reach %q, got %q", first, body)
+		}
+		if reissued != "" {
+			t.Errorf("Expected no new cookie while the pinned backend is up, got %q", reissued)
+		}
+	}
+
+	// A down backend is replaced and the cookie reset to the new one
+	if err := lb.DisableBackend(cookie); err != nil {
+		t.Fatalf("Failed to disable backend: %v", err)
+	}
+	second, moved := send(cookie)
+	if second == first || moved == "" || moved == cookie {
+		t.Fatalf("Expected a new backend and cookie once %s is down, got %q with cookie %q", cookie, second, moved)
+	}
+	if body, _ := send(moved); body != second {
+		t.Errorf("Expected the reissued cookie to pin %q, got %q", second, body)
+	}
+
+	// So is one that was removed
+	removed := servers[0].URL
+	for i, server := range servers {
+		if strings.HasSuffix(second, fmt.Sprintf("Backend %d", i+1)) {
+			removed = server.URL
+		}
+	}
+	if err := lb.RemoveBackend(removed); err != nil {
+		t.Fatalf("Failed to remove backend: %v", err)
+	}
+	third, reset := send(moved)
+	if third == second || reset == "" || reset == moved {
+		t.Errorf("Expected a new backend and cookie once %s is removed, got %q with cookie %q", moved, third, reset)
+	}
+}
+
+func TestRoutesSurviveBackendChanges(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	var configs []balancer.BackendConfig
+	for i := 1; i <= 3; i++ {
+		server := httptest.NewServer(createBackendHandler(i, logger))
+		defer server.Close()
+		configs = append(configs, balancer.BackendConfig{URL: server.URL})
+	}
+	extra := httptest.NewServer(createBackendHandler(4, logger))
+	defer extra.Close()
+
+	lb, err := balancer.NewLoadBalancer(configs, logger,
+		balancer.WithRoutes(balancer.Route{Name: "canary", Match: balancer.MatchHeader("X-Canary", "true"), Backends: []int{1}}),
+		balancer.WithPathRoutes(balancer.PathRoute{Prefix: "/api/", Backends: []int{2}}))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	token, _ := balancer.GenerateJWT("User")
+	send := func(path string, canary bool) (int, string) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if canary {
+			req.Header.Set("X-Canary", "true")
+		}
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+
+	// Removing the first backend must not shift the routes onto the next
+	if err := lb.RemoveBackend(configs[0].URL); err != nil {
+		t.Fatalf("Failed to remove backend: %v", err)
+	}
+	if err := lb.AddBackend(extra.URL, false); err != nil {
+		t.Fatalf("Failed to add backend: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		if _, body := send("/", true); body != "Response from Backend 2" {
+			t.Errorf("Expected the canary route to stay on backend 2, got %q", body)
+		}
+		if _, body := send("/api/x", false); body != "Response from Backend 3" {
+			t.Errorf("Expected the path route to stay on backend 3, got %q", body)
+		}
+	}
+
+	// A route whose only backend is removed has none left rather than
+	// inheriting another one
+	if err := lb.RemoveBackend(configs[1].URL); err != nil {
+		t.Fatalf("Failed to remove backend: %v", err)
+	}
+	if status, body := send("/", true); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 once the canary backend is gone, got %d %q", status, body)
+	}
+}
+
+func TestRoleRateLimits(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	// Two requests right away, then one every 10 seconds
+	lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: backend.URL}}, logger,
+		balancer.WithRoleRateLimits(map[string]balancer.RateLimit{"User": {Rate: 0.1, Burst: 2}}))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	// Use up the burst with requests that stay in flight
+	done := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			code, _ := sendWithRole(t, server.URL+"/", "User")
+			done <- code
+		}()
+		<-started
+	}
+	active := func() int64 {
+		return lb.GetStats()["backends"].([]map[string]interface{})[0]["activeConnections"].(int64)
+	}
+	if n := active(); n != 2 {
+		t.Fatalf("Expected 2 active requests, got %d", n)
+	}
+
+	token, _ := balancer.GenerateJWT("User")
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	lb.ServeHTTP(rec, req)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected %d once the burst is used, got %d", http.StatusTooManyRequests, rec.Code)
+	}
+	retryAfter, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+	if err != nil || retryAfter < 1 || retryAfter > 10 {
+		t.Errorf("Expected a Retry-After of up to 10 seconds, got %q", rec.Header().Get("Retry-After"))
+	}
+	// The rejected request never reached a backend
+	if n := active(); n != 2 {
+		t.Errorf("Expected the rejected request to leave 2 active requests, got %d", n)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if code := <-done; code != http.StatusOK {
+			t.Errorf("Expected requests within the burst to succeed, got %d", code)
+		}
+	}
+	stats := lb.GetStats()["backends"].([]map[string]interface{})[0]
+	if stats["requestCount"] != uint64(2) || stats["activeConnections"] != int64(0) {
+		t.Errorf("Expected 2 requests and none active, got %v and %v", stats["requestCount"], stats["activeConnections"])
+	}
+
+	// Other roles have no limit
+	if code, _ := sendWithRole(t, server.URL+"/", "Client"); code != http.StatusOK {
+		t.Errorf("Expected an unlimited role to pass, got %d", code)
+	}
+}
+
+func TestAccessRules(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	backend := httptest.NewServer(createBackendHandler(1, logger))
+	defer backend.Close()
+
+	lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: backend.URL, Admin: true}}, logger,
+		balancer.WithAccessRules(
+			balancer.AccessRule{PathPrefix: "/admin/", Roles: []string{"Admin"}},
+			balancer.AccessRule{PathPrefix: "/admin/reports", Roles: []string{"Admin", "User"}},
+		))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	send := func(target, role string) int {
+		req := httptest.NewRequest("GET", target, nil)
+		if role != "" {
+			token, _ := balancer.GenerateJWT(role)
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	tests := []struct {
+		path string
+		role string
+		want int
+	}{
+		{"/admin/users", "Admin", http.StatusOK},
+		{"/admin/users", "User", http.StatusForbidden},
+		{"/admin", "User", http.StatusForbidden},
+		// Ways around a plain prefix match
+		{"/public/../admin/users", "User", http.StatusForbidden},
+		{"//admin/users", "User", http.StatusForbidden},
+		{"/admin//users", "User", http.StatusForbidden},
+		{"/./admin/users", "User", http.StatusForbidden},
+		{"/admin/reports/../users", "User", http.StatusForbidden},
+		// Prefixes match whole segments and the longest one wins
+		{"/administrator", "User", http.StatusOK},
+		{"/admin/reports/daily", "User", http.StatusOK},
+		{"/admin/reportsx", "User", http.StatusForbidden},
+		{"/public", "User", http.StatusOK},
+		// Authentication comes before authorization
+		{"/admin/users", "", http.StatusUnauthorized},
+		{"/public", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if got := send(tt.path, tt.role); got != tt.want {
+			t.Errorf("%s as %q: expected %d, got %d", tt.path, tt.role, tt.want, got)
+		}
+	}
+}
+
+func TestRoleRoutesSurviveBackendChanges(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	var configs []balancer.BackendConfig
+	for i := 1; i <= 3; i++ {
+		server := httptest.NewServer(createBackendHandler(i, logger))
+		defer server.Close()
+		configs = append(configs, balancer.BackendConfig{URL: server.URL, Admin: i == 2})
+	}
+	extra := httptest.NewServer(createBackendHandler(4, logger))
+	defer extra.Close()
+
+	lb, err := balancer.NewLoadBalancer(configs, logger,
+		balancer.WithRoleRoutes(map[string][]int{"Admin": {1}, "User": {0, 2}}))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	send := func(role string) (int, string) {
+		token, _ := balancer.GenerateJWT(role)
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+
+	// Removing the first backend must not move the admin role onto the
+	// regular backend that now sits at its position
+	if err := lb.RemoveBackend(configs[0].URL); err != nil {
+		t.Fatalf("Failed to remove backend: %v", err)
+	}
+	if err := lb.AddBackend(extra.URL, false); err != nil {
+		t.Fatalf("Failed to add backend: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		if _, body := send("Admin"); body != "Response from Backend 2" {
+			t.Errorf("Expected the admin role to stay on backend 2, got %q", body)
+		}
+		if _, body := send("User"); body != "Response from Backend 3" {
+			t.Errorf("Expected the user role to stay on backend 3, got %q", body)
+		}
+	}
+
+	// With its only backend gone the admin role is refused
+	if err := lb.RemoveBackend(configs[1].URL); err != nil {
+		t.Fatalf("Failed to remove backend: %v", err)
+	}
+	if status, body := send("Admin"); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 once the admin backend is gone, got %d %q", status, body)
+	}
+}
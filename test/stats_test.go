@@ -0,0 +1,303 @@
+package test
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"loadBalancer/balancer"
+)
+
+func TestStatusCodeStats(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/fail":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer backend.Close()
+
+	lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: backend.URL}}, logger)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	for _, path := range []string{"/", "/", "/missing", "/fail"} {
+		sendWithRole(t, server.URL+path, "User")
+	}
+
+	stats := lb.GetStats()["backends"].([]map[string]interface{})[0]
+	codes := stats["statusCodes"].(map[string]uint64)
+	want := map[string]uint64{"2xx": 2, "3xx": 0, "4xx": 1, "5xx": 1}
+	for class, count := range want {
+		if codes[class] != count {
+			t.Errorf("Expected %d %s responses, got %d", count, class, codes[class])
+		}
+	}
+}
+
+func TestConnectionPoolStats(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: backend.URL}}, logger)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	// waitFor polls the connection counts, which settle just after the
+	// response reaches the client
+	waitFor := func(open, idle, inUse int64) {
+		t.Helper()
+		var stats map[string]interface{}
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			stats = lb.GetStats()["backends"].([]map[string]interface{})[0]
+			if stats["openConnections"] == open && stats["idleConnections"] == idle && stats["inUseConnections"] == inUse {
+				return
+			}
+		}
+		t.Fatalf("Expected %d open, %d idle and %d in-use connections, got %v, %v and %v",
+			open, idle, inUse, stats["openConnections"], stats["idleConnections"], stats["inUseConnections"])
+	}
+
+	// Sequential requests share one connection
+	for i := 0; i < 3; i++ {
+		sendWithRole(t, server.URL+"/", "User")
+	}
+	waitFor(1, 1, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sendWithRole(t, server.URL+"/slow", "User")
+		}()
+	}
+	waitFor(3, 0, 3)
+	close(release)
+	wg.Wait()
+	waitFor(3, 3, 0)
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	backend := httptest.NewServer(createBackendHandler(1, logger))
+	defer backend.Close()
+
+	lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: backend.URL}}, logger, balancer.WithMetricsPath("/metrics"))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	for i := 0; i < 3; i++ {
+		if code, _ := sendWithRole(t, server.URL+"/", "User"); code != http.StatusOK {
+			t.Fatalf("Expected %d, got %d", http.StatusOK, code)
+		}
+	}
+
+	// The endpoint needs no token
+	scrape := func() string {
+		t.Helper()
+		resp, err := http.Get(server.URL + "/metrics")
+		if err != nil {
+			t.Fatalf("Failed to scrape metrics: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected %d from the metrics endpoint, got %d", http.StatusOK, resp.StatusCode)
+		}
+		if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain") {
+			t.Errorf("Expected the text exposition format, got %q", contentType)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	metrics := scrape()
+
+	label := fmt.Sprintf(`{backend=%q}`, backend.URL)
+	for _, series := range []string{
+		// Scrapes are not counted as requests
+		"lb_requests_total 3",
+		"lb_backend_requests_total" + label + " 3",
+		"lb_backend_up" + label + " 1",
+		"lb_request_duration_seconds_count" + label + " 3",
+		`lb_retry_outcomes_total{outcome="first_try_success"} 3`,
+	} {
+		if !strings.Contains(metrics, series+"\n") {
+			t.Errorf("Expected series %q in:\n%s", series, metrics)
+		}
+	}
+	for _, help := range []string{"lb_requests_total", "lb_backend_up", "lb_request_duration_seconds"} {
+		if !strings.Contains(metrics, "# HELP "+help+" ") || !strings.Contains(metrics, "# TYPE "+help+" ") {
+			t.Errorf("Expected HELP and TYPE lines for %s", help)
+		}
+	}
+
+	// A removed backend's series go away with it
+	if err := lb.RemoveBackend(backend.URL); err != nil {
+		t.Fatalf("Failed to remove backend: %v", err)
+	}
+	if metrics := scrape(); strings.Contains(metrics, label) {
+		t.Errorf("Expected no series for the removed backend, got:\n%s", metrics)
+	}
+}
+
+func TestStatsDExporter(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	backend := httptest.NewServer(createBackendHandler(1, logger))
+	defer backend.Close()
+
+	lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: backend.URL}}, logger)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	for i := 0; i < 3; i++ {
+		if code, _ := sendWithRole(t, server.URL+"/", "User"); code != http.StatusOK {
+			t.Fatalf("Expected %d, got %d", http.StatusOK, code)
+		}
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer conn.Close()
+
+	// receive collects the lines of the packets arriving within wait
+	receive := func(wait time.Duration) map[string]string {
+		lines := make(map[string]string)
+		buf := make([]byte, 64*1024)
+		conn.SetReadDeadline(time.Now().Add(wait))
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return lines
+			}
+			for _, line := range strings.Split(string(buf[:n]), "\n") {
+				name, value, _ := strings.Cut(line, ":")
+				lines[name] = value
+			}
+		}
+	}
+
+	interval := 200 * time.Millisecond
+	exporter, err := lb.PushStatsD(conn.LocalAddr().String(), interval)
+	if err != nil {
+		t.Fatalf("Failed to start the exporter: %v", err)
+	}
+
+	bucket := ".backend." + strings.NewReplacer(":", "_", "/", "_", ".", "_").Replace(backend.URL)
+	lines := receive(2 * interval)
+	want := map[string]string{
+		"lb_requests_total":                                 "3|c",
+		"lb_backend_requests_total" + bucket:                "3|c",
+		"lb_backend_up" + bucket:                            "1|g",
+		"lb_request_duration_seconds" + bucket + ".count":   "3|c",
+		"lb_retry_outcomes_total.outcome.first_try_success": "3|c",
+	}
+	for name, value := range want {
+		if lines[name] != value {
+			t.Errorf("Expected %s:%s in the first push, got %q", name, value, lines[name])
+		}
+	}
+	if value := lines["lb_request_duration_seconds"+bucket]; !strings.HasSuffix(value, "|ms") {
+		t.Errorf("Expected the mean request duration as a timer, got %q", value)
+	}
+
+	// Close pushes once more: counters that did not move are left out
+	if err := exporter.Close(); err != nil {
+		t.Fatalf("Failed to close the exporter: %v", err)
+	}
+	lines = receive(100 * time.Millisecond)
+	if value, ok := lines["lb_requests_total"]; ok {
+		t.Errorf("Expected no unchanged counter in the final push, got %q", value)
+	}
+	if value := lines["lb_backend_up"+bucket]; value != "1|g" {
+		t.Errorf("Expected gauges in the final push, got %q", value)
+	}
+
+	// And the loop stops
+	if lines := receive(3 * interval); len(lines) > 0 {
+		t.Errorf("Expected no pushes after Close, got %v", lines)
+	}
+}
+
+func TestConnectionReuseStats(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	backend := httptest.NewServer(createBackendHandler(1, logger))
+	defer backend.Close()
+
+	lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: backend.URL}}, logger)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	stats := func() map[string]interface{} {
+		return lb.GetStats()["backends"].([]map[string]interface{})[0]
+	}
+	if stats()["connectionsDialed"].(uint64) != 0 || stats()["connReuseRatio"].(float64) != 0 {
+		t.Fatalf("Expected no connections before any request, got %v", stats())
+	}
+
+	const requests = 5
+	for i := 0; i < requests; i++ {
+		if code, _ := sendWithRole(t, server.URL+"/", "User"); code != http.StatusOK {
+			t.Fatalf("Expected %d, got %d", http.StatusOK, code)
+		}
+		// The connection goes back to the pool just after the response
+		// reaches the client
+		deadline := time.Now().Add(2 * time.Second)
+		for stats()["idleConnections"].(int64) != 1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected the connection to become idle after request %d", i+1)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// One dial, then keep-alive reuse for every later request
+	backendStats := stats()
+	if dialed := backendStats["connectionsDialed"].(uint64); dialed != 1 {
+		t.Errorf("Expected 1 dialed connection, got %d", dialed)
+	}
+	if reused := backendStats["connectionsReused"].(uint64); reused != requests-1 {
+		t.Errorf("Expected %d reused connections, got %d", requests-1, reused)
+	}
+	if ratio := backendStats["connReuseRatio"].(float64); ratio != float64(requests-1)/requests {
+		t.Errorf("Expected a reuse ratio of %v, got %v", float64(requests-1)/requests, ratio)
+	}
+}
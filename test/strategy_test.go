@@ -0,0 +1,597 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"loadBalancer/balancer"
+)
+
+// activeByBackend returns the number of in-flight requests per backend ID
+func activeByBackend(lb *balancer.LoadBalancer) map[int]int64 {
+	active := make(map[int]int64)
+	for _, backend := range lb.GetStats()["backends"].([]map[string]interface{}) {
+		active[backend["id"].(int)] = backend["activeConnections"].(int64)
+	}
+	return active
+}
+
+func TestWeightedLeastConnections(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	// Backends hold every request open until released
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	heavy := httptest.NewServer(handler)
+	defer heavy.Close()
+	light := httptest.NewServer(handler)
+	defer light.Close()
+	configs := []balancer.BackendConfig{
+		{URL: heavy.URL, Weight: 3},
+		{URL: light.URL, Weight: 1},
+	}
+
+	const concurrent = 8
+	distribute := func(strategy balancer.Strategy) map[int]int64 {
+		lb, err := balancer.NewLoadBalancer(configs, logger, balancer.WithStrategy(strategy))
+		if err != nil {
+			t.Fatalf("Failed to create load balancer: %v", err)
+		}
+		server := httptest.NewServer(lb)
+		defer server.Close()
+
+		done := make(chan struct{}, concurrent)
+		for i := 0; i < concurrent; i++ {
+			go func() {
+				sendWithRole(t, server.URL, "User")
+				done <- struct{}{}
+			}()
+			// Wait until the request is in flight so each selection sees
+			// the previous ones
+			deadline := time.Now().Add(2 * time.Second)
+			for {
+				active := activeByBackend(lb)
+				if active[1]+active[2] == int64(i+1) {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("Request %d never reached a backend", i+1)
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+
+		active := activeByBackend(lb)
+		for i := 0; i < concurrent; i++ {
+			release <- struct{}{}
+		}
+		for i := 0; i < concurrent; i++ {
+			<-done
+		}
+		return active
+	}
+
+	// Plain least-connections ignores the weights
+	if active := distribute(balancer.StrategyLeastConnections); active[1] != 4 || active[2] != 4 {
+		t.Errorf("Expected least-connections to split 4/4, got %d/%d", active[1], active[2])
+	}
+	// With two backends power of two choices always compares both
+	if active := distribute(balancer.StrategyPowerOfTwo); active[1] != 4 || active[2] != 4 {
+		t.Errorf("Expected p2c to split 4/4, got %d/%d", active[1], active[2])
+	}
+	// Weighted least-connections follows the 3:1 weights
+	if active := distribute(balancer.StrategyWeightedLeastConnections); active[1] != 6 || active[2] != 2 {
+		t.Errorf("Expected weighted least-connections to split 6/2, got %d/%d", active[1], active[2])
+	}
+}
+
+func TestHealthScoring(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	healthy := httptest.NewServer(createBackendHandler(1, logger))
+	defer healthy.Close()
+	degraded := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer degraded.Close()
+
+	lb, err := balancer.NewLoadBalancer(
+		[]balancer.BackendConfig{{URL: healthy.URL}, {URL: degraded.URL}},
+		logger,
+		balancer.WithStrategy(balancer.StrategyWeighted),
+		balancer.WithHealthScoring(balancer.HealthScoring{ErrorWeight: 4}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	failures := 0
+	for i := 0; i < 100; i++ {
+		if status, _ := sendWithRole(t, server.URL, "User"); status != http.StatusOK {
+			failures++
+		}
+	}
+	// Without scoring about half the requests would fail
+	if failures > 20 {
+		t.Errorf("Expected the degraded backend to get little traffic, %d of 100 requests failed", failures)
+	}
+
+	stats := lb.GetStats()["backends"].([]map[string]interface{})
+	if stats[0]["healthScore"].(float64) != 1 || stats[1]["healthScore"].(float64) >= 0.1 {
+		t.Errorf("Expected scores near 1 and 0, got %v and %v", stats[0]["healthScore"], stats[1]["healthScore"])
+	}
+}
+
+func TestRandomStrategy(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	var configs []balancer.BackendConfig
+	for i := 0; i < 3; i++ {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer server.Close()
+		configs = append(configs, balancer.BackendConfig{URL: server.URL})
+	}
+	configs = append(configs, balancer.BackendConfig{URL: "http://127.0.0.1:1"})
+
+	lb, err := balancer.NewLoadBalancer(configs, logger, balancer.WithStrategy(balancer.StrategyRandom))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	if err := lb.DisableBackend("http://127.0.0.1:1"); err != nil {
+		t.Fatalf("Failed to disable backend: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	for i := 0; i < 300; i++ {
+		if status, _ := sendWithRole(t, server.URL, "User"); status != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, status)
+		}
+	}
+
+	// Every enabled backend gets a share, the disabled one none
+	for i, backend := range lb.GetStats()["backends"].([]map[string]interface{}) {
+		count := backend["requestCount"].(uint64)
+		if i < 3 && count < 50 {
+			t.Errorf("Expected backend %d to get about a third of 300 requests, got %d", i+1, count)
+		}
+		if i == 3 && count != 0 {
+			t.Errorf("Expected no requests for the disabled backend, got %d", count)
+		}
+	}
+}
+
+func TestCustomSelector(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	var configs []balancer.BackendConfig
+	for i := 0; i < 3; i++ {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer server.Close()
+		configs = append(configs, balancer.BackendConfig{URL: server.URL})
+	}
+
+	// Tenant "acme" lives on the second backend, everyone else is balanced
+	home := configs[1].URL
+	selector := balancer.SelectorFunc(func(r *http.Request, role string, backends []*balancer.Backend) *balancer.Backend {
+		if r.Header.Get("X-Tenant") != "acme" {
+			return nil
+		}
+		for _, backend := range backends {
+			if backend.URL.String() == home {
+				return backend
+			}
+		}
+		return nil
+	})
+	lb, err := balancer.NewLoadBalancer(configs, logger, balancer.WithSelector(selector))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	token, _ := balancer.GenerateJWT("User")
+	send := func(tenant string) {
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("X-Tenant", tenant)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error sending request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+	}
+	counts := func() []uint64 {
+		var counts []uint64
+		for _, backend := range lb.GetStats()["backends"].([]map[string]interface{}) {
+			counts = append(counts, backend["requestCount"].(uint64))
+		}
+		return counts
+	}
+
+	for i := 0; i < 6; i++ {
+		send("acme")
+	}
+	if got := counts(); got[0] != 0 || got[1] != 6 || got[2] != 0 {
+		t.Errorf("Expected all acme requests on backend 2, got %v", got)
+	}
+	for i := 0; i < 6; i++ {
+		send("other")
+	}
+	if got := counts(); got[0] != 2 || got[1] != 8 || got[2] != 2 {
+		t.Errorf("Expected other tenants to be spread round robin, got %v", got)
+	}
+
+	// A selected backend that is down leaves the request to the strategy
+	if err := lb.DisableBackend(home); err != nil {
+		t.Fatalf("Failed to disable backend: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		send("acme")
+	}
+	if got := counts(); got[1] != 8 || got[0]+got[2] != 8 {
+		t.Errorf("Expected acme requests to fall back to the other backends, got %v", got)
+	}
+}
+
+func TestIPHashStrategy(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	var configs []balancer.BackendConfig
+	for i := 1; i <= 3; i++ {
+		server := httptest.NewServer(createBackendHandler(i, logger))
+		defer server.Close()
+		configs = append(configs, balancer.BackendConfig{URL: server.URL})
+	}
+	lb, err := balancer.NewLoadBalancer(configs, logger, balancer.WithStrategy(balancer.StrategyIPHash))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	token, _ := balancer.GenerateJWT("User")
+	send := func(ip string) string {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = ip + ":40000"
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, rec.Code)
+		}
+		return rec.Body.String()
+	}
+	assign := func() map[string]string {
+		assigned := make(map[string]string)
+		for i := 1; i <= 30; i++ {
+			ip := fmt.Sprintf("10.0.0.%d", i)
+			assigned[ip] = send(ip)
+		}
+		return assigned
+	}
+
+	// The same client keeps reaching the same backend, and clients spread
+	// over all of them
+	initial := assign()
+	used := make(map[string]bool)
+	for ip, backend := range initial {
+		used[backend] = true
+		for i := 0; i < 3; i++ {
+			if got := send(ip); got != backend {
+				t.Errorf("Expected %s to stay on %q, got %q", ip, backend, got)
+			}
+		}
+	}
+	if len(used) != 3 {
+		t.Errorf("Expected 30 clients to spread over 3 backends, got %d", len(used))
+	}
+
+	// Clients are rehashed over the backends still up, none reaches the
+	// one that is down, and each sticks to its new backend
+	if err := lb.DisableBackend(configs[0].URL); err != nil {
+		t.Fatalf("Failed to disable backend: %v", err)
+	}
+	down := assign()
+	for ip, backend := range down {
+		if backend == "Response from Backend 1" {
+			t.Errorf("Expected %s to leave the disabled backend", ip)
+		}
+		if got := send(ip); got != backend {
+			t.Errorf("Expected %s to stay on %q, got %q", ip, backend, got)
+		}
+	}
+
+	// Once the backend is back every client returns to where it started
+	if err := lb.EnableBackend(configs[0].URL); err != nil {
+		t.Fatalf("Failed to enable backend: %v", err)
+	}
+	for ip, backend := range assign() {
+		if backend != initial[ip] {
+			t.Errorf("Expected %s back on %q, got %q", ip, initial[ip], backend)
+		}
+	}
+}
+
+func TestConsistentHashStrategy(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	var configs []balancer.BackendConfig
+	for i := 1; i <= 3; i++ {
+		server := httptest.NewServer(createBackendHandler(i, logger))
+		defer server.Close()
+		configs = append(configs, balancer.BackendConfig{URL: server.URL})
+	}
+	extra := httptest.NewServer(createBackendHandler(4, logger))
+	defer extra.Close()
+
+	lb, err := balancer.NewLoadBalancer(configs, logger,
+		balancer.WithStrategy(balancer.StrategyConsistentHash),
+		balancer.WithConsistentHash(0, "X-User"))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	token, _ := balancer.GenerateJWT("User")
+	send := func(key string) string {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("X-User", key)
+		rec := httptest.NewRecorder()
+		lb.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, rec.Code)
+		}
+		return rec.Body.String()
+	}
+	assign := func() map[string]string {
+		assigned := make(map[string]string)
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("user-%d", i)
+			assigned[key] = send(key)
+		}
+		return assigned
+	}
+
+	// The same key keeps reaching the same backend, and keys spread over
+	// all of them
+	initial := assign()
+	used := make(map[string]int)
+	for key, backend := range initial {
+		used[backend]++
+		if got := send(key); got != backend {
+			t.Errorf("Expected %s to stay on %q, got %q", key, backend, got)
+		}
+	}
+	for backend, count := range used {
+		if count < 10 {
+			t.Errorf("Expected each backend to get a fair share of 100 keys, %q got %d", backend, count)
+		}
+	}
+	if len(used) != 3 {
+		t.Errorf("Expected 100 keys to spread over 3 backends, got %v", used)
+	}
+
+	// Only the keys of a backend that is down move, the others stay put
+	const first = "Response from Backend 1"
+	if err := lb.DisableBackend(configs[0].URL); err != nil {
+		t.Fatalf("Failed to disable backend: %v", err)
+	}
+	for key, backend := range assign() {
+		if initial[key] == first && backend == first {
+			t.Errorf("Expected %s to leave the disabled backend", key)
+		}
+		if initial[key] != first && backend != initial[key] {
+			t.Errorf("Expected %s to stay on %q, got %q", key, initial[key], backend)
+		}
+	}
+	if err := lb.EnableBackend(configs[0].URL); err != nil {
+		t.Fatalf("Failed to enable backend: %v", err)
+	}
+	for key, backend := range assign() {
+		if backend != initial[key] {
+			t.Errorf("Expected %s back on %q, got %q", key, initial[key], backend)
+		}
+	}
+
+	// A removed backend's keys move the same way, and an added backend
+	// only takes keys over, never shuffles them between the others
+	if err := lb.RemoveBackend(configs[0].URL); err != nil {
+		t.Fatalf("Failed to remove backend: %v", err)
+	}
+	removed := assign()
+	for key, backend := range removed {
+		if initial[key] != first && backend != initial[key] {
+			t.Errorf("Expected %s to stay on %q after the removal, got %q", key, initial[key], backend)
+		}
+	}
+	if err := lb.AddBackend(extra.URL, false); err != nil {
+		t.Fatalf("Failed to add backend: %v", err)
+	}
+	moved := 0
+	for key, backend := range assign() {
+		if backend == removed[key] {
+			continue
+		}
+		moved++
+		if backend != "Response from Backend 4" {
+			t.Errorf("Expected %s to stay on %q or move to the new backend, got %q", key, removed[key], backend)
+		}
+	}
+	if moved == 0 || moved > 60 {
+		t.Errorf("Expected the new backend to take a share of the keys, %d of 100 moved", moved)
+	}
+}
+
+func TestBackendLoadReporting(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	// The busy backend reports whatever load is stored, the other none
+	var report atomic.Value
+	report.Store("")
+	busy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if value := report.Load().(string); value != "" {
+			w.Header().Set("X-Backend-Load", value)
+		}
+	}))
+	defer busy.Close()
+	idle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer idle.Close()
+
+	halfLife := 200 * time.Millisecond
+	lb, err := balancer.NewLoadBalancer(
+		[]balancer.BackendConfig{{URL: busy.URL}, {URL: idle.URL}},
+		logger,
+		balancer.WithStrategy(balancer.StrategyWeighted),
+		balancer.WithBackendLoadReporting("X-Backend-Load", halfLife),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	busyStats := func() map[string]interface{} {
+		return lb.GetStats()["backends"].([]map[string]interface{})[0]
+	}
+	// share returns the fraction of n requests the busy backend served
+	share := func(n int) float64 {
+		before := busyStats()["requestCount"].(uint64)
+		for i := 0; i < n; i++ {
+			if status, _ := sendWithRole(t, server.URL, "User"); status != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d", http.StatusOK, status)
+			}
+		}
+		return float64(busyStats()["requestCount"].(uint64)-before) / float64(n)
+	}
+
+	// A missing or unparsable report leaves the weights alone
+	for _, value := range []string{"", "busy", "NaN"} {
+		report.Store(value)
+		if got := share(200); got < 0.3 || got > 0.7 {
+			t.Errorf("Expected an even split with load %q, the busy backend got %.2f", value, got)
+		}
+		if load := busyStats()["reportedLoad"].(float64); load != 0 {
+			t.Errorf("Expected load %q to be ignored, got %v", value, load)
+		}
+	}
+
+	// A backend near saturation gets a much smaller share, about 0.1/1.1
+	report.Store("0.9")
+	if got := share(200); got > 0.25 {
+		t.Errorf("Expected the loaded backend to get a small share, got %.2f", got)
+	}
+	if load := busyStats()["reportedLoad"].(float64); load < 0.8 || load > 0.9 {
+		t.Errorf("Expected a reported load near 0.9, got %v", load)
+	}
+
+	// Without fresh reports the load halves every half-life
+	report.Store("")
+	time.Sleep(2 * halfLife)
+	if load := busyStats()["reportedLoad"].(float64); load <= 0 || load > 0.9/4 {
+		t.Errorf("Expected the load to decay to at most %v after two half-lives, got %v", 0.9/4, load)
+	}
+	time.Sleep(4 * halfLife)
+	if got := share(200); got < 0.3 || got > 0.7 {
+		t.Errorf("Expected an even split once the load faded, the busy backend got %.2f", got)
+	}
+}
+
+func TestSlowStart(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	var down atomic.Bool
+	flapping := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer flapping.Close()
+	steady := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer steady.Close()
+
+	const window = time.Second
+	lb, err := balancer.NewLoadBalancer(
+		[]balancer.BackendConfig{{URL: flapping.URL}, {URL: steady.URL}},
+		logger,
+		balancer.WithSlowStart(window),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	flappingStats := func() map[string]interface{} {
+		return lb.GetStats()["backends"].([]map[string]interface{})[0]
+	}
+	waitAlive := func(alive bool) {
+		deadline := time.Now().Add(2 * time.Second)
+		for flappingStats()["isAlive"].(bool) != alive {
+			if time.Now().After(deadline) {
+				t.Fatalf("Backend never became alive=%v", alive)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	// share returns the fraction of n requests the flapping backend served
+	share := func(n int) float64 {
+		before := flappingStats()["requestCount"].(uint64)
+		for i := 0; i < n; i++ {
+			if status, _ := sendWithRole(t, server.URL, "User"); status != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d", http.StatusOK, status)
+			}
+		}
+		return float64(flappingStats()["requestCount"].(uint64)-before) / float64(n)
+	}
+
+	// Backends that never went down are not held back
+	if factor := flappingStats()["warmupFactor"].(float64); factor != 1 {
+		t.Errorf("Expected no warmup before any recovery, got %v", factor)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lb.HealthCheck(ctx, 10*time.Millisecond)
+
+	down.Store(true)
+	waitAlive(false)
+	down.Store(false)
+	waitAlive(true)
+	recovered := time.Now()
+
+	// Right after recovering the backend starts near the floor rather than
+	// at its round-robin half
+	if factor := flappingStats()["warmupFactor"].(float64); factor < 0.1 || factor > 0.2 {
+		t.Errorf("Expected a warmup factor near the 0.1 floor, got %v", factor)
+	}
+	if got := share(200); got > 0.2 {
+		t.Errorf("Expected a small share right after recovering, got %.2f", got)
+	}
+
+	// Halfway through the window it has ramped up part of the way
+	time.Sleep(time.Until(recovered.Add(window / 2)))
+	if factor := flappingStats()["warmupFactor"].(float64); factor < 0.4 || factor > 0.8 {
+		t.Errorf("Expected a warmup factor near 0.55 halfway through, got %v", factor)
+	}
+
+	// After the window it gets its full share again
+	time.Sleep(time.Until(recovered.Add(window)))
+	if factor := flappingStats()["warmupFactor"].(float64); factor != 1 {
+		t.Errorf("Expected the warmup to end after the window, got %v", factor)
+	}
+	if got := share(200); got < 0.4 || got > 0.6 {
+		t.Errorf("Expected a round-robin half after the window, got %.2f", got)
+	}
+}
@@ -0,0 +1,414 @@
+package test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"loadBalancer/balancer"
+)
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	// Backend accepts the request but never sends headers until the client goes away
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer stalled.Close()
+
+	lb, err := balancer.NewLoadBalancer(
+		[]balancer.BackendConfig{{URL: stalled.URL}},
+		logger,
+		balancer.WithResponseHeaderTimeout(100*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	lbServer := httptest.NewServer(lb)
+	defer lbServer.Close()
+
+	token, err := balancer.GenerateJWT("User")
+	if err != nil {
+		t.Fatalf("Error generating token: %v", err)
+	}
+	req, err := http.NewRequest("GET", lbServer.URL, nil)
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("Expected status %d, got %d", http.StatusGatewayTimeout, resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Request took %v, expected the header timeout to cut it short", elapsed)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer stalled.Close()
+
+	// The request deadline is shorter than the header timeout and cuts in first
+	lb, err := balancer.NewLoadBalancer(
+		[]balancer.BackendConfig{{URL: stalled.URL}},
+		logger,
+		balancer.WithRequestTimeout(100*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	lbServer := httptest.NewServer(lb)
+	defer lbServer.Close()
+
+	start := time.Now()
+	status, _ := sendWithRole(t, lbServer.URL, "User")
+	if status != http.StatusGatewayTimeout {
+		t.Errorf("Expected status %d, got %d", http.StatusGatewayTimeout, status)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Request took %v, expected the request timeout to cut it short", elapsed)
+	}
+}
+
+func TestOversizedResponseHeaders(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Huge", strings.Repeat("a", 8<<10))
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	lb, err := balancer.NewLoadBalancer(
+		[]balancer.BackendConfig{{URL: backend.URL}},
+		logger,
+		balancer.WithMaxResponseHeaderBytes(4<<10),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	status, body := sendWithRole(t, server.URL, "User")
+	if status != http.StatusBadGateway {
+		t.Errorf("Expected %d for oversized headers, got %d", http.StatusBadGateway, status)
+	}
+	if body != "Backend server 1 sent oversized response headers" {
+		t.Errorf("Unexpected body %q", body)
+	}
+}
+
+func TestBackendKeepAlives(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	var connections int64
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+	backend.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&connections, 1)
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+
+	token, _ := balancer.GenerateJWT("User")
+	// wave sends n concurrent requests and waits for all of them
+	wave := func(lb *balancer.LoadBalancer, n int) {
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req := httptest.NewRequest("GET", "/", nil)
+				req.Header.Set("Authorization", "Bearer "+token)
+				lb.ServeHTTP(httptest.NewRecorder(), req)
+			}()
+		}
+		wg.Wait()
+	}
+
+	// The default idle pool keeps every connection of a burst for the next
+	// one, where net/http would keep only two
+	lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: backend.URL}}, logger)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	wave(lb, 10)
+	wave(lb, 10)
+	if n := atomic.LoadInt64(&connections); n > 12 {
+		t.Errorf("Expected the second burst to reuse connections, %d were opened", n)
+	}
+
+	// The connect timeout only bounds dialing: connections that outlive it
+	// are still reused
+	atomic.StoreInt64(&connections, 0)
+	shortDial, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: backend.URL}}, logger, balancer.WithDialTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		wave(shortDial, 1)
+	}
+	if n := atomic.LoadInt64(&connections); n != 1 {
+		t.Errorf("Expected one connection with a short dial timeout, got %d", n)
+	}
+
+	atomic.StoreInt64(&connections, 0)
+	noKeepAlive, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: backend.URL}}, logger, balancer.WithKeepAlives(false))
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		wave(noKeepAlive, 1)
+	}
+	if n := atomic.LoadInt64(&connections); n != 3 {
+		t.Errorf("Expected a connection per request without keep-alives, got %d", n)
+	}
+}
+
+func TestBodySizeLimits(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	var received int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		atomic.AddInt64(&received, 1)
+		if r.URL.Path == "/large" {
+			w.Write([]byte(strings.Repeat("a", 2048)))
+			return
+		}
+		if r.URL.Path == "/stream" {
+			// Without a Content-Length the cap is only hit while copying
+			w.Write([]byte(strings.Repeat("a", 1024)))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(strings.Repeat("a", 1024)))
+			return
+		}
+		w.Write([]byte(strings.Repeat("a", int(n))))
+	}))
+	defer backend.Close()
+
+	lb, err := balancer.NewLoadBalancer(
+		[]balancer.BackendConfig{{URL: backend.URL}},
+		logger,
+		balancer.WithRetries(1),
+		balancer.WithCircuitBreaker(1, time.Minute),
+		balancer.WithMaxRequestBodyBytes(1024),
+		balancer.WithMaxResponseBodyBytes(1024),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	token, _ := balancer.GenerateJWT("User")
+	post := func(path string, body io.Reader) (int, string, error) {
+		req, _ := http.NewRequest("POST", server.URL+path, body)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, "", err
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data), err
+	}
+
+	// A body declared too large is rejected before reaching the backend
+	status, body, err := post("/", strings.NewReader(strings.Repeat("b", 2048)))
+	if err != nil || status != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected %d for a declared oversized body, got %d (%v)", http.StatusRequestEntityTooLarge, status, err)
+	}
+	if body != "Request body too large" {
+		t.Errorf("Unexpected body %q", body)
+	}
+	if n := atomic.LoadInt64(&received); n != 0 {
+		t.Errorf("Expected the backend not to be called, got %d requests", n)
+	}
+
+	// A chunked body is cut off once it passes the cap
+	chunked := io.MultiReader(strings.NewReader(strings.Repeat("b", 2048)))
+	status, _, err = post("/", chunked)
+	if err != nil || status != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected %d for a chunked oversized body, got %d (%v)", http.StatusRequestEntityTooLarge, status, err)
+	}
+
+	// Bodies within the cap pass, and the client's oversized requests did
+	// not open the backend's circuit
+	status, body, err = post("/", strings.NewReader(strings.Repeat("b", 1024)))
+	if err != nil || status != http.StatusOK || len(body) != 1024 {
+		t.Errorf("Expected a 1024 byte echo, got %d with %d bytes (%v)", status, len(body), err)
+	}
+
+	// A streamed response is cut off at the cap
+	_, body, err = post("/stream", nil)
+	if err == nil || len(body) > 1024 {
+		t.Errorf("Expected the streamed response to be cut off at 1024 bytes, got %d bytes (%v)", len(body), err)
+	}
+
+	// A response declared too large is replaced with a gateway error
+	status, body, err = post("/large", nil)
+	if err != nil || status != http.StatusBadGateway {
+		t.Errorf("Expected %d for an oversized response, got %d (%v)", http.StatusBadGateway, status, err)
+	}
+	if body != "Backend server 1 sent an oversized response" {
+		t.Errorf("Unexpected body %q", body)
+	}
+}
+
+func TestServerSentEvents(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	next := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 1; i <= 3; i++ {
+			select {
+			case <-next:
+			case <-r.Context().Done():
+				return
+			}
+			fmt.Fprintf(w, "data: event %d\n\n", i)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer backend.Close()
+	defer close(next)
+
+	lb, err := balancer.NewLoadBalancer(
+		[]balancer.BackendConfig{{URL: backend.URL}},
+		logger,
+		balancer.WithRequestTimeout(200*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	server := httptest.NewServer(lb)
+	defer server.Close()
+
+	token, _ := balancer.GenerateJWT("User")
+	req, _ := http.NewRequest("GET", server.URL+"/events", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "text/event-stream")
+
+	// The backend only sends its headers with the first event
+	done := make(chan *http.Response)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("Error opening event stream: %v", err)
+		}
+		done <- resp
+	}()
+	next <- struct{}{}
+	resp := <-done
+	if resp == nil {
+		return
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+
+	// Each event reaches the client as soon as the backend sends it, even
+	// after the request timeout has passed
+	for i := 1; i <= 3; i++ {
+		if i > 1 {
+			time.Sleep(150 * time.Millisecond)
+			select {
+			case next <- struct{}{}:
+			case <-time.After(time.Second):
+				t.Fatalf("Stream closed before event %d", i)
+			}
+		}
+		line := make(chan string, 1)
+		go func() {
+			s, _ := reader.ReadString('\n')
+			reader.ReadString('\n')
+			line <- s
+		}()
+		select {
+		case s := <-line:
+			if want := fmt.Sprintf("data: event %d\n", i); s != want {
+				t.Fatalf("Expected %q, got %q", want, s)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Event %d was not delivered promptly", i)
+		}
+	}
+}
+
+func TestBackendHTTP2(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	h2c := httptest.NewUnstartedServer(handler)
+	h2c.Config.Protocols = new(http.Protocols)
+	h2c.Config.Protocols.SetHTTP1(true)
+	h2c.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2c.Start()
+	defer h2c.Close()
+	tlsServer := httptest.NewUnstartedServer(handler)
+	tlsServer.EnableHTTP2 = true
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+
+	// Each backend speaks its own protocol, so mixed fleets work
+	for _, c := range []struct {
+		backend balancer.BackendConfig
+		want    string
+	}{
+		{balancer.BackendConfig{URL: h2c.URL}, "HTTP/1.1"},
+		{balancer.BackendConfig{URL: h2c.URL, Protocol: balancer.ProtocolHTTP2}, "HTTP/2.0"},
+		{balancer.BackendConfig{URL: tlsServer.URL, InsecureSkipVerify: true}, "HTTP/2.0"},
+		{balancer.BackendConfig{URL: tlsServer.URL, InsecureSkipVerify: true, Protocol: balancer.ProtocolHTTP1}, "HTTP/1.1"},
+	} {
+		lb, err := balancer.NewLoadBalancer([]balancer.BackendConfig{c.backend}, logger)
+		if err != nil {
+			t.Fatalf("Failed to create load balancer: %v", err)
+		}
+		server := httptest.NewServer(lb)
+		status, body := sendWithRole(t, server.URL, "User")
+		server.Close()
+		if status != http.StatusOK || body != c.want {
+			t.Errorf("Expected %s to %s with protocol %q, got %d %q", c.want, c.backend.URL, c.backend.Protocol, status, body)
+		}
+	}
+
+	if _, err := balancer.NewLoadBalancer([]balancer.BackendConfig{{URL: h2c.URL, Protocol: "spdy"}}, logger); err == nil {
+		t.Error("Expected an unknown protocol to be rejected")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"loadBalancer/balancer"
+)
+
+func main() {
+	// Command line flags for configuration
+	file := flag.String("file", "traffic.jsonl", "Recording produced by the load balancer's -record flag")
+	target := flag.String("target", "http://localhost:8080", "Base URL of the load balancer to replay against")
+	role := flag.String("role", "User", "Role for the JWT attached to replayed requests (empty sends none)")
+	delay := flag.Duration("delay", 0, "Pause between replayed requests")
+	flag.Parse()
+
+	logger := log.New(os.Stdout, "replay: ", log.LstdFlags)
+
+	f, err := os.Open(*file)
+	if err != nil {
+		logger.Fatalf("Failed to open recording: %v", err)
+	}
+	recs, err := balancer.ReadRecording(f)
+	f.Close()
+	if err != nil {
+		logger.Fatalf("Failed to read recording: %v", err)
+	}
+
+	// Authorization is redacted in recordings, so mint a fresh token
+	var token string
+	if *role != "" {
+		token, err = balancer.GenerateJWT(*role)
+		if err != nil {
+			logger.Fatalf("Failed to generate token: %v", err)
+		}
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	statuses := make(map[int]int)
+	for i, rec := range recs {
+		req, err := balancer.NewReplayRequest(*target, rec)
+		if err != nil {
+			logger.Printf("Request %d: %v", i+1, err)
+			continue
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			logger.Printf("Request %d %s %s failed: %v", i+1, rec.Method, rec.URI, err)
+			statuses[0]++
+			continue
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		statuses[resp.StatusCode]++
+		logger.Printf("Request %d %s %s: %d", i+1, rec.Method, rec.URI, resp.StatusCode)
+
+		if *delay > 0 {
+			time.Sleep(*delay)
+		}
+	}
+
+	fmt.Printf("Replayed %d requests\n", len(recs))
+	for status, count := range statuses {
+		if status == 0 {
+			fmt.Printf("  errors: %d\n", count)
+			continue
+		}
+		fmt.Printf("  %d: %d\n", status, count)
+	}
+}